@@ -0,0 +1,371 @@
+package wru
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/shibukawa/uuid62"
+	"github.com/ymotongpoo/datemaki"
+	"gocloud.dev/gcerrors"
+)
+
+// AccessTokenPrefix is the prefix of personal access tokens. It distinguishes them from session IDs in Authorization header.
+const AccessTokenPrefix = "wrupat_"
+
+var (
+	ErrInvalidAccessToken  = errors.New("invalid access token")
+	ErrAccessTokenNotFound = errors.New("access token not found")
+)
+
+// AccessTokenData is a personal access token for machine clients like scripts and CI jobs.
+// The token itself is not stored. ID is the hash of the token.
+type AccessTokenData struct {
+	ID         string    `docstore:"id" json:"-"`
+	TokenID    string    `docstore:"token_id" json:"id"`
+	UserID     string    `docstore:"user_id" json:"-"`
+	Name       string    `docstore:"name" json:"name"`
+	Scopes     []string  `docstore:"scopes" json:"scopes"`
+	CreatedAt  time.Time `docstore:"created_at" json:"created_at"`
+	ExpireAt   time.Time `docstore:"expire_at" json:"expire_at"`
+	LastUsedAt time.Time `docstore:"last_used_at" json:"last_used_at"`
+
+	// User Informations
+	DisplayName  string `docstore:"display_name" json:"-"`
+	Email        string `docstore:"email" json:"-"`
+	Organization string `docstore:"org" json:"-"`
+}
+
+func (t AccessTokenData) ScopeString() string {
+	return strings.Join(t.Scopes, ", ")
+}
+
+func (t AccessTokenData) CreatedAtFormat() string {
+	return t.CreatedAt.Format("2006/Jan/02 15:04")
+}
+
+func (t AccessTokenData) ExpireAtFormat() string {
+	return t.ExpireAt.Format("2006/Jan/02 15:04")
+}
+
+func (t AccessTokenData) LastUsedAtForHuman() string {
+	if t.LastUsedAt.IsZero() {
+		return "never"
+	}
+	return datemaki.FormatDuration(time.Now().Sub(t.LastUsedAt))
+}
+
+type AllAccessTokens []AccessTokenData
+
+func (at AllAccessTokens) WriteAsJson(w io.Writer) error {
+	type Tokens struct {
+		Tokens []AccessTokenData `json:"tokens"`
+	}
+
+	e := json.NewEncoder(w)
+	return e.Encode(&Tokens{
+		Tokens: at,
+	})
+}
+
+// AccessTokenMarker is added to the session that is authorized by personal access token
+type AccessTokenMarker struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+func newAccessToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashAccessToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// accessTokenFromRequest returns the personal access token in Authorization header
+func accessTokenFromRequest(r *http.Request) string {
+	if token := bearerToken(r); strings.HasPrefix(token, AccessTokenPrefix) {
+		return token
+	}
+	return ""
+}
+
+func (s *ServerlessSessionStorage) CreateAccessToken(ctx context.Context, user *User, name string, scopes []string, expireAt time.Time) (string, *AccessTokenData, error) {
+	token := newAccessToken()
+	tokenID, err := uuid62.V4()
+	if err != nil {
+		return "", nil, err
+	}
+	data := &AccessTokenData{
+		ID:           hashAccessToken(token),
+		TokenID:      tokenID,
+		UserID:       user.UserID,
+		Name:         name,
+		Scopes:       scopes,
+		CreatedAt:    currentTime(ctx),
+		ExpireAt:     expireAt,
+		DisplayName:  user.DisplayName,
+		Email:        user.Email,
+		Organization: user.Organization,
+	}
+	err = s.accessTokens.Create(ctx, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, data, nil
+}
+
+func (s *ServerlessSessionStorage) GetAccessTokens(ctx context.Context, userID string) ([]AccessTokenData, error) {
+	iter := s.accessTokens.Query().Where("user_id", "=", userID).Get(ctx)
+	defer iter.Stop()
+	now := currentTime(ctx)
+	var result []AccessTokenData
+	for {
+		var t AccessTokenData
+		err := iter.Next(ctx, &t)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		} else if now.Before(t.ExpireAt) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+func (s *ServerlessSessionStorage) RevokeAccessToken(ctx context.Context, userID, tokenID string) error {
+	tokens, err := s.GetAccessTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if t.TokenID == tokenID {
+			return s.accessTokens.Delete(ctx, &AccessTokenData{ID: t.ID})
+		}
+	}
+	return ErrAccessTokenNotFound
+}
+
+func (s *ServerlessSessionStorage) FindByAccessToken(ctx context.Context, token string) (*Session, error) {
+	t := AccessTokenData{ID: hashAccessToken(token)}
+	err := s.accessTokens.Get(ctx, &t)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, ErrInvalidAccessToken
+		}
+		return nil, err
+	}
+	now := currentTime(ctx)
+	if !now.Before(t.ExpireAt) {
+		s.accessTokens.Delete(ctx, &t)
+		return nil, ErrInvalidAccessToken
+	}
+	// reduce writes for scripts that call APIs frequently
+	if now.Sub(t.LastUsedAt) > time.Minute {
+		t.LastUsedAt = now
+		s.accessTokens.Replace(ctx, &t)
+	}
+	return &Session{
+		LoginAt:      UnixTime(t.CreatedAt),
+		ExpireAt:     UnixTime(t.ExpireAt),
+		LastAccessAt: UnixTime(now),
+		UserID:       t.UserID,
+		DisplayName:  t.DisplayName,
+		Email:        t.Email,
+		Organization: t.Organization,
+		Scopes:       t.Scopes,
+		Status:       ActiveSession,
+		Data:         make(map[string]string),
+		Token: &AccessTokenMarker{
+			ID:   t.TokenID,
+			Name: t.Name,
+		},
+	}, nil
+}
+
+// applyCurrentUser updates the session of the access token by the current user table.
+// Tokens of removed users are rejected and scopes that are removed from the user are dropped.
+func applyCurrentUser(ir *IdentityRegister, ses *Session) error {
+	u, err := ir.FindUserByID(ses.UserID)
+	if err != nil {
+		return err
+	}
+	if u.IsService() {
+		return ErrUserNotFound
+	}
+	var scopes []string
+	for _, scope := range ses.Scopes {
+		if containsString(u.Scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	ses.Scopes = scopes
+	ses.DisplayName = u.DisplayName
+	ses.Email = u.Email
+	ses.Organization = u.Organization
+	return nil
+}
+
+// serveAccessToken handles the request that has personal access token. It returns false if the request doesn't have it.
+func serveAccessToken(c *Config, s SessionStorage, ir *IdentityRegister, w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	token := accessTokenFromRequest(r)
+	if token == "" {
+		return false
+	}
+	ses, err := s.FindByAccessToken(r.Context(), token)
+	if err == nil {
+		err = applyCurrentUser(ir, ses)
+	}
+	if err != nil {
+		if err != ErrInvalidAccessToken && err != ErrUserNotFound {
+			c.logger().Error("access token lookup error", "error", err)
+		}
+		c.audit(r, &AuditEvent{Type: AuditAccessTokenRejected, Reason: err.Error()})
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wru", error="invalid_token"`)
+		writeErrorPage(w, r, http.StatusUnauthorized, "The access token is invalid or expired.")
+		return true
+	}
+	if !checkAccessPolicy(c, w, r, ses) {
+		return true
+	}
+	setIdentityHeaders(c, r.Header, ses)
+	next.ServeHTTP(w, setSessionInfo(r, "", ses))
+	return true
+}
+
+type accessTokensPageContext struct {
+	Tokens []AccessTokenData
+	Scopes []string
+	// MaxDays is the maximum expiration term of new tokens
+	MaxDays int
+	// NewToken is shown only once just after it is created
+	NewToken string
+}
+
+type newAccessTokenResponse struct {
+	Token string `json:"token"`
+	AccessTokenData
+}
+
+func (wh wruHandler) accessTokenMaxDays() int {
+	return int(wh.c.AccessTokenMaxTerm / (24 * time.Hour))
+}
+
+func (wh wruHandler) AccessTokens(w http.ResponseWriter, r *http.Request) {
+	_, ses := GetSession(r)
+	tokens, err := wh.s.GetAccessTokens(r.Context(), ses.UserID)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isHTML(r) {
+		executeTemplate(w, r, http.StatusOK, UserTokensPageTemplate, &accessTokensPageContext{
+			Tokens:  tokens,
+			Scopes:  ses.Scopes,
+			MaxDays: wh.accessTokenMaxDays(),
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		AllAccessTokens(tokens).WriteAsJson(w)
+	}
+}
+
+func (wh wruHandler) CreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	_, ses := GetSession(r)
+	u, err := wh.ir.FindUserByID(ses.UserID)
+	if err != nil {
+		http.Error(w, "user not found: "+ses.UserID, http.StatusNotFound)
+		return
+	}
+	err = r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > 100 {
+		writeErrorPage(w, r, http.StatusBadRequest, "Token name is required (100 characters or less).")
+		return
+	}
+	scopes := r.Form["scopes"]
+	for _, scope := range scopes {
+		if !containsString(u.Scopes, scope) {
+			writeErrorPage(w, r, http.StatusBadRequest, "You don't have the scope: "+scope)
+			return
+		}
+	}
+	days, err := strconv.Atoi(r.Form.Get("expires_in"))
+	if err != nil || days < 1 || days > wh.accessTokenMaxDays() {
+		writeErrorPage(w, r, http.StatusBadRequest, "Expiration should be between 1 and "+strconv.Itoa(wh.accessTokenMaxDays())+" days.")
+		return
+	}
+	expireAt := currentTime(r.Context()).Add(time.Duration(days) * 24 * time.Hour)
+	token, data, err := wh.s.CreateAccessToken(r.Context(), u, name, scopes, expireAt)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wh.c.audit(r, &AuditEvent{Type: AuditAccessTokenCreated, UserID: u.UserID, Success: true, Detail: map[string]string{"token": data.TokenID, "name": name, "scopes": strings.Join(scopes, ","), "expire_at": expireAt.Format(time.RFC3339)}})
+	if isHTML(r) {
+		tokens, _ := wh.s.GetAccessTokens(r.Context(), u.UserID)
+		executeTemplate(w, r, http.StatusCreated, UserTokensPageTemplate, &accessTokensPageContext{
+			Tokens:   tokens,
+			Scopes:   u.Scopes,
+			MaxDays:  wh.accessTokenMaxDays(),
+			NewToken: token,
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(&newAccessTokenResponse{
+			Token:           token,
+			AccessTokenData: *data,
+		})
+	}
+}
+
+func (wh wruHandler) RevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	_, ses := GetSession(r)
+	tokenID := chi.URLParam(r, "tokenID")
+	err := wh.s.RevokeAccessToken(r.Context(), ses.UserID, tokenID)
+	wh.c.audit(r, &AuditEvent{Type: AuditAccessTokenRevoked, UserID: ses.UserID, Success: err == nil, Detail: map[string]string{"token": tokenID}})
+	if err != nil {
+		if isHTML(r) {
+			http.Redirect(w, r, "/.wru/user/tokens?revoke_error", http.StatusFound)
+		} else {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"status": "error"}`)
+		}
+		return
+	}
+	if isHTML(r) {
+		http.Redirect(w, r, "/.wru/user/tokens", http.StatusFound)
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, `{"status": "ok"}`)
+	}
+}
@@ -0,0 +1,326 @@
+package wru
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccessTokenStorage(t *testing.T) {
+	ctx, s, _, _ := login(t, "user1")
+	now := currentTime(ctx)
+
+	token, data, err := s.CreateAccessToken(ctx, dummyUser("user1"), "ci", []string{"login"}, now.Add(24*time.Hour))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, AccessTokenPrefix))
+	// token itself is not stored
+	assert.NotEqual(t, token, data.ID)
+	assert.NotContains(t, data.ID, token)
+
+	ses, err := s.FindByAccessToken(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", ses.UserID)
+	assert.Equal(t, []string{"login"}, ses.Scopes)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, &AccessTokenMarker{ID: data.TokenID, Name: "ci"}, ses.Token)
+
+	// session IDs and other tokens are not accepted
+	_, err = s.FindByAccessToken(ctx, AccessTokenPrefix+"dummy")
+	assert.ErrorIs(t, err, ErrInvalidAccessToken)
+
+	tokens, err := s.GetAccessTokens(ctx, "user1")
+	assert.NoError(t, err)
+	if assert.Len(t, tokens, 1) {
+		assert.Equal(t, "ci", tokens[0].Name)
+		assert.Equal(t, now, tokens[0].LastUsedAt)
+	}
+
+	// expired
+	_, err = s.FindByAccessToken(setFixTime(ctx, now.Add(25*time.Hour)), token)
+	assert.ErrorIs(t, err, ErrInvalidAccessToken)
+}
+
+func TestAccessTokenStorage_Revoke(t *testing.T) {
+	ctx, s, _, _ := login(t, "user1")
+	now := currentTime(ctx)
+	token, data, err := s.CreateAccessToken(ctx, dummyUser("user1"), "ci", nil, now.Add(24*time.Hour))
+	assert.NoError(t, err)
+
+	// other users can't revoke it
+	assert.ErrorIs(t, s.RevokeAccessToken(ctx, "user2", data.TokenID), ErrAccessTokenNotFound)
+	assert.NoError(t, s.RevokeAccessToken(ctx, "user1", data.TokenID))
+	_, err = s.FindByAccessToken(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidAccessToken)
+	tokens, err := s.GetAccessTokens(ctx, "user1")
+	assert.NoError(t, err)
+	assert.Empty(t, tokens)
+}
+
+func createAccessTokenRequest(c *Config, sid string, form url.Values) *http.Request {
+	form.Set(CSRFTokenField, "token")
+	r := postForm(c, "/.wru/user/tokens", sid, "token", form, "")
+	r.Header.Set("Accept", "application/json")
+	return r
+}
+
+func TestCreateAccessToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		form       url.Values
+		wantStatus int
+	}{
+		{
+			name:       "success",
+			form:       url.Values{"name": {"ci"}, "scopes": {"login"}, "expires_in": {"30"}},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "no scopes",
+			form:       url.Values{"name": {"ci"}, "expires_in": {"30"}},
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "scope that user doesn't have",
+			form:       url.Values{"name": {"ci"}, "scopes": {"admin"}, "expires_in": {"30"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no name",
+			form:       url.Values{"scopes": {"login"}, "expires_in": {"30"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "too long expiration",
+			form:       url.Values{"name": {"ci"}, "expires_in": {"91"}},
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no expiration",
+			form:       url.Values{"name": {"ci"}},
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1,scope:login"))
+			sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, createAccessTokenRequest(c, sid, tt.form))
+			assert.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantStatus != http.StatusCreated {
+				assert.Empty(t, sink.types())
+				return
+			}
+			var res struct {
+				Token  string   `json:"token"`
+				ID     string   `json:"id"`
+				Name   string   `json:"name"`
+				Scopes []string `json:"scopes"`
+			}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.True(t, strings.HasPrefix(res.Token, AccessTokenPrefix))
+			assert.Equal(t, "ci", res.Name)
+			assert.Equal(t, []AuditEventType{AuditAccessTokenCreated}, sink.types())
+
+			ses, err := s.FindByAccessToken(context.Background(), res.Token)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.form["scopes"], ses.Scopes)
+		})
+	}
+}
+
+func TestListAndRevokeAccessToken(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+	token, data, err := s.CreateAccessToken(context.Background(), dummyUser("user1"), "ci", nil, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/.wru/user/tokens", nil)
+	r.Header.Set("Accept", "application/json")
+	r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: sid})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"`+data.TokenID+`"`)
+	assert.NotContains(t, w.Body.String(), token)
+	assert.NotContains(t, w.Body.String(), data.ID)
+
+	r = postForm(c, "/.wru/user/tokens/"+data.TokenID+"/revoke", sid, "token", url.Values{CSRFTokenField: {"token"}}, "")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/user/tokens", w.Header().Get("Location"))
+	assert.Equal(t, []AuditEventType{AuditAccessTokenRevoked}, sink.types())
+	_, err = s.FindByAccessToken(context.Background(), token)
+	assert.ErrorIs(t, err, ErrInvalidAccessToken)
+}
+
+func TestAccessTokenIsNotAcceptedForWruPages(t *testing.T) {
+	h, _, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	token, _, err := s.CreateAccessToken(context.Background(), dummyUser("user1"), "ci", []string{"login"}, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/.wru/user/tokens", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestAccessTokenProxy(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Header().Set("Wru-Set-Session-Data", "key=value")
+	}))
+	defer backend.Close()
+
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Host:   mustParseUrl(backend.URL),
+				Path:   "/admin/",
+				Scopes: []string{"admin"},
+			},
+			{
+				Host: mustParseUrl(backend.URL),
+				Path: "/",
+			},
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewSessionStorage(context.Background(), c, nil)
+	assert.NoError(t, err)
+	ir, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{"WRU_USER_1=id:user1,name:user1,scope:admin,scope:user"}, nil)
+	h, err := NewIdentityAwareProxyHandler(c, s, ir)
+	assert.NoError(t, err)
+	user, _ := ir.FindUserByID("user1")
+	token, data, err := s.CreateAccessToken(context.Background(), user, "ci", []string{"user"}, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		token      string
+		path       string
+		wantStatus int
+		wantEvent  []AuditEventType
+	}{
+		{
+			name:       "valid token",
+			token:      token,
+			path:       "/api",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "token doesn't have the scope",
+			token:      token,
+			path:       "/admin/",
+			wantStatus: http.StatusForbidden,
+			wantEvent:  []AuditEventType{AuditScopeDenied},
+		},
+		{
+			name:       "invalid token",
+			token:      AccessTokenPrefix + "invalid",
+			path:       "/api",
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditAccessTokenRejected},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.events = nil
+			got = nil
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantEvent, sink.types())
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			assert.Empty(t, got.Get("Authorization"))
+			var ses map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(got.Get("Wru-Session")), &ses))
+			assert.Equal(t, "user1", ses["id"])
+			assert.Equal(t, []interface{}{"user"}, ses["scopes"])
+			assert.Equal(t, map[string]interface{}{"id": data.TokenID, "name": "ci"}, ses["token"])
+			assert.Empty(t, w.Header().Get("Wru-Set-Session-Data"))
+		})
+	}
+}
+
+func TestAccessTokenProxy_UserTableChange(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(backend.URL),
+				Path: "/",
+			},
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewSessionStorage(context.Background(), c, nil)
+	assert.NoError(t, err)
+	ir, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{"WRU_USER_1=id:user1,name:user1,scope:admin,scope:user"}, nil)
+	h, err := NewIdentityAwareProxyHandler(c, s, ir)
+	assert.NoError(t, err)
+	user, _ := ir.FindUserByID("user1")
+	token, _, err := s.CreateAccessToken(context.Background(), user, "ci", []string{"admin", "user"}, time.Now().Add(time.Hour))
+	assert.NoError(t, err)
+
+	request := func() *httptest.ResponseRecorder {
+		got = nil
+		r := httptest.NewRequest("GET", "/api", nil)
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// the scope is removed from the user
+	ir2, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{"WRU_USER_1=id:user1,name:user one,scope:user"}, nil)
+	ir.lock.Lock()
+	ir.fromID = ir2.fromID
+	ir.lock.Unlock()
+	w := request()
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ses map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(got.Get("Wru-Session")), &ses))
+	assert.Equal(t, []interface{}{"user"}, ses["scopes"])
+	assert.Equal(t, "user one", ses["name"])
+
+	// the user is removed from the user table
+	ir.lock.Lock()
+	ir.fromID = map[string]*User{}
+	ir.lock.Unlock()
+	w = request()
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Nil(t, got)
+	assert.Equal(t, []AuditEventType{AuditAccessTokenRejected}, sink.types())
+}
@@ -61,7 +61,9 @@ func githubCallback(c *Config, r *http.Request, loginInfo map[string]string) (gi
 		return
 	}
 
-	token, err := githubClient.Exchange(context.Background(), r.Form.Get("code"))
+	ctx, end := startSpan(r.Context(), "github.Exchange")
+	token, err := githubClient.Exchange(ctx, r.Form.Get("code"))
+	end(err)
 	if err != nil {
 		err = fmt.Errorf("can't get access token: %w", err)
 		return
@@ -73,7 +75,9 @@ func githubCallback(c *Config, r *http.Request, loginInfo map[string]string) (gi
 
 	client := github.NewClient(oauth2.NewClient(context.Background(), tokenSource))
 
-	user, _, err := client.Users.Get(context.Background(), "")
+	ctx, end = startSpan(r.Context(), "github.Users.Get")
+	user, _, err := client.Users.Get(ctx, "")
+	end(err)
 	if err != nil {
 		err = fmt.Errorf("can't get access token: %w", err)
 		return
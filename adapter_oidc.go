@@ -16,6 +16,9 @@ import (
 var provider *oidc.Provider
 var oauth2Config *oauth2.Config
 
+// oidcEmailVerifiedKey is the login info that is set when the ID token has email_verified claim
+const oidcEmailVerifiedKey = "oidc_email_verified"
+
 func initOpenIDConnectConfig(ctx context.Context, c *Config, out io.Writer) error {
 	if c.OIDC.Available() {
 		var err error
@@ -70,7 +73,9 @@ func oidcCallback(c *Config, r *http.Request, loginInfo map[string]string) (oidc
 		return "", nil, err
 	}
 
-	accessToken, err := oauth2Config.Exchange(context.Background(), r.Form.Get("code"), oidc.Nonce(nonce))
+	ctx, end := startSpan(r.Context(), "oidc.Exchange")
+	accessToken, err := oauth2Config.Exchange(ctx, r.Form.Get("code"), oidc.Nonce(nonce))
+	end(err)
 	if err != nil {
 		err = fmt.Errorf("can't get access token: %w", err)
 		return
@@ -115,5 +120,9 @@ func oidcCallback(c *Config, r *http.Request, loginInfo map[string]string) (oidc
 		// "github-refresh": token.RefreshToken,
 		// "github-token": token.AccessToken,
 	}
+	// only the verified email address can be used for UserMatching.OIDCEmailFallback
+	if verified, _ := idTokenClaims["email_verified"].(bool); ok && verified {
+		newLoginInfo[oidcEmailVerifiedKey] = "true"
+	}
 	return
 }
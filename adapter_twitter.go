@@ -79,12 +79,16 @@ func twitterCallback(c *Config, r *http.Request, loginInfo map[string]string) (t
 		return "", nil, errors.New("internal server error: oauth_token missing")
 	}
 
-	cred, _, err := twitterClient.RequestToken(nil, tc, r.FormValue("oauth_verifier"))
+	ctx, end := startSpan(r.Context(), "twitter.RequestToken")
+	cred, _, err := twitterClient.RequestTokenContext(ctx, tc, r.FormValue("oauth_verifier"))
+	end(err)
 	if err != nil {
 		return "", nil, fmt.Errorf("getting access token error: %w", err)
 	}
 
-	resp, err := twitterClient.Get(nil, cred, "https://api.twitter.com/1.1/account/verify_credentials.json", url.Values{})
+	ctx, end = startSpan(r.Context(), "twitter.VerifyCredentials")
+	resp, err := twitterClient.GetContext(ctx, cred, "https://api.twitter.com/1.1/account/verify_credentials.json", url.Values{})
+	end(err)
 
 	if err != nil {
 		return "", nil, fmt.Errorf("twitter login error error: %w", err)
@@ -0,0 +1,304 @@
+package wru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shibukawa/uuid62"
+	"gocloud.dev/blob"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+type AuditEventType string
+
+const (
+	AuditLoginStart      AuditEventType = "login_start"
+	AuditLoginSuccess    AuditEventType = "login_success"
+	AuditLoginFailure    AuditEventType = "login_failure"
+	AuditLogout          AuditEventType = "logout"
+	AuditSessionRevoked  AuditEventType = "session_revoked"
+	AuditScopeDenied     AuditEventType = "scope_denied"
+	AuditAccessDenied    AuditEventType = "access_denied"
+	AuditSessionMismatch AuditEventType = "session_binding_mismatch"
+	AuditCSRFFailure     AuditEventType = "csrf_failure"
+	AuditUserTableReload AuditEventType = "user_table_reload"
+
+	AuditAccessTokenCreated  AuditEventType = "access_token_created"
+	AuditAccessTokenRevoked  AuditEventType = "access_token_revoked"
+	AuditAccessTokenRejected AuditEventType = "access_token_rejected"
+
+	AuditDeviceApproved AuditEventType = "device_approved"
+	AuditDeviceDenied   AuditEventType = "device_denied"
+
+	AuditOIDCTokenIssued AuditEventType = "oidc_token_issued"
+
+	AuditMFAEnrolled AuditEventType = "mfa_enrolled"
+	AuditMFADisabled AuditEventType = "mfa_disabled"
+	AuditMFAFailure  AuditEventType = "mfa_failure"
+
+	AuditPasskeyRegistered AuditEventType = "passkey_registered"
+	AuditPasskeyRemoved    AuditEventType = "passkey_removed"
+)
+
+// AuditEvent is a record of the audit log. It is written as one line JSON.
+type AuditEvent struct {
+	Time      time.Time      `json:"time"`
+	Type      AuditEventType `json:"type"`
+	UserID    string         `json:"user_id,omitempty"`
+	IdP       string         `json:"idp,omitempty"`
+	IP        string         `json:"ip,omitempty"`
+	Country   string         `json:"country,omitempty"`
+	UserAgent string         `json:"user_agent,omitempty"`
+	Path      string         `json:"path,omitempty"`
+	Success   bool           `json:"success"`
+	Reason    string         `json:"reason,omitempty"`
+	// Detail has event type specific information
+	Detail map[string]string `json:"detail,omitempty"`
+}
+
+// AuditSink is a destination of audit events. Set Config.AuditSink to use custom sink.
+type AuditSink interface {
+	Write(ctx context.Context, e *AuditEvent) error
+	Close() error
+}
+
+// audit writes event to the audit sink. Client information is filled from r if it is not nil.
+func (c *Config) audit(r *http.Request, e *AuditEvent) {
+	if c.AuditSink == nil {
+		return
+	}
+	ctx := context.Background()
+	if r != nil {
+		ctx = r.Context()
+		country, ip := getGeoLocation(c, r)
+		if e.IP == "" {
+			e.IP = ip
+			e.Country = country
+		}
+		if e.UserAgent == "" {
+			e.UserAgent = r.Header.Get("User-Agent")
+		}
+		if e.Path == "" {
+			e.Path = r.URL.Path
+		}
+	}
+	if e.Time.IsZero() {
+		e.Time = currentTime(ctx)
+	}
+	if err := c.AuditSink.Write(ctx, e); err != nil {
+		c.logger().Error("audit log error", "error", err)
+	}
+}
+
+// hashSessionID returns short hash of session ID to identify sessions in logs without leaking them
+func hashSessionID(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(h[:8])
+}
+
+// NewAuditSink creates sink from destination string.
+//
+//	"stdout" or "stderr": write to console
+//	local path (starts with "/" or "."): write to file with rotation. Query parameters max_size(MB), max_backups and max_age(days) control rotation
+//	blob URL (s3://, gs://, file:// ...): write batches of events as new objects under the path
+func NewAuditSink(ctx context.Context, dest string) (AuditSink, error) {
+	switch {
+	case dest == "stdout":
+		return &writerAuditSink{w: os.Stdout}, nil
+	case dest == "stderr":
+		return &writerAuditSink{w: os.Stderr}, nil
+	case strings.HasPrefix(dest, ".") || strings.HasPrefix(dest, "/"):
+		return newFileAuditSink(dest)
+	default:
+		return newBlobAuditSink(ctx, dest)
+	}
+}
+
+type writerAuditSink struct {
+	w    io.Writer
+	lock sync.Mutex
+}
+
+func (s *writerAuditSink) Write(ctx context.Context, e *AuditEvent) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return json.NewEncoder(s.w).Encode(e)
+}
+
+func (s *writerAuditSink) Close() error {
+	if c, ok := s.w.(io.Closer); ok && s.w != os.Stdout && s.w != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+func newFileAuditSink(dest string) (AuditSink, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	l := &lumberjack.Logger{
+		Filename:   u.Path,
+		MaxSize:    100,
+		MaxBackups: 10,
+	}
+	q := u.Query()
+	for key, target := range map[string]*int{
+		"max_size":    &l.MaxSize,
+		"max_backups": &l.MaxBackups,
+		"max_age":     &l.MaxAge,
+	} {
+		if v := q.Get(key); v != "" {
+			if _, err := fmt.Sscanf(v, "%d", target); err != nil {
+				return nil, fmt.Errorf("invalid audit log option %s: %s", key, v)
+			}
+		}
+	}
+	return &writerAuditSink{w: l}, nil
+}
+
+const (
+	blobAuditBatchSize = 100
+	// blobAuditMaxBuffer is the limit of events kept for retry while the blob storage is unavailable
+	blobAuditMaxBuffer = 100 * blobAuditBatchSize
+	blobAuditTimeout   = 30 * time.Second
+)
+
+// blobAuditSink stores events as JSON Lines objects. Blob storages don't support append,
+// so it buffers events and writes them as a new object when the buffer is full or at every minute.
+// Events are kept in the buffer if the upload fails and the next flush retries them.
+// Errors of background writes are returned from next Write call.
+type blobAuditSink struct {
+	bucket *blob.Bucket
+	prefix string
+	buffer []*AuditEvent
+	err    error
+	lock   sync.Mutex
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newBlobAuditSink(ctx context.Context, dest string) (AuditSink, error) {
+	bucketUrl, prefix, err := SplitBlobPath(dest)
+	if err != nil {
+		return nil, err
+	}
+	b, err := blob.OpenBucket(ctx, bucketUrl)
+	if err != nil {
+		return nil, err
+	}
+	prefix = strings.TrimPrefix(prefix, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	s := &blobAuditSink{
+		bucket: b,
+		prefix: prefix,
+		done:   make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-t.C:
+				if err := s.flush(); err != nil {
+					s.lock.Lock()
+					s.err = err
+					s.lock.Unlock()
+				}
+			}
+		}
+	}()
+	return s, nil
+}
+
+func (s *blobAuditSink) Write(ctx context.Context, e *AuditEvent) error {
+	s.lock.Lock()
+	s.buffer = append(s.buffer, e)
+	// upload is retried at every batch size while the blob storage fails
+	full := len(s.buffer)%blobAuditBatchSize == 0
+	err := s.err
+	s.err = nil
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if full {
+		// the request context isn't used. Client's disconnection shouldn't cancel other users' events.
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *blobAuditSink) flush() error {
+	s.lock.Lock()
+	events := s.buffer
+	s.buffer = nil
+	s.lock.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	err := s.upload(events)
+	if err != nil {
+		s.lock.Lock()
+		s.buffer = append(events, s.buffer...)
+		if dropped := len(s.buffer) - blobAuditMaxBuffer; dropped > 0 {
+			s.buffer = s.buffer[dropped:]
+			err = fmt.Errorf("%w: %d events are dropped", err, dropped)
+		}
+		s.lock.Unlock()
+	}
+	return err
+}
+
+func (s *blobAuditSink) upload(events []*AuditEvent) error {
+	id, err := uuid62.V4()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), blobAuditTimeout)
+	defer cancel()
+	key := s.prefix + events[0].Time.UTC().Format("2006/01/02/150405") + "-" + id + ".jsonl"
+	w, err := s.bucket.NewWriter(ctx, key, &blob.WriterOptions{ContentType: "application/x-ndjson"})
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(w)
+	for _, event := range events {
+		if err := e.Encode(event); err != nil {
+			// canceling the context before Close aborts the write
+			cancel()
+			w.Close()
+			return err
+		}
+	}
+	return w.Close()
+}
+
+func (s *blobAuditSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	err := s.flush()
+	if err2 := s.bucket.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,221 @@
+package wru
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/memblob"
+)
+
+func TestWriterAuditSink(t *testing.T) {
+	var buf bytes.Buffer
+	c := &Config{AuditSink: &writerAuditSink{w: &buf}}
+	r := dummyRequest()
+	c.audit(r, &AuditEvent{Type: AuditLogout, UserID: "user1", Success: true})
+
+	var e map[string]interface{}
+	err := json.Unmarshal(buf.Bytes(), &e)
+	assert.NoError(t, err)
+	assert.Equal(t, "logout", e["type"])
+	assert.Equal(t, "user1", e["user_id"])
+	assert.Equal(t, "192.0.2.1", e["ip"])
+	assert.Contains(t, e["user_agent"], "Chrome")
+}
+
+func TestFileAuditSink(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	s, err := NewAuditSink(context.Background(), logPath+"?max_size=1")
+	assert.NoError(t, err)
+	err = s.Write(context.Background(), &AuditEvent{Type: AuditLogout})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	content, err := os.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), `"type":"logout"`)
+}
+
+func TestBlobAuditSink(t *testing.T) {
+	ctx := context.Background()
+	s, err := newBlobAuditSink(ctx, "mem://audit-test/events")
+	assert.NoError(t, err)
+	bs := s.(*blobAuditSink)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.Write(ctx, &AuditEvent{Type: AuditLoginSuccess}))
+	}
+	assert.NoError(t, bs.flush())
+
+	iter := bs.bucket.List(&blob.ListOptions{Prefix: "events/"})
+	obj, err := iter.Next(ctx)
+	assert.NoError(t, err)
+	content, err := bs.bucket.ReadAll(ctx, obj.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(content), "\n"))
+	_, err = iter.Next(ctx)
+	assert.Equal(t, io.EOF, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestBlobAuditSink_Retry(t *testing.T) {
+	ctx := context.Background()
+	s, err := newBlobAuditSink(ctx, "mem://audit-test/events")
+	assert.NoError(t, err)
+	bs := s.(*blobAuditSink)
+	bucket := bs.bucket
+	unavailable, err := blob.OpenBucket(ctx, "mem://")
+	assert.NoError(t, err)
+	unavailable.Close()
+
+	bs.bucket = unavailable
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, s.Write(ctx, &AuditEvent{Type: AuditLoginSuccess}))
+	}
+	assert.Error(t, bs.flush())
+	assert.NoError(t, s.Write(ctx, &AuditEvent{Type: AuditLogout}))
+
+	// failed events are uploaded with the next flush
+	bs.bucket = bucket
+	assert.NoError(t, bs.flush())
+	iter := bucket.List(&blob.ListOptions{Prefix: "events/"})
+	obj, err := iter.Next(ctx)
+	assert.NoError(t, err)
+	content, err := bucket.ReadAll(ctx, obj.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(content), "\n"))
+	assert.NoError(t, s.Close())
+}
+
+func TestAuditDebugLogin(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+
+	tests := []struct {
+		name       string
+		userID     string
+		wantStatus int
+		wantEvent  AuditEventType
+	}{
+		{
+			name:       "success",
+			userID:     "user1",
+			wantStatus: http.StatusFound,
+			wantEvent:  AuditLoginSuccess,
+		},
+		{
+			name:       "unknown user",
+			userID:     "user2",
+			wantStatus: http.StatusNotFound,
+			wantEvent:  AuditLoginFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.events = nil
+			w := debugLogin(t, context.Background(), h, c, s, tt.userID)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, []AuditEventType{tt.wantEvent}, sink.types())
+		})
+	}
+}
+
+func TestAuditScopeDenied(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	sink := &memoryAuditSink{}
+	p, err := NewReverseProxy(&Config{
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Host:   mustParseUrl(backend.URL),
+				Path:   "/admin/",
+				Scopes: []string{"admin"},
+			},
+			{
+				Host: mustParseUrl(backend.URL),
+				Path: "/",
+			},
+		},
+	}, nil)
+	assert.NoError(t, err)
+
+	ses := &Session{UserID: "user1", Scopes: []string{"user"}}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, setSessionInfo(httptest.NewRequest("GET", "/admin/test", nil), "sid", ses))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []AuditEventType{AuditScopeDenied}, sink.types())
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, setSessionInfo(httptest.NewRequest("GET", "/test", nil), "sid", ses))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAuditScopeDenied_Middleware(t *testing.T) {
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Path:   "/admin/",
+				Scopes: []string{"admin"},
+			},
+		},
+		Users: []*User{
+			{UserID: "batch", DisplayName: "batch job", Kind: ServiceAccount, SecretHash: testSecretHash, Scopes: []string{"batch"}},
+			{UserID: "admin-batch", DisplayName: "admin job", Kind: ServiceAccount, SecretHash: testSecretHash, Scopes: []string{"admin"}},
+		},
+	}
+	_, middleware := NewAuthorizationMiddleware(context.Background(), c, nil)
+	h := middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		path       string
+		userID     string
+		wantStatus int
+		wantEvent  []AuditEventType
+	}{
+		{
+			name:       "route without scopes",
+			path:       "/test",
+			userID:     "batch",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "user doesn't have the scope",
+			path:       "/admin/test",
+			userID:     "batch",
+			wantStatus: http.StatusForbidden,
+			wantEvent:  []AuditEventType{AuditScopeDenied},
+		},
+		{
+			name:       "user has the scope",
+			path:       "/admin/test",
+			userID:     "admin-batch",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.events = nil
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept", "application/json")
+			r.SetBasicAuth(tt.userID, "secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantEvent, sink.types())
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package wru
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ClientCertConfig enables login by TLS client certificates (mutual TLS).
+// Certificates signed by CACert are mapped to users by the e-mail addresses of SAN or the common name of the subject
+// (the x509 field of the user table).
+type ClientCertConfig struct {
+	// CACert is PEM content or file path of the CA that signs client certificates
+	CACert string
+	// Require rejects TLS connections without client certificates.
+	// Otherwise, clients without certificates can login via ID providers.
+	Require bool
+
+	pool *x509.CertPool
+}
+
+func (cc ClientCertConfig) Available() bool {
+	return cc.pool != nil
+}
+
+func (cc ClientCertConfig) clientAuth() tls.ClientAuthType {
+	if cc.Require {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.VerifyClientCertIfGiven
+}
+
+func parseClientCertAuth(src string) (bool, error) {
+	switch src {
+	case "", "request":
+		return false, nil
+	case "require":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid client certificate auth mode: %s (request or require)", src)
+}
+
+func initClientCert(c *Config) error {
+	if c.ClientCert.CACert == "" {
+		return nil
+	}
+	if c.TlsCert == "" || c.TlsKey == "" {
+		return errors.New("client certificate authentication requires TLS (WRU_TLS_CERT and WRU_TLS_KEY)")
+	}
+	ca, err := readPEM(c.ClientCert.CACert)
+	if err != nil {
+		return fmt.Errorf("can't read client CA cert: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return errors.New("client CA cert doesn't contain any certificate")
+	}
+	c.ClientCert.pool = pool
+	return nil
+}
+
+// TLSConfig returns the TLS setting of the wru server. It returns nil if TLS is disabled.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if c.TlsCert == "" || c.TlsKey == "" {
+		return nil, nil
+	}
+	cert, err := tls.X509KeyPair([]byte(c.TlsCert), []byte(c.TlsKey))
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if c.ClientCert.Available() {
+		tlsConfig.ClientCAs = c.ClientCert.pool
+		tlsConfig.ClientAuth = c.ClientCert.clientAuth()
+	}
+	return tlsConfig, nil
+}
+
+// clientCertAccounts returns the candidates of x509 account of the verified client certificate.
+// E-mail addresses of SAN have priority over the common name.
+func clientCertAccounts(r *http.Request) []string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	leaf := r.TLS.VerifiedChains[0][0]
+	accounts := append([]string{}, leaf.EmailAddresses...)
+	if leaf.Subject.CommonName != "" {
+		accounts = append(accounts, leaf.Subject.CommonName)
+	}
+	return accounts
+}
+
+// findClientCertSession returns the active session that was started by the certificate of the same subject.
+// Clients that don't keep cookies like CLI tools reuse it instead of creating a session for each request.
+func findClientCertSession(c *Config, s SessionStorage, r *http.Request, userID, account string) (string, *Session) {
+	sessions, err := s.GetUserSessions(r.Context(), userID)
+	if err != nil {
+		return "", nil
+	}
+	for _, ss := range sessions {
+		info := ss.LoginInfo
+		if info["login-idp"] != "x509" || info["x509_subject"] != account || len(mismatchedBindings(c, r, info)) > 0 {
+			continue
+		}
+		if ses, err := s.FindBySessionToken(r.Context(), ss.ID); err == nil && ses.Status == ActiveSession {
+			return ss.ID, ses
+		}
+	}
+	return "", nil
+}
+
+// loginWithClientCertificate starts a session without the interactive login if the request has the verified client certificate.
+// It returns false if the certificate is not available or not mapped to any user and then the normal login is used.
+// If the user needs the second factor, it redirects to the verification page and returns true without session.
+func loginWithClientCertificate(c *Config, s SessionStorage, ir *IdentityRegister, w http.ResponseWriter, r *http.Request) (string, *Session, bool) {
+	if !c.ClientCert.Available() || ir == nil {
+		return "", nil, false
+	}
+	accounts := clientCertAccounts(r)
+	if len(accounts) == 0 {
+		return "", nil, false
+	}
+	var user *User
+	var account string
+	for _, a := range accounts {
+		if u, err := ir.FindUserOf(X509, a); err == nil && !u.IsService() {
+			user = u
+			account = a
+			break
+		}
+	}
+	if user == nil {
+		loginCounter.WithLabelValues("x509", loginUserNotFound).Inc()
+		c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "x509", UserID: accounts[0], Reason: loginUserNotFound})
+		c.logger().Debug("client certificate is not mapped to any user", "subject", accounts[0])
+		return "", nil, false
+	}
+	if sid, ses := findClientCertSession(c, s, r, user.UserID, account); ses != nil {
+		setSessionID(r.Context(), w, sid, c, ActiveSession)
+		return sid, ses, true
+	}
+	loginID, err := s.StartLogin(r.Context(), map[string]string{
+		"landingURL": r.RequestURI,
+	})
+	loginInfo := map[string]string{
+		"login-idp":    "x509",
+		"x509_subject": account,
+	}
+	if err == nil {
+		// a client certificate is a single factor as well as ID providers
+		wh := wruHandler{c: c, s: s, ir: ir}
+		if wh.requireSecondFactor(w, r, loginID, user, "x509", loginInfo) {
+			return "", nil, true
+		}
+	}
+	var sid string
+	if err == nil {
+		sid, _, err = s.StartSession(r.Context(), loginID, user, r, loginInfo)
+	}
+	var ses *Session
+	if err == nil {
+		ses, err = s.FindBySessionToken(r.Context(), sid)
+	}
+	if err != nil {
+		loginCounter.WithLabelValues("x509", loginSessionError).Inc()
+		c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "x509", UserID: user.UserID, Reason: err.Error()})
+		c.logger().Error("client certificate login error", "user", user.UserID, "error", err)
+		return "", nil, false
+	}
+	loginCounter.WithLabelValues("x509", loginSuccess).Inc()
+	c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: "x509", UserID: user.UserID, Success: true, Detail: map[string]string{
+		"subject": account,
+	}})
+	c.logger().Info("login", "user", user.UserID, "idp", "x509")
+	setSessionID(r.Context(), w, sid, c, ActiveSession)
+	return sid, ses, true
+}
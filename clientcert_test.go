@@ -0,0 +1,368 @@
+package wru
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+func (tc *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	cert, err := tls.X509KeyPair([]byte(tc.certPEM), []byte(tc.keyPEM))
+	assert.NoError(t, err)
+	return cert
+}
+
+// issueTestCert creates self-signed CA certificate if parent is nil
+func issueTestCert(t *testing.T, parent *testCert, template *x509.Certificate) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func newClientCertTestEnv(t *testing.T) (ca, server *testCert) {
+	t.Helper()
+	ca = issueTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "wru test CA"}})
+	server = issueTestCert(t, ca, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return ca, server
+}
+
+func issueClientCert(t *testing.T, ca *testCert, commonName string, emails ...string) *testCert {
+	t.Helper()
+	return issueTestCert(t, ca, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: commonName},
+		EmailAddresses: emails,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func Test_initClientCert(t *testing.T) {
+	ca, server := newClientCertTestEnv(t)
+	tests := []struct {
+		name    string
+		c       Config
+		wantErr string
+	}{
+		{
+			name: "disabled",
+			c:    Config{},
+		},
+		{
+			name: "enabled",
+			c: Config{
+				TlsCert:    server.certPEM,
+				TlsKey:     server.keyPEM,
+				ClientCert: ClientCertConfig{CACert: ca.certPEM},
+			},
+		},
+		{
+			name: "TLS is disabled",
+			c: Config{
+				ClientCert: ClientCertConfig{CACert: ca.certPEM},
+			},
+			wantErr: "client certificate authentication requires TLS (WRU_TLS_CERT and WRU_TLS_KEY)",
+		},
+		{
+			name: "no certificate",
+			c: Config{
+				TlsCert:    server.certPEM,
+				TlsKey:     server.keyPEM,
+				ClientCert: ClientCertConfig{CACert: "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----"},
+			},
+			wantErr: "client CA cert doesn't contain any certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := initClientCert(&tt.c)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.c.ClientCert.CACert != "", tt.c.ClientCert.Available())
+			}
+		})
+	}
+}
+
+func Test_parseClientCertAuth(t *testing.T) {
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{src: "", want: false},
+		{src: "request", want: false},
+		{src: "require", want: true},
+		{src: "optional", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			got, err := parseClientCertAuth(tt.src)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func newClientCertTestServer(t *testing.T, require bool) (*httptest.Server, *testCert, SessionStorage, *memoryAuditSink) {
+	t.Helper()
+	ca, server := newClientCertTestEnv(t)
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:       "https://example.com",
+		DevMode:    true,
+		TlsCert:    server.certPEM,
+		TlsKey:     server.keyPEM,
+		ClientCert: ClientCertConfig{CACert: ca.certPEM, Require: require},
+		AuditSink:  sink,
+		MFA: MFAConfig{
+			RequiredScopes: []string{"admin"},
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewMemorySessionStorage(context.Background(), c, xid.New().String())
+	assert.NoError(t, err)
+	ir, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{
+		"WRU_USER_1=id:user1,name:user1,x509:user1@example.com",
+		"WRU_USER_2=id:user2,name:user2,x509:build-agent",
+		"WRU_USER_3=id:admin,name:admin,scope:admin,x509:admin@example.com",
+	}, nil)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ses := GetSession(r)
+		io.WriteString(w, ses.UserID)
+	})
+	srv := httptest.NewUnstartedServer(authMiddleware(c, s, ir)(next))
+	srv.TLS, err = c.TLSConfig()
+	assert.NoError(t, err)
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv, ca, s, sink
+}
+
+func clientCertTestClient(t *testing.T, ca, cert *testCert) *http.Client {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	tlsConfig := &tls.Config{RootCAs: pool}
+	if cert != nil {
+		tlsConfig.Certificates = []tls.Certificate{cert.tlsCertificate(t)}
+	}
+	return &http.Client{
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func TestClientCertificateLogin(t *testing.T) {
+	srv, ca, s, _ := newClientCertTestServer(t, false)
+	other := issueTestCert(t, nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other CA"}})
+
+	tests := []struct {
+		name     string
+		cert     *testCert
+		wantUser string
+	}{
+		{
+			name:     "SAN e-mail",
+			cert:     issueClientCert(t, ca, "unknown", "user1@example.com"),
+			wantUser: "user1",
+		},
+		{
+			name:     "common name",
+			cert:     issueClientCert(t, ca, "build-agent"),
+			wantUser: "user2",
+		},
+		{
+			name: "not mapped",
+			cert: issueClientCert(t, ca, "unknown"),
+		},
+		{
+			name: "signed by other CA",
+			cert: issueClientCert(t, other, "build-agent"),
+		},
+		{
+			name: "no certificate",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := clientCertTestClient(t, ca, tt.cert).Get(srv.URL + "/dashboard")
+			assert.NoError(t, err)
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if tt.wantUser == "" {
+				assert.Equal(t, http.StatusFound, res.StatusCode)
+				assert.Equal(t, "/.wru/login", res.Header.Get("Location"))
+				return
+			}
+			assert.Equal(t, http.StatusOK, res.StatusCode)
+			assert.Equal(t, tt.wantUser, string(body))
+			var sid string
+			for _, ck := range res.Cookies() {
+				if ck.Name == "WRU_SESSION" {
+					sid = ck.Value
+				}
+			}
+			ses, err := s.FindBySessionToken(context.Background(), sid)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantUser, ses.UserID)
+			assert.Equal(t, "x509", ses.loginInfo["login-idp"])
+		})
+	}
+}
+
+func TestClientCertificateLogin_ReuseSession(t *testing.T) {
+	srv, ca, s, sink := newClientCertTestServer(t, false)
+	client := clientCertTestClient(t, ca, issueClientCert(t, ca, "build-agent"))
+
+	res, err := client.Get(srv.URL + "/")
+	assert.NoError(t, err)
+	res.Body.Close()
+	var cookie *http.Cookie
+	for _, ck := range res.Cookies() {
+		if ck.Name == "WRU_SESSION" {
+			cookie = ck
+		}
+	}
+	assert.NotNil(t, cookie)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+	req.AddCookie(cookie)
+	res, err = client.Do(req)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	sessions, err := s.GetUserSessions(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, []AuditEventType{AuditLoginSuccess}, sink.types())
+}
+
+func TestClientCertificateLogin_WithoutCookie(t *testing.T) {
+	srv, ca, s, sink := newClientCertTestServer(t, false)
+	client := clientCertTestClient(t, ca, issueClientCert(t, ca, "build-agent"))
+
+	var sids []string
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(srv.URL + "/")
+		assert.NoError(t, err)
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		for _, ck := range res.Cookies() {
+			if ck.Name == "WRU_SESSION" {
+				sids = append(sids, ck.Value)
+			}
+		}
+	}
+	// the session is reused for the same certificate
+	assert.Len(t, sids, 3)
+	assert.Equal(t, sids[0], sids[1])
+	assert.Equal(t, sids[0], sids[2])
+	sessions, err := s.GetUserSessions(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, []AuditEventType{AuditLoginSuccess}, sink.types())
+
+	// sessions of other ID providers are not used
+	startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+	res, err := clientCertTestClient(t, ca, issueClientCert(t, ca, "unknown", "user1@example.com")).Get(srv.URL + "/")
+	assert.NoError(t, err)
+	res.Body.Close()
+	sessions, err = s.GetUserSessions(context.Background(), "user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 2)
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	srv, ca, _, _ := newClientCertTestServer(t, true)
+
+	_, err := clientCertTestClient(t, ca, nil).Get(srv.URL + "/")
+	assert.Error(t, err)
+
+	res, err := clientCertTestClient(t, ca, issueClientCert(t, ca, "build-agent")).Get(srv.URL + "/")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestClientCertificateLogin_SecondFactor(t *testing.T) {
+	srv, ca, s, sink := newClientCertTestServer(t, false)
+	client := clientCertTestClient(t, ca, issueClientCert(t, ca, "admin", "admin@example.com"))
+
+	// the certificate is the first factor. The user of the required scope goes to the second factor step.
+	res, err := client.Get(srv.URL + "/dashboard")
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusFound, res.StatusCode)
+	assert.Equal(t, "/.wru/mfa", res.Header.Get("Location"))
+	var sid string
+	for _, ck := range res.Cookies() {
+		if ck.Name == "WRU_SESSION" {
+			sid = ck.Value
+		}
+	}
+	ses, err := s.FindBySessionToken(context.Background(), sid)
+	assert.NoError(t, err)
+	assert.Equal(t, BeforeLogin, ses.Status)
+	assert.Equal(t, "admin", ses.Data[mfaUserKey])
+	assert.Equal(t, "x509", ses.Data[mfaIdPKey])
+	assert.Equal(t, "/dashboard", ses.Data["landingURL"])
+
+	sessions, err := s.GetUserSessions(context.Background(), "admin")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+	assert.Empty(t, sink.types())
+}
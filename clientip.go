@@ -0,0 +1,211 @@
+package wru
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDRList parses comma separated CIDRs. Single IP address is also accepted.
+func parseCIDRList(src string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, s := range strings.Split(src, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := parseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address: %s", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %s", s)
+	}
+	return n, nil
+}
+
+func joinCIDRs(nets []*net.IPNet) string {
+	var result []string
+	for _, n := range nets {
+		result = append(result, n.String())
+	}
+	return strings.Join(result, ", ")
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns IP address of the client.
+//
+// Proxy header fields are used only when the request comes from trusted proxies.
+// The proxy chain is read from Forwarded (RFC 7239), X-Forwarded-For or X-Real-IP (in this order of priority).
+// If Config.TrustedProxyHops is set, the address that is the number of hops away from wru is the client.
+// Otherwise, the chain is read from right to left and the first address that is not in Config.TrustedProxies is the client.
+func clientIP(c *Config, r *http.Request) string {
+	peer := r.RemoteAddr
+	if ip := parseNode(peer); ip != nil {
+		peer = ip.String()
+	}
+	if c.TrustedProxyHops <= 0 && !containsIP(c.TrustedProxies, net.ParseIP(peer)) {
+		return peer
+	}
+	chain := append(proxyChain(r.Header), peer)
+	if c.TrustedProxyHops > 0 {
+		i := len(chain) - 1 - c.TrustedProxyHops
+		if i < 0 {
+			i = 0
+		}
+		// skip unknown or obfuscated nodes
+		for ; i < len(chain); i++ {
+			if ip := parseNode(chain[i]); ip != nil {
+				return ip.String()
+			}
+		}
+		return peer
+	}
+	client := peer
+	for i := len(chain) - 2; i >= 0; i-- {
+		ip := parseNode(chain[i])
+		if ip == nil {
+			// the chain is broken. The last trusted proxy is the client.
+			break
+		}
+		client = ip.String()
+		if !containsIP(c.TrustedProxies, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// proxyChain returns the list of node names from client to the nearest proxy
+func proxyChain(h http.Header) []string {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values)
+	}
+	var result []string
+	if values := h.Values("X-Forwarded-For"); len(values) > 0 {
+		for _, v := range values {
+			for _, n := range strings.Split(v, ",") {
+				if n = strings.TrimSpace(n); n != "" {
+					result = append(result, n)
+				}
+			}
+		}
+		return result
+	}
+	if v := strings.TrimSpace(h.Get("X-Real-IP")); v != "" {
+		result = append(result, v)
+	}
+	return result
+}
+
+// parseForwarded returns "for" parameters of Forwarded header fields (RFC 7239).
+// Elements without "for" parameter are returned as "unknown" to keep the length of the chain.
+func parseForwarded(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, element := range splitQuoted(v, ',') {
+			node := "unknown"
+			for _, pair := range splitQuoted(element, ';') {
+				kv := strings.SplitN(pair, "=", 2)
+				if len(kv) != 2 || !strings.EqualFold(strings.TrimSpace(kv[0]), "for") {
+					continue
+				}
+				node = unquote(strings.TrimSpace(kv[1]))
+			}
+			result = append(result, node)
+		}
+	}
+	return result
+}
+
+// splitQuoted splits src by sep outside of quoted-string
+func splitQuoted(src string, sep byte) []string {
+	var result []string
+	inQuote := false
+	escaped := false
+	start := 0
+	for i := 0; i < len(src); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote && src[i] == '\\':
+			escaped = true
+		case src[i] == '"':
+			inQuote = !inQuote
+		case !inQuote && src[i] == sep:
+			if s := strings.TrimSpace(src[start:i]); s != "" {
+				result = append(result, s)
+			}
+			start = i + 1
+		}
+	}
+	if s := strings.TrimSpace(src[start:]); s != "" {
+		result = append(result, s)
+	}
+	return result
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+		var b strings.Builder
+		escaped := false
+		for i := 0; i < len(s); i++ {
+			if !escaped && s[i] == '\\' {
+				escaped = true
+				continue
+			}
+			escaped = false
+			b.WriteByte(s[i])
+		}
+		return b.String()
+	}
+	return s
+}
+
+// parseNode parses node name like "192.0.2.1", "192.0.2.1:1234", "[2001:db8::1]:8080" or "2001:db8::1".
+// It returns nil for "unknown" and obfuscated identifiers like "_hidden".
+func parseNode(node string) net.IP {
+	node = strings.TrimSpace(node)
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		node = host
+	}
+	node = strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+	// IPv6 zone is not an address
+	if i := strings.IndexByte(node, '%'); i >= 0 {
+		node = node[:i]
+	}
+	return net.ParseIP(node)
+}
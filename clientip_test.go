@@ -0,0 +1,143 @@
+package wru
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_clientIP(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies string
+		hops           int
+		remoteAddr     string
+		header         map[string]string
+		want           string
+	}{
+		{
+			name:       "direct access",
+			remoteAddr: "192.0.2.1:1234",
+			want:       "192.0.2.1",
+		},
+		{
+			name:       "direct access via IPv6",
+			remoteAddr: "[2001:db8::1]:1234",
+			want:       "2001:db8::1",
+		},
+		{
+			name:       "ignore X-Forwarded-For from untrusted client",
+			remoteAddr: "192.0.2.1:1234",
+			header:     map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "192.0.2.1",
+		},
+		{
+			name:           "trusted proxy",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header:         map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:           "198.51.100.1",
+		},
+		{
+			name:           "spoofed first element",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header:         map[string]string{"X-Forwarded-For": "203.0.113.1, 198.51.100.1, 10.0.0.2"},
+			want:           "198.51.100.1",
+		},
+		{
+			name:           "forwarded",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header:         map[string]string{"Forwarded": `for=192.0.2.43;proto=https, for="[2001:db8:cafe::17]:4711";by=10.0.0.1`},
+			want:           "2001:db8:cafe::17",
+		},
+		{
+			name:           "forwarded has priority over X-Forwarded-For",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header: map[string]string{
+				"Forwarded":       `for="192.0.2.43:8080";proto=https`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			want: "192.0.2.43",
+		},
+		{
+			name:           "unknown node breaks chain",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header:         map[string]string{"Forwarded": `for=192.0.2.43, for=unknown, for=10.0.0.3`},
+			want:           "10.0.0.3",
+		},
+		{
+			name:           "X-Real-IP",
+			trustedProxies: "10.0.0.0/8",
+			remoteAddr:     "10.0.0.1:1234",
+			header:         map[string]string{"X-Real-IP": "198.51.100.1"},
+			want:           "198.51.100.1",
+		},
+		{
+			name:       "hop count",
+			hops:       2,
+			remoteAddr: "203.0.113.5:1234",
+			header:     map[string]string{"X-Forwarded-For": "192.0.2.200, 198.51.100.1, 203.0.113.9"},
+			want:       "198.51.100.1",
+		},
+		{
+			name:       "hop count is larger than chain",
+			hops:       3,
+			remoteAddr: "203.0.113.5:1234",
+			header:     map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			want:       "198.51.100.1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				TrustedProxies:   mustParseCIDRList(tt.trustedProxies),
+				TrustedProxyHops: tt.hops,
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, clientIP(c, r))
+		})
+	}
+}
+
+func Test_parseForwarded(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{
+			name:   "single",
+			values: []string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			want:   []string{"192.0.2.60"},
+		},
+		{
+			name:   "case insensitive key and quoted value",
+			values: []string{`For="[2001:db8:cafe::17]:4711"`},
+			want:   []string{"[2001:db8:cafe::17]:4711"},
+		},
+		{
+			name:   "multiple elements and fields",
+			values: []string{"for=192.0.2.43, for=198.51.100.17", "for=_hidden"},
+			want:   []string{"192.0.2.43", "198.51.100.17", "_hidden"},
+		},
+		{
+			name:   "quoted separator",
+			values: []string{`for="192.0.2.1";host="a,b;c", proto=https`},
+			want:   []string{"192.0.2.1", "unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseForwarded(tt.values))
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -46,7 +47,8 @@ func main() {
 			},
 		},
 	}
-	wruHandler, authMiddleware := wru.NewAuthorizationMiddleware(ctx, c, os.Stdout)
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	wruHandler, authMiddleware := wru.NewAuthorizationMiddleware(ctx, c, os.Stdout, wru.WithLogger(logger))
 	r.Use(middleware.Logger)
 	r.Mount("/", wruHandler)
 	r.With(authMiddleware).Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -2,9 +2,7 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -24,12 +22,10 @@ import (
 	_ "gocloud.dev/blob/s3blob"
 )
 
-func init() {
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	log.SetPrefix("🦀 ")
-}
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "users" {
+		os.Exit(usersCommand(os.Args[2:]))
+	}
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
 
@@ -38,44 +34,47 @@ func main() {
 		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Parse config error: %s", err.Error()))
 		os.Exit(1)
 	}
+	logger := c.Logger
 	sessionStorage, err := wru.NewSessionStorage(ctx, c, os.Stdout)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Connect session error: %s", err.Error()))
+		logger.Error("connect session error", "error", err)
 		os.Exit(1)
 	}
 	userStorage, warnings, err := wru.NewIdentityRegister(ctx, c, os.Stdout)
+	for _, w := range warnings {
+		logger.Warn("user parse warning", "warning", w)
+	}
 	if err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Read user table error: %s", err.Error()))
+		logger.Error("read user table error", "error", err)
 		os.Exit(1)
 	}
-	for _, w := range warnings {
-		fmt.Fprintln(os.Stderr, color.Warn.Sprintf("User parse warning: %s", w))
-	}
 	handler, err := wru.NewIdentityAwareProxyHandler(c, sessionStorage, userStorage)
+	if err != nil {
+		logger.Error("create proxy error", "error", err)
+		os.Exit(1)
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", c.Port),
 		Handler: handler,
 	}
+	adminSrv := &http.Server{
+		Addr:    fmt.Sprintf(":%d", c.AdminPort),
+		Handler: wru.NewAdminHandler(c),
+	}
 
-	var cert tls.Certificate
-	if c.TlsCert != "" && c.TlsKey != "" {
-		cert, err = tls.X509KeyPair([]byte(c.TlsCert), []byte(c.TlsKey))
-		if err != nil {
-			fmt.Fprintln(os.Stderr, color.Error.Sprintf("TLS error: %s", err.Error()))
-			return
-		}
+	srv.TLSConfig, err = c.TLSConfig()
+	if err != nil {
+		logger.Error("tls error", "error", err)
+		return
 	}
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		var err error
-		if c.TlsCert != "" && c.TlsKey != "" {
+		if srv.TLSConfig != nil {
 			color.Infof("starting wru server at https://localhost:%d\n", c.Port)
-			srv.TLSConfig = &tls.Config{
-				Certificates: []tls.Certificate{cert},
-			}
 			err = srv.ListenAndServeTLS("", "")
 		} else {
 			color.Infof("starting wru server at http://localhost:%d\n", c.Port)
@@ -83,15 +82,33 @@ func main() {
 		}
 		if err != http.ErrServerClosed {
 			// unexpected error. port in use?
-			fmt.Fprintln(os.Stderr, color.Error.Sprintf("Server Error: %v", err))
+			logger.Error("server error", "error", err)
+			os.Exit(1)
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		color.Infof("starting admin server at http://localhost:%d\n", c.AdminPort)
+		err := adminSrv.ListenAndServe()
+		if err != http.ErrServerClosed {
+			logger.Error("admin server error", "error", err)
 			os.Exit(1)
 		}
 	}()
 	<-ctx.Done()
 	wait, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	if err := adminSrv.Shutdown(wait); err != nil {
+		logger.Error("shutdown admin server error", "error", err)
+		os.Exit(1)
+	}
 	if err := srv.Shutdown(wait); err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Shutdown Server Error: %v", err))
+		logger.Error("shutdown server error", "error", err)
+		os.Exit(1)
+	}
+	if err := c.Shutdown(wait); err != nil {
+		logger.Error("shutdown error", "error", err)
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	wru "github.com/future-architect/future-wru"
+	"github.com/gookit/color"
+)
+
+const usersUsage = `Usage: wru users validate <file>
+
+Validate the user table CSV. <file> is a local path or a blob URL like s3://bucket/users.csv.
+It exits with status 1 if the table has problems.
+`
+
+// usersCommand runs "wru users" subcommands and returns the exit status
+func usersCommand(args []string) int {
+	if len(args) != 2 || args[0] != "validate" {
+		fmt.Fprint(os.Stderr, usersUsage)
+		return 2
+	}
+	var m wru.UserMatching
+	if v := os.Getenv("WRU_USER_MATCH_STRIP_PLUS"); v != "" {
+		var err error
+		m.StripPlusAddressing, err = strconv.ParseBool(v)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, color.Error.Sprintf("Parse WRU_USER_MATCH_STRIP_PLUS error: %s", err.Error()))
+			return 2
+		}
+	}
+	path := args[1]
+	if !strings.Contains(path, "://") && !filepath.IsAbs(path) {
+		// relative path without "./" is also a local file on command line
+		path = "./" + path
+	}
+	users, warnings, err := wru.ValidateUserTable(context.Background(), path, m)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Read user table error: %s", err.Error()))
+		return 1
+	}
+	for _, w := range warnings {
+		color.Fprintf(os.Stdout, "<yellow>%s</>\n", w)
+	}
+	if len(warnings) > 0 {
+		color.Fprintf(os.Stdout, "<red>%d users, %d problems in %s</>\n", len(users), len(warnings), args[1])
+		return 1
+	}
+	color.Fprintf(os.Stdout, "<green>%d users in %s: ok</>\n", len(users), args[1])
+	return 0
+}
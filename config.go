@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/gookit/color"
 	"io"
+	"log/slog"
+	"net"
 	"net/url"
 	"os"
 	"regexp"
@@ -14,6 +16,7 @@ import (
 
 	"github.com/kelseyhightower/envconfig"
 	"github.com/oschwald/geoip2-golang"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 )
 
 type ClientSessionFieldType int
@@ -21,29 +24,52 @@ type ClientSessionFieldType int
 const (
 	CookieField ClientSessionFieldType = iota + 1
 	CookieWithJSField
+	// HeaderField is a custom header field like "X-Wru-Token: <session id>"
+	HeaderField
+	// BearerField is "Authorization: Bearer <session id>"
+	BearerField
 	InvalidField
 )
 
 type configFromEnv struct {
 	Port      uint16 `envconfig:"PORT" default:"3000"`
 	Host      string `envconfig:"HOST" required:"true"`
-	AdminPort uint16 `envconfig:"ADMIN_PORT" default:"3001"` // todo: implment admin screen
+	AdminPort uint16 `envconfig:"ADMIN_PORT" default:"3001"`
 
 	DevMode               bool   `envconfig:"WRU_DEV_MODE" default:"true"`
 	TlsCert               string `envconfig:"WRU_TLS_CERT"`
 	TlsKey                string `envconfig:"WRU_TLS_KEY"`
+	TlsClientCA           string `envconfig:"WRU_TLS_CLIENT_CA"`
+	TlsClientAuth         string `envconfig:"WRU_TLS_CLIENT_AUTH" default:"request"`
 	ForwardTo             string `envconfig:"WRU_FORWARD_TO" required:"true"`
 	DefaultLandingPage    string `envconfig:"WRU_DEFAULT_LANDING_PAGE" default:"/"`
+	AllowedRedirectHosts  string `envconfig:"WRU_ALLOWED_REDIRECT_HOSTS"`
 	SessionStorage        string `envconfig:"WRU_SESSION_STORAGE"`
 	ClientSessionIDCookie string `envconfig:"WRU_CLIENT_SESSION_ID_COOKIE" default:"WRU_SESSION@cookie"`
+	DeviceClients         string `envconfig:"WRU_DEVICE_CLIENTS"`
 	ServerSessionField    string `envconfig:"WRU_SERVER_SESSION_FIELD" default:"Wru-Session"`
+	CookieDomain          string `envconfig:"WRU_COOKIE_DOMAIN"`
+	CookiePath            string `envconfig:"WRU_COOKIE_PATH" default:"/"`
+	CookieSameSite        string `envconfig:"WRU_COOKIE_SAMESITE" default:"lax"`
+	CookiePrefix          string `envconfig:"WRU_COOKIE_PREFIX"`
+	SessionCookie         bool   `envconfig:"WRU_SESSION_COOKIE"`
+
+	IdentityHeaders           bool   `envconfig:"WRU_IDENTITY_HEADERS"`
+	IdentityHeaderUserField   string `envconfig:"WRU_IDENTITY_HEADER_USER_FIELD" default:"X-Wru-User"`
+	IdentityHeaderEmailField  string `envconfig:"WRU_IDENTITY_HEADER_EMAIL_FIELD" default:"X-Wru-Email"`
+	IdentityHeaderOrgField    string `envconfig:"WRU_IDENTITY_HEADER_ORG_FIELD" default:"X-Wru-Org"`
+	IdentityHeaderScopesField string `envconfig:"WRU_IDENTITY_HEADER_SCOPES_FIELD" default:"X-Wru-Scopes"`
 
 	UserTable           string        `envconfig:"WRU_USER_TABLE"`
 	UserTableReloadTerm time.Duration `envconfig:"WRU_USER_TABLE_RELOAD_TERM"`
+	UserTableStrict     bool          `envconfig:"WRU_USER_TABLE_STRICT"`
+	UserMatchStripPlus  bool          `envconfig:"WRU_USER_MATCH_STRIP_PLUS"`
+	UserMatchOIDCEmail  bool          `envconfig:"WRU_USER_MATCH_OIDC_EMAIL"`
 
 	LoginTimeoutTerm           time.Duration `envconfig:"WRU_LOGIN_TIMEOUT_TERM" default:"10m"`
 	SessionIdleTimeoutTerm     time.Duration `envconfig:"WRU_SESSION_IDLE_TIMEOUT_TERM" default:"1h"`
 	SessionAbsoluteTimeoutTerm time.Duration `envconfig:"WRU_SESSION_ABSOLUTE_TIMEOUT_TERM" default:"720h"`
+	AccessTokenMaxTerm         time.Duration `envconfig:"WRU_ACCESS_TOKEN_MAX_TERM" default:"2160h"`
 
 	HTMLTemplateFolder string `envconfig:"WRU_HTML_TEMPLATE_FOLDER"`
 
@@ -57,7 +83,70 @@ type configFromEnv struct {
 	OIDCClientID     string `envconfig:"WRU_OIDC_CLIENT_ID"`
 	OIDCClientSecret string `envconfig:"WRU_OIDC_CLIENT_SECRET"`
 
+	OIDCIssuerClients    string        `envconfig:"WRU_OIDC_ISSUER_CLIENTS"`
+	OIDCIssuerSigningKey string        `envconfig:"WRU_OIDC_ISSUER_SIGNING_KEY"`
+	OIDCIssuerTokenTerm  time.Duration `envconfig:"WRU_OIDC_ISSUER_TOKEN_TERM" default:"1h"`
+
+	MFAEncryptionKey  string `envconfig:"WRU_MFA_ENCRYPTION_KEY"`
+	MFARequiredScopes string `envconfig:"WRU_MFA_REQUIRED_SCOPES"`
+	MFAIssuer         string `envconfig:"WRU_MFA_ISSUER"`
+
+	WebAuthn       bool   `envconfig:"WRU_WEBAUTHN"`
+	WebAuthnRPID   string `envconfig:"WRU_WEBAUTHN_RP_ID"`
+	WebAuthnRPName string `envconfig:"WRU_WEBAUTHN_RP_NAME"`
+
+	EmailLogin         bool          `envconfig:"WRU_EMAIL_LOGIN"`
+	EmailLoginFrom     string        `envconfig:"WRU_EMAIL_LOGIN_FROM"`
+	EmailLoginLinkTerm time.Duration `envconfig:"WRU_EMAIL_LOGIN_LINK_TERM"`
+	SMTPServer         string        `envconfig:"WRU_SMTP_SERVER"`
+	SMTPUser           string        `envconfig:"WRU_SMTP_USER"`
+	SMTPPassword       string        `envconfig:"WRU_SMTP_PASSWORD"`
+
 	GeoIPDatabase string `envconfig:"WRU_GEIIP_DATABASE"`
+
+	TrustedProxies   string `envconfig:"WRU_TRUSTED_PROXIES"`
+	TrustedProxyHops int    `envconfig:"WRU_TRUSTED_PROXY_HOPS"`
+	AllowIPs         string `envconfig:"WRU_ALLOW_IPS"`
+	DenyIPs          string `envconfig:"WRU_DENY_IPS"`
+	AllowCountries   string `envconfig:"WRU_ALLOW_COUNTRIES"`
+	DenyCountries    string `envconfig:"WRU_DENY_COUNTRIES"`
+	ScopePolicies    string `envconfig:"WRU_SCOPE_POLICIES"`
+
+	HSTSMaxAge           time.Duration `envconfig:"WRU_HSTS_MAX_AGE" default:"8760h"`
+	FrameOptions         string        `envconfig:"WRU_FRAME_OPTIONS" default:"DENY"`
+	ReferrerPolicy       string        `envconfig:"WRU_REFERRER_POLICY" default:"same-origin"`
+	ProxyResponseHeaders string        `envconfig:"WRU_PROXY_RESPONSE_HEADERS"`
+
+	SessionBinding           string `envconfig:"WRU_SESSION_BINDING"`
+	SessionBindingAction     string `envconfig:"WRU_SESSION_BINDING_ACTION" default:"log"`
+	SessionBindingIPv4Prefix int    `envconfig:"WRU_SESSION_BINDING_IPV4_PREFIX" default:"24"`
+	SessionBindingIPv6Prefix int    `envconfig:"WRU_SESSION_BINDING_IPV6_PREFIX" default:"64"`
+
+	AuditLog string `envconfig:"WRU_AUDIT_LOG"`
+
+	LoginRateLimitIP      string        `envconfig:"WRU_LOGIN_RATE_LIMIT_IP" default:"20/1m"`
+	LoginRateLimitUser    string        `envconfig:"WRU_LOGIN_RATE_LIMIT_USER" default:"10/1m"`
+	LoginLockoutThreshold int           `envconfig:"WRU_LOGIN_LOCKOUT_THRESHOLD" default:"0"`
+	LoginLockoutDuration  time.Duration `envconfig:"WRU_LOGIN_LOCKOUT_DURATION" default:"15m"`
+
+	LogLevel  string `envconfig:"WRU_LOG_LEVEL" default:"info"`
+	LogFormat string `envconfig:"WRU_LOG_FORMAT" default:"text"`
+	AccessLog string `envconfig:"WRU_ACCESS_LOG" default:"combined"`
+
+	OTLPEndpoint       string `envconfig:"WRU_OTLP_ENDPOINT"`
+	OTLPInsecure       bool   `envconfig:"WRU_OTLP_INSECURE"`
+	TracingServiceName string `envconfig:"WRU_TRACING_SERVICE_NAME" default:"wru"`
+
+	UpstreamDialTimeout           time.Duration `envconfig:"WRU_UPSTREAM_DIAL_TIMEOUT" default:"30s"`
+	UpstreamResponseHeaderTimeout time.Duration `envconfig:"WRU_UPSTREAM_RESPONSE_HEADER_TIMEOUT"`
+	UpstreamIdleConnTimeout       time.Duration `envconfig:"WRU_UPSTREAM_IDLE_CONN_TIMEOUT" default:"90s"`
+	UpstreamMaxIdleConns          int           `envconfig:"WRU_UPSTREAM_MAX_IDLE_CONNS" default:"100"`
+	UpstreamMaxIdleConnsPerHost   int           `envconfig:"WRU_UPSTREAM_MAX_IDLE_CONNS_PER_HOST"`
+	UpstreamCACert                string        `envconfig:"WRU_UPSTREAM_CA_CERT"`
+	UpstreamClientCert            string        `envconfig:"WRU_UPSTREAM_CLIENT_CERT"`
+	UpstreamClientKey             string        `envconfig:"WRU_UPSTREAM_CLIENT_KEY"`
+	UpstreamInsecureSkipVerify    bool          `envconfig:"WRU_UPSTREAM_INSECURE_SKIP_VERIFY"`
+	UpstreamHTTP2                 bool          `envconfig:"WRU_UPSTREAM_HTTP2" default:"true"`
 }
 
 type Config struct {
@@ -69,18 +158,29 @@ type Config struct {
 	AdminPort                uint16
 	TlsCert                  string
 	TlsKey                   string
+	ClientCert               ClientCertConfig
 	ForwardTo                []Route
+	Upstream                 UpstreamTransport
 	DefaultLandingPage       string
+	AllowedRedirectHosts     []string
 	UserTable                string
 	UserTableReloadTerm      time.Duration
+	UserTableStrict          bool
+	UserMatching             UserMatching
 	SessionStorage           string
 	ServerSessionField       string
+	IdentityHeaders          IdentityHeaderConfig
 	ClientSessionFieldCookie ClientSessionFieldType
 	ClientSessionKey         string
+	Cookie                   CookieConfig
+	// DeviceClients are client IDs of CLI tools that can use the device authorization grant in header modes
+	DeviceClients []string
 
 	LoginTimeoutTerm           time.Duration
 	SessionIdleTimeoutTerm     time.Duration
 	SessionAbsoluteTimeoutTerm time.Duration
+	// AccessTokenMaxTerm is the maximum expiration term of personal access tokens
+	AccessTokenMaxTerm time.Duration
 
 	HTMLTemplateFolder string
 
@@ -90,14 +190,60 @@ type Config struct {
 
 	availableIDPs map[string]bool
 
+	// OIDCIssuer makes wru an OpenID Connect provider for applications behind it
+	OIDCIssuer OIDCIssuerConfig
+
+	// MFA is TOTP second factor after the login of ID providers
+	MFA MFAConfig
+
+	// WebAuthn enables passkeys for the login and the second factor
+	WebAuthn WebAuthnConfig
+
+	// EmailLogin enables passwordless login by links sent to User.Email
+	EmailLogin EmailLoginConfig
+
 	RedisSession RedisConfig
 
 	GeoIPDatabasePath string
 
+	// TrustedProxies are load balancers or proxies in front of wru. Forwarded, X-Forwarded-For and X-Real-IP are used only when requests come from them.
+	TrustedProxies []*net.IPNet
+	// TrustedProxyHops is the number of proxies in front of wru. Use it instead of TrustedProxies if the addresses of proxies are not fixed.
+	TrustedProxyHops int
+	// AccessPolicy is applied to all requests
+	AccessPolicy AccessPolicy
+	// ScopePolicies are applied to users that have the scope
+	ScopePolicies map[string]*AccessPolicy
+
+	SecurityHeaders SecurityHeaders
+
+	// SessionBinding detects sessions that are used from the client different from the one that logged in
+	SessionBinding SessionBinding
+
+	// AuditLog is a destination of audit log (see NewAuditSink). It is ignored if AuditSink is set.
+	AuditLog  string
+	AuditSink AuditSink
+
+	LoginRateLimit LoginRateLimit
+	// RateLimitStore keeps states of LoginRateLimit and jti claims of used JWT assertions. It is created from SessionStorage if it is nil.
+	RateLimitStore RateLimitStore
+
+	// OTLPEndpoint is host:port of OpenTelemetry collector (OTLP/HTTP). Tracing is disabled if it is empty.
+	OTLPEndpoint       string
+	OTLPInsecure       bool
+	TracingServiceName string
+
+	// Logger is used for runtime logs. slog.Default() is used if it is nil.
+	Logger *slog.Logger
+	// AccessLog is a format of access log ("json" or "combined"). Access log is disabled if it is empty.
+	AccessLog       string
+	AccessLogOutput io.Writer
+
 	Users []*User
 
 	// internal use
-	geoIPDB *geoip2.Reader
+	geoIPDB        *geoip2.Reader
+	tracerProvider *sdktrace.TracerProvider
 
 	// internal use
 	init bool
@@ -114,10 +260,60 @@ func NewConfigFromEnv(ctx context.Context, out io.Writer) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	sameSite, err := parseSameSite(e.CookieSameSite)
+	if err != nil {
+		return nil, err
+	}
 	fieldKey, fieldType, err := parseClientSessionField(e.ClientSessionIDCookie)
 	if err != nil {
 		return nil, err
 	}
+	logger, err := NewLogger(os.Stderr, e.LogFormat, e.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies, err := parseCIDRList(e.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	allowIPs, err := parseCIDRList(e.AllowIPs)
+	if err != nil {
+		return nil, err
+	}
+	denyIPs, err := parseCIDRList(e.DenyIPs)
+	if err != nil {
+		return nil, err
+	}
+	scopePolicies, err := parseScopePolicies(e.ScopePolicies)
+	if err != nil {
+		return nil, err
+	}
+	proxyResponseHeaders, err := parseHeaderList(e.ProxyResponseHeaders)
+	if err != nil {
+		return nil, err
+	}
+	sessionBinding, err := parseSessionBinding(e.SessionBinding, e.SessionBindingAction)
+	if err != nil {
+		return nil, err
+	}
+	sessionBinding.IPv4Prefix = e.SessionBindingIPv4Prefix
+	sessionBinding.IPv6Prefix = e.SessionBindingIPv6Prefix
+	rateLimitIP, err := parseRateLimit(e.LoginRateLimitIP)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitUser, err := parseRateLimit(e.LoginRateLimitUser)
+	if err != nil {
+		return nil, err
+	}
+	oidcClients, err := parseOIDCClients(e.OIDCIssuerClients)
+	if err != nil {
+		return nil, err
+	}
+	requireClientCert, err := parseClientCertAuth(e.TlsClientAuth)
+	if err != nil {
+		return nil, err
+	}
 
 	c := Config{
 		Port:                       e.Port,
@@ -127,16 +323,38 @@ func NewConfigFromEnv(ctx context.Context, out io.Writer) (*Config, error) {
 		TlsKey:                     e.TlsKey,
 		UserTable:                  e.UserTable,
 		UserTableReloadTerm:        e.UserTableReloadTerm,
+		UserTableStrict:            e.UserTableStrict,
 		ForwardTo:                  routes,
 		DefaultLandingPage:         e.DefaultLandingPage,
+		AllowedRedirectHosts:       splitList(e.AllowedRedirectHosts, ","),
 		SessionStorage:             e.SessionStorage,
 		ServerSessionField:         e.ServerSessionField,
 		ClientSessionKey:           fieldKey,
 		ClientSessionFieldCookie:   fieldType,
+		DeviceClients:              splitList(e.DeviceClients, ","),
 		LoginTimeoutTerm:           e.LoginTimeoutTerm,
 		SessionIdleTimeoutTerm:     e.SessionIdleTimeoutTerm,
 		SessionAbsoluteTimeoutTerm: e.SessionAbsoluteTimeoutTerm,
+		AccessTokenMaxTerm:         e.AccessTokenMaxTerm,
 		HTMLTemplateFolder:         e.HTMLTemplateFolder,
+		ClientCert: ClientCertConfig{
+			CACert:  e.TlsClientCA,
+			Require: requireClientCert,
+		},
+		Cookie: CookieConfig{
+			Domain:        e.CookieDomain,
+			Path:          e.CookiePath,
+			SameSite:      sameSite,
+			Prefix:        e.CookiePrefix,
+			SessionCookie: e.SessionCookie,
+		},
+		IdentityHeaders: IdentityHeaderConfig{
+			Enabled:      e.IdentityHeaders,
+			User:         e.IdentityHeaderUserField,
+			Email:        e.IdentityHeaderEmailField,
+			Organization: e.IdentityHeaderOrgField,
+			Scopes:       e.IdentityHeaderScopesField,
+		},
 		Twitter: TwitterConfig{
 			ConsumerKey:    e.TwitterConsumerKey,
 			ConsumerSecret: e.TwitterConsumerSecret,
@@ -150,8 +368,75 @@ func NewConfigFromEnv(ctx context.Context, out io.Writer) (*Config, error) {
 			ClientID:     e.OIDCClientID,
 			ClientSecret: e.OIDCClientSecret,
 		},
+		OIDCIssuer: OIDCIssuerConfig{
+			Clients:    oidcClients,
+			SigningKey: e.OIDCIssuerSigningKey,
+			TokenTerm:  e.OIDCIssuerTokenTerm,
+		},
+		MFA: MFAConfig{
+			EncryptionKey:  e.MFAEncryptionKey,
+			RequiredScopes: splitList(e.MFARequiredScopes, ","),
+			Issuer:         e.MFAIssuer,
+		},
+		WebAuthn: WebAuthnConfig{
+			Enabled: e.WebAuthn,
+			RPID:    e.WebAuthnRPID,
+			RPName:  e.WebAuthnRPName,
+		},
+		UserMatching: UserMatching{
+			StripPlusAddressing: e.UserMatchStripPlus,
+			OIDCEmailFallback:   e.UserMatchOIDCEmail,
+		},
+		EmailLogin: EmailLoginConfig{
+			Enabled:      e.EmailLogin,
+			From:         e.EmailLoginFrom,
+			LinkTerm:     e.EmailLoginLinkTerm,
+			SMTPServer:   e.SMTPServer,
+			SMTPUser:     e.SMTPUser,
+			SMTPPassword: e.SMTPPassword,
+		},
+		Upstream: UpstreamTransport{
+			DialTimeout:           e.UpstreamDialTimeout,
+			ResponseHeaderTimeout: e.UpstreamResponseHeaderTimeout,
+			IdleConnTimeout:       e.UpstreamIdleConnTimeout,
+			MaxIdleConns:          e.UpstreamMaxIdleConns,
+			MaxIdleConnsPerHost:   e.UpstreamMaxIdleConnsPerHost,
+			CACert:                e.UpstreamCACert,
+			ClientCert:            e.UpstreamClientCert,
+			ClientKey:             e.UpstreamClientKey,
+			InsecureSkipVerify:    boolPtr(e.UpstreamInsecureSkipVerify),
+			HTTP2:                 boolPtr(e.UpstreamHTTP2),
+		},
 		DevMode:           e.DevMode,
 		GeoIPDatabasePath: e.GeoIPDatabase,
+		AuditLog:          e.AuditLog,
+		TrustedProxies:    trustedProxies,
+		TrustedProxyHops:  e.TrustedProxyHops,
+		AccessPolicy: AccessPolicy{
+			AllowIPs:       allowIPs,
+			DenyIPs:        denyIPs,
+			AllowCountries: splitList(e.AllowCountries, ","),
+			DenyCountries:  splitList(e.DenyCountries, ","),
+		},
+		ScopePolicies: scopePolicies,
+		SecurityHeaders: SecurityHeaders{
+			HSTSMaxAge:           e.HSTSMaxAge,
+			FrameOptions:         e.FrameOptions,
+			ReferrerPolicy:       e.ReferrerPolicy,
+			ProxyResponseHeaders: proxyResponseHeaders,
+		},
+		SessionBinding: sessionBinding,
+		LoginRateLimit: LoginRateLimit{
+			PerIP:            rateLimitIP,
+			PerUser:          rateLimitUser,
+			LockoutThreshold: e.LoginLockoutThreshold,
+			LockoutDuration:  e.LoginLockoutDuration,
+		},
+		OTLPEndpoint:       e.OTLPEndpoint,
+		OTLPInsecure:       e.OTLPInsecure,
+		TracingServiceName: e.TracingServiceName,
+		Logger:             logger,
+		AccessLog:          e.AccessLog,
 	}
 	err = c.Init(ctx, out)
 	if err != nil {
@@ -182,6 +467,7 @@ func (c *Config) Init(ctx context.Context, out io.Writer) error {
 	if c.ServerSessionField == "" {
 		c.ServerSessionField = "Wru-Session"
 	}
+	c.IdentityHeaders.setDefaults()
 	if c.LoginTimeoutTerm == 0 {
 		c.LoginTimeoutTerm = 10 * time.Minute
 	}
@@ -191,13 +477,37 @@ func (c *Config) Init(ctx context.Context, out io.Writer) error {
 	if c.SessionAbsoluteTimeoutTerm == 0 {
 		c.SessionAbsoluteTimeoutTerm = 720 * time.Hour
 	}
+	if c.AccessTokenMaxTerm == 0 {
+		c.AccessTokenMaxTerm = 90 * 24 * time.Hour
+	}
 
 	// existing check
 	if c.Host == "" {
 		return errors.New("config Host is required")
 	}
+	if err := initCookie(c); err != nil {
+		return err
+	}
+	if c.AccessTokenMaxTerm < 24*time.Hour {
+		return fmt.Errorf("access token max term should be 24h or longer: %s", c.AccessTokenMaxTerm)
+	}
+
+	switch c.AccessLog {
+	case "", AccessLogJSON, AccessLogCombined:
+	default:
+		return fmt.Errorf("invalid access log format: %s", c.AccessLog)
+	}
+
+	for _, r := range c.ForwardTo {
+		if _, err := r.Transport.merge(c.Upstream).newTransport(); err != nil {
+			return fmt.Errorf("invalid upstream setting of %s: %w", r.Path, err)
+		}
+	}
 
 	c.availableIDPs = make(map[string]bool)
+	if err := initEmailLogin(c); err != nil {
+		return err
+	}
 
 	if !c.DevMode {
 		initTwitterClient(c, out)
@@ -215,17 +525,74 @@ func (c *Config) Init(ctx context.Context, out io.Writer) error {
 		}
 		c.geoIPDB = db
 	}
+	if c.geoIPDB == nil {
+		usesCountry := c.AccessPolicy.usesCountry()
+		for _, p := range c.ScopePolicies {
+			usesCountry = usesCountry || p.usesCountry()
+		}
+		for _, r := range c.ForwardTo {
+			usesCountry = usesCountry || r.Policy.usesCountry()
+		}
+		if usesCountry {
+			return errors.New("country policy requires GeoIP database")
+		}
+		if c.SessionBinding.Country {
+			return errors.New("country session binding requires GeoIP database")
+		}
+	}
+	if err := initOIDCIssuer(c); err != nil {
+		return err
+	}
+	if err := initClientCert(c); err != nil {
+		return err
+	}
+	if err := initMFA(c); err != nil {
+		return err
+	}
+	if err := initWebAuthn(c); err != nil {
+		return err
+	}
+	c.SecurityHeaders.setDefaults()
+	if err := c.SecurityHeaders.validate(); err != nil {
+		return err
+	}
+	c.SessionBinding.setDefaults()
+	if c.SessionBinding.IPv4Prefix < 0 || c.SessionBinding.IPv4Prefix > 32 || c.SessionBinding.IPv6Prefix < 0 || c.SessionBinding.IPv6Prefix > 128 {
+		return fmt.Errorf("invalid session binding prefix: /%d, /%d", c.SessionBinding.IPv4Prefix, c.SessionBinding.IPv6Prefix)
+	}
 	err := initTemplate(c, os.Stdout)
 	if err != nil {
 		return fmt.Errorf("Parse HTML template error: %s", err.Error())
 	}
+	err = initTracing(ctx, c, out)
+	if err != nil {
+		return err
+	}
+	if c.AuditSink == nil && c.AuditLog != "" {
+		c.AuditSink, err = NewAuditSink(ctx, c.AuditLog)
+		if err != nil {
+			return fmt.Errorf("Open audit log error: %s", err.Error())
+		}
+	}
+	if c.RateLimitStore == nil {
+		c.RateLimitStore, err = NewRateLimitStore(ctx, c.SessionStorage)
+		if err != nil {
+			return fmt.Errorf("Open rate limit storage error: %s", err.Error())
+		}
+	}
 
 	c.init = true
 	if out != nil {
 		color.Fprintf(out, "<blue>Host:</> %s\n", c.Host)
 		color.Fprintf(out, "<blue>Port:</> %d\n", c.Port)
+		color.Fprintf(out, "<blue>Admin Port:</> %d\n", c.AdminPort)
 		if c.TlsCert != "" && c.TlsKey != "" {
 			color.Fprintf(out, "<blue>TLS:</> <green>enabled</>\n")
+			if c.ClientCert.Available() && c.ClientCert.Require {
+				color.Fprintf(out, "<blue>TLS Client Certificate:</> <green>required</>\n")
+			} else if c.ClientCert.Available() {
+				color.Fprintf(out, "<blue>TLS Client Certificate:</> <green>enabled</>\n")
+			}
 		} else {
 			color.Fprintf(out, "<blue>TLS:</> <red>disabled</>\n")
 		}
@@ -234,6 +601,94 @@ func (c *Config) Init(ctx context.Context, out io.Writer) error {
 		for _, r := range c.ForwardTo {
 			color.Fprintf(out, "  <green>%s</> => %s (%s)\n", r.Path, r.Host.String(), strings.Join(r.Scopes, ", "))
 		}
+		if c.ClientSessionFieldCookie.isHeader() {
+			color.Fprintf(out, "<blue>Session Header:</> %s\n", c.ClientSessionKey)
+			if len(c.DeviceClients) > 0 {
+				color.Fprintf(out, "<blue>Device Login Clients:</> %s\n", strings.Join(c.DeviceClients, ", "))
+			}
+		}
+		color.Fprintf(out, "<blue>Session Cookie:</> %s (%s)\n", sessionCookieName(c), c.Cookie.String())
+		color.Fprintf(out, "<blue>Access Token Max Term:</> %d days\n", int(c.AccessTokenMaxTerm/(24*time.Hour)))
+		if len(c.AllowedRedirectHosts) > 0 {
+			color.Fprintf(out, "<blue>Allowed Redirect Hosts:</> %s\n", strings.Join(c.AllowedRedirectHosts, ", "))
+		}
+		if c.OIDCIssuer.Available() {
+			color.Fprintf(out, "<blue>OIDC Issuer:</> <green>%s</>\n", oidcIssuerURL(c))
+			for _, cl := range c.OIDCIssuer.Clients {
+				color.Fprintf(out, "  <green>%s</> => %s (%s)\n", cl.ID, strings.Join(cl.RedirectURIs, " | "), strings.Join(cl.Scopes, ", "))
+			}
+			if c.OIDCIssuer.SigningKey == "" {
+				color.Fprintf(out, "  <red>temporary signing key is used. Tokens are invalid after restart.</>\n")
+			}
+		}
+		if c.MFA.Available() {
+			if len(c.MFA.RequiredScopes) > 0 {
+				color.Fprintf(out, "<blue>MFA:</> <green>enabled (required for %s)</>\n", strings.Join(c.MFA.RequiredScopes, ", "))
+			} else {
+				color.Fprintf(out, "<blue>MFA:</> <green>enabled</>\n")
+			}
+			if c.MFA.EncryptionKey == "" {
+				color.Fprintf(out, "  <red>temporary encryption key is used. Enrolled secrets are invalid after restart.</>\n")
+			}
+		}
+		if c.WebAuthn.Available() {
+			color.Fprintf(out, "<blue>Passkey:</> <green>enabled (RP ID: %s)</>\n", c.WebAuthn.RPID)
+		}
+		if c.UserMatching.StripPlusAddressing {
+			color.Fprintf(out, "<blue>User Matching:</> <green>ignore plus addressing of email addresses</>\n")
+		}
+		if c.UserMatching.OIDCEmailFallback {
+			color.Fprintf(out, "<blue>User Matching:</> <green>match OIDC login by verified email if oidc account is not registered</>\n")
+		}
+		if c.UserTableStrict {
+			color.Fprintf(out, "<blue>User Table Validation:</> <green>strict (users with problems are not loaded)</>\n")
+		}
+		if c.EmailLogin.Available() {
+			color.Fprintf(out, "<blue>Email Login:</> <green>enabled (SMTP: %s, link term: %s)</>\n", c.EmailLogin.SMTPServer, c.EmailLogin.LinkTerm)
+		}
+		if c.Upstream.insecureSkipVerify() {
+			color.Fprintf(out, "<blue>Upstream TLS Verification:</> <red>disabled</>\n")
+		}
+		if c.AuditSink != nil {
+			color.Fprintf(out, "<blue>Audit Log:</> <green>enabled(%s)</>\n", c.AuditLog)
+		} else {
+			color.Fprintf(out, "<blue>Audit Log:</> <red>disabled</>\n")
+		}
+		if c.LoginRateLimit.enabled() {
+			l := c.LoginRateLimit
+			color.Fprintf(out, "<blue>Login Rate Limit:</> <green>IP: %s, User: %s, Lockout: %d failures/%s</>\n", l.PerIP, l.PerUser, l.LockoutThreshold, l.LockoutDuration)
+			if l.LockoutThreshold > 0 && len(c.TrustedProxies) == 0 && c.TrustedProxyHops == 0 {
+				color.Fprintf(out, "  <red>no trusted proxies. All clients behind a load balancer share one lockout.</>\n")
+			}
+		} else {
+			color.Fprintf(out, "<blue>Login Rate Limit:</> <red>disabled</>\n")
+		}
+		if c.AccessLog != "" {
+			color.Fprintf(out, "<blue>Access Log:</> <green>enabled(%s)</>\n", c.AccessLog)
+		} else {
+			color.Fprintf(out, "<blue>Access Log:</> <red>disabled</>\n")
+		}
+		if len(c.TrustedProxies) > 0 {
+			color.Fprintf(out, "<blue>Trusted Proxies:</> %s\n", joinCIDRs(c.TrustedProxies))
+		}
+		if c.TrustedProxyHops > 0 {
+			color.Fprintf(out, "<blue>Trusted Proxy Hops:</> %d\n", c.TrustedProxyHops)
+		}
+		if !c.AccessPolicy.empty() {
+			color.Fprintf(out, "<blue>Access Policy:</> %s\n", c.AccessPolicy.String())
+		}
+		for scope, p := range c.ScopePolicies {
+			color.Fprintf(out, "<blue>Access Policy for %s:</> %s\n", scope, p.String())
+		}
+		if c.SecurityHeaders.HSTSMaxAge > 0 && strings.HasPrefix(c.Host, "https://") {
+			color.Fprintf(out, "<blue>HSTS:</> <green>max-age=%d</>\n", int(c.SecurityHeaders.HSTSMaxAge.Seconds()))
+		}
+		if len(c.SecurityHeaders.ProxyResponseHeaders) > 0 {
+			color.Fprintf(out, "<blue>Proxy Response Headers:</> %s\n", joinHeaders(c.SecurityHeaders.ProxyResponseHeaders))
+		}
+		if c.SessionBinding.enabled() {
+			color.Fprintf(out, "<blue>Session Binding:</> <green>%s</>\n", c.SessionBinding.String())
+		}
 		if c.GeoIPDatabasePath != "" {
 			color.Fprintf(out, "<blue>GeoIP:</> <green>enabled(%s)</>\n", c.GeoIPDatabasePath)
 		} else {
@@ -243,7 +698,26 @@ func (c *Config) Init(ctx context.Context, out io.Writer) error {
 	return nil
 }
 
-var rre = regexp.MustCompile(`\s*(/.*)\s*=>\s*(https?://[^\s (]+)(\s*\((.*)\))?\s*`)
+// Shutdown flushes remaining trace spans and audit events. Call it before exiting process.
+func (c *Config) Shutdown(ctx context.Context) error {
+	var err error
+	if c.tracerProvider != nil {
+		err = c.tracerProvider.Shutdown(ctx)
+	}
+	if c.AuditSink != nil {
+		if err2 := c.AuditSink.Close(); err == nil {
+			err = err2
+		}
+	}
+	if c.RateLimitStore != nil {
+		if err2 := c.RateLimitStore.Close(); err == nil {
+			err = err2
+		}
+	}
+	return err
+}
+
+var rre = regexp.MustCompile(`\s*(/.*)\s*=>\s*(https?://[^\s (\[]+)(\s*\(([^)]*)\))?(\s*\[([^\]]*)\])?\s*`)
 
 func parseForwardList(src string) ([]Route, error) {
 	var result []Route
@@ -266,10 +740,20 @@ func parseForwardList(src string) ([]Route, error) {
 		if err != nil {
 			return nil, err
 		}
+		var transport *UpstreamTransport
+		var policy *AccessPolicy
+		if strings.TrimSpace(match[6]) != "" {
+			transport, policy, err = parseRouteOptions(match[6])
+			if err != nil {
+				return nil, fmt.Errorf("wrong route definition: (%d)=%s: %w", i, route, err)
+			}
+		}
 		result = append(result, Route{
-			Path:   strings.TrimSpace(match[1]),
-			Host:   u,
-			Scopes: scopes,
+			Path:      strings.TrimSpace(match[1]),
+			Host:      u,
+			Scopes:    scopes,
+			Transport: transport,
+			Policy:    policy,
 		})
 	}
 	return result, nil
@@ -284,6 +768,13 @@ func parseClientSessionField(src string) (string, ClientSessionFieldType, error)
 		return fragments[0], CookieField, nil
 	} else if fragments[1] == "cookie-with-js" {
 		return fragments[0], CookieWithJSField, nil
+	} else if fragments[1] == "header" {
+		if strings.EqualFold(fragments[0], "Authorization") {
+			return "Authorization", BearerField, nil
+		}
+		return fragments[0], HeaderField, nil
+	} else if fragments[1] == "bearer" {
+		return "Authorization", BearerField, nil
 	}
 	return "", InvalidField, errors.New("invalid client session field")
 }
@@ -292,6 +783,35 @@ type Route struct {
 	Path   string
 	Host   *url.URL
 	Scopes []string
+	// Transport overwrites Config.Upstream for this route if it is not nil
+	Transport *UpstreamTransport
+	// Policy is applied to requests for this route in addition to Config.AccessPolicy
+	Policy *AccessPolicy
+}
+
+// IdentityHeaderConfig is a setting of discrete header fields that have user information for backend servers.
+// These fields are always removed from client requests even if Enabled is false.
+type IdentityHeaderConfig struct {
+	Enabled      bool
+	User         string
+	Email        string
+	Organization string
+	Scopes       string
+}
+
+func (c *IdentityHeaderConfig) setDefaults() {
+	if c.User == "" {
+		c.User = "X-Wru-User"
+	}
+	if c.Email == "" {
+		c.Email = "X-Wru-Email"
+	}
+	if c.Organization == "" {
+		c.Organization = "X-Wru-Org"
+	}
+	if c.Scopes == "" {
+		c.Scopes = "X-Wru-Scopes"
+	}
 }
 
 type TwitterConfig struct {
@@ -1,9 +1,11 @@
 package wru
 
 import (
+	"context"
 	"github.com/stretchr/testify/assert"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func mustParseUrl(src string) *url.URL {
@@ -50,6 +52,61 @@ func Test_parseForwardList(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "single route with transport options",
+			args: args{
+				src: "/api => https://localhost:8443 (admin) [insecure, h2, response-header-timeout=10s]",
+			},
+			want: []Route{
+				{
+					Path:   "/api",
+					Host:   mustParseUrl("https://localhost:8443"),
+					Scopes: []string{"admin"},
+					Transport: &UpstreamTransport{
+						InsecureSkipVerify:    boolPtr(true),
+						HTTP2:                 boolPtr(true),
+						ResponseHeaderTimeout: 10 * time.Second,
+					},
+				},
+			},
+		},
+		{
+			name: "route can turn off flags",
+			args: args{
+				src: "/api => https://localhost:8443 [insecure=false, h2=false]",
+			},
+			want: []Route{
+				{
+					Path: "/api",
+					Host: mustParseUrl("https://localhost:8443"),
+					Transport: &UpstreamTransport{
+						InsecureSkipVerify: boolPtr(false),
+						HTTP2:              boolPtr(false),
+					},
+				},
+			},
+		},
+		{
+			name: "wrong route option",
+			args: args{
+				src: "/api => https://localhost:8443 [unknown]",
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong flag value",
+			args: args{
+				src: "/api => https://localhost:8443 [h2=maybe]",
+			},
+			wantErr: true,
+		},
+		{
+			name: "client key without cert",
+			args: args{
+				src: "/api => https://localhost:8443 [key=/etc/wru/client-key.pem]",
+			},
+			wantErr: true,
+		},
 		{
 			name: "wrong route without role",
 			args: args{
@@ -106,6 +163,37 @@ func Test_parseClientSessionHeader(t *testing.T) {
 			want:     "WruSession",
 			wantType: CookieWithJSField,
 		},
+		{
+			name: "for custom header",
+			args: args{
+				src: "X-Wru-Token@header",
+			},
+			want:     "X-Wru-Token",
+			wantType: HeaderField,
+		},
+		{
+			name: "for authorization header",
+			args: args{
+				src: "authorization@header",
+			},
+			want:     "Authorization",
+			wantType: BearerField,
+		},
+		{
+			name: "for bearer",
+			args: args{
+				src: "@bearer",
+			},
+			want:     "Authorization",
+			wantType: BearerField,
+		},
+		{
+			name: "unknown",
+			args: args{
+				src: "WruSession@query",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -120,3 +208,26 @@ func Test_parseClientSessionHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestNewConfigFromEnv_LoginRateLimit(t *testing.T) {
+	t.Setenv("WRU_DEV_MODE", "true")
+	t.Setenv("HOST", "http://localhost:3000")
+	t.Setenv("WRU_FORWARD_TO", "/ => http://localhost:8000")
+	c, err := NewConfigFromEnv(context.Background(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Shutdown(context.Background())
+	assert.Equal(t, RateLimit{Count: 20, Per: time.Minute}, c.LoginRateLimit.PerIP)
+	// lockout by IP address is opt-in. All users behind a load balancer share one address without trusted proxies.
+	assert.Equal(t, 0, c.LoginRateLimit.LockoutThreshold)
+
+	t.Setenv("WRU_LOGIN_LOCKOUT_THRESHOLD", "5")
+	t.Setenv("WRU_TRUSTED_PROXIES", "10.0.0.0/8")
+	c, err = NewConfigFromEnv(context.Background(), nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer c.Shutdown(context.Background())
+	assert.Equal(t, 5, c.LoginRateLimit.LockoutThreshold)
+}
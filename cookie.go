@@ -0,0 +1,151 @@
+package wru
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	hostCookiePrefix   = "__Host-"
+	secureCookiePrefix = "__Secure-"
+)
+
+// CookieConfig is attributes of the session cookie
+type CookieConfig struct {
+	// Domain shares the session between subdomains like "example.com". The cookie is sent only to Config.Host if it is empty.
+	Domain string
+	// Path of the cookie (default is "/")
+	Path string
+	// SameSite mode (default is http.SameSiteLaxMode)
+	SameSite http.SameSite
+	// Prefix is "__Host-" or "__Secure-". It is added to the cookie name.
+	Prefix string
+	// SessionCookie removes Expires attribute. The cookie is removed when the browser is closed.
+	SessionCookie bool
+}
+
+func (cc *CookieConfig) setDefaults() {
+	if cc.Path == "" {
+		cc.Path = "/"
+	}
+	if cc.SameSite == 0 {
+		cc.SameSite = http.SameSiteLaxMode
+	}
+}
+
+func (cc CookieConfig) String() string {
+	var attrs []string
+	if cc.Domain != "" {
+		attrs = append(attrs, "Domain="+cc.Domain)
+	}
+	attrs = append(attrs, "Path="+cc.Path, "SameSite="+sameSiteString(cc.SameSite))
+	if cc.SessionCookie {
+		attrs = append(attrs, "session cookie")
+	}
+	return strings.Join(attrs, "; ")
+}
+
+// parseSameSite parses "lax", "strict" or "none"
+func parseSameSite(src string) (http.SameSite, error) {
+	switch strings.ToLower(strings.TrimSpace(src)) {
+	case "":
+		return 0, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid SameSite mode: %s (lax, strict or none is available)", src)
+}
+
+func sameSiteString(s http.SameSite) string {
+	switch s {
+	case http.SameSiteStrictMode:
+		return "Strict"
+	case http.SameSiteNoneMode:
+		return "None"
+	default:
+		return "Lax"
+	}
+}
+
+// initCookie adds prefix to the cookie name and rejects attributes that browsers refuse
+func initCookie(c *Config) error {
+	cc := &c.Cookie
+	cc.setDefaults()
+	switch cc.Prefix {
+	case "", hostCookiePrefix, secureCookiePrefix:
+	default:
+		return fmt.Errorf("invalid cookie prefix: %s (%s or %s is available)", cc.Prefix, hostCookiePrefix, secureCookiePrefix)
+	}
+	if cc.Prefix != "" && !c.ClientSessionFieldCookie.isHeader() && !strings.HasPrefix(c.ClientSessionKey, cc.Prefix) {
+		c.ClientSessionKey = cc.Prefix + c.ClientSessionKey
+	}
+	name := sessionCookieName(c)
+	if !strings.HasPrefix(cc.Path, "/") {
+		return fmt.Errorf("cookie path should start with '/': %s", cc.Path)
+	}
+	secure := strings.HasPrefix(c.Host, "https://")
+	if cc.SameSite == http.SameSiteNoneMode && !secure {
+		return errors.New("SameSite=None cookie requires https Host")
+	}
+	// browsers don't send Strict cookies in redirects from ID providers, so callbacks lose the login session
+	if cc.SameSite == http.SameSiteStrictMode && !c.DevMode && (c.Twitter.Available() || c.GitHub.Available() || c.OIDC.Available()) {
+		return errors.New("SameSite=Strict cookie can't be used with Twitter, GitHub or OpenID Connect login (use lax)")
+	}
+	switch {
+	case strings.HasPrefix(name, hostCookiePrefix):
+		if !secure {
+			return fmt.Errorf("%s cookie requires https Host", hostCookiePrefix)
+		}
+		if cc.Domain != "" {
+			return fmt.Errorf("%s cookie can't have Domain attribute", hostCookiePrefix)
+		}
+		if cc.Path != "/" {
+			return fmt.Errorf("%s cookie requires Path=/", hostCookiePrefix)
+		}
+	case strings.HasPrefix(name, secureCookiePrefix):
+		if !secure {
+			return fmt.Errorf("%s cookie requires https Host", secureCookiePrefix)
+		}
+	}
+	if cc.Domain != "" {
+		u, err := url.Parse(c.Host)
+		if err != nil {
+			return err
+		}
+		domain := strings.ToLower(strings.TrimPrefix(cc.Domain, "."))
+		host := strings.ToLower(u.Hostname())
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return fmt.Errorf("cookie domain %s doesn't match Host %s", cc.Domain, c.Host)
+		}
+	}
+	return nil
+}
+
+// newSessionCookie returns the session cookie. Zero expires means removing the cookie.
+func newSessionCookie(c *Config, value string, expires time.Time) *http.Cookie {
+	cc := c.Cookie
+	cc.setDefaults()
+	ck := &http.Cookie{
+		Name:     sessionCookieName(c),
+		Value:    value,
+		Path:     cc.Path,
+		Domain:   cc.Domain,
+		Secure:   strings.HasPrefix(c.Host, "https://"),
+		HttpOnly: c.ClientSessionFieldCookie != CookieWithJSField,
+		SameSite: cc.SameSite,
+	}
+	if expires.IsZero() {
+		ck.Expires = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+	} else if !cc.SessionCookie {
+		ck.Expires = expires
+	}
+	return ck
+}
@@ -0,0 +1,214 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_initCookie(t *testing.T) {
+	tests := []struct {
+		name    string
+		host    string
+		cookie  CookieConfig
+		wantKey string
+		wantErr bool
+	}{
+		{
+			name:    "default",
+			host:    "http://localhost:3000",
+			wantKey: "WRU_SESSION",
+		},
+		{
+			name:    "subdomain",
+			host:    "https://login.example.com",
+			cookie:  CookieConfig{Domain: "example.com"},
+			wantKey: "WRU_SESSION",
+		},
+		{
+			name:    "domain doesn't match host",
+			host:    "https://login.example.com",
+			cookie:  CookieConfig{Domain: "example.org"},
+			wantErr: true,
+		},
+		{
+			name:    "suffix is not a parent domain",
+			host:    "https://login.badexample.com",
+			cookie:  CookieConfig{Domain: "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "host prefix",
+			host:    "https://example.com",
+			cookie:  CookieConfig{Prefix: "__Host-"},
+			wantKey: "__Host-WRU_SESSION",
+		},
+		{
+			name:    "host prefix with domain",
+			host:    "https://login.example.com",
+			cookie:  CookieConfig{Prefix: "__Host-", Domain: "example.com"},
+			wantErr: true,
+		},
+		{
+			name:    "host prefix with path",
+			host:    "https://example.com",
+			cookie:  CookieConfig{Prefix: "__Host-", Path: "/app"},
+			wantErr: true,
+		},
+		{
+			name:    "host prefix without https",
+			host:    "http://localhost:3000",
+			cookie:  CookieConfig{Prefix: "__Host-"},
+			wantErr: true,
+		},
+		{
+			name:    "secure prefix with domain",
+			host:    "https://login.example.com",
+			cookie:  CookieConfig{Prefix: "__Secure-", Domain: "example.com"},
+			wantKey: "__Secure-WRU_SESSION",
+		},
+		{
+			name:    "secure prefix without https",
+			host:    "http://localhost:3000",
+			cookie:  CookieConfig{Prefix: "__Secure-"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown prefix",
+			host:    "https://example.com",
+			cookie:  CookieConfig{Prefix: "__Wru-"},
+			wantErr: true,
+		},
+		{
+			name:    "SameSite=None",
+			host:    "https://example.com",
+			cookie:  CookieConfig{SameSite: http.SameSiteNoneMode},
+			wantKey: "WRU_SESSION",
+		},
+		{
+			name:    "SameSite=None without https",
+			host:    "http://localhost:3000",
+			cookie:  CookieConfig{SameSite: http.SameSiteNoneMode},
+			wantErr: true,
+		},
+		{
+			name:    "relative path",
+			host:    "https://example.com",
+			cookie:  CookieConfig{Path: "app"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Host: tt.host, DevMode: true, Cookie: tt.cookie}
+			err := c.Init(context.Background(), nil)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantKey, c.ClientSessionKey)
+			}
+		})
+	}
+}
+
+func Test_initCookie_SameSiteStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		devMode bool
+		github  GitHubConfig
+		oidc    OIDCConfig
+		wantErr bool
+	}{
+		{
+			name: "no federated login",
+		},
+		{
+			name:    "GitHub login",
+			github:  GitHubConfig{ClientID: "id", ClientSecret: "secret"},
+			wantErr: true,
+		},
+		{
+			name:    "OpenID Connect login",
+			oidc:    OIDCConfig{ProviderURL: "https://idp.example.com", ClientID: "id", ClientSecret: "secret"},
+			wantErr: true,
+		},
+		{
+			name:    "DevMode",
+			devMode: true,
+			github:  GitHubConfig{ClientID: "id", ClientSecret: "secret"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Host:    "https://example.com",
+				DevMode: tt.devMode,
+				Cookie:  CookieConfig{SameSite: http.SameSiteStrictMode},
+				GitHub:  tt.github,
+				OIDC:    tt.oidc,
+			}
+			err := initCookie(c)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func Test_parseSameSite(t *testing.T) {
+	got, err := parseSameSite("Strict")
+	assert.NoError(t, err)
+	assert.Equal(t, http.SameSiteStrictMode, got)
+	_, err = parseSameSite("always")
+	assert.Error(t, err)
+}
+
+func Test_newSessionCookie(t *testing.T) {
+	expires := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	c := &Config{
+		Host:                     "https://login.example.com",
+		ClientSessionKey:         "WRU_SESSION",
+		ClientSessionFieldCookie: CookieField,
+		Cookie:                   CookieConfig{Domain: "example.com", SameSite: http.SameSiteStrictMode},
+	}
+	ck := newSessionCookie(c, "sid", expires)
+	assert.Equal(t, "example.com", ck.Domain)
+	assert.Equal(t, "/", ck.Path)
+	assert.Equal(t, http.SameSiteStrictMode, ck.SameSite)
+	assert.True(t, ck.Secure)
+	assert.True(t, ck.HttpOnly)
+	assert.Equal(t, expires, ck.Expires)
+
+	c.Cookie.SessionCookie = true
+	ck = newSessionCookie(c, "sid", expires)
+	assert.True(t, ck.Expires.IsZero())
+
+	// removing cookie always has Expires
+	ck = newSessionCookie(c, "", time.Time{})
+	assert.True(t, ck.Expires.Before(expires))
+}
+
+func TestPrefixedSessionCookie(t *testing.T) {
+	h, _, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), func(c *Config) {
+		c.Cookie.Prefix = "__Host-"
+	})
+
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+	r := httptest.NewRequest("GET", "/.wru/user", nil)
+	r.Header.Set("Accept", "application/json")
+	r.AddCookie(&http.Cookie{Name: "__Host-WRU_SESSION", Value: sid})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	// CSRF token cookie shares the prefix
+	if cookies := w.Result().Cookies(); assert.Len(t, cookies, 1) {
+		assert.Equal(t, "__Host-WRU_SESSION_CSRF", cookies[0].Name)
+	}
+}
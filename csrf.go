@@ -0,0 +1,117 @@
+package wru
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// CSRFTokenField is a form field name of CSRF token
+	CSRFTokenField = "csrf_token"
+	// CSRFTokenHeader is a header field name of CSRF token for non-form clients
+	CSRFTokenHeader = "X-CSRF-Token"
+)
+
+type contextCSRFKey string
+
+const csrfTokenKey contextCSRFKey = "csrfToken"
+
+// csrfCookieName returns the name of the cookie that keeps CSRF token.
+// It shares the prefix with the session cookie.
+func csrfCookieName(c *Config) string {
+	return sessionCookieName(c) + "_CSRF"
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func csrfTokenFromContext(ctx context.Context) string {
+	if t, ok := ctx.Value(csrfTokenKey).(string); ok {
+		return t
+	}
+	return ""
+}
+
+// sameOrigin checks Origin header field (or Referer if Origin doesn't exist).
+// Requests without both of them are accepted because they are not sent from browsers in most cases. The token check protects them.
+func sameOrigin(c *Config, r *http.Request) bool {
+	src := r.Header.Get("Origin")
+	if src == "" {
+		src = r.Header.Get("Referer")
+		if src == "" {
+			return true
+		}
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.Host == "" {
+		// including "null" origin
+		return false
+	}
+	if host, err := url.Parse(c.Host); err == nil && host.Host != "" {
+		return strings.EqualFold(u.Scheme, host.Scheme) && strings.EqualFold(u.Host, host.Host)
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfProtection is a double-submit cookie protection for wru endpoints.
+// The token is stored in the cookie and forms should send it as csrf_token field (or X-CSRF-Token header field).
+// State changing requests are also rejected if Origin/Referer is not Config.Host.
+func csrfProtection(c *Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var cookieToken string
+			if ck, err := r.Cookie(csrfCookieName(c)); err == nil {
+				cookieToken = ck.Value
+			}
+			// browsers don't send header based sessions automatically
+			if !isSafeMethod(r.Method) && sessionIDFromHeader(c, r) == "" {
+				reason := ""
+				if !sameOrigin(c, r) {
+					reason = "origin"
+				} else {
+					token := r.Header.Get(CSRFTokenHeader)
+					if token == "" {
+						token = r.PostFormValue(CSRFTokenField)
+					}
+					if cookieToken == "" || subtle.ConstantTimeCompare([]byte(cookieToken), []byte(token)) != 1 {
+						reason = "token"
+					}
+				}
+				if reason != "" {
+					c.logger().Warn("csrf check failed", "path", r.URL.Path, "reason", reason, "origin", r.Header.Get("Origin"))
+					c.audit(r, &AuditEvent{Type: AuditCSRFFailure, Reason: reason, Detail: map[string]string{"path": r.URL.Path}})
+					writeErrorPage(w, r, http.StatusForbidden, "The request was rejected because it may be forged. Please reload the page and try again.")
+					return
+				}
+			}
+			if cookieToken == "" {
+				cookieToken = newCSRFToken()
+				http.SetCookie(w, &http.Cookie{
+					Name:     csrfCookieName(c),
+					Value:    cookieToken,
+					Path:     "/",
+					Secure:   strings.HasPrefix(c.Host, "https://"),
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfTokenKey, cookieToken)))
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sameOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		origin  string
+		referer string
+		want    bool
+	}{
+		{
+			name: "no header",
+			want: true,
+		},
+		{
+			name:   "same origin",
+			origin: "https://example.com",
+			want:   true,
+		},
+		{
+			name:   "other origin",
+			origin: "https://evil.example.com",
+			want:   false,
+		},
+		{
+			name:   "other scheme",
+			origin: "http://example.com",
+			want:   false,
+		},
+		{
+			name:   "null origin",
+			origin: "null",
+			want:   false,
+		},
+		{
+			name:    "same referer",
+			referer: "https://example.com/.wru/user/sessions",
+			want:    true,
+		},
+		{
+			name:    "other referer",
+			referer: "https://evil.example.com/.wru/user/sessions",
+			want:    false,
+		},
+		{
+			name:    "origin precedes referer",
+			origin:  "https://evil.example.com",
+			referer: "https://example.com/.wru/user/sessions",
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/.wru/logout", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.referer != "" {
+				r.Header.Set("Referer", tt.referer)
+			}
+			assert.Equal(t, tt.want, sameOrigin(&Config{Host: "https://example.com"}, r))
+		})
+	}
+}
+
+func TestCSRFProtection_DebugLogin(t *testing.T) {
+	tests := []struct {
+		name        string
+		cookieToken string
+		formToken   string
+		origin      string
+		wantStatus  int
+		wantEvent   AuditEventType
+	}{
+		{
+			name:        "valid token",
+			cookieToken: "token",
+			formToken:   "token",
+			origin:      "https://example.com",
+			wantStatus:  http.StatusFound,
+			wantEvent:   AuditLoginSuccess,
+		},
+		{
+			name:       "no cookie",
+			formToken:  "token",
+			wantStatus: http.StatusForbidden,
+			wantEvent:  AuditCSRFFailure,
+		},
+		{
+			name:        "no form field",
+			cookieToken: "token",
+			wantStatus:  http.StatusForbidden,
+			wantEvent:   AuditCSRFFailure,
+		},
+		{
+			name:        "wrong token",
+			cookieToken: "token",
+			formToken:   "forged",
+			wantStatus:  http.StatusForbidden,
+			wantEvent:   AuditCSRFFailure,
+		},
+		{
+			name:        "cross site",
+			cookieToken: "token",
+			formToken:   "token",
+			origin:      "https://evil.example.com",
+			wantStatus:  http.StatusForbidden,
+			wantEvent:   AuditCSRFFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+			sid := startLogin(t, context.Background(), s)
+			form := url.Values{"userid": {"user1"}}
+			if tt.formToken != "" {
+				form.Set(CSRFTokenField, tt.formToken)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, postForm(c, "/.wru/login", sid, tt.cookieToken, form, tt.origin))
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, []AuditEventType{tt.wantEvent}, sink.types())
+		})
+	}
+}
+
+func TestCSRFProtection_HeaderToken(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+	otherID := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	r := postForm(c, "/.wru/user/sessions/"+otherID+"/logout", sid, "token", url.Values{}, "")
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set(CSRFTokenHeader, "token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err := s.FindBySessionToken(context.Background(), otherID)
+	assert.ErrorIs(t, err, ErrInvalidSessionToken)
+}
+
+func TestCSRFProtection_SessionLogout(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+	otherID := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	// forged request from other site
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, "/.wru/user/sessions/"+otherID+"/logout", sid, "token", url.Values{}, "https://evil.example.com"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, err := s.FindBySessionToken(context.Background(), otherID)
+	assert.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, "/.wru/user/sessions/"+otherID+"/logout", sid, "token", url.Values{CSRFTokenField: {"token"}}, "https://example.com"))
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, err = s.FindBySessionToken(context.Background(), otherID)
+	assert.ErrorIs(t, err, ErrInvalidSessionToken)
+}
+
+func TestLogout(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	// GET shows confirmation page and doesn't log out
+	r := httptest.NewRequest("GET", "/.wru/logout", nil)
+	r.Header.Set("Accept", "text/html")
+	r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: sid})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var token string
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == csrfCookieName(c) {
+			token = ck.Value
+		}
+	}
+	assert.NotEmpty(t, token)
+	assert.Contains(t, w.Body.String(), `name="csrf_token" value="`+token+`"`)
+	_, err := s.FindBySessionToken(context.Background(), sid)
+	assert.NoError(t, err)
+
+	// JSON clients should use POST
+	r = httptest.NewRequest("GET", "/.wru/logout", nil)
+	r.Header.Set("Accept", "application/json")
+	r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: sid})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, "/.wru/logout", sid, token, url.Values{CSRFTokenField: {token}}, "https://example.com"))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/login", w.Header().Get("Location"))
+	_, err = s.FindBySessionToken(context.Background(), sid)
+	assert.ErrorIs(t, err, ErrInvalidSessionToken)
+}
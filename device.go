@@ -0,0 +1,350 @@
+package wru
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"gocloud.dev/gcerrors"
+)
+
+// Device authorization grant (RFC 8628) for CLI tools.
+// Each request is stored as two login codes: the device code points to the user code,
+// and the user code keeps the client and the status of the request.
+// The approval records only the user ID. The session of the CLI is started when the CLI polls after that,
+// so the session ID is not stored anywhere except the session storage itself.
+
+const (
+	deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	// devicePollInterval is the minimum interval of polling to the token endpoint in seconds
+	devicePollInterval = 5
+	// userCodeChars doesn't have vowels and confusable characters (RFC 8628 6.1)
+	userCodeChars = "BCDFGHJKLMNPQRSTVWXZ"
+)
+
+// kinds of login codes and keys of their data for device authorization requests
+const (
+	deviceCodeKey     = "device_code"
+	deviceUserCodeKey = "device_user_code"
+	deviceClientKey   = "device_client"
+	deviceStatusKey   = "device_status"
+	deviceUserIDKey   = "device_user_id"
+	// deviceApprovalKey is stored in the login session of the browser
+	deviceApprovalKey = "device_approval"
+)
+
+// newRandomCode returns the secret code for the single use like device code and authorization code
+func newRandomCode() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newUserCode returns the code like "BCDF-GHJK" that users type in the browser
+func newUserCode() string {
+	// bytes over the largest multiple of len(userCodeChars) are skipped not to bias characters
+	limit := 256 - 256%len(userCodeChars)
+	b := make([]byte, 16)
+	code := make([]byte, 0, 9)
+	for {
+		rand.Read(b)
+		for _, v := range b {
+			if int(v) >= limit {
+				continue
+			}
+			if len(code) == 4 {
+				code = append(code, '-')
+			}
+			code = append(code, userCodeChars[int(v)%len(userCodeChars)])
+			if len(code) == 9 {
+				return string(code)
+			}
+		}
+	}
+}
+
+func (c *Config) deviceFlowAvailable() bool {
+	return c.ClientSessionFieldCookie.isHeader() && len(c.DeviceClients) > 0
+}
+
+// devicePollRateLimitKey is the key of the rate limit that enforces polling interval of the device code
+func devicePollRateLimitKey(deviceCodeHash string) string {
+	return "device:" + deviceCodeHash
+}
+
+// normalizeUserCode ignores case, spaces and hyphens that users may type
+func normalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	var b strings.Builder
+	for _, c := range code {
+		if strings.ContainsRune(userCodeChars, c) {
+			b.WriteRune(c)
+		}
+	}
+	result := b.String()
+	if len(result) != 8 {
+		return ""
+	}
+	return result[:4] + "-" + result[4:]
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type,omitempty"`
+	Header      string `json:"header"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// writeOAuthError writes the error response of OAuth 2.0 (RFC 6749 5.2)
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":             code,
+		"error_description": description,
+	})
+}
+
+// DeviceCode issues device code and user code for CLI tools
+func (wh wruHandler) DeviceCode(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID := r.Form.Get("client_id")
+	if !containsString(wh.c.DeviceClients, clientID) {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "unknown client_id")
+		return
+	}
+	deviceCode := newRandomCode()
+	expireAt := currentTime(r.Context()).Add(wh.c.LoginTimeoutTerm)
+	var userCode string
+	// user codes are short. Retry if it is already used by other request.
+	for i := 0; i < 10; i++ {
+		userCode = newUserCode()
+		err = wh.s.CreateLoginCode(r.Context(), deviceUserCodeKey, userCode, map[string]string{
+			deviceClientKey: clientID,
+		}, expireAt)
+		if gcerrors.Code(err) != gcerrors.AlreadyExists {
+			break
+		}
+	}
+	if err == nil {
+		err = wh.s.CreateLoginCode(r.Context(), deviceCodeKey, deviceCode, map[string]string{
+			deviceUserCodeKey: userCode,
+		}, expireAt)
+	}
+	if err != nil {
+		wh.c.logger().Error("device code error", "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "session storage access error")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&deviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         wh.c.Host + "/.wru/device",
+		VerificationURIComplete: wh.c.Host + "/.wru/device?user_code=" + userCode,
+		ExpiresIn:               int(wh.c.LoginTimeoutTerm / time.Second),
+		Interval:                devicePollInterval,
+	})
+}
+
+// DeviceToken is polled by CLI tools. It starts the session and returns its ID once after the user approves the request.
+func (wh wruHandler) DeviceToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if r.Form.Get("grant_type") != deviceGrantType {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "grant_type should be "+deviceGrantType)
+		return
+	}
+	deviceCode := r.Form.Get("device_code")
+	if deviceCode == "" {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "device_code is required")
+		return
+	}
+	ctx := r.Context()
+	device, err := wh.s.FindLoginCode(ctx, deviceCodeKey, deviceCode)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "device_code is expired or invalid")
+		return
+	}
+	interval := RateLimit{Count: 1, Per: devicePollInterval * time.Second}
+	if wait := wh.rl.check(ctx, devicePollRateLimitKey(hashAccessToken(deviceCode)), interval); wait > 0 {
+		writeOAuthError(w, http.StatusBadRequest, "slow_down", "polling is too frequent")
+		return
+	}
+	userCode := device[deviceUserCodeKey]
+	request, err := wh.s.FindLoginCode(ctx, deviceUserCodeKey, userCode)
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "device_code is expired or invalid")
+		return
+	}
+	switch request[deviceStatusKey] {
+	case "approved":
+	case "denied":
+		wh.s.ConsumeLoginCode(ctx, deviceCodeKey, deviceCode)
+		wh.s.ConsumeLoginCode(ctx, deviceUserCodeKey, userCode)
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "the request was denied")
+		return
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "authorization_pending", "waiting for approval")
+		return
+	}
+	// single use. Only one of concurrent polls can consume it.
+	if _, err := wh.s.ConsumeLoginCode(ctx, deviceCodeKey, deviceCode); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "expired_token", "device_code is expired or invalid")
+		return
+	}
+	wh.s.ConsumeLoginCode(ctx, deviceUserCodeKey, userCode)
+	user, err := wh.ir.FindUserByID(request[deviceUserIDKey])
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "access_denied", "the user is not found")
+		return
+	}
+	// the session binding compares the following requests with this poll from the CLI
+	token, err := wh.s.StartLogin(ctx, nil)
+	if err == nil {
+		token, _, err = wh.s.StartSession(ctx, token, user, r, map[string]string{
+			"login-idp":     "device",
+			deviceClientKey: request[deviceClientKey],
+		})
+	}
+	if err != nil {
+		wh.c.logger().Error("device authorization error", "user", user.UserID, "error", err)
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", "session storage access error")
+		return
+	}
+	wh.c.logger().Info("device authorized", "user", user.UserID, "client", request[deviceClientKey])
+	res := deviceTokenResponse{
+		AccessToken: token,
+		Header:      wh.c.ClientSessionKey,
+	}
+	if wh.c.ClientSessionFieldCookie == BearerField {
+		res.TokenType = "Bearer"
+	}
+	if active, err := wh.s.FindBySessionToken(ctx, token); err == nil {
+		res.ExpiresIn = int(time.Time(active.ExpireAt).Sub(currentTime(r.Context())) / time.Second)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&res)
+}
+
+type devicePageContext struct {
+	UserCode string
+	// Status is "approved" or "denied" after the user's action
+	Status string
+	Error  string
+}
+
+// Device is the verification page. Users enter the user code that the CLI shows.
+func (wh wruHandler) Device(w http.ResponseWriter, r *http.Request) {
+	executeTemplate(w, r, http.StatusOK, DevicePageTemplate, &devicePageContext{
+		UserCode: r.URL.Query().Get("user_code"),
+	})
+}
+
+// DeviceAction approves or denies the request. Approval requires the normal browser login and
+// the request is approved by completeLogin after that.
+func (wh wruHandler) DeviceAction(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	userCode := normalizeUserCode(r.Form.Get("user_code"))
+	var request map[string]string
+	if userCode != "" {
+		request, err = wh.s.FindLoginCode(r.Context(), deviceUserCodeKey, userCode)
+	}
+	if userCode == "" || err != nil || request[deviceStatusKey] != "" {
+		// user codes are short. Failures count for the lockout to prevent guessing them.
+		wh.rl.fail(r.Context(), ipRateLimitKey(clientIP(wh.c, r)))
+		loginCounter.WithLabelValues("device", loginIDPError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "device", Reason: "invalid user code"})
+		executeTemplate(w, r, http.StatusNotFound, DevicePageTemplate, &devicePageContext{
+			UserCode: r.Form.Get("user_code"),
+			Error:    "The code is invalid or expired.",
+		})
+		return
+	}
+	if r.Form.Get("action") == "deny" {
+		wh.denyDevice(w, r, request, userCode)
+		return
+	}
+	sid, err := wh.s.StartLogin(r.Context(), map[string]string{
+		"landingURL":      "/.wru/device",
+		deviceApprovalKey: userCode,
+	})
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionID(r.Context(), w, sid, wh.c, BeforeLogin)
+	http.Redirect(w, r, "/.wru/login", http.StatusFound)
+}
+
+func (wh wruHandler) denyDevice(w http.ResponseWriter, r *http.Request, request map[string]string, userCode string) {
+	request[deviceStatusKey] = "denied"
+	err := wh.s.UpdateLoginCode(r.Context(), deviceUserCodeKey, userCode, request)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wh.c.audit(r, &AuditEvent{Type: AuditDeviceDenied, Detail: map[string]string{"client": request[deviceClientKey]}})
+	executeTemplate(w, r, http.StatusOK, DevicePageTemplate, &devicePageContext{
+		UserCode: userCode,
+		Status:   "denied",
+	})
+}
+
+// completeDeviceLogin approves the request for the user who logged in via the verification page.
+// The session of the browser is used only for this approval. The session of the CLI is started by DeviceToken.
+func completeDeviceLogin(c *Config, s SessionStorage, w http.ResponseWriter, r *http.Request, sessionID string, userCode string) {
+	ses, err := s.FindBySessionToken(r.Context(), sessionID)
+	s.Logout(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	request, err := s.FindLoginCode(r.Context(), deviceUserCodeKey, userCode)
+	if err != nil || request[deviceStatusKey] != "" {
+		executeTemplate(w, r, http.StatusNotFound, DevicePageTemplate, &devicePageContext{
+			UserCode: userCode,
+			Error:    "The code is invalid or expired.",
+		})
+		return
+	}
+	request[deviceStatusKey] = "approved"
+	request[deviceUserIDKey] = ses.UserID
+	err = s.UpdateLoginCode(r.Context(), deviceUserCodeKey, userCode, request)
+	if err != nil {
+		c.logger().Error("device approval error", "user", ses.UserID, "error", err)
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c.audit(r, &AuditEvent{Type: AuditDeviceApproved, UserID: ses.UserID, Success: true, Detail: map[string]string{
+		"client": request[deviceClientKey],
+	}})
+	removeSessionID(w, c)
+	executeTemplate(w, r, http.StatusOK, DevicePageTemplate, &devicePageContext{
+		UserCode: userCode,
+		Status:   "approved",
+	})
+}
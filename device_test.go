@@ -0,0 +1,342 @@
+package wru
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_normalizeUserCode(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want string
+	}{
+		{
+			name: "as is",
+			code: "BCDF-GHJK",
+			want: "BCDF-GHJK",
+		},
+		{
+			name: "lower case without hyphen",
+			code: " bcdfghjk ",
+			want: "BCDF-GHJK",
+		},
+		{
+			name: "too short",
+			code: "BCDF-GHJ",
+			want: "",
+		},
+		{
+			name: "vowels are not used",
+			code: "ABCD-EFGH",
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, normalizeUserCode(tt.code))
+		})
+	}
+	userCode := newUserCode()
+	assert.Equal(t, userCode, normalizeUserCode(userCode))
+}
+
+func Test_newUserCode(t *testing.T) {
+	counts := map[rune]int{}
+	for i := 0; i < 5000; i++ {
+		code := newUserCode()
+		assert.Equal(t, code, normalizeUserCode(code))
+		for _, r := range strings.ReplaceAll(code, "-", "") {
+			counts[r]++
+		}
+	}
+	// 40000 characters are distributed to 20 characters evenly (2000 each)
+	assert.Len(t, counts, len(userCodeChars))
+	for r, count := range counts {
+		assert.InDelta(t, 2000, count, 300, string(r))
+	}
+}
+
+func requestDeviceCode(t *testing.T, h http.Handler) *deviceCodeResponse {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/.wru/device/code", strings.NewReader(url.Values{"client_id": {"wru-cli"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("User-Agent", "wru-cli/1.0")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res deviceCodeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return &res
+}
+
+func pollDeviceToken(h http.Handler, grantType, deviceCode string) *httptest.ResponseRecorder {
+	return pollDeviceTokenAt(h, time.Now(), grantType, deviceCode)
+}
+
+func pollDeviceTokenAt(h http.Handler, now time.Time, grantType, deviceCode string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/.wru/device/token", strings.NewReader(url.Values{"grant_type": {grantType}, "device_code": {deviceCode}}.Encode()))
+	r = r.WithContext(setFixTime(r.Context(), now))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func deviceErrorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var res map[string]string
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	return res["error"]
+}
+
+func submitUserCode(t *testing.T, h http.Handler, c *Config, userCode, action string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/.wru/device?user_code="+userCode, nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), userCode)
+	csrfToken := cookieValue(w, csrfCookieName(c))
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, "/.wru/device", "", csrfToken, url.Values{"user_code": {userCode}, "action": {action}, CSRFTokenField: {csrfToken}}, ""))
+	return w
+}
+
+func TestDeviceFlow(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField))
+
+	code := requestDeviceCode(t, h)
+	assert.NotEmpty(t, code.DeviceCode)
+	assert.Len(t, code.UserCode, 9)
+	assert.Equal(t, "https://example.com/.wru/device", code.VerificationURI)
+	assert.Equal(t, 5, code.Interval)
+
+	w := pollDeviceToken(h, deviceGrantType, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "authorization_pending", deviceErrorCode(t, w))
+
+	// approval requires browser login
+	w = submitUserCode(t, h, c, strings.ToLower(code.UserCode), "approve")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/login", w.Header().Get("Location"))
+	loginID := cookieValue(w, sessionCookieName(c))
+	assert.NotEmpty(t, loginID)
+
+	r := postForm(c, "/.wru/login", "", "token", url.Values{"userid": {"user1"}, CSRFTokenField: {"token"}}, "")
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: loginID})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "The device is authorized")
+	assert.Equal(t, []AuditEventType{AuditLoginSuccess, AuditDeviceApproved}, sink.types())
+
+	// the session of the CLI is started by polling, so the approval doesn't store its ID
+	sessions, err := s.GetUserSessions(context.Background(), "user1")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	w = pollDeviceToken(h, deviceGrantType, code.DeviceCode)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res deviceTokenResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, "Bearer", res.TokenType)
+	assert.NotZero(t, res.ExpiresIn)
+
+	ses, err := s.FindBySessionToken(context.Background(), res.AccessToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", ses.UserID)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, "device", ses.loginInfo["login-idp"])
+	assert.Equal(t, "wru-cli", ses.loginInfo[deviceClientKey])
+
+	// the session of the browser is used only for approval
+	sessions, err = s.GetUserSessions(context.Background(), "user1")
+	assert.NoError(t, err)
+	assert.Len(t, sessions, 1)
+
+	// the token is usable with header based transport
+	r = httptest.NewRequest("GET", "/.wru/user", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer "+res.AccessToken)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// device code is single use
+	w = pollDeviceToken(h, deviceGrantType, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "expired_token", deviceErrorCode(t, w))
+}
+
+func TestDeviceFlow_Deny(t *testing.T) {
+	h, c, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField))
+	code := requestDeviceCode(t, h)
+
+	w := submitUserCode(t, h, c, code.UserCode, "deny")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "denied")
+
+	w = pollDeviceToken(h, deviceGrantType, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "access_denied", deviceErrorCode(t, w))
+}
+
+func TestDeviceFlow_Errors(t *testing.T) {
+	h, c, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField))
+	code := requestDeviceCode(t, h)
+
+	tests := []struct {
+		name       string
+		grantType  string
+		deviceCode string
+		want       string
+	}{
+		{
+			name:       "unsupported grant type",
+			grantType:  "authorization_code",
+			deviceCode: code.DeviceCode,
+			want:       "unsupported_grant_type",
+		},
+		{
+			name:       "no device code",
+			grantType:  deviceGrantType,
+			deviceCode: "",
+			want:       "invalid_request",
+		},
+		{
+			name:       "unknown device code",
+			grantType:  deviceGrantType,
+			deviceCode: "unknown",
+			want:       "expired_token",
+		},
+		{
+			name:       "user code is not a device code",
+			grantType:  deviceGrantType,
+			deviceCode: code.UserCode,
+			want:       "expired_token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := pollDeviceToken(h, tt.grantType, tt.deviceCode)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Equal(t, tt.want, deviceErrorCode(t, w))
+		})
+	}
+
+	// unknown user code
+	w := submitUserCode(t, h, c, "BCDF-GHJK", "approve")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid or expired")
+}
+
+func TestDeviceFlowIsOnlyForHeaderTransport(t *testing.T) {
+	h, _, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	r := httptest.NewRequest("POST", "/.wru/device/code", nil)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.NotEqual(t, http.StatusOK, w.Code)
+}
+
+func TestDeviceFlowIsOnlyForRegisteredClients(t *testing.T) {
+	tests := []struct {
+		name     string
+		clients  []string
+		clientID string
+		want     int
+	}{
+		{
+			name:     "registered client",
+			clients:  []string{"wru-cli"},
+			clientID: "wru-cli",
+			want:     http.StatusOK,
+		},
+		{
+			name:     "unknown client",
+			clients:  []string{"wru-cli"},
+			clientID: "other-cli",
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "no client id",
+			clients:  []string{"wru-cli"},
+			clientID: "",
+			want:     http.StatusUnauthorized,
+		},
+		{
+			name:     "device flow is disabled",
+			clients:  nil,
+			clientID: "wru-cli",
+			// falls through to the CSRF protected routes
+			want: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField), func(c *Config) {
+				c.DeviceClients = tt.clients
+			})
+			r := httptest.NewRequest("POST", "/.wru/device/code", strings.NewReader(url.Values{"client_id": {tt.clientID}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.want, w.Code)
+			if tt.want == http.StatusUnauthorized {
+				assert.Equal(t, "invalid_client", deviceErrorCode(t, w))
+			}
+		})
+	}
+}
+
+func TestDeviceFlow_SlowDown(t *testing.T) {
+	h, _, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField), func(c *Config) {
+		c.LoginRateLimit = LoginRateLimit{PerIP: RateLimit{Count: 100, Per: time.Minute}}
+	})
+	code := requestDeviceCode(t, h)
+	now := time.Now()
+
+	w := pollDeviceTokenAt(h, now, deviceGrantType, code.DeviceCode)
+	assert.Equal(t, "authorization_pending", deviceErrorCode(t, w))
+
+	w = pollDeviceTokenAt(h, now.Add(time.Second), deviceGrantType, code.DeviceCode)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "slow_down", deviceErrorCode(t, w))
+
+	w = pollDeviceTokenAt(h, now.Add(7*time.Second), deviceGrantType, code.DeviceCode)
+	assert.Equal(t, "authorization_pending", deviceErrorCode(t, w))
+}
+
+func TestDeviceFlow_UserCodeLockout(t *testing.T) {
+	h, c, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField), func(c *Config) {
+		c.LoginRateLimit = LoginRateLimit{
+			PerIP:            RateLimit{Count: 100, Per: time.Minute},
+			LockoutThreshold: 2,
+			LockoutDuration:  time.Minute,
+		}
+	})
+	sink := &memoryAuditSink{}
+	c.AuditSink = sink
+	code := requestDeviceCode(t, h)
+
+	for i := 0; i < 2; i++ {
+		w := submitUserCode(t, h, c, "BCDF-GHJK", "approve")
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	assert.Equal(t, []AuditEventType{AuditLoginFailure, AuditLoginFailure}, sink.types())
+	assert.Equal(t, "device", sink.events[0].IdP)
+	assert.Equal(t, "invalid user code", sink.events[0].Reason)
+
+	// even the right code is rejected during lockout
+	w := submitUserCode(t, h, c, code.UserCode, "approve")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, loginRateLimited, sink.events[2].Reason)
+}
@@ -0,0 +1,256 @@
+package wru
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Passwordless login by email for users who don't have accounts of ID providers.
+// wru sends a link to User.Email of the user table. The link has a random single-use token
+// and only its hash is stored as a login code until it expires.
+// The link opens the confirmation page and the login is completed by POST,
+// so link scanners of mail servers can't consume the token.
+
+// kind of login codes and keys of their data for login links
+const (
+	emailLoginTokenKey = "email_login_token"
+	emailLoginUserKey  = "email_login_user"
+)
+
+// EmailLoginConfig is the setting of login links sent by email
+type EmailLoginConfig struct {
+	Enabled bool
+	// From is the sender address like "wru <noreply@example.com>"
+	From string
+	// LinkTerm is the expiration term of login links. Default is 10 minutes.
+	// It should be shorter than LoginTimeoutTerm.
+	LinkTerm time.Duration
+	// SMTPServer is host:port of SMTP server. STARTTLS is used if the server supports it.
+	SMTPServer   string
+	SMTPUser     string
+	SMTPPassword string
+
+	from *mail.Address
+}
+
+func (e EmailLoginConfig) Available() bool {
+	return e.from != nil
+}
+
+func initEmailLogin(c *Config) error {
+	if !c.EmailLogin.Enabled {
+		return nil
+	}
+	if c.EmailLogin.From == "" {
+		return errors.New("email login requires sender address")
+	}
+	from, err := mail.ParseAddress(c.EmailLogin.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address of email login: %w", err)
+	}
+	if _, _, err := net.SplitHostPort(c.EmailLogin.SMTPServer); err != nil {
+		return fmt.Errorf("email login requires SMTP server (host:port): %s", c.EmailLogin.SMTPServer)
+	}
+	if c.EmailLogin.LinkTerm == 0 {
+		c.EmailLogin.LinkTerm = min(10*time.Minute, c.LoginTimeoutTerm)
+	}
+	if c.EmailLogin.LinkTerm < time.Minute || c.EmailLogin.LinkTerm > c.LoginTimeoutTerm {
+		return fmt.Errorf("email login link term should be between 1m and login timeout term(%s): %s", c.LoginTimeoutTerm, c.EmailLogin.LinkTerm)
+	}
+	c.EmailLogin.from = from
+	c.availableIDPs["email"] = true
+	return nil
+}
+
+// send sends plain text mail via SMTP server
+func (e EmailLoginConfig) send(to *mail.Address, subject, body string) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", e.from.String())
+	fmt.Fprintf(&msg, "To: %s\r\n", to.String())
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qw := quotedprintable.NewWriter(&msg)
+	qw.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n")))
+	qw.Close()
+
+	var auth smtp.Auth
+	if e.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(e.SMTPServer)
+		auth = smtp.PlainAuth("", e.SMTPUser, e.SMTPPassword, host)
+	}
+	return smtp.SendMail(e.SMTPServer, auth, e.from.Address, []string{to.Address}, msg.Bytes())
+}
+
+type emailLoginPageContext struct {
+	Email string
+	Token string
+	// Status is "sent" after sending the link
+	Status string
+	Error  string
+}
+
+// EmailLogin sends the login link. It shows the same page whether the address is registered or not.
+func (wh wruHandler) EmailLogin(w http.ResponseWriter, r *http.Request) {
+	_, ses := GetSession(r)
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	address := strings.TrimSpace(r.Form.Get("email"))
+	if address == "" {
+		executeTemplate(w, r, http.StatusBadRequest, EmailLoginPageTemplate, &emailLoginPageContext{
+			Error: "Enter your email address.",
+		})
+		return
+	}
+	landingURL := wh.c.DefaultLandingPage
+	if ses != nil && ses.Data["landingURL"] != "" {
+		landingURL = ses.Data["landingURL"]
+	}
+	user, err := wh.ir.FindUserByEmail(address)
+	if err == nil && user.IsService() {
+		// service accounts can't login
+		err = ErrUserNotFound
+	}
+	if err != nil {
+		wh.rl.fail(r.Context(), ipRateLimitKey(clientIP(wh.c, r)))
+		loginCounter.WithLabelValues("email", loginUserNotFound).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "email", Reason: loginUserNotFound, Detail: map[string]string{"email": address}})
+	} else if wait := wh.rl.check(r.Context(), userRateLimitKey(user.UserID), wh.c.LoginRateLimit.PerUser); wait > 0 {
+		// it doesn't return 429 not to tell the address is registered
+		loginCounter.WithLabelValues("email", loginRateLimited).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "email", UserID: user.UserID, Reason: loginRateLimited})
+	} else if err := wh.sendLoginLink(r, user, landingURL); err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	executeTemplate(w, r, http.StatusOK, EmailLoginPageTemplate, &emailLoginPageContext{
+		Email:  address,
+		Status: "sent",
+	})
+}
+
+// sendLoginLink stores the hash of the new token and sends the link in background
+// so that the response time doesn't tell the address is registered.
+func (wh wruHandler) sendLoginLink(r *http.Request, user *User, landingURL string) error {
+	to, err := mail.ParseAddress(user.Email)
+	if err != nil {
+		wh.c.logger().Error("invalid email address of user", "user", user.UserID, "error", err)
+		return nil
+	}
+	to.Name = user.DisplayName
+	token := newRandomCode()
+	err = wh.s.CreateLoginCode(r.Context(), emailLoginTokenKey, token, map[string]string{
+		"landingURL":      landingURL,
+		emailLoginUserKey: user.UserID,
+	}, currentTime(r.Context()).Add(wh.c.EmailLogin.LinkTerm))
+	if err != nil {
+		return err
+	}
+	loginCounter.WithLabelValues("email", loginStarted).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginStart, IdP: "email", UserID: user.UserID, Success: true, Detail: map[string]string{"email": user.Email}})
+
+	link := wh.c.Host + "/.wru/login/email/verify?token=" + url.QueryEscape(token)
+	subject := "Login link for " + wh.c.Host
+	body := fmt.Sprintf("Hello %s,\n\nOpen the following link to login to %s:\n\n%s\n\nThe link expires in %d minutes and it can be used only once.\nIf you didn't request it, you can ignore this email.\n",
+		user.DisplayName, wh.c.Host, link, int(wh.c.EmailLogin.LinkTerm/time.Minute))
+	go func() {
+		if err := wh.c.EmailLogin.send(to, subject, body); err != nil {
+			wh.c.logger().Error("send login link error", "user", user.UserID, "error", err)
+		} else {
+			wh.c.logger().Info("login link is sent", "user", user.UserID)
+		}
+	}()
+	return nil
+}
+
+// EmailLoginConfirm is the page opened by the link. It posts the token to EmailLoginVerify.
+func (wh wruHandler) EmailLoginConfirm(w http.ResponseWriter, r *http.Request) {
+	executeTemplate(w, r, http.StatusOK, EmailLoginPageTemplate, &emailLoginPageContext{
+		Token: r.URL.Query().Get("token"),
+	})
+}
+
+// EmailLoginVerify consumes the token and starts the session
+func (wh wruHandler) EmailLoginVerify(w http.ResponseWriter, r *http.Request) {
+	id, _ := GetSession(r)
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	ipKey := ipRateLimitKey(clientIP(wh.c, r))
+	token := r.Form.Get("token")
+	// single use
+	var link map[string]string
+	if token != "" {
+		link, err = wh.s.ConsumeLoginCode(r.Context(), emailLoginTokenKey, token)
+	}
+	if token == "" || err != nil || link[emailLoginUserKey] == "" {
+		wh.rl.fail(r.Context(), ipKey)
+		loginCounter.WithLabelValues("email", loginIDPError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "email", Reason: "invalid or expired link"})
+		executeTemplate(w, r, http.StatusUnauthorized, EmailLoginPageTemplate, &emailLoginPageContext{
+			Error: "The link is invalid or expired. Please request a new link.",
+		})
+		return
+	}
+	userID := link[emailLoginUserKey]
+	user, err := wh.ir.FindUserByID(userID)
+	if err == nil && user.IsService() {
+		err = ErrUserNotFound
+	}
+	if err != nil {
+		// the user is removed from the user table after sending the link
+		wh.rl.fail(r.Context(), ipKey)
+		loginCounter.WithLabelValues("email", loginUserNotFound).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "email", UserID: userID, Reason: loginUserNotFound})
+		writeErrorPage(w, r, http.StatusNotFound, "user not found: "+userID)
+		return
+	}
+	if wait := wh.rl.check(r.Context(), userRateLimitKey(user.UserID), wh.c.LoginRateLimit.PerUser); wait > 0 {
+		tooManyRequests(wh.c, w, r, user.UserID, wait)
+		return
+	}
+	if id == "" {
+		id, err = wh.s.StartLogin(r.Context(), map[string]string{
+			"landingURL": link["landingURL"],
+		})
+		if err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	loginInfo := map[string]string{
+		"login-idp": "email",
+		"email":     user.Email,
+	}
+	if wh.requireSecondFactor(w, r, id, user, "email", loginInfo) {
+		return
+	}
+	newID, oldInfo, err := wh.s.StartSession(r.Context(), id, user, r, loginInfo)
+	if err != nil {
+		loginCounter.WithLabelValues("email", loginSessionError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "email", UserID: user.UserID, Reason: err.Error()})
+		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.rl.succeed(r.Context(), ipKey)
+	loginCounter.WithLabelValues("email", loginSuccess).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: "email", UserID: user.UserID, Success: true, Detail: map[string]string{"email": user.Email}})
+	wh.c.logger().Info("login", "user", user.UserID, "idp", "email")
+	completeLogin(wh.c, wh.s, w, r, newID, oldInfo)
+}
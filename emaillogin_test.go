@@ -0,0 +1,255 @@
+package wru
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type smtpMessage struct {
+	From string
+	To   []string
+	Data string
+}
+
+// startSMTPStandIn starts the minimum SMTP server that accepts all mails
+func startSMTPStandIn(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	messages := make(chan smtpMessage, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTPStandIn(textproto.NewConn(conn), messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func serveSMTPStandIn(conn *textproto.Conn, messages chan<- smtpMessage) {
+	defer conn.Close()
+	conn.PrintfLine("220 localhost ESMTP stand-in")
+	var msg smtpMessage
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch command {
+		case "EHLO", "HELO":
+			conn.PrintfLine("250 localhost")
+		case "MAIL":
+			msg = smtpMessage{From: strings.Trim(strings.TrimPrefix(line[5:], "FROM:"), "<>")}
+			conn.PrintfLine("250 OK")
+		case "RCPT":
+			msg.To = append(msg.To, strings.Trim(strings.TrimPrefix(line[5:], "TO:"), "<>"))
+			conn.PrintfLine("250 OK")
+		case "DATA":
+			conn.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+			data, err := io.ReadAll(conn.DotReader())
+			if err != nil {
+				return
+			}
+			msg.Data = string(data)
+			messages <- msg
+			conn.PrintfLine("250 OK")
+		case "QUIT":
+			conn.PrintfLine("221 Bye")
+			return
+		default:
+			conn.PrintfLine("250 OK")
+		}
+	}
+}
+
+var emailLoginTestUsers = []string{
+	"WRU_USER_1=id:user1,name:User One,mail:user1@example.com,scope:user",
+	"WRU_USER_2=id:bot,name:bot,mail:bot@example.com,kind:service,secret:sha256:00",
+}
+
+// withEmailLogin sends login links via the SMTP stand-in and returns the channel of the sent mails
+func withEmailLogin(t *testing.T) (func(c *Config), <-chan smtpMessage) {
+	t.Helper()
+	addr, messages := startSMTPStandIn(t)
+	return func(c *Config) {
+		c.EmailLogin = EmailLoginConfig{
+			Enabled:    true,
+			From:       "wru <noreply@example.com>",
+			SMTPServer: addr,
+		}
+	}, messages
+}
+
+var loginLinkRE = regexp.MustCompile(`https://example\.com/\.wru/login/email/verify\?token=([-_0-9A-Za-z]+)`)
+
+// receiveLoginLink waits the mail and returns the token in the link
+func receiveLoginLink(t *testing.T, messages <-chan smtpMessage) (smtpMessage, string) {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		m, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(msg.Data)))
+		assert.NoError(t, err)
+		body, err := io.ReadAll(quotedprintable.NewReader(m.Body))
+		assert.NoError(t, err)
+		match := loginLinkRE.FindStringSubmatch(string(body))
+		if assert.NotNil(t, match, string(body)) {
+			return msg, match[1]
+		}
+		return msg, ""
+	case <-time.After(5 * time.Second):
+		t.Fatal("login link is not sent")
+		return smtpMessage{}, ""
+	}
+}
+
+func Test_initEmailLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       EmailLoginConfig
+		wantErr      bool
+		wantLinkTerm time.Duration
+	}{
+		{
+			name:   "disabled",
+			config: EmailLoginConfig{},
+		},
+		{
+			name:         "default link term",
+			config:       EmailLoginConfig{Enabled: true, From: "noreply@example.com", SMTPServer: "localhost:25"},
+			wantLinkTerm: 10 * time.Minute,
+		},
+		{
+			name:    "no sender",
+			config:  EmailLoginConfig{Enabled: true, SMTPServer: "localhost:25"},
+			wantErr: true,
+		},
+		{
+			name:    "invalid sender",
+			config:  EmailLoginConfig{Enabled: true, From: "noreply", SMTPServer: "localhost:25"},
+			wantErr: true,
+		},
+		{
+			name:    "no port",
+			config:  EmailLoginConfig{Enabled: true, From: "noreply@example.com", SMTPServer: "localhost"},
+			wantErr: true,
+		},
+		{
+			name:    "longer than login timeout",
+			config:  EmailLoginConfig{Enabled: true, From: "noreply@example.com", SMTPServer: "localhost:25", LinkTerm: time.Hour},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{
+				Host:             "https://example.com",
+				LoginTimeoutTerm: 10 * time.Minute,
+				EmailLogin:       tt.config,
+				availableIDPs:    map[string]bool{},
+			}
+			err := initEmailLogin(c)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.config.Enabled, c.EmailLogin.Available())
+			assert.Equal(t, tt.wantLinkTerm, c.EmailLogin.LinkTerm)
+		})
+	}
+}
+
+func TestEmailLogin(t *testing.T) {
+	opt, messages := withEmailLogin(t)
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, emailLoginTestUsers...), opt)
+
+	w := postMFAForm(t, h, c, "/.wru/login/email", startLogin(t, context.Background(), s), url.Values{"email": {"user1@example.com"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "a login link has been sent")
+
+	msg, token := receiveLoginLink(t, messages)
+	assert.Equal(t, "noreply@example.com", msg.From)
+	assert.Equal(t, []string{"user1@example.com"}, msg.To)
+	assert.Contains(t, msg.Data, "Subject: Login link for https://example.com")
+
+	// the link opens the confirmation page. GET doesn't consume the token.
+	r := httptest.NewRequest("GET", "/.wru/login/email/verify?token="+token, nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `value="`+token+`"`)
+
+	// the link may be opened in the other browser
+	w = postMFAForm(t, h, c, "/.wru/login/email/verify", "", url.Values{"token": {token}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+	ses, err := s.FindBySessionToken(context.Background(), cookieValue(w, sessionCookieName(c)))
+	assert.NoError(t, err)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, "user1", ses.UserID)
+	assert.Equal(t, "email", ses.loginInfo["login-idp"])
+
+	// single use
+	w = postMFAForm(t, h, c, "/.wru/login/email/verify", "", url.Values{"token": {token}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []AuditEventType{AuditLoginStart, AuditLoginSuccess, AuditLoginFailure}, sink.types())
+	assert.Equal(t, "email", sink.events[1].IdP)
+}
+
+func TestEmailLogin_UnknownAddress(t *testing.T) {
+	opt, messages := withEmailLogin(t)
+	h, c, _, sink := newTestHandler(t, newTestRegister(t, emailLoginTestUsers...), opt)
+
+	// the response is as same as registered addresses
+	for _, address := range []string{"unknown@example.com", "bot@example.com"} {
+		w := postMFAForm(t, h, c, "/.wru/login/email", "", url.Values{"email": {address}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "a login link has been sent")
+	}
+	assert.Equal(t, []AuditEventType{AuditLoginFailure, AuditLoginFailure}, sink.types())
+	assert.Equal(t, loginUserNotFound, sink.events[0].Reason)
+
+	// only the mail to the registered user is sent
+	w := postMFAForm(t, h, c, "/.wru/login/email", "", url.Values{"email": {"user1@example.com"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	msg, _ := receiveLoginLink(t, messages)
+	assert.Equal(t, []string{"user1@example.com"}, msg.To)
+}
+
+func TestEmailLogin_ExpiredLink(t *testing.T) {
+	opt, messages := withEmailLogin(t)
+	h, c, _, sink := newTestHandler(t, newTestRegister(t, emailLoginTestUsers...), opt)
+	c.EmailLogin.LinkTerm = time.Minute
+
+	w := postMFAForm(t, h, c, "/.wru/login/email", "", url.Values{"email": {"user1@example.com"}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, token := receiveLoginLink(t, messages)
+
+	// the login session that keeps the link is still alive, but the link is expired
+	r := postForm(c, "/.wru/login/email/verify", "", "token", url.Values{"token": {token}, CSRFTokenField: {"token"}}, "")
+	r = r.WithContext(setFixTime(r.Context(), time.Now().Add(2*time.Minute)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), "The link is invalid or expired.")
+	assert.Equal(t, []AuditEventType{AuditLoginStart, AuditLoginFailure}, sink.types())
+}
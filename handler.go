@@ -2,7 +2,6 @@ package wru
 
 import (
 	"io"
-	"log"
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
@@ -12,18 +11,48 @@ type wruHandler struct {
 	c  *Config
 	s  SessionStorage
 	ir *IdentityRegister
+	rl *loginLimiter
 }
 
 func (wh wruHandler) Login(w http.ResponseWriter, r *http.Request) {
+	if returnTo := r.URL.Query().Get("return_to"); returnTo != "" {
+		landingURL := safeLandingURL(wh.c, returnTo)
+		sid, _ := GetSession(r)
+		var err error
+		if sid == "" {
+			sid, err = wh.s.StartLogin(r.Context(), map[string]string{
+				"landingURL": landingURL,
+			})
+		} else {
+			sid, err = wh.s.AddLoginInfo(r.Context(), sid, map[string]string{
+				"landingURL": landingURL,
+			})
+		}
+		if err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		setSessionID(r.Context(), w, sid, wh.c, BeforeLogin)
+	}
 	if wh.c.DevMode {
-		pages.ExecuteTemplate(w, "debug_login.html", &debugLoginPageContext{
-			Users: wh.ir.AllUsers(),
+		var users []*User
+		for _, u := range wh.ir.AllUsers() {
+			if !u.IsService() {
+				users = append(users, u)
+			}
+		}
+		executeTemplate(w, r, http.StatusOK, "debug_login.html", &debugLoginPageContext{
+			Users:   users,
+			Passkey: wh.c.WebAuthn.Available(),
+			Email:   wh.c.EmailLogin.Available(),
 		})
 	} else {
-		pages.ExecuteTemplate(w, "login.html", &loginPageContext{
+		executeTemplate(w, r, http.StatusOK, "login.html", &loginPageContext{
 			Twitter: wh.c.Twitter.Available(),
 			GitHub:  wh.c.GitHub.Available(),
 			OIDC:    wh.c.OIDC.Available(),
+			Passkey: wh.c.WebAuthn.Available(),
+			Email:   wh.c.EmailLogin.Available(),
 		})
 	}
 }
@@ -36,25 +65,41 @@ func (wh wruHandler) DebugLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	userID := r.Form.Get("userid")
+	if wait := wh.rl.check(r.Context(), userRateLimitKey(userID), wh.c.LoginRateLimit.PerUser); wait > 0 {
+		tooManyRequests(wh.c, w, r, userID, wait)
+		return
+	}
+	ipKey := ipRateLimitKey(clientIP(wh.c, r))
 	user, err := wh.ir.FindUserByID(userID)
+	if err == nil && user.IsService() {
+		// service accounts can't login
+		err = ErrUserNotFound
+	}
 	if err != nil {
+		wh.rl.fail(r.Context(), ipKey)
+		loginCounter.WithLabelValues("debug", loginUserNotFound).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "debug", UserID: userID, Reason: loginUserNotFound})
 		http.Error(w, "user not found: "+userID, http.StatusNotFound)
+		return
 	}
 	loginInfo := map[string]string{
 		"login-idp": "debug",
 	}
+	if wh.requireSecondFactor(w, r, id, user, "debug", loginInfo) {
+		return
+	}
 	newID, oldInfo, err := wh.s.StartSession(r.Context(), id, user, r, loginInfo)
 	if err != nil {
+		loginCounter.WithLabelValues("debug", loginSessionError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "debug", UserID: userID, Reason: err.Error()})
 		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("🐣 login as %s\n", userID)
-	setSessionID(r.Context(), w, newID, wh.c, ActiveSession)
-	if u, ok := oldInfo["landingURL"]; ok {
-		http.Redirect(w, r, u, http.StatusFound)
-	} else {
-		http.Redirect(w, r, wh.c.DefaultLandingPage, http.StatusFound)
-	}
+	wh.rl.succeed(r.Context(), ipKey)
+	loginCounter.WithLabelValues("debug", loginSuccess).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: "debug", UserID: userID, Success: true})
+	wh.c.logger().Info("login", "user", userID, "idp", "debug")
+	completeLogin(wh.c, wh.s, w, r, newID, oldInfo)
 }
 
 func (wh wruHandler) FederatedLogin(w http.ResponseWriter, r *http.Request) {
@@ -97,9 +142,13 @@ func (wh wruHandler) FederatedLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
+		loginCounter.WithLabelValues(idp, loginIDPError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginStart, IdP: idp, Reason: err.Error()})
 		http.Error(w, "can't start login sequence: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	loginCounter.WithLabelValues(idp, loginStarted).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginStart, IdP: idp, Success: true})
 	newSessionID, err := wh.s.AddLoginInfo(r.Context(), oldSessionID, loginInfo)
 	if err != nil {
 		http.Error(w, "session storage access error: "+err.Error(), http.StatusBadRequest)
@@ -110,7 +159,11 @@ func (wh wruHandler) FederatedLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (wh wruHandler) Callback(w http.ResponseWriter, r *http.Request) {
-	id, ses, _ := lookupSessionFromRequest(wh.c, wh.s, r)
+	id, ses, ok := lookupSessionFromRequest(wh.c, wh.s, r)
+	if !ok {
+		http.Error(w, "login session not found", http.StatusBadRequest)
+		return
+	}
 	idpName := ses.Data["idp"]
 	var idpUser string
 	var err error
@@ -132,7 +185,7 @@ func (wh wruHandler) Callback(w http.ResponseWriter, r *http.Request) {
 		idp = GitHub
 		idpUser, newLoginInfo, err = githubCallback(wh.c, r, ses.Data)
 	case "oidc":
-		if !wh.c.GitHub.Available() {
+		if !wh.c.OIDC.Available() {
 			http.Error(w, "OpenID Connect login is not configured", http.StatusBadRequest)
 			return
 		}
@@ -142,22 +195,48 @@ func (wh wruHandler) Callback(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "undefined provider: "+idpName, http.StatusBadRequest)
 		return
 	}
+	ipKey := ipRateLimitKey(clientIP(wh.c, r))
+	if err != nil {
+		wh.rl.fail(r.Context(), ipKey)
+		loginCounter.WithLabelValues(idpName, loginIDPError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: idpName, Reason: err.Error()})
+		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	user, err := wh.ir.FindUserOf(idp, idpUser)
+	var user *User
+	if idp == OIDC {
+		user, err = wh.ir.FindUserOfOIDC(idpUser, newLoginInfo[oidcEmailVerifiedKey] == "true")
+	} else {
+		user, err = wh.ir.FindUserOf(idp, idpUser)
+	}
 	if err != nil {
+		wh.rl.fail(r.Context(), ipKey)
+		loginCounter.WithLabelValues(idpName, loginUserNotFound).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: idpName, Reason: loginUserNotFound, Detail: map[string]string{"account": idpUser}})
 		http.Error(w, "user not found: "+idpUser+" of "+idpName, http.StatusNotFound)
 		return
 	}
+	if wait := wh.rl.check(r.Context(), userRateLimitKey(user.UserID), wh.c.LoginRateLimit.PerUser); wait > 0 {
+		tooManyRequests(wh.c, w, r, user.UserID, wait)
+		return
+	}
 
+	if wh.requireSecondFactor(w, r, id, user, idpName, newLoginInfo) {
+		return
+	}
 	newID, oldInfo, err := wh.s.StartSession(r.Context(), id, user, r, newLoginInfo)
-	setSessionID(r.Context(), w, newID, wh.c, ActiveSession)
-	log.Printf("🐣 login as %s of %s\n", idpUser, idpName)
-	setSessionID(r.Context(), w, newID, wh.c, ActiveSession)
-	if u, ok := oldInfo["landingURL"]; ok {
-		http.Redirect(w, r, u, http.StatusFound)
-	} else {
-		http.Redirect(w, r, wh.c.DefaultLandingPage, http.StatusFound)
+	if err != nil {
+		loginCounter.WithLabelValues(idpName, loginSessionError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: idpName, UserID: user.UserID, Reason: err.Error()})
+		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
+		return
 	}
+	wh.rl.succeed(r.Context(), ipKey)
+	loginCounter.WithLabelValues(idpName, loginSuccess).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: idpName, UserID: user.UserID, Success: true, Detail: map[string]string{"account": idpUser}})
+	wh.c.logger().Info("login", "user", user.UserID, "idp", idpName, "account", idpUser)
+	completeLogin(wh.c, wh.s, w, r, newID, oldInfo)
 }
 
 func (wh wruHandler) Confirm(w http.ResponseWriter, r *http.Request) {
@@ -168,9 +247,22 @@ func (wh wruHandler) ConfirmAction(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "not implemented", http.StatusInternalServerError)
 }
 
+// LogoutConfirm shows the confirmation page. Logout is available only by POST to protect users from forged requests.
+func (wh wruHandler) LogoutConfirm(w http.ResponseWriter, r *http.Request) {
+	if isHTML(r) {
+		executeTemplate(w, r, http.StatusOK, LogoutPageTemplate, nil)
+	} else {
+		w.Header().Set("Allow", http.MethodPost)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, `{"status": "error", "message": "use POST to logout"}`)
+	}
+}
+
 func (wh wruHandler) Logout(w http.ResponseWriter, r *http.Request) {
-	id, _ := GetSession(r)
+	id, ses := GetSession(r)
 	err := wh.s.Logout(r.Context(), id)
+	wh.c.audit(r, &AuditEvent{Type: AuditLogout, UserID: ses.UserID, Success: err == nil})
 	if err != nil {
 		if isHTML(r) {
 			http.Redirect(w, r, "/.wru/login?logout_error", http.StatusFound)
@@ -200,7 +292,7 @@ func (wh wruHandler) User(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isHTML(r) {
-		pages.ExecuteTemplate(w, "user_status.html", u)
+		executeTemplate(w, r, http.StatusOK, "user_status.html", u)
 	} else {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		u.WriteAsJson(w)
@@ -222,7 +314,7 @@ func (wh wruHandler) Sessions(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if isHTML(r) {
-		pages.ExecuteTemplate(w, "user_sessions.html", sessions)
+		executeTemplate(w, r, http.StatusOK, "user_sessions.html", sessions)
 	} else {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		AllUserSessions(sessions).WriteAsJson(w)
@@ -230,13 +322,14 @@ func (wh wruHandler) Sessions(w http.ResponseWriter, r *http.Request) {
 }
 
 func (wh wruHandler) SessionLogout(w http.ResponseWriter, r *http.Request) {
-	currentID, _ := GetSession(r)
+	currentID, ses := GetSession(r)
 	targetID := chi.URLParam(r, "sessionID")
 	if currentID == targetID {
 		http.Error(w, "target session ID should not be as same as current ID", http.StatusBadRequest)
 		return
 	}
 	err := wh.s.Logout(r.Context(), targetID)
+	wh.c.audit(r, &AuditEvent{Type: AuditSessionRevoked, UserID: ses.UserID, Success: err == nil, Detail: map[string]string{"session": hashSessionID(targetID)}})
 	if err != nil {
 		if isHTML(r) {
 			http.Redirect(w, r, "/.wru/user/sessions?logout_error", http.StatusFound)
@@ -258,14 +351,27 @@ func (wh wruHandler) SessionLogout(w http.ResponseWriter, r *http.Request) {
 func authMiddleware(c *Config, s SessionStorage, u *IdentityRegister) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		r := newHandler(c, s, u)
+		rl := newLoginLimiter(c)
 		r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			if serveAccessToken(c, s, u, w, r, next) || serveServiceAccount(c, u, rl, w, r, next) {
+				return
+			}
 			sid, ses, ok := lookupSessionFromRequest(c, s, r)
 			if !ok || (ses.Status != ActiveSession) {
-				if r.RequestURI == "/favicon.ico" {
-					http.Error(w, "not found", http.StatusNotFound)
+				if sid, ses, ok = loginWithClientCertificate(c, s, u, w, r); !ok {
+					if r.RequestURI == "/favicon.ico" {
+						http.Error(w, "not found", http.StatusNotFound)
+						return
+					}
+					startSessionAndRedirect(c, s, w, r)
+					return
+				}
+				if ses == nil {
+					// redirected to the second factor
 					return
 				}
-				startSessionAndRedirect(c, s, w, r)
+			}
+			if !verifySessionBinding(c, s, w, r, sid, ses) || !checkAccessPolicy(c, w, r, ses) {
 				return
 			}
 			next.ServeHTTP(w, setSessionInfo(r, sid, ses))
@@ -279,20 +385,73 @@ func newHandler(c *Config, s SessionStorage, u *IdentityRegister) *chi.Mux {
 		c:  c,
 		s:  s,
 		ir: u,
+		rl: newLoginLimiter(c),
 	}
 	r := chi.NewRouter()
+	if c.deviceFlowAvailable() {
+		// APIs for CLI tools that don't have cookies. They are out of CSRF protection.
+		r.With(wruPageHeaders(c), wh.rl.middleware).Post("/.wru/device/code", wh.DeviceCode)
+		r.With(wruPageHeaders(c)).Post("/.wru/device/token", wh.DeviceToken)
+	}
+	if c.OIDCIssuer.Available() {
+		// APIs for OIDC clients. They authenticate by client secret or access token instead of cookies.
+		r.With(wruPageHeaders(c)).Post("/.wru/oidc/token", wh.OIDCToken)
+		r.With(wruPageHeaders(c)).Get("/.wru/oidc/userinfo", wh.OIDCUserInfo)
+		r.With(wruPageHeaders(c)).Post("/.wru/oidc/userinfo", wh.OIDCUserInfo)
+	}
 	r.Route("/.wru", func(r chi.Router) {
+		r.Use(wruPageHeaders(c), csrfProtection(c))
 		r.With(MustNotLogin(c, s)).Get("/login", wh.Login)
 		if c.DevMode {
-			r.With(MustNotLogin(c, s)).Post("/login", wh.DebugLogin)
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Post("/login", wh.DebugLogin)
 		} else {
-			r.With(MustNotLogin(c, s)).Get("/login/{provider}", wh.FederatedLogin)
-			r.With(MustNotLogin(c, s)).Get("/callback", wh.Callback)
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Get("/login/{provider}", wh.FederatedLogin)
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Get("/callback", wh.Callback)
+		}
+		if c.WebAuthn.Available() {
+			r.With(MustNotLogin(c, s)).Post("/login/passkey/options", wh.PasskeyLoginOptions)
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Post("/login/passkey", wh.PasskeyLogin)
 		}
-		r.With(MustLogin(c, s)).Get("/logout", wh.Logout)
+		if c.EmailLogin.Available() {
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Post("/login/email", wh.EmailLogin)
+			r.With(MustNotLogin(c, s)).Get("/login/email/verify", wh.EmailLoginConfirm)
+			r.With(MustNotLogin(c, s), wh.rl.middleware).Post("/login/email/verify", wh.EmailLoginVerify)
+		}
+		if c.ClientSessionFieldCookie.isHeader() {
+			r.Get("/login/token", wh.LoginToken)
+		}
+		if c.deviceFlowAvailable() {
+			r.Get("/device", wh.Device)
+			r.With(wh.rl.middleware).Post("/device", wh.DeviceAction)
+		}
+		r.With(MustLogin(c, s)).Get("/logout", wh.LogoutConfirm)
+		r.With(MustLogin(c, s)).Post("/logout", wh.Logout)
 		r.With(MustLogin(c, s)).Get("/user", wh.User)
 		r.With(MustLogin(c, s)).Get("/user/sessions", wh.Sessions)
 		r.With(MustLogin(c, s)).Post("/user/sessions/{sessionID}/logout", wh.SessionLogout)
+		r.With(MustLogin(c, s)).Get("/user/tokens", wh.AccessTokens)
+		r.With(MustLogin(c, s)).Post("/user/tokens", wh.CreateAccessToken)
+		r.With(MustLogin(c, s)).Post("/user/tokens/{tokenID}/revoke", wh.RevokeAccessToken)
+		if c.MFA.Available() || c.WebAuthn.Available() {
+			r.With(MustLogin(c, s)).Get("/mfa", wh.MFA)
+			r.With(MustLogin(c, s), wh.rl.middleware).Post("/mfa", wh.MFAAction)
+		}
+		if c.MFA.Available() {
+			r.With(MustLogin(c, s)).Get("/user/mfa", wh.UserMFA)
+			r.With(MustLogin(c, s)).Post("/user/mfa", wh.UserMFAAction)
+		}
+		if c.WebAuthn.Available() {
+			r.With(MustLogin(c, s)).Post("/mfa/passkey/options", wh.MFAPasskeyOptions)
+			r.With(MustLogin(c, s)).Get("/user/passkeys", wh.UserPasskeys)
+			r.With(MustLogin(c, s)).Post("/user/passkeys", wh.RegisterPasskey)
+			r.With(MustLogin(c, s)).Post("/user/passkeys/options", wh.PasskeyRegisterOptions)
+			r.With(MustLogin(c, s)).Post("/user/passkeys/{passkeyID}/delete", wh.RemovePasskey)
+		}
+		if c.OIDCIssuer.Available() {
+			r.Get("/oidc/.well-known/openid-configuration", wh.OIDCDiscovery)
+			r.Get("/oidc/jwks", wh.OIDCJWKS)
+			r.With(MustLogin(c, s)).Get("/oidc/authorize", wh.OIDCAuthorize)
+		}
 	})
 	return r
 }
@@ -302,5 +461,5 @@ func NewIdentityAwareProxyHandler(c *Config, s SessionStorage, u *IdentityRegist
 	if err != nil {
 		return nil, err
 	}
-	return authMiddleware(c, s, u)(h), nil
+	return tracingMiddleware(accessLogMiddleware(c, securityHeadersMiddleware(c, accessPolicyMiddleware(c, authMiddleware(c, s, u)(h))))), nil
 }
@@ -3,7 +3,6 @@ package wru
 import (
 	"context"
 	"net/http"
-	"strings"
 	"time"
 
 	"github.com/golang/gddo/httputil"
@@ -25,6 +24,10 @@ type loginInfo struct {
 }
 
 func setSessionInfo(r *http.Request, sid string, ses *Session) *http.Request {
+	if e := accessLogFromContext(r.Context()); e != nil && ses != nil {
+		e.userID = ses.UserID
+		e.session = hashSessionID(sid)
+	}
 	return r.WithContext(context.WithValue(r.Context(), loginInfoKey, &loginInfo{
 		sid: sid,
 		ses: ses,
@@ -46,6 +49,9 @@ func MustLogin(c *Config, s SessionStorage) func(http.Handler) http.Handler {
 				startSessionAndRedirect(c, s, w, r)
 				return
 			}
+			if !verifySessionBinding(c, s, w, r, sid, ses) {
+				return
+			}
 			next.ServeHTTP(w, setSessionInfo(r, sid, ses))
 		})
 	}
@@ -56,7 +62,7 @@ func MustNotLogin(c *Config, s SessionStorage) func(http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			sid, ses, ok := lookupSessionFromRequest(c, s, r)
 			if ok && ses.Status == ActiveSession {
-				http.Redirect(w, r, c.DefaultLandingPage, http.StatusFound)
+				http.Redirect(w, r, safeLandingURL(c, r.URL.Query().Get("return_to")), http.StatusFound)
 				return
 			}
 			next.ServeHTTP(w, setSessionInfo(r, sid, ses))
@@ -73,27 +79,9 @@ func setSessionID(ctx context.Context, w http.ResponseWriter, sessionID string,
 	} else {
 		expires = now.Add(c.SessionAbsoluteTimeoutTerm)
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     c.ClientSessionKey,
-		Value:    sessionID,
-		Path:     "/",
-		Domain:   "",
-		Expires:  expires,
-		Secure:   strings.HasPrefix(c.Host, "https://"),
-		HttpOnly: c.ClientSessionFieldCookie == CookieField,
-		SameSite: http.SameSiteLaxMode,
-	})
+	http.SetCookie(w, newSessionCookie(c, sessionID, expires))
 }
 
 func removeSessionID(w http.ResponseWriter, c *Config) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     c.ClientSessionKey,
-		Value:    "",
-		Path:     "/",
-		Domain:   "",
-		Expires:  time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC),
-		Secure:   strings.HasPrefix(c.Host, "https://"),
-		HttpOnly: c.ClientSessionFieldCookie == CookieField,
-		SameSite: http.SameSiteLaxMode,
-	})
+	http.SetCookie(w, newSessionCookie(c, "", time.Time{}))
 }
@@ -0,0 +1,94 @@
+package wru
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugLogin_Error(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+
+	// unknown user doesn't reach StartSession
+	w := debugLogin(t, context.Background(), h, c, s, "user2")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Empty(t, w.Header().Get("Location"))
+	assert.Empty(t, w.Result().Cookies())
+
+	// session storage error
+	h = newHandler(c, failingSessionStorage{s}, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	w = debugLogin(t, context.Background(), h, c, s, "user1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, w.Result().Cookies())
+	assert.Equal(t, []AuditEventType{AuditLoginFailure, AuditLoginFailure}, sink.types())
+}
+
+// failingSessionStorage can't start sessions
+type failingSessionStorage struct {
+	SessionStorage
+}
+
+func (f failingSessionStorage) StartSession(ctx context.Context, oldSessionID string, user *User, r *http.Request, newLoginInfo map[string]string) (string, map[string]string, error) {
+	return "", nil, errors.New("storage is down")
+}
+
+func TestCallback_Error(t *testing.T) {
+	tests := []struct {
+		name     string
+		idp      string
+		noCookie bool
+		want     string
+	}{
+		{
+			name: "github",
+			idp:  "github",
+			want: "state is different",
+		},
+		{
+			name: "oidc",
+			idp:  "oidc",
+			want: "state is different",
+		},
+		{
+			name: "not configured",
+			idp:  "twitter",
+			want: "Twitter login is not configured",
+		},
+		{
+			name:     "no login session",
+			idp:      "github",
+			noCookie: true,
+			want:     "login session not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// only the ID provider of the login is configured. callback isn't routed in DevMode.
+			_, c, s, _ := newTestHandler(t, nil, func(c *Config) {
+				switch tt.idp {
+				case "github":
+					c.GitHub = GitHubConfig{ClientID: "id", ClientSecret: "secret"}
+				case "oidc":
+					c.OIDC = OIDCConfig{ProviderURL: "https://idp.example.com", ClientID: "id", ClientSecret: "secret"}
+				}
+			})
+			wh := &wruHandler{c: c, s: s, ir: newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), rl: newLoginLimiter(c)}
+			loginID, err := s.AddLoginInfo(context.Background(), startLogin(t, context.Background(), s), map[string]string{"idp": tt.idp, "state": "state"})
+			assert.NoError(t, err)
+
+			r := httptest.NewRequest("GET", "/.wru/callback?state=other&code=code", nil)
+			if !tt.noCookie {
+				r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: loginID})
+			}
+			w := httptest.NewRecorder()
+			wh.Callback(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+			assert.Contains(t, w.Body.String(), tt.want)
+			assert.Empty(t, w.Result().Cookies())
+		})
+	}
+}
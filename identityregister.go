@@ -2,15 +2,18 @@ package wru
 
 import (
 	"context"
+	"crypto"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -26,11 +29,15 @@ const (
 	Twitter IDPlatform = "Twitter"
 	GitHub  IDPlatform = "GitHub"
 	OIDC    IDPlatform = "OIDC"
+	// X509 is the subject of TLS client certificates (e-mail address of SAN or common name)
+	X509 IDPlatform = "X509"
 )
 
 var (
 	ErrUserNotFound = errors.New("user not found")
 	ErrNotModified  = errors.New("not modified")
+	// ErrInvalidUserTable is returned when the user table has problems and Config.UserTableStrict is true
+	ErrInvalidUserTable = errors.New("invalid user table")
 )
 
 type FederatedAccount struct {
@@ -45,6 +52,13 @@ type User struct {
 	Email                 string             `json:"email"`
 	Scopes                []string           `json:"scopes"`
 	FederatedUserAccounts []FederatedAccount `json:"federated_accounts"`
+	Kind                  UserKind           `json:"kind,omitempty"`
+	// SecretHash is bcrypt hash or "sha256:<hex>" of the secret of the service account
+	SecretHash string `json:"-"`
+	// JWTKey is PEM content or file path of the public key to verify JWT assertions of the service account
+	JWTKey string `json:"-"`
+
+	jwtKey crypto.PublicKey
 }
 
 func (u User) ScopeString() string {
@@ -56,14 +70,59 @@ func (u User) WriteAsJson(w io.Writer) error {
 	return e.Encode(&u)
 }
 
+func (u User) hasAccountOf(idp IDPlatform) bool {
+	for _, a := range u.FederatedUserAccounts {
+		if a.Service == idp && a.Account != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// UserMatching configures how accounts of ID providers and email addresses are matched with the user table.
+// Email-like accounts are always matched case-insensitively.
+type UserMatching struct {
+	// StripPlusAddressing ignores "+tag" of the local part ("user+tag@example.com" matches "user@example.com")
+	StripPlusAddressing bool
+	// OIDCEmailFallback matches OIDC login by User.Email if the user doesn't have oidc account
+	OIDCEmailFallback bool
+}
+
+// normalize returns the key of indexes. Accounts that are not email-like are not modified.
+func (m UserMatching) normalize(account string) string {
+	at := strings.LastIndex(account, "@")
+	if at < 1 || at == len(account)-1 {
+		return account
+	}
+	local, domain := strings.TrimSpace(account[:at]), strings.TrimSpace(account[at+1:])
+	if m.StripPlusAddressing {
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+	}
+	return strings.ToLower(local + "@" + domain)
+}
+
 type IdentityRegister struct {
 	fromID         map[string]*User
 	fromIDPUser    map[IDPlatform]map[string]*User
+	fromEmail      map[string]*User
+	matching       UserMatching
 	sourceBlobUrl  string
 	fileModifiedAt time.Time
 	lock           *sync.RWMutex
 }
 
+func newIdentityRegister(m UserMatching) *IdentityRegister {
+	return &IdentityRegister{
+		fromID:      make(map[string]*User),
+		fromIDPUser: map[IDPlatform]map[string]*User{},
+		fromEmail:   make(map[string]*User),
+		matching:    m,
+		lock:        &sync.RWMutex{},
+	}
+}
+
 func (ir IdentityRegister) AllUsers() []*User {
 	ir.lock.RLock()
 	defer ir.lock.RUnlock()
@@ -90,30 +149,60 @@ func (ir *IdentityRegister) FindUserByID(userID string) (*User, error) {
 func (ir *IdentityRegister) FindUserOf(idp IDPlatform, userID string) (*User, error) {
 	ir.lock.RLock()
 	defer ir.lock.RUnlock()
+	key := ir.matching.normalize(userID)
 	if idpUsers, ok := ir.fromIDPUser[idp]; ok {
-		if u, ok := idpUsers[userID]; ok {
+		if u, ok := idpUsers[key]; ok {
 			return u, nil
 		}
 	}
 	return nil, ErrUserNotFound
 }
 
+// FindUserOfOIDC is FindUserOf(OIDC, account) with UserMatching.OIDCEmailFallback.
+// The fallback is used only if the provider verified the email address (email_verified claim is true).
+func (ir *IdentityRegister) FindUserOfOIDC(account string, emailVerified bool) (*User, error) {
+	u, err := ir.FindUserOf(OIDC, account)
+	if err == nil || !ir.matching.OIDCEmailFallback || !emailVerified {
+		return u, err
+	}
+	ir.lock.RLock()
+	defer ir.lock.RUnlock()
+	// users that have oidc account should login only by it
+	if u, ok := ir.fromEmail[ir.matching.normalize(account)]; ok && !u.hasAccountOf(OIDC) {
+		return u, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+// FindUserByEmail returns the user whose User.Email is the address
+func (ir *IdentityRegister) FindUserByEmail(email string) (*User, error) {
+	ir.lock.RLock()
+	defer ir.lock.RUnlock()
+	if u, ok := ir.fromEmail[ir.matching.normalize(email)]; ok {
+		return u, nil
+	}
+	return nil, ErrUserNotFound
+}
+
 var userRE = regexp.MustCompile(`WRU_USER_\d+=(.*)`)
 
 func NewIdentityRegister(ctx context.Context, c *Config, out io.Writer) (*IdentityRegister, []string, error) {
 	if c != nil && c.UserTable != "" {
 		return NewIdentityRegisterFromConfig(ctx, c, out)
 	}
-	return NewIdentityRegisterFromEnv(ctx, os.Environ(), out)
+	var m UserMatching
+	if c != nil {
+		m = c.UserMatching
+	}
+	ir, warnings, err := newIdentityRegisterFromEnv(ctx, os.Environ(), m, out)
+	if err == nil && c != nil && c.UserTableStrict && len(warnings) > 0 {
+		return nil, warnings, fmt.Errorf("%w: %d problems in WRU_USER_%%d env vars", ErrInvalidUserTable, len(warnings))
+	}
+	return ir, warnings, err
 }
 
 func NewIdentityRegisterFromConfig(ctx context.Context, c *Config, out io.Writer) (*IdentityRegister, []string, error) {
-	ir := &IdentityRegister{
-		fromID:      make(map[string]*User),
-		fromIDPUser: map[IDPlatform]map[string]*User{},
-		lock:        &sync.RWMutex{},
-	}
-	var warnings []string
+	ir := newIdentityRegister(c.UserMatching)
 	if !strings.HasPrefix(c.UserTable, ".") && !strings.HasPrefix(c.UserTable, "/") {
 		var err error
 		c.UserTable, err = gocloudurls.NormalizeBlobURL(c.UserTable, os.Environ())
@@ -122,14 +211,27 @@ func NewIdentityRegisterFromConfig(ctx context.Context, c *Config, out io.Writer
 		}
 	}
 	ir.sourceBlobUrl = c.UserTable
-	users, modTime, err := readUsersFromBlob(ctx, c.UserTable, ir.fileModifiedAt)
+	users, warnings, modTime, err := readUsersFromBlob(ctx, c.UserTable, ir.fileModifiedAt, c.UserMatching)
 	if err != nil {
+		userTableReloadCounter.WithLabelValues("failure").Inc()
+		c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Reason: err.Error(), Detail: map[string]string{"source": c.UserTable}})
 		return nil, nil, err
 	}
-	ir.fileModifiedAt = modTime
 	for _, u := range users {
-		ir.appendUser(u)
+		if err := ir.appendUser(u); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+	}
+	if c.UserTableStrict && len(warnings) > 0 {
+		err := fmt.Errorf("%w: %d problems in %s", ErrInvalidUserTable, len(warnings), c.UserTable)
+		userTableReloadCounter.WithLabelValues("failure").Inc()
+		c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Reason: err.Error(), Detail: map[string]string{"source": c.UserTable}})
+		return nil, warnings, err
 	}
+	userTableReloadCounter.WithLabelValues("success").Inc()
+	c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Success: true, Detail: map[string]string{"source": c.UserTable, "users": strconv.Itoa(len(users))}})
+	ir.fileModifiedAt = modTime
+	ir.updateUserGauge()
 	if out != nil {
 		color.Fprintf(out, "Read %d users from %s\n", len(users), c.UserTable)
 	}
@@ -142,31 +244,48 @@ func NewIdentityRegisterFromConfig(ctx context.Context, c *Config, out io.Writer
 				case <-ctx.Done():
 					return
 				case <-t.C:
-					ir2 := &IdentityRegister{
-						fromID:      make(map[string]*User),
-						fromIDPUser: map[IDPlatform]map[string]*User{},
-					}
-					users, modTime, err := readUsersFromBlob(ctx, c.UserTable, ir.fileModifiedAt)
+					ir2 := newIdentityRegister(c.UserMatching)
+					users, warnings, modTime, err := readUsersFromBlob(ctx, c.UserTable, ir.fileModifiedAt, c.UserMatching)
 					if err != nil {
 						if !errors.Is(err, ErrNotModified) {
-							if out != nil {
-								color.Fprintf(out, "<error>Reload user table error: %s</>\n", err.Error())
-							}
-							return
+							userTableReloadCounter.WithLabelValues("failure").Inc()
+							c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Reason: err.Error(), Detail: map[string]string{"source": c.UserTable}})
+							c.logger().Error("reload user table error", "source", c.UserTable, "error", err)
+							continue
 						} else {
-							// log.Println("file is not modified")
+							c.logger().Debug("user table is not modified", "source", c.UserTable)
 							continue
 						}
 					}
 					for _, u := range users {
-						ir2.appendUser(u)
+						if err := ir2.appendUser(u); err != nil {
+							warnings = append(warnings, err.Error())
+						}
+					}
+					for _, w := range warnings {
+						c.logger().Warn("user parse warning", "warning", w)
+					}
+					if c.UserTableStrict && len(warnings) > 0 {
+						// keep the current table and don't read the broken file again until it is modified
+						err := fmt.Errorf("%w: %d problems in %s", ErrInvalidUserTable, len(warnings), c.UserTable)
+						userTableReloadCounter.WithLabelValues("failure").Inc()
+						c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Reason: err.Error(), Detail: map[string]string{"source": c.UserTable}})
+						c.logger().Error("reload user table error", "source", c.UserTable, "error", err)
+						ir.lock.Lock()
+						ir.fileModifiedAt = modTime
+						ir.lock.Unlock()
+						continue
 					}
-					color.Fprintf(out, "Read %d users from %s\n", len(users), c.UserTable)
+					c.logger().Info("reload user table", "source", c.UserTable, "users", len(users))
 					ir.lock.Lock()
 					ir.fromID = ir2.fromID
 					ir.fromIDPUser = ir2.fromIDPUser
+					ir.fromEmail = ir2.fromEmail
 					ir.fileModifiedAt = modTime
 					ir.lock.Unlock()
+					userTableReloadCounter.WithLabelValues("success").Inc()
+					c.audit(nil, &AuditEvent{Type: AuditUserTableReload, Success: true, Detail: map[string]string{"source": c.UserTable, "users": strconv.Itoa(len(users))}})
+					ir.updateUserGauge()
 				}
 			}
 		}()
@@ -175,11 +294,11 @@ func NewIdentityRegisterFromConfig(ctx context.Context, c *Config, out io.Writer
 }
 
 func NewIdentityRegisterFromEnv(ctx context.Context, envs []string, out io.Writer) (*IdentityRegister, []string, error) {
-	ir := &IdentityRegister{
-		fromID:      make(map[string]*User),
-		fromIDPUser: map[IDPlatform]map[string]*User{},
-		lock:        &sync.RWMutex{},
-	}
+	return newIdentityRegisterFromEnv(ctx, envs, UserMatching{}, out)
+}
+
+func newIdentityRegisterFromEnv(ctx context.Context, envs []string, m UserMatching, out io.Writer) (*IdentityRegister, []string, error) {
+	ir := newIdentityRegister(m)
 	var warnings []string
 
 	if out != nil {
@@ -189,25 +308,90 @@ func NewIdentityRegisterFromEnv(ctx context.Context, envs []string, out io.Write
 	for _, env := range envs {
 		u := parseUserFromEnv(env)
 		if u != nil {
-			ir.appendUser(u)
+			if err := ir.appendUser(u); err != nil {
+				warnings = append(warnings, err.Error())
+				continue
+			}
 			if out != nil {
-				color.Fprintf(out, "  '%s'(%s) @ %s (scopes: %s)\n", u.DisplayName, u.UserID, u.Organization, strings.Join(u.Scopes, ", "))
+				if u.IsService() {
+					color.Fprintf(out, "  '%s'(%s) @ %s (scopes: %s) <gray>service</>\n", u.DisplayName, u.UserID, u.Organization, strings.Join(u.Scopes, ", "))
+				} else {
+					color.Fprintf(out, "  '%s'(%s) @ %s (scopes: %s)\n", u.DisplayName, u.UserID, u.Organization, strings.Join(u.Scopes, ", "))
+				}
 			}
 		}
 	}
+	warnings = append(warnings, ir.duplicateWarnings()...)
+	ir.updateUserGauge()
 	return ir, warnings, nil
 }
 
-func (ir *IdentityRegister) appendUser(u *User) {
+func (ir *IdentityRegister) updateUserGauge() {
+	ir.lock.RLock()
+	defer ir.lock.RUnlock()
+	userGauge.Set(float64(len(ir.fromID)))
+}
+
+// appendUser adds user to the register. Service accounts are not linked with federated accounts because they can't login.
+func (ir *IdentityRegister) appendUser(u *User) error {
+	if err := u.initServiceAccount(); err != nil {
+		return err
+	}
 	ir.fromID[u.UserID] = u
+	if u.IsService() {
+		return nil
+	}
+	if u.Email != "" {
+		ir.fromEmail[ir.matching.normalize(u.Email)] = u
+	}
 	for _, service := range u.FederatedUserAccounts {
-		if service.Service != "" {
+		if service.Service != "" && service.Account != "" {
 			if _, ok := ir.fromIDPUser[service.Service]; !ok {
 				ir.fromIDPUser[service.Service] = make(map[string]*User)
 			}
-			ir.fromIDPUser[service.Service][service.Account] = u
+			ir.fromIDPUser[service.Service][ir.matching.normalize(service.Account)] = u
 		}
 	}
+	return nil
+}
+
+// duplicateWarnings reports email addresses and federated accounts that are shared by multiple users after normalization.
+// Only the user added last can login by them.
+func (ir *IdentityRegister) duplicateWarnings() []string {
+	ir.lock.RLock()
+	defer ir.lock.RUnlock()
+	emails := map[string][]string{}
+	accounts := map[FederatedAccount][]string{}
+	for _, u := range ir.fromID {
+		if u.IsService() {
+			continue
+		}
+		if u.Email != "" {
+			key := ir.matching.normalize(u.Email)
+			emails[key] = append(emails[key], u.UserID)
+		}
+		for _, a := range u.FederatedUserAccounts {
+			if a.Service != "" && a.Account != "" {
+				key := FederatedAccount{Service: a.Service, Account: ir.matching.normalize(a.Account)}
+				accounts[key] = append(accounts[key], u.UserID)
+			}
+		}
+	}
+	var warnings []string
+	for email, userIDs := range emails {
+		if len(userIDs) > 1 {
+			sort.Strings(userIDs)
+			warnings = append(warnings, fmt.Sprintf("duplicate email address %s: %s", email, strings.Join(userIDs, ", ")))
+		}
+	}
+	for account, userIDs := range accounts {
+		if len(userIDs) > 1 {
+			sort.Strings(userIDs)
+			warnings = append(warnings, fmt.Sprintf("duplicate %s account %s: %s", account.Service, account.Account, strings.Join(userIDs, ", ")))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
 }
 
 func SplitBlobPath(resourceUrl string) (string, string, error) {
@@ -227,95 +411,149 @@ func SplitBlobPath(resourceUrl string) (string, string, error) {
 	}
 }
 
-func readUsersFromBlob(ctx context.Context, path string, modifiedAt time.Time) ([]*User, time.Time, error) {
+func readUsersFromBlob(ctx context.Context, path string, modifiedAt time.Time, m UserMatching) ([]*User, []string, time.Time, error) {
 	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "/") {
 		bucketUrl, res, err := SplitBlobPath(path)
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, nil, time.Time{}, err
 		}
 		b, err := blob.OpenBucket(ctx, bucketUrl)
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, nil, time.Time{}, err
 		}
 		defer b.Close()
 
 		a, err := b.Attributes(ctx, res)
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, nil, time.Time{}, err
 		}
 		if modifiedAt.Before(a.ModTime) {
 			r, err := b.NewReader(ctx, res, &blob.ReaderOptions{})
 			if err != nil {
-				return nil, time.Time{}, err
+				return nil, nil, time.Time{}, err
 			}
 			defer r.Close()
-			users, err := parseUsersFromBlob(r)
+			users, warnings, err := parseUsersFromBlob(r, m)
 			if err != nil {
-				return nil, time.Time{}, err
+				return nil, nil, time.Time{}, err
 			}
-			return users, a.ModTime, err
+			return users, warnings, a.ModTime, err
 		}
 	} else {
 		s, err := os.Stat(path)
 		if err != nil {
-			return nil, time.Time{}, err
+			return nil, nil, time.Time{}, err
 		}
 		if modifiedAt.Before(s.ModTime()) {
 			f, err := os.Open(path)
 			if err != nil {
-				return nil, time.Time{}, err
+				return nil, nil, time.Time{}, err
 			}
 			defer f.Close()
-			users, err := parseUsersFromBlob(f)
+			users, warnings, err := parseUsersFromBlob(f, m)
 			if err != nil {
-				return nil, time.Time{}, err
+				return nil, nil, time.Time{}, err
 			}
-			return users, s.ModTime(), nil
+			return users, warnings, s.ModTime(), nil
+		}
+	}
+	return nil, nil, time.Time{}, ErrNotModified
+}
+
+// ValidateUserTable reads the user table CSV and returns problems with line numbers like "line 3: ...".
+// The table is loaded even if it has problems unless Config.UserTableStrict is true.
+func ValidateUserTable(ctx context.Context, path string, m UserMatching) ([]*User, []string, error) {
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "/") {
+		var err error
+		path, err = gocloudurls.NormalizeBlobURL(path, os.Environ())
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	users, warnings, _, err := readUsersFromBlob(ctx, path, time.Time{}, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, u := range users {
+		if err := u.initServiceAccount(); err != nil {
+			warnings = append(warnings, err.Error())
 		}
 	}
-	return nil, time.Time{}, ErrNotModified
+	return users, warnings, nil
+}
+
+var userTableColumns = map[string]string{
+	"id":           "id",
+	"userid":       "id",
+	"name":         "name",
+	"mail":         "mail",
+	"email":        "mail",
+	"org":          "org",
+	"organization": "org",
+	"scopes":       "scope",
+	"scope":        "scope",
+	"twitter":      "twitter",
+	"github":       "github",
+	"oidc":         "oidc",
+	"x509":         "x509",
+	"kind":         "kind",
+	"secret":       "secret",
+	"jwt_key":      "jwt-key",
+	"jwt-key":      "jwt-key",
+}
+
+var userTableAccounts = map[string]IDPlatform{
+	"twitter": Twitter,
+	"github":  GitHub,
+	"oidc":    OIDC,
+	"x509":    X509,
 }
 
-func parseUsersFromBlob(r io.Reader) ([]*User, error) {
+// parseUsersFromBlob parses the user table CSV. Warnings have line numbers of the CSV.
+// Rows without id are ignored. Other problems like duplicated user IDs are reported but the rows are used
+// (the latter row wins as well as the index of IdentityRegister).
+func parseUsersFromBlob(r io.Reader, m UserMatching) ([]*User, []string, error) {
 	cr := csv.NewReader(r)
 	var result []*User
+	var warnings []string
 	headers, err := cr.Read()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	keys := map[int]string{}
 	foundID := false
 	for i, h := range headers {
-		if h == "id" || h == "userid" {
-			keys[i] = "id"
+		key, ok := userTableColumns[strings.TrimSpace(h)]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("line 1: unknown column %q is ignored", h))
+			continue
+		}
+		for _, k := range keys {
+			if k == key {
+				warnings = append(warnings, fmt.Sprintf("line 1: duplicate column %q overwrites the former one", h))
+				break
+			}
+		}
+		keys[i] = key
+		if key == "id" {
 			foundID = true
-		} else if h == "name" {
-			keys[i] = "name"
-		} else if h == "mail" || h == "email" {
-			keys[i] = "mail"
-		} else if h == "org" || h == "organization" {
-			keys[i] = "org"
-		} else if h == "scopes" || h == "scope" {
-			keys[i] = "scope"
-		} else if h == "twitter" {
-			keys[i] = "twitter"
-		} else if h == "github" {
-			keys[i] = "github"
-		} else if h == "oidc" {
-			keys[i] = "oidc"
 		}
 	}
 	if !foundID {
-		return nil, errors.New("invalid csv: no id field")
+		return nil, nil, errors.New("invalid csv: no id field")
 	}
+	ids := map[string]int{}
+	emails := map[string]*userTableRow{}
+	accounts := map[FederatedAccount]*userTableRow{}
 	for {
 		records, err := cr.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		line, _ := cr.FieldPos(0)
 		u := &User{}
 		for i, r := range records {
 			if key, ok := keys[i]; ok {
@@ -329,30 +567,68 @@ func parseUsersFromBlob(r io.Reader) ([]*User, error) {
 				case "org":
 					u.Organization = r
 				case "scope":
-					u.Scopes = strings.Split(r, ",")
-				case "twitter":
-					u.FederatedUserAccounts = append(u.FederatedUserAccounts, FederatedAccount{
-						Service: Twitter,
-						Account: r,
-					})
-				case "github":
-					u.FederatedUserAccounts = append(u.FederatedUserAccounts, FederatedAccount{
-						Service: GitHub,
-						Account: r,
-					})
-				case "oidc":
-					u.FederatedUserAccounts = append(u.FederatedUserAccounts, FederatedAccount{
-						Service: OIDC,
-						Account: r,
-					})
+					u.Scopes = nil
+					for _, scope := range strings.Split(r, ",") {
+						if scope = strings.TrimSpace(scope); scope != "" {
+							u.Scopes = append(u.Scopes, scope)
+						}
+					}
+					if len(u.Scopes) == 0 {
+						warnings = append(warnings, fmt.Sprintf("line %d: no scope", line))
+					} else if len(u.Scopes) != len(strings.Split(r, ",")) {
+						warnings = append(warnings, fmt.Sprintf("line %d: empty scope in %q is ignored", line, r))
+					}
+				case "twitter", "github", "oidc", "x509":
+					if r != "" {
+						u.FederatedUserAccounts = append(u.FederatedUserAccounts, FederatedAccount{
+							Service: userTableAccounts[key],
+							Account: r,
+						})
+					}
+				case "kind":
+					u.Kind = UserKind(r)
+				case "secret":
+					u.SecretHash = r
+				case "jwt-key":
+					u.JWTKey = r
 				}
 			}
 		}
-		if u.UserID != "" {
-			result = append(result, u)
+		if u.UserID == "" {
+			warnings = append(warnings, fmt.Sprintf("line %d: no user id. The row is ignored", line))
+			continue
+		}
+		if prev, ok := ids[u.UserID]; ok {
+			warnings = append(warnings, fmt.Sprintf("line %d: duplicate user id %s (line %d)", line, u.UserID, prev))
+		}
+		ids[u.UserID] = line
+		result = append(result, u)
+		if u.IsService() {
+			// service accounts are not in indexes of email and federated accounts
+			continue
+		}
+		row := &userTableRow{userID: u.UserID, line: line}
+		if u.Email != "" {
+			key := m.normalize(u.Email)
+			if prev, ok := emails[key]; ok && prev.userID != u.UserID {
+				warnings = append(warnings, fmt.Sprintf("line %d: duplicate email address %s of %s (%s at line %d)", line, u.Email, u.UserID, prev.userID, prev.line))
+			}
+			emails[key] = row
+		}
+		for _, a := range u.FederatedUserAccounts {
+			key := FederatedAccount{Service: a.Service, Account: m.normalize(a.Account)}
+			if prev, ok := accounts[key]; ok && prev.userID != u.UserID {
+				warnings = append(warnings, fmt.Sprintf("line %d: duplicate %s account %s of %s (%s at line %d)", line, a.Service, a.Account, u.UserID, prev.userID, prev.line))
+			}
+			accounts[key] = row
 		}
 	}
-	return result, nil
+	return result, warnings, nil
+}
+
+type userTableRow struct {
+	userID string
+	line   int
 }
 
 func parseUserFromEnv(env string) *User {
@@ -402,6 +678,19 @@ func parseUserFromEnv(env string) *User {
 				Service: OIDC,
 				Account: elems[1],
 			})
+		case "x509":
+			u.FederatedUserAccounts = append(u.FederatedUserAccounts, FederatedAccount{
+				Service: X509,
+				Account: elems[1],
+			})
+		case "kind":
+			u.Kind = UserKind(elems[1])
+		case "secret":
+			u.SecretHash = elems[1]
+		case "jwt-key":
+			fallthrough
+		case "jwt_key":
+			u.JWTKey = elems[1]
 		}
 	}
 	if u.UserID != "" {
@@ -3,6 +3,8 @@ package wru
 import (
 	"context"
 	"io"
+	"os"
+	"path/filepath"
 	"time"
 
 	// _ "gocloud.dev/blob/fileblob"
@@ -143,10 +145,50 @@ user1,test user,user1@example.com,R&D,"admin,user,org:rd",user1
 			},
 			wantErr: false,
 		},
+		{
+			name: "client certificate",
+			args: args{
+				src: `id,name,x509
+user1,test user,user1@example.com
+`,
+			},
+			want: []*User{
+				{
+					DisplayName: "test user",
+					UserID:      "user1",
+					FederatedUserAccounts: []FederatedAccount{
+						{
+							Service: X509,
+							Account: "user1@example.com",
+						},
+					},
+				},
+			},
+			wantErr: false,
+		},
+		{
+			name: "service account",
+			args: args{
+				src: `id,name,scopes,kind,secret,jwt_key
+batch,batch job,batch,service,sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b,/etc/wru/batch.pem
+`,
+			},
+			want: []*User{
+				{
+					DisplayName: "batch job",
+					UserID:      "batch",
+					Scopes:      []string{"batch"},
+					Kind:        ServiceAccount,
+					SecretHash:  "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b",
+					JWTKey:      "/etc/wru/batch.pem",
+				},
+			},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseUsersFromBlob(strings.NewReader(tt.args.src))
+			got, _, err := parseUsersFromBlob(strings.NewReader(tt.args.src), UserMatching{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseUsersFromBlob() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -211,7 +253,7 @@ func Test_readUsersFromBlob(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _, err := readUsersFromBlob(context.Background(), tt.args.path, time.Time{})
+			got, _, _, err := readUsersFromBlob(context.Background(), tt.args.path, time.Time{}, UserMatching{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("readUsersFromBlob() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -231,3 +273,310 @@ func TestUserStorage_FindUserAPIs(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "user1@example.com", u.Email)
 }
+
+func TestUserMatching_normalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		matching UserMatching
+		account  string
+		want     string
+	}{
+		{
+			name:    "not email",
+			account: "GitHubUser",
+			want:    "GitHubUser",
+		},
+		{
+			name:    "case insensitive",
+			account: "User1@Example.COM",
+			want:    "user1@example.com",
+		},
+		{
+			name:    "plus addressing is kept by default",
+			account: "user1+wru@example.com",
+			want:    "user1+wru@example.com",
+		},
+		{
+			name:     "strip plus addressing",
+			matching: UserMatching{StripPlusAddressing: true},
+			account:  "User1+WRU@example.com",
+			want:     "user1@example.com",
+		},
+		{
+			name:     "plus at the head is not tag",
+			matching: UserMatching{StripPlusAddressing: true},
+			account:  "+user1@example.com",
+			want:     "+user1@example.com",
+		},
+		{
+			name:    "no domain",
+			account: "User1@",
+			want:    "User1@",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.matching.normalize(tt.account))
+		})
+	}
+}
+
+func TestIdentityRegister_FindUserOf(t *testing.T) {
+	envs := []string{
+		"WRU_USER_1=id:user1,name:user1,mail:User1@example.com,oidc:user1@idp.example.com",
+		"WRU_USER_2=id:user2,name:user2,mail:user2@example.com,x509:User2@Example.com",
+	}
+	tests := []struct {
+		name     string
+		matching UserMatching
+		idp      IDPlatform
+		account  string
+		// emailVerified is for OIDC
+		emailVerified bool
+		want          string
+	}{
+		{
+			name:    "exact",
+			idp:     OIDC,
+			account: "user1@idp.example.com",
+			want:    "user1",
+		},
+		{
+			name:    "case insensitive",
+			idp:     X509,
+			account: "user2@EXAMPLE.com",
+			want:    "user2",
+		},
+		{
+			name:    "plus addressing",
+			idp:     OIDC,
+			account: "user1+test@idp.example.com",
+		},
+		{
+			name:     "strip plus addressing",
+			matching: UserMatching{StripPlusAddressing: true},
+			idp:      OIDC,
+			account:  "user1+test@idp.example.com",
+			want:     "user1",
+		},
+		{
+			name:    "no email fallback",
+			idp:     OIDC,
+			account: "user2@example.com",
+		},
+		{
+			name:          "email fallback",
+			matching:      UserMatching{OIDCEmailFallback: true},
+			idp:           OIDC,
+			account:       "USER2@example.com",
+			emailVerified: true,
+			want:          "user2",
+		},
+		{
+			name:     "email fallback requires verified email",
+			matching: UserMatching{OIDCEmailFallback: true},
+			idp:      OIDC,
+			account:  "user2@example.com",
+		},
+		{
+			name:          "email fallback is not used for users who have oidc account",
+			matching:      UserMatching{OIDCEmailFallback: true},
+			idp:           OIDC,
+			account:       "user1@example.com",
+			emailVerified: true,
+		},
+		{
+			name:     "email fallback is only for OIDC",
+			matching: UserMatching{OIDCEmailFallback: true},
+			idp:      X509,
+			account:  "user1@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ir, _, err := newIdentityRegisterFromEnv(context.Background(), envs, tt.matching, nil)
+			assert.NoError(t, err)
+			var u *User
+			if tt.idp == OIDC {
+				u, err = ir.FindUserOfOIDC(tt.account, tt.emailVerified)
+			} else {
+				u, err = ir.FindUserOf(tt.idp, tt.account)
+			}
+			if tt.want == "" {
+				assert.Equal(t, ErrUserNotFound, err)
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, u.UserID)
+			}
+		})
+	}
+}
+
+func TestIdentityRegister_FindUserByEmail(t *testing.T) {
+	ir, _, err := newIdentityRegisterFromEnv(context.Background(), []string{
+		"WRU_USER_1=id:user1,name:user1,mail:User1@Example.com",
+	}, UserMatching{StripPlusAddressing: true}, nil)
+	assert.NoError(t, err)
+	u, err := ir.FindUserByEmail(" user1+wru@example.COM")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "user1", u.UserID)
+	}
+	_, err = ir.FindUserByEmail("user2@example.com")
+	assert.Equal(t, ErrUserNotFound, err)
+}
+
+func TestNewIdentityRegisterFromEnv_DuplicateWarnings(t *testing.T) {
+	_, warnings, err := newIdentityRegisterFromEnv(context.Background(), []string{
+		"WRU_USER_1=id:user1,name:user1,mail:user1@example.com,github:user1",
+		"WRU_USER_2=id:user2,name:user2,mail:User1+wru@example.com,github:user1",
+		"WRU_USER_3=id:user3,name:user3,mail:user3@example.com,oidc:User3@example.com",
+		"WRU_USER_4=id:user4,name:user4,mail:user3@example.com,oidc:user3@EXAMPLE.com",
+		// service accounts don't login
+		"WRU_USER_5=id:bot,name:bot,mail:user1@example.com,kind:service,secret:sha256:00",
+	}, UserMatching{StripPlusAddressing: true}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"duplicate GitHub account user1: user1, user2",
+		"duplicate OIDC account user3@example.com: user3, user4",
+		"duplicate email address user1@example.com: user1, user2",
+		"duplicate email address user3@example.com: user3, user4",
+	}, warnings)
+}
+
+func Test_parseUsersFromBlob_Warnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		src          string
+		wantUsers    []string
+		wantWarnings []string
+	}{
+		{
+			name: "valid",
+			src: `id,name,mail,scopes,github
+user1,user1,user1@example.com,"admin,user",user1
+user2,user2,user2@example.com,user,
+`,
+			wantUsers: []string{"user1", "user2"},
+		},
+		{
+			name: "unknown and duplicate columns",
+			src: `id,name,mail,email,role
+user1,user1,user1@example.com,user1@example.com,admin
+`,
+			wantUsers: []string{"user1"},
+			wantWarnings: []string{
+				`line 1: duplicate column "email" overwrites the former one`,
+				`line 1: unknown column "role" is ignored`,
+			},
+		},
+		{
+			name: "empty scopes",
+			src: `id,name,scopes
+user1,user1,
+user2,user2,"admin,,user"
+`,
+			wantUsers: []string{"user1", "user2"},
+			wantWarnings: []string{
+				"line 2: no scope",
+				`line 3: empty scope in "admin,,user" is ignored`,
+			},
+		},
+		{
+			name: "no id",
+			src: `id,name,scopes
+,user1,user
+`,
+			wantWarnings: []string{
+				"line 2: no user id. The row is ignored",
+			},
+		},
+		{
+			name: "duplicate user ids and accounts",
+			src: `id,name,mail,scopes,github
+user1,user1,user1@example.com,user,user1
+user2,user2,User1@example.com,user,user1
+user2,user3,user3@example.com,user,user3
+`,
+			wantUsers: []string{"user1", "user2", "user2"},
+			wantWarnings: []string{
+				"line 3: duplicate email address User1@example.com of user2 (user1 at line 2)",
+				"line 3: duplicate GitHub account user1 of user2 (user1 at line 2)",
+				"line 4: duplicate user id user2 (line 3)",
+			},
+		},
+		{
+			name: "service accounts are not matched with emails",
+			src: `id,name,mail,scopes,kind,secret
+user1,user1,user1@example.com,user,,
+bot,bot,user1@example.com,batch,service,sha256:00
+`,
+			wantUsers: []string{"user1", "bot"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, warnings, err := parseUsersFromBlob(strings.NewReader(tt.src), UserMatching{})
+			assert.NoError(t, err)
+			var userIDs []string
+			for _, u := range users {
+				userIDs = append(userIDs, u.UserID)
+			}
+			assert.Equal(t, tt.wantUsers, userIDs)
+			assert.Equal(t, tt.wantWarnings, warnings)
+		})
+	}
+}
+
+func TestNewIdentityRegisterFromConfig_Strict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.csv")
+	err := os.WriteFile(path, []byte(`id,name,scopes
+user1,user1,user
+user1,user2,user
+`), 0o600)
+	assert.NoError(t, err)
+
+	// the table is loaded with warnings by default
+	ir, warnings, err := NewIdentityRegisterFromConfig(context.Background(), &Config{UserTable: path}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"line 3: duplicate user id user1 (line 2)"}, warnings)
+	u, err := ir.FindUserByID("user1")
+	assert.NoError(t, err)
+	assert.Equal(t, "user2", u.DisplayName)
+
+	// strict mode refuses the table
+	sink := &memoryAuditSink{}
+	ir, warnings, err = NewIdentityRegisterFromConfig(context.Background(), &Config{UserTable: path, UserTableStrict: true, AuditSink: sink}, nil)
+	assert.ErrorIs(t, err, ErrInvalidUserTable)
+	assert.Nil(t, ir)
+	assert.Equal(t, []string{"line 3: duplicate user id user1 (line 2)"}, warnings)
+	if assert.Len(t, sink.events, 1) {
+		assert.Equal(t, AuditUserTableReload, sink.events[0].Type)
+		assert.False(t, sink.events[0].Success)
+	}
+}
+
+func TestNewIdentityRegister_StrictEnv(t *testing.T) {
+	t.Setenv("WRU_USER_1", "id:user1,name:user1,mail:user1@example.com")
+	t.Setenv("WRU_USER_2", "id:user2,name:user2,mail:User1@example.com")
+
+	// env users are loaded with warnings by default
+	ir, warnings, err := NewIdentityRegister(context.Background(), &Config{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"duplicate email address user1@example.com: user1, user2"}, warnings)
+	assert.NotNil(t, ir)
+
+	// strict mode refuses them
+	ir, warnings, err = NewIdentityRegister(context.Background(), &Config{UserTableStrict: true}, nil)
+	assert.ErrorIs(t, err, ErrInvalidUserTable)
+	assert.Nil(t, ir)
+	assert.Equal(t, []string{"duplicate email address user1@example.com: user1, user2"}, warnings)
+}
+
+func TestValidateUserTable(t *testing.T) {
+	users, warnings, err := ValidateUserTable(context.Background(), "./testdata/testuser.csv", UserMatching{})
+	assert.NoError(t, err)
+	assert.Len(t, users, 3)
+	assert.Equal(t, []string{"line 4: duplicate user id user2 (line 3)"}, warnings)
+
+	_, _, err = ValidateUserTable(context.Background(), "./testdata/testuser.notfound.csv", UserMatching{})
+	assert.Error(t, err)
+}
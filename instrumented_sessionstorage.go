@@ -0,0 +1,186 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// instrumentedSessionStorage records latency, errors and trace spans of each method of SessionStorage
+type instrumentedSessionStorage struct {
+	s SessionStorage
+}
+
+func (i instrumentedSessionStorage) start(ctx context.Context, method string) (context.Context, func(err error)) {
+	start := time.Now()
+	ctx, end := startSpan(ctx, "SessionStorage."+method)
+	return ctx, func(err error) {
+		end(err)
+		sessionStorageDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+		if err != nil {
+			sessionStorageErrors.WithLabelValues(method).Inc()
+		}
+	}
+}
+
+func (i instrumentedSessionStorage) StartLogin(ctx context.Context, info map[string]string) (sessionID string, err error) {
+	ctx, done := i.start(ctx, "StartLogin")
+	defer func() { done(err) }()
+	return i.s.StartLogin(ctx, info)
+}
+
+func (i instrumentedSessionStorage) AddLoginInfo(ctx context.Context, oldSessionID string, info map[string]string) (newSessionID string, err error) {
+	ctx, done := i.start(ctx, "AddLoginInfo")
+	defer func() { done(err) }()
+	return i.s.AddLoginInfo(ctx, oldSessionID, info)
+}
+
+func (i instrumentedSessionStorage) StartSession(ctx context.Context, oldSessionID string, user *User, r *http.Request, newLoginInfo map[string]string) (newSessionID string, info map[string]string, err error) {
+	ctx, done := i.start(ctx, "StartSession")
+	defer func() { done(err) }()
+	return i.s.StartSession(ctx, oldSessionID, user, r, newLoginInfo)
+}
+
+func (i instrumentedSessionStorage) Logout(ctx context.Context, sessionID string) (err error) {
+	ctx, done := i.start(ctx, "Logout")
+	defer func() { done(err) }()
+	return i.s.Logout(ctx, sessionID)
+}
+
+func (i instrumentedSessionStorage) GetUserSessions(ctx context.Context, userID string) (sessions []SingleSessionData, err error) {
+	ctx, done := i.start(ctx, "GetUserSessions")
+	defer func() { done(err) }()
+	return i.s.GetUserSessions(ctx, userID)
+}
+
+func (i instrumentedSessionStorage) FindBySessionToken(ctx context.Context, sessionID string) (ses *Session, err error) {
+	ctx, done := i.start(ctx, "FindBySessionToken")
+	defer func() {
+		// invalid token is not a storage error
+		if err == ErrInvalidSessionToken {
+			done(nil)
+		} else {
+			done(err)
+		}
+	}()
+	return i.s.FindBySessionToken(ctx, sessionID)
+}
+
+func (i instrumentedSessionStorage) UpdateSessionData(ctx context.Context, sessionID string, directives []*Directive) (err error) {
+	ctx, done := i.start(ctx, "UpdateSessionData")
+	defer func() { done(err) }()
+	return i.s.UpdateSessionData(ctx, sessionID, directives)
+}
+
+func (i instrumentedSessionStorage) RenewSession(ctx context.Context, oldSessionID string) (sessionID string, err error) {
+	ctx, done := i.start(ctx, "RenewSession")
+	defer func() { done(err) }()
+	return i.s.RenewSession(ctx, oldSessionID)
+}
+
+func (i instrumentedSessionStorage) CreateAccessToken(ctx context.Context, user *User, name string, scopes []string, expireAt time.Time) (token string, data *AccessTokenData, err error) {
+	ctx, done := i.start(ctx, "CreateAccessToken")
+	defer func() { done(err) }()
+	return i.s.CreateAccessToken(ctx, user, name, scopes, expireAt)
+}
+
+func (i instrumentedSessionStorage) GetAccessTokens(ctx context.Context, userID string) (tokens []AccessTokenData, err error) {
+	ctx, done := i.start(ctx, "GetAccessTokens")
+	defer func() { done(err) }()
+	return i.s.GetAccessTokens(ctx, userID)
+}
+
+func (i instrumentedSessionStorage) RevokeAccessToken(ctx context.Context, userID, tokenID string) (err error) {
+	ctx, done := i.start(ctx, "RevokeAccessToken")
+	defer func() { done(err) }()
+	return i.s.RevokeAccessToken(ctx, userID, tokenID)
+}
+
+func (i instrumentedSessionStorage) FindByAccessToken(ctx context.Context, token string) (ses *Session, err error) {
+	ctx, done := i.start(ctx, "FindByAccessToken")
+	defer func() {
+		// invalid token is not a storage error
+		if err == ErrInvalidAccessToken {
+			done(nil)
+		} else {
+			done(err)
+		}
+	}()
+	return i.s.FindByAccessToken(ctx, token)
+}
+
+func (i instrumentedSessionStorage) CreateLoginCode(ctx context.Context, kind, code string, data map[string]string, expireAt time.Time) (err error) {
+	ctx, done := i.start(ctx, "CreateLoginCode")
+	defer func() { done(err) }()
+	return i.s.CreateLoginCode(ctx, kind, code, data, expireAt)
+}
+
+func (i instrumentedSessionStorage) FindLoginCode(ctx context.Context, kind, code string) (data map[string]string, err error) {
+	ctx, done := i.start(ctx, "FindLoginCode")
+	defer func() {
+		// invalid code is not a storage error
+		if err == ErrInvalidSessionToken {
+			done(nil)
+		} else {
+			done(err)
+		}
+	}()
+	return i.s.FindLoginCode(ctx, kind, code)
+}
+
+func (i instrumentedSessionStorage) UpdateLoginCode(ctx context.Context, kind, code string, data map[string]string) (err error) {
+	ctx, done := i.start(ctx, "UpdateLoginCode")
+	defer func() { done(err) }()
+	return i.s.UpdateLoginCode(ctx, kind, code, data)
+}
+
+func (i instrumentedSessionStorage) ConsumeLoginCode(ctx context.Context, kind, code string) (data map[string]string, err error) {
+	ctx, done := i.start(ctx, "ConsumeLoginCode")
+	defer func() {
+		if err == ErrInvalidSessionToken {
+			done(nil)
+		} else {
+			done(err)
+		}
+	}()
+	return i.s.ConsumeLoginCode(ctx, kind, code)
+}
+
+func (i instrumentedSessionStorage) GetMFA(ctx context.Context, userID string) (data *MFAData, err error) {
+	ctx, done := i.start(ctx, "GetMFA")
+	defer func() {
+		// users without second factor are not storage errors
+		if err == ErrMFANotFound {
+			done(nil)
+		} else {
+			done(err)
+		}
+	}()
+	return i.s.GetMFA(ctx, userID)
+}
+
+func (i instrumentedSessionStorage) SaveMFA(ctx context.Context, data *MFAData) (err error) {
+	ctx, done := i.start(ctx, "SaveMFA")
+	defer func() { done(err) }()
+	return i.s.SaveMFA(ctx, data)
+}
+
+func (i instrumentedSessionStorage) DeleteMFA(ctx context.Context, userID string) (err error) {
+	ctx, done := i.start(ctx, "DeleteMFA")
+	defer func() { done(err) }()
+	return i.s.DeleteMFA(ctx, userID)
+}
+
+func (i instrumentedSessionStorage) GetPasskeys(ctx context.Context, userID string) (credentials []WebAuthnCredential, err error) {
+	ctx, done := i.start(ctx, "GetPasskeys")
+	defer func() { done(err) }()
+	return i.s.GetPasskeys(ctx, userID)
+}
+
+func (i instrumentedSessionStorage) SavePasskeys(ctx context.Context, userID string, credentials []WebAuthnCredential) (err error) {
+	ctx, done := i.start(ctx, "SavePasskeys")
+	defer func() { done(err) }()
+	return i.s.SavePasskeys(ctx, userID, credentials)
+}
+
+var _ SessionStorage = &instrumentedSessionStorage{}
@@ -0,0 +1,182 @@
+package wru
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// AccessPolicy allows or denies clients by IP address and country (ISO 3166-1 alpha-2 code like "JP").
+// Deny rules take precedence. If there are allow rules, clients should match at least one of them.
+type AccessPolicy struct {
+	AllowIPs       []*net.IPNet
+	DenyIPs        []*net.IPNet
+	AllowCountries []string
+	DenyCountries  []string
+}
+
+func (p *AccessPolicy) empty() bool {
+	return p == nil || (len(p.AllowIPs) == 0 && len(p.DenyIPs) == 0 && len(p.AllowCountries) == 0 && len(p.DenyCountries) == 0)
+}
+
+func (p *AccessPolicy) usesCountry() bool {
+	return p != nil && (len(p.AllowCountries) > 0 || len(p.DenyCountries) > 0)
+}
+
+// Allowed returns true if the client is allowed by the policy. nil policy allows all clients.
+func (p *AccessPolicy) Allowed(ip net.IP, country string) bool {
+	if p.empty() {
+		return true
+	}
+	if containsIP(p.DenyIPs, ip) || containsCountry(p.DenyCountries, country) {
+		return false
+	}
+	if len(p.AllowIPs) == 0 && len(p.AllowCountries) == 0 {
+		return true
+	}
+	return containsIP(p.AllowIPs, ip) || containsCountry(p.AllowCountries, country)
+}
+
+func (p *AccessPolicy) String() string {
+	var rules []string
+	if len(p.AllowIPs) > 0 {
+		rules = append(rules, "allow-ip="+joinCIDRs(p.AllowIPs))
+	}
+	if len(p.DenyIPs) > 0 {
+		rules = append(rules, "deny-ip="+joinCIDRs(p.DenyIPs))
+	}
+	if len(p.AllowCountries) > 0 {
+		rules = append(rules, "allow-country="+strings.Join(p.AllowCountries, ", "))
+	}
+	if len(p.DenyCountries) > 0 {
+		rules = append(rules, "deny-country="+strings.Join(p.DenyCountries, ", "))
+	}
+	return strings.Join(rules, " ")
+}
+
+func containsCountry(countries []string, country string) bool {
+	if country == "" {
+		return false
+	}
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOption parses route option style policy like "allow-ip=10.0.0.0/8|192.168.0.0/16".
+// It returns false if the key is not a policy option.
+func (p *AccessPolicy) parseOption(key, value string) (bool, error) {
+	var err error
+	switch key {
+	case "allow-ip":
+		p.AllowIPs, err = parseCIDRList(strings.ReplaceAll(value, "|", ","))
+	case "deny-ip":
+		p.DenyIPs, err = parseCIDRList(strings.ReplaceAll(value, "|", ","))
+	case "allow-country":
+		p.AllowCountries = splitList(value, "|")
+	case "deny-country":
+		p.DenyCountries = splitList(value, "|")
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func splitList(src, sep string) []string {
+	var result []string
+	for _, s := range strings.Split(src, sep) {
+		if s = strings.TrimSpace(s); s != "" {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
+var scopePolicyRe = regexp.MustCompile(`^\s*([^\s\[]+)\s*\[([^\]]*)\]\s*$`)
+
+// parseScopePolicies parses policies for users that have the scope like "admin [allow-ip=10.0.0.0/8]; ops [deny-country=CN|RU]"
+func parseScopePolicies(src string) (map[string]*AccessPolicy, error) {
+	result := make(map[string]*AccessPolicy)
+	for i, def := range strings.Split(src, ";") {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		match := scopePolicyRe.FindStringSubmatch(def)
+		if len(match) == 0 {
+			return nil, fmt.Errorf("wrong scope policy definition: (%d)=%s", i, def)
+		}
+		p := &AccessPolicy{}
+		for _, opt := range strings.Split(match[2], ",") {
+			opt = strings.TrimSpace(opt)
+			if opt == "" {
+				continue
+			}
+			kv := strings.SplitN(opt, "=", 2)
+			var value string
+			if len(kv) == 2 {
+				value = strings.TrimSpace(kv[1])
+			}
+			ok, err := p.parseOption(strings.TrimSpace(kv[0]), value)
+			if !ok {
+				return nil, fmt.Errorf("unknown scope policy option: %s", kv[0])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("wrong scope policy definition: (%d)=%s: %w", i, def, err)
+			}
+		}
+		result[match[1]] = p
+	}
+	return result, nil
+}
+
+// checkAccessPolicy returns false and writes 403 response if the client is not allowed.
+// scope policies are evaluated only for the scopes of the session.
+func checkAccessPolicy(c *Config, w http.ResponseWriter, r *http.Request, ses *Session, policies ...*AccessPolicy) bool {
+	if ses != nil {
+		for _, scope := range ses.Scopes {
+			if p, ok := c.ScopePolicies[scope]; ok {
+				policies = append(policies, p)
+			}
+		}
+	}
+	if len(policies) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(c, r))
+	var country string
+	for _, p := range policies {
+		if p.empty() {
+			continue
+		}
+		if p.usesCountry() && country == "" {
+			_, country = lookupCountry(c, ip)
+		}
+		if !p.Allowed(ip, country) {
+			var userID string
+			if ses != nil {
+				userID = ses.UserID
+			}
+			c.audit(r, &AuditEvent{Type: AuditAccessDenied, UserID: userID, Detail: map[string]string{"ip": ip.String(), "country": country}})
+			writeErrorPage(w, r, http.StatusForbidden, "Access from your network is not allowed.")
+			return false
+		}
+	}
+	return true
+}
+
+// accessPolicyMiddleware applies Config.AccessPolicy to all requests
+func accessPolicyMiddleware(c *Config, next http.Handler) http.Handler {
+	if c.AccessPolicy.empty() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if checkAccessPolicy(c, w, r, nil, &c.AccessPolicy) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package wru
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustParseCIDRList(src string) []*net.IPNet {
+	result, err := parseCIDRList(src)
+	if err != nil {
+		panic(err)
+	}
+	return result
+}
+
+func TestAccessPolicy_Allowed(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *AccessPolicy
+		ip      string
+		country string
+		want    bool
+	}{
+		{
+			name:   "nil policy",
+			policy: nil,
+			ip:     "192.0.2.1",
+			want:   true,
+		},
+		{
+			name:   "allowed ip",
+			policy: &AccessPolicy{AllowIPs: mustParseCIDRList("192.0.2.0/24")},
+			ip:     "192.0.2.1",
+			want:   true,
+		},
+		{
+			name:   "not in allow list",
+			policy: &AccessPolicy{AllowIPs: mustParseCIDRList("192.0.2.0/24")},
+			ip:     "198.51.100.1",
+			want:   false,
+		},
+		{
+			name:   "deny precedes allow",
+			policy: &AccessPolicy{AllowIPs: mustParseCIDRList("192.0.2.0/24"), DenyIPs: mustParseCIDRList("192.0.2.1")},
+			ip:     "192.0.2.1",
+			want:   false,
+		},
+		{
+			name:   "ipv6",
+			policy: &AccessPolicy{DenyIPs: mustParseCIDRList("2001:db8::/32")},
+			ip:     "2001:db8::1",
+			want:   false,
+		},
+		{
+			name:    "allowed country",
+			policy:  &AccessPolicy{AllowIPs: mustParseCIDRList("192.0.2.0/24"), AllowCountries: []string{"JP"}},
+			ip:      "198.51.100.1",
+			country: "JP",
+			want:    true,
+		},
+		{
+			name:    "denied country",
+			policy:  &AccessPolicy{DenyCountries: []string{"jp"}},
+			ip:      "198.51.100.1",
+			country: "JP",
+			want:    false,
+		},
+		{
+			name:   "unknown country is not allowed",
+			policy: &AccessPolicy{AllowCountries: []string{"JP"}},
+			ip:     "198.51.100.1",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.policy.Allowed(net.ParseIP(tt.ip), tt.country))
+		})
+	}
+}
+
+func Test_parseScopePolicies(t *testing.T) {
+	got, err := parseScopePolicies("admin [allow-ip=10.0.0.0/8|192.168.0.0/16]; ops [deny-country=CN|RU, deny-ip=192.0.2.1]")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]*AccessPolicy{
+		"admin": {AllowIPs: mustParseCIDRList("10.0.0.0/8,192.168.0.0/16")},
+		"ops":   {DenyCountries: []string{"CN", "RU"}, DenyIPs: mustParseCIDRList("192.0.2.1")},
+	}, got)
+
+	_, err = parseScopePolicies("admin [allow-ip=localhost]")
+	assert.Error(t, err)
+	_, err = parseScopePolicies("admin [unknown=1]")
+	assert.Error(t, err)
+	_, err = parseScopePolicies("admin")
+	assert.Error(t, err)
+}
+
+func TestAccessPolicyMiddleware(t *testing.T) {
+	sink := &memoryAuditSink{}
+	c := &Config{
+		AuditSink:    sink,
+		AccessPolicy: AccessPolicy{DenyIPs: mustParseCIDRList("192.0.2.0/24")},
+	}
+	h := accessPolicyMiddleware(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, dummyRequest())
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, []AuditEventType{AuditAccessDenied}, sink.types())
+
+	r := dummyRequest()
+	r.RemoteAddr = "198.51.100.1:1234"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestScopeAccessPolicy(t *testing.T) {
+	c := &Config{
+		ScopePolicies: map[string]*AccessPolicy{
+			"admin": {AllowIPs: mustParseCIDRList("10.0.0.0/8")},
+		},
+	}
+	w := httptest.NewRecorder()
+	assert.False(t, checkAccessPolicy(c, w, dummyRequest(), &Session{Scopes: []string{"admin"}}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	assert.True(t, checkAccessPolicy(c, w, dummyRequest(), &Session{Scopes: []string{"user"}}))
+}
+
+func TestRouteAccessPolicy_Middleware(t *testing.T) {
+	routes, err := parseForwardList("/admin => http://localhost:8080 [allow-ip=10.0.0.0/8]; / => http://localhost:8080")
+	assert.NoError(t, err)
+	sink := &memoryAuditSink{}
+	c := &Config{
+		AuditSink: sink,
+		ForwardTo: routes,
+	}
+	h := routeMiddleware(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		wantStatus int
+		wantEvent  []AuditEventType
+	}{
+		{
+			name:       "route without policy",
+			path:       "/test",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "denied by route policy",
+			path:       "/admin/test",
+			remoteAddr: "192.0.2.1:1234",
+			wantStatus: http.StatusForbidden,
+			wantEvent:  []AuditEventType{AuditAccessDenied},
+		},
+		{
+			name:       "allowed by route policy",
+			path:       "/admin/test",
+			remoteAddr: "10.0.0.1:1234",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.events = nil
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantEvent, sink.types())
+		})
+	}
+}
+
+func TestRouteAccessPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	routes, err := parseForwardList("/admin => " + backend.URL + " [allow-ip=10.0.0.0/8]; / => " + backend.URL)
+	assert.NoError(t, err)
+	p, err := NewReverseProxy(&Config{ForwardTo: routes}, nil)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/admin/test", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
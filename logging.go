@@ -0,0 +1,188 @@
+package wru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats
+const (
+	AccessLogJSON     = "json"
+	AccessLogCombined = "combined"
+)
+
+// NewLogger creates leveled logger. format is "text" or "json".
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level: %s", level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format: %s", format)
+}
+
+// MiddlewareOption modifies config before NewAuthorizationMiddleware initializes it
+type MiddlewareOption func(c *Config)
+
+// WithLogger sets logger that wru uses instead of slog.Default()
+func WithLogger(l *slog.Logger) MiddlewareOption {
+	return func(c *Config) {
+		c.Logger = l
+	}
+}
+
+func (c *Config) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return slog.Default()
+}
+
+// accessLogEntry collects information from inner handlers and proxy transport
+type accessLogEntry struct {
+	userID   string
+	session  string
+	route    string
+	upstream string
+}
+
+type accessLogKeyType string
+
+const accessLogKey accessLogKeyType = "accessLog"
+
+func accessLogFromContext(ctx context.Context) *accessLogEntry {
+	e, _ := ctx.Value(accessLogKey).(*accessLogEntry)
+	return e
+}
+
+// accessLogMiddleware writes one line per request in the format of Config.AccessLog
+func accessLogMiddleware(c *Config, next http.Handler) http.Handler {
+	var write func(r *http.Request, e *accessLogEntry, sr *statusRecorder, start time.Time, latency time.Duration)
+	w := c.AccessLogOutput
+	if w == nil {
+		w = os.Stdout
+	}
+	switch c.AccessLog {
+	case AccessLogJSON:
+		l := slog.New(slog.NewJSONHandler(w, nil))
+		write = func(r *http.Request, e *accessLogEntry, sr *statusRecorder, start time.Time, latency time.Duration) {
+			ip := clientIP(c, r)
+			l.LogAttrs(r.Context(), slog.LevelInfo, "access",
+				slog.String("method", r.Method),
+				slog.String("path", redactURI(r.URL)),
+				slog.String("proto", r.Proto),
+				slog.Int("status", sr.status),
+				slog.Int64("bytes", sr.bytes),
+				slog.Duration("latency", latency),
+				slog.String("ip", ip),
+				slog.String("user_agent", r.UserAgent()),
+				slog.String("referer", redactReferer(r.Referer())),
+				slog.String("user_id", e.userID),
+				slog.String("session", e.session),
+				slog.String("route", e.route),
+				slog.String("upstream", e.upstream),
+			)
+		}
+	case AccessLogCombined:
+		var lock sync.Mutex
+		write = func(r *http.Request, e *accessLogEntry, sr *statusRecorder, start time.Time, latency time.Duration) {
+			ip := clientIP(c, r)
+			line := fmt.Sprintf("%s - %s [%s] %q %d %d %q %q %d %q %q %q\n",
+				ip, dashIfEmpty(e.userID), start.Format("02/Jan/2006:15:04:05 -0700"),
+				r.Method+" "+redactURI(r.URL)+" "+r.Proto, sr.status, sr.bytes,
+				dashIfEmpty(redactReferer(r.Referer())), dashIfEmpty(r.UserAgent()),
+				latency.Milliseconds(), dashIfEmpty(e.session), dashIfEmpty(e.route), dashIfEmpty(e.upstream))
+			lock.Lock()
+			defer lock.Unlock()
+			io.WriteString(w, line)
+		}
+	default:
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessLogEntry{}
+		sr := &statusRecorder{ResponseWriter: rw}
+		r = r.WithContext(context.WithValue(r.Context(), accessLogKey, e))
+		next.ServeHTTP(sr, r)
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		write(r, e, sr, start, time.Since(start))
+	})
+}
+
+// sensitiveQueryParams are credentials that wru and ID providers send in URLs like authorization codes and login links
+var sensitiveQueryParams = map[string]bool{
+	"code":           true,
+	"state":          true,
+	"token":          true,
+	"user_code":      true,
+	"device_code":    true,
+	"code_verifier":  true,
+	"client_secret":  true,
+	"access_token":   true,
+	"id_token":       true,
+	"oauth_token":    true,
+	"oauth_verifier": true,
+}
+
+// redactQuery replaces values of sensitiveQueryParams with "REDACTED". The order of params is kept for readability.
+func redactQuery(rawQuery string) string {
+	params := strings.Split(rawQuery, "&")
+	for i, p := range params {
+		key, _, found := strings.Cut(p, "=")
+		if name, err := url.QueryUnescape(key); err == nil && found && sensitiveQueryParams[name] {
+			params[i] = key + "=REDACTED"
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redactURI returns the request URI for access logs
+func redactURI(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	r := *u
+	r.RawQuery = redactQuery(u.RawQuery)
+	return r.RequestURI()
+}
+
+// redactReferer is redactURI for the referer header. Unparsable referers are not logged.
+func redactReferer(referer string) string {
+	if referer == "" {
+		return ""
+	}
+	u, err := url.Parse(referer)
+	if err != nil {
+		return ""
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = redactQuery(u.RawQuery)
+	}
+	return u.String()
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
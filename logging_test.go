@@ -0,0 +1,148 @@
+package wru
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewLogger(&buf, "json", "warn")
+	assert.NoError(t, err)
+	l.Info("hidden")
+	l.Warn("shown", "key", "value")
+	assert.NotContains(t, buf.String(), "hidden")
+	assert.Contains(t, buf.String(), `"msg":"shown","key":"value"`)
+
+	_, err = NewLogger(&buf, "xml", "info")
+	assert.Error(t, err)
+	_, err = NewLogger(&buf, "text", "verbose")
+	assert.Error(t, err)
+}
+
+func TestAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name   string
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{
+			name:   "json",
+			format: AccessLogJSON,
+			check: func(t *testing.T, line string) {
+				var e map[string]interface{}
+				assert.NoError(t, json.Unmarshal([]byte(line), &e))
+				assert.Equal(t, "GET", e["method"])
+				assert.Equal(t, "/api/test?q=1&code=REDACTED", e["path"])
+				assert.Equal(t, "https://example.com/.wru/login/email/verify?token=REDACTED", e["referer"])
+				assert.Equal(t, float64(200), e["status"])
+				assert.Equal(t, float64(5), e["bytes"])
+				assert.Equal(t, "192.0.2.1", e["ip"])
+				assert.Equal(t, "user1", e["user_id"])
+				assert.Equal(t, hashSessionID("session1"), e["session"])
+				assert.Equal(t, "/api", e["route"])
+				assert.Equal(t, upstream.URL, e["upstream"])
+				assert.Contains(t, e, "latency")
+			},
+		},
+		{
+			name:   "combined",
+			format: AccessLogCombined,
+			check: func(t *testing.T, line string) {
+				assert.True(t, strings.HasPrefix(line, "192.0.2.1 - user1 ["), line)
+				assert.Contains(t, line, `"GET /api/test?q=1&code=REDACTED HTTP/1.1" 200 5 "https://example.com/.wru/login/email/verify?token=REDACTED" "test-agent"`)
+				assert.NotContains(t, line, "secret")
+				assert.Contains(t, line, `"`+hashSessionID("session1")+`" "/api" "`+upstream.URL+`"`)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := &Config{
+				ForwardTo:       []Route{{Path: "/api", Host: mustParseUrl(upstream.URL)}},
+				AccessLog:       tt.format,
+				AccessLogOutput: &buf,
+			}
+			p, err := NewReverseProxy(c, nil)
+			assert.NoError(t, err)
+			h := accessLogMiddleware(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p.ServeHTTP(w, setSessionInfo(r, "session1", &Session{UserID: "user1"}))
+			}))
+
+			r := httptest.NewRequest("GET", "/api/test?q=1&code=secret1", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			r.Header.Set("User-Agent", "test-agent")
+			r.Header.Set("Referer", "https://example.com/.wru/login/email/verify?token=secret2")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, "hello", w.Body.String())
+			tt.check(t, strings.TrimSpace(buf.String()))
+		})
+	}
+}
+
+func Test_redactURI(t *testing.T) {
+	tests := []struct {
+		name string
+		uri  string
+		want string
+	}{
+		{
+			name: "no query",
+			uri:  "/api/test",
+			want: "/api/test",
+		},
+		{
+			name: "other params are kept",
+			uri:  "/api/test?q=1&page=2",
+			want: "/api/test?q=1&page=2",
+		},
+		{
+			name: "authorization code and state",
+			uri:  "/.wru/callback?state=abc&code=xyz&scope=openid",
+			want: "/.wru/callback?state=REDACTED&code=REDACTED&scope=openid",
+		},
+		{
+			name: "email login link",
+			uri:  "/.wru/login/email/verify?token=xyz",
+			want: "/.wru/login/email/verify?token=REDACTED",
+		},
+		{
+			name: "escaped key",
+			uri:  "/.wru/device?user%5Fcode=BCDF-GHJK",
+			want: "/.wru/device?user%5Fcode=REDACTED",
+		},
+		{
+			name: "param without value",
+			uri:  "/api/test?code",
+			want: "/api/test?code",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, redactURI(mustParseUrl("https://example.com"+tt.uri)))
+		})
+	}
+}
+
+func TestAccessLogDisabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := accessLogMiddleware(&Config{}, next)
+	assert.NotNil(t, h)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
@@ -0,0 +1,123 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	loginCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wru",
+		Name:      "logins_total",
+		Help:      "Number of login attempts by ID provider and outcome.",
+	}, []string{"idp", "outcome"})
+
+	sessionStorageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "wru",
+		Name:      "session_storage_duration_seconds",
+		Help:      "Latency of session storage operations.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	sessionStorageErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wru",
+		Name:      "session_storage_errors_total",
+		Help:      "Number of failed session storage operations.",
+	}, []string{"method"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "wru",
+		Name:      "upstream_duration_seconds",
+		Help:      "Latency of requests to backend servers by route and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "status"})
+
+	userTableReloadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wru",
+		Name:      "user_table_reloads_total",
+		Help:      "Number of user table loads by result.",
+	}, []string{"result"})
+
+	userGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wru",
+		Name:      "users",
+		Help:      "Number of users in identity register.",
+	})
+)
+
+// Login outcomes for wru_logins_total
+const (
+	loginSuccess      = "success"
+	loginStarted      = "started"
+	loginIDPError     = "idp_error"
+	loginUserNotFound = "user_not_found"
+	loginSessionError = "session_error"
+	loginRateLimited  = "rate_limited"
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		loginCounter,
+		sessionStorageDuration,
+		sessionStorageErrors,
+		upstreamDuration,
+		userTableReloadCounter,
+		userGauge,
+	)
+}
+
+// MetricsHandler returns handler for Prometheus. cmd/wru serves it at /metrics of admin port.
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// NewAdminHandler returns handler for admin port.
+func NewAdminHandler(c *Config) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", MetricsHandler())
+	return mux
+}
+
+type activeSessionCounter interface {
+	CountActiveSessions(ctx context.Context) (int, error)
+}
+
+type activeSessionCollector struct {
+	desc    *prometheus.Desc
+	counter activeSessionCounter
+}
+
+func (c activeSessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c activeSessionCollector) Collect(ch chan<- prometheus.Metric) {
+	count, err := c.counter.CountActiveSessions(context.Background())
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count))
+}
+
+func registerActiveSessionCollector(s SessionStorage) {
+	counter, ok := s.(activeSessionCounter)
+	if !ok {
+		return
+	}
+	c := &activeSessionCollector{
+		desc:    prometheus.NewDesc("wru_active_sessions", "Number of logged in sessions.", nil, nil),
+		counter: counter,
+	}
+	// session storage can be created multiple times in tests
+	metricsRegistry.Unregister(c)
+	metricsRegistry.MustRegister(c)
+}
@@ -0,0 +1,42 @@
+package wru
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedSessionStorage(t *testing.T) {
+	ctx, s, sid, err := login(t, "user1")
+	assert.NoError(t, err)
+
+	is := &instrumentedSessionStorage{s: s}
+	before := testutil.ToFloat64(sessionStorageErrors.WithLabelValues("RenewSession"))
+
+	_, err = is.FindBySessionToken(ctx, sid)
+	assert.NoError(t, err)
+	_, err = is.RenewSession(ctx, "invalid-session-id")
+	assert.Error(t, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(sessionStorageErrors.WithLabelValues("RenewSession")))
+
+	count, err := s.CountActiveSessions(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	_, s, _, err := login(t, "user1")
+	assert.NoError(t, err)
+	registerActiveSessionCollector(s)
+	loginCounter.WithLabelValues("debug", loginSuccess).Inc()
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(&Config{}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	body, _ := io.ReadAll(w.Body)
+	assert.Contains(t, string(body), `wru_logins_total{idp="debug",outcome="success"}`)
+	assert.Contains(t, string(body), `wru_active_sessions`)
+}
@@ -0,0 +1,722 @@
+package wru
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"gocloud.dev/gcerrors"
+)
+
+// TOTP (RFC 6238) second factor.
+// Users enroll at /.wru/user/mfa. After the login of ID provider, the users who enrolled, who registered passkeys or who have
+// one of the required scopes are redirected to /.wru/mfa and the session starts after the verification.
+// The pending login information is kept in the login session until then.
+
+const (
+	totpPeriod        = 30
+	recoveryCodeCount = 10
+)
+
+// keys of login info of the login session that waits for the second factor
+const (
+	mfaUserKey = "mfa_user"
+	mfaIdPKey  = "mfa_idp"
+	// mfaInfoPrefix is the prefix of the login info from the ID provider that is passed to StartSession
+	mfaInfoPrefix = "mfa_info:"
+	// mfaVerifiedKey keeps amr between the verification and the confirmation of the recovery codes
+	mfaVerifiedKey = "mfa_verified"
+)
+
+// amr values (RFC 8176) that are stored as "amr" in login info
+const (
+	amrTOTP         = "mfa,otp"
+	amrRecoveryCode = "mfa,recovery"
+)
+
+var ErrMFANotFound = errors.New("second factor is not enrolled")
+
+// MFAConfig is the setting of the second factor
+type MFAConfig struct {
+	// EncryptionKey is base64 encoded 32 bytes key to encrypt TOTP secrets in session storage (AES-256-GCM).
+	// A temporary key is generated in DevMode if it is empty.
+	EncryptionKey string
+	// RequiredScopes are scopes whose users have to use the second factor. Other users can enroll optionally.
+	RequiredScopes []string
+	// Issuer is the name shown in authenticator apps. Default is the host name of wru.
+	Issuer string
+
+	key []byte
+}
+
+func (m MFAConfig) Available() bool {
+	return m.key != nil
+}
+
+func (m MFAConfig) requiredFor(u *User) bool {
+	for _, required := range m.RequiredScopes {
+		if containsString(u.Scopes, required) {
+			return true
+		}
+	}
+	return false
+}
+
+func initMFA(c *Config) error {
+	if c.MFA.Issuer == "" {
+		if u, err := url.Parse(c.Host); err == nil {
+			c.MFA.Issuer = u.Hostname()
+		}
+	}
+	if c.MFA.EncryptionKey != "" {
+		key, err := base64.StdEncoding.DecodeString(c.MFA.EncryptionKey)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key of MFA: %w", err)
+		}
+		if len(key) != 32 {
+			return fmt.Errorf("encryption key of MFA should be 32 bytes: %d bytes", len(key))
+		}
+		c.MFA.key = key
+	} else if c.DevMode {
+		c.MFA.key = make([]byte, 32)
+		rand.Read(c.MFA.key)
+	} else if len(c.MFA.RequiredScopes) > 0 {
+		return errors.New("encryption key of MFA is required")
+	}
+	return nil
+}
+
+// encrypt encrypts TOTP secret. The user ID is used as additional data to prevent copying secrets between users.
+func (m MFAConfig) encrypt(userID, plain string) (string, error) {
+	gcm, err := m.gcm()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	rand.Read(nonce)
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), []byte(userID))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (m MFAConfig) decrypt(userID, encrypted string) (string, error) {
+	gcm, err := m.gcm()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted secret is too short")
+	}
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(userID))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func (m MFAConfig) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(m.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// MFAData is the second factor of the user. ID is the user ID.
+type MFAData struct {
+	ID string `docstore:"id"`
+	// Secret is the encrypted TOTP secret
+	Secret string `docstore:"secret"`
+	// Enabled is false until the user verifies the first code
+	Enabled bool `docstore:"enabled"`
+	// RecoveryCodes are hashes of unused recovery codes
+	RecoveryCodes []string  `docstore:"recovery_codes"`
+	LastUsedStep  int64     `docstore:"last_used_step"`
+	CreatedAt     time.Time `docstore:"created_at"`
+}
+
+func (d *MFAData) enrolled() bool {
+	return d != nil && d.Enabled
+}
+
+// useRecoveryCode removes the code if it is valid
+func (d *MFAData) useRecoveryCode(code string) bool {
+	hash := hashAccessToken(normalizeRecoveryCode(code))
+	for i, h := range d.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			d.RecoveryCodes = append(d.RecoveryCodes[:i:i], d.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerlessSessionStorage) GetMFA(ctx context.Context, userID string) (*MFAData, error) {
+	d := &MFAData{ID: userID}
+	err := s.mfa.Get(ctx, d)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, ErrMFANotFound
+		}
+		return nil, err
+	}
+	return d, nil
+}
+
+func (s *ServerlessSessionStorage) SaveMFA(ctx context.Context, data *MFAData) error {
+	return s.mfa.Put(ctx, data)
+}
+
+func (s *ServerlessSessionStorage) DeleteMFA(ctx context.Context, userID string) error {
+	err := s.mfa.Delete(ctx, &MFAData{ID: userID})
+	if gcerrors.Code(err) == gcerrors.NotFound {
+		return ErrMFANotFound
+	}
+	return err
+}
+
+func totpValidateOpts() totp.ValidateOpts {
+	return totp.ValidateOpts{
+		Period:    totpPeriod,
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+	}
+}
+
+// verifyTOTP accepts codes of the previous, current and next time steps for clock skew.
+// Steps that were already used are rejected to prevent replay.
+func verifyTOTP(secret, code string, now time.Time, lastUsedStep int64) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	current := now.Unix() / totpPeriod
+	for _, step := range []int64{current - 1, current, current + 1} {
+		if step <= lastUsedStep {
+			continue
+		}
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpValidateOpts())
+		if err == nil && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// isTOTPCode distinguishes TOTP codes from recovery codes in the same input field
+func isTOTPCode(code string) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != 6 {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// newRecoveryCodes returns codes like "1a2b3-c4d5e" and their hashes
+func newRecoveryCodes() (codes, hashes []string) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashAccessToken(code))
+	}
+	return codes, hashes
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+func totpKeyURL(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", "6")
+	q.Set("period", "30")
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: q.Encode(),
+	}
+	return u.String()
+}
+
+// totpQRCode returns the QR code of the key URL as data URL for <img> element
+func totpQRCode(keyURL string) (template.URL, error) {
+	key, err := otp.NewKeyFromURL(keyURL)
+	if err != nil {
+		return "", err
+	}
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+type mfaPageContext struct {
+	// Action is the URL of the form: /.wru/mfa while login or /.wru/user/mfa for settings
+	Action   string
+	Enrolled bool
+	Required bool
+	// Passkey shows the button to use the registered passkeys
+	Passkey bool
+	// QRCode and Secret are shown for enrollment
+	QRCode template.URL
+	Secret string
+	// RecoveryCodes are shown only once after they are generated
+	RecoveryCodes          []string
+	RemainingRecoveryCodes int
+	Message                string
+	Error                  string
+}
+
+// secondFactor returns the enrolled or pending second factor of the user.
+// New secret is generated for the user who doesn't enroll.
+func (wh wruHandler) secondFactor(ctx context.Context, user *User) (*MFAData, error) {
+	data, err := wh.s.GetMFA(ctx, user.UserID)
+	if err == nil {
+		return data, nil
+	} else if err != ErrMFANotFound {
+		return nil, err
+	}
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      wh.c.MFA.Issuer,
+		AccountName: user.UserID,
+		Period:      totpPeriod,
+		Digits:      otp.DigitsSix,
+		Algorithm:   otp.AlgorithmSHA1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	secret, err := wh.c.MFA.encrypt(user.UserID, key.Secret())
+	if err != nil {
+		return nil, err
+	}
+	data = &MFAData{
+		ID:        user.UserID,
+		Secret:    secret,
+		CreatedAt: currentTime(ctx),
+	}
+	if err := wh.s.SaveMFA(ctx, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// mfaPage returns the page context. It has the QR code if the user doesn't enroll yet.
+func (wh wruHandler) mfaPage(action string, user *User, data *MFAData) (*mfaPageContext, error) {
+	page := &mfaPageContext{
+		Action:                 action,
+		Enrolled:               data.enrolled(),
+		Required:               wh.c.MFA.requiredFor(user),
+		RemainingRecoveryCodes: len(data.RecoveryCodes),
+	}
+	if !data.enrolled() {
+		secret, err := wh.c.MFA.decrypt(user.UserID, data.Secret)
+		if err != nil {
+			return nil, err
+		}
+		page.Secret = secret
+		page.QRCode, err = totpQRCode(totpKeyURL(wh.c.MFA.Issuer, user.UserID, secret))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// verifySecondFactor checks the TOTP code or the recovery code and updates the data. It returns amr value.
+func (wh wruHandler) verifySecondFactor(ctx context.Context, user *User, data *MFAData, code string) (string, error) {
+	if isTOTPCode(code) {
+		secret, err := wh.c.MFA.decrypt(user.UserID, data.Secret)
+		if err != nil {
+			return "", err
+		}
+		step, ok := verifyTOTP(secret, code, currentTime(ctx), data.LastUsedStep)
+		if !ok {
+			return "", nil
+		}
+		data.LastUsedStep = step
+		return amrTOTP, wh.s.SaveMFA(ctx, data)
+	}
+	if data.enrolled() && data.useRecoveryCode(code) {
+		return amrRecoveryCode, wh.s.SaveMFA(ctx, data)
+	}
+	return "", nil
+}
+
+// enableSecondFactor completes the enrollment and returns the recovery codes
+func (wh wruHandler) enableSecondFactor(r *http.Request, user *User, data *MFAData) ([]string, error) {
+	codes, hashes := newRecoveryCodes()
+	wasEnrolled := data.Enabled
+	data.Enabled = true
+	data.RecoveryCodes = hashes
+	if err := wh.s.SaveMFA(r.Context(), data); err != nil {
+		return nil, err
+	}
+	if !wasEnrolled {
+		wh.c.audit(r, &AuditEvent{Type: AuditMFAEnrolled, UserID: user.UserID, Success: true})
+		wh.c.logger().Info("second factor is enrolled", "user", user.UserID)
+	}
+	return codes, nil
+}
+
+// requireSecondFactor suspends the login before StartSession if the user has to use the second factor.
+// It returns false if the login can continue without it.
+func (wh wruHandler) requireSecondFactor(w http.ResponseWriter, r *http.Request, loginID string, user *User, idpName string, loginInfo map[string]string) bool {
+	if !wh.c.MFA.Available() && !wh.c.WebAuthn.Available() {
+		return false
+	}
+	var data *MFAData
+	var err error
+	if wh.c.MFA.Available() {
+		data, err = wh.s.GetMFA(r.Context(), user.UserID)
+		if err == ErrMFANotFound {
+			err = nil
+		}
+	}
+	var passkey bool
+	if err == nil {
+		passkey, err = wh.hasPasskeys(r.Context(), user.UserID)
+	}
+	if err != nil {
+		wh.c.logger().Error("second factor access error", "user", user.UserID, "error", err)
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	if !data.enrolled() && !passkey && !wh.c.MFA.requiredFor(user) {
+		return false
+	}
+	info := map[string]string{
+		mfaUserKey: user.UserID,
+		mfaIdPKey:  idpName,
+	}
+	for k, v := range loginInfo {
+		info[mfaInfoPrefix+k] = v
+	}
+	newID, err := wh.s.AddLoginInfo(r.Context(), loginID, info)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	setSessionID(r.Context(), w, newID, wh.c, BeforeLogin)
+	http.Redirect(w, r, "/.wru/mfa", http.StatusFound)
+	return true
+}
+
+// pendingSecondFactor returns the user of the login session that waits for the second factor
+func (wh wruHandler) pendingSecondFactor(w http.ResponseWriter, r *http.Request) (string, *Session, *User, bool) {
+	id, ses := GetSession(r)
+	if ses != nil && ses.Status == ActiveSession {
+		http.Redirect(w, r, "/.wru/user/mfa", http.StatusFound)
+		return "", nil, nil, false
+	}
+	if ses == nil || ses.Data[mfaUserKey] == "" {
+		http.Redirect(w, r, "/.wru/login", http.StatusFound)
+		return "", nil, nil, false
+	}
+	user, err := wh.ir.FindUserByID(ses.Data[mfaUserKey])
+	if err != nil {
+		writeErrorPage(w, r, http.StatusNotFound, "user not found: "+ses.Data[mfaUserKey])
+		return "", nil, nil, false
+	}
+	return id, ses, user, true
+}
+
+// loginMFAPage returns the page context while login.
+// The users who have passkeys but don't enroll TOTP can use only passkeys, so the pending secret is not created for them.
+func (wh wruHandler) loginMFAPage(ctx context.Context, user *User) (*mfaPageContext, error) {
+	passkey, err := wh.hasPasskeys(ctx, user.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !wh.c.MFA.Available() {
+		return &mfaPageContext{Action: "/.wru/mfa", Passkey: passkey}, nil
+	}
+	if passkey {
+		data, err := wh.s.GetMFA(ctx, user.UserID)
+		if err != nil && err != ErrMFANotFound {
+			return nil, err
+		}
+		if !data.enrolled() {
+			return &mfaPageContext{Action: "/.wru/mfa", Required: wh.c.MFA.requiredFor(user), Passkey: true}, nil
+		}
+	}
+	data, err := wh.secondFactor(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	page, err := wh.mfaPage("/.wru/mfa", user, data)
+	if err != nil {
+		return nil, err
+	}
+	page.Passkey = passkey
+	return page, nil
+}
+
+// MFA is the verification page while login. The user who has to use the second factor but doesn't enroll yet enrolls here.
+func (wh wruHandler) MFA(w http.ResponseWriter, r *http.Request) {
+	_, _, user, ok := wh.pendingSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	page, err := wh.loginMFAPage(r.Context(), user)
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	executeTemplate(w, r, http.StatusOK, MFAPageTemplate, page)
+}
+
+// MFAAction verifies the second factor and starts the session
+func (wh wruHandler) MFAAction(w http.ResponseWriter, r *http.Request) {
+	id, ses, user, ok := wh.pendingSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	// the user confirmed the recovery codes after the enrollment
+	if amr := ses.Data[mfaVerifiedKey]; amr != "" && r.Form.Get("action") == "continue" {
+		wh.finishSecondFactor(w, r, id, ses, user, amr)
+		return
+	}
+	userKey := userRateLimitKey(user.UserID)
+	if wait := wh.rl.check(r.Context(), userKey, wh.c.LoginRateLimit.PerUser); wait > 0 {
+		tooManyRequests(wh.c, w, r, user.UserID, wait)
+		return
+	}
+	if credential := r.Form.Get("credential"); credential != "" && wh.c.WebAuthn.Available() {
+		passkeyUser, _, err := wh.verifyPasskey(r, credential, webAuthnMFA, id)
+		// the passkey should be the pending user's one
+		if err == nil && passkeyUser.UserID != user.UserID {
+			err = errors.New("passkey of other user")
+		}
+		if err != nil {
+			wh.mfaFailure(w, r, ses, user, err.Error(), "Passkey authentication failed.")
+			return
+		}
+		wh.finishSecondFactor(w, r, id, ses, user, amrPasskey)
+		return
+	}
+	if !wh.c.MFA.Available() {
+		wh.mfaFailure(w, r, ses, user, "code is not available", "Use your passkey.")
+		return
+	}
+	data, err := wh.secondFactor(r.Context(), user)
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	enrolling := !data.enrolled()
+	amr, err := wh.verifySecondFactor(r.Context(), user, data, r.Form.Get("code"))
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if amr == "" {
+		wh.mfaFailure(w, r, ses, user, "invalid code", "The code is invalid.")
+		return
+	}
+	if !enrolling {
+		wh.finishSecondFactor(w, r, id, ses, user, amr)
+		return
+	}
+	codes, err := wh.enableSecondFactor(r, user, data)
+	var newID string
+	if err == nil {
+		newID, err = wh.s.AddLoginInfo(r.Context(), id, map[string]string{mfaVerifiedKey: amr})
+	}
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionID(r.Context(), w, newID, wh.c, BeforeLogin)
+	executeTemplate(w, r, http.StatusOK, MFAPageTemplate, &mfaPageContext{
+		Action:        "/.wru/mfa",
+		Enrolled:      true,
+		RecoveryCodes: codes,
+	})
+}
+
+// mfaFailure shows the verification page again with the error message
+func (wh wruHandler) mfaFailure(w http.ResponseWriter, r *http.Request, ses *Session, user *User, reason, message string) {
+	wh.rl.fail(r.Context(), userRateLimitKey(user.UserID))
+	wh.c.audit(r, &AuditEvent{Type: AuditMFAFailure, IdP: ses.Data[mfaIdPKey], UserID: user.UserID, Reason: reason})
+	page, err := wh.loginMFAPage(r.Context(), user)
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page.Error = message
+	executeTemplate(w, r, http.StatusUnauthorized, MFAPageTemplate, page)
+}
+
+// finishSecondFactor starts the session with the login info from the ID provider
+func (wh wruHandler) finishSecondFactor(w http.ResponseWriter, r *http.Request, id string, ses *Session, user *User, amr string) {
+	idpName := ses.Data[mfaIdPKey]
+	loginInfo := map[string]string{
+		"amr": amr,
+	}
+	for k, v := range ses.Data {
+		if strings.HasPrefix(k, mfaInfoPrefix) {
+			loginInfo[strings.TrimPrefix(k, mfaInfoPrefix)] = v
+		}
+	}
+	newID, oldInfo, err := wh.s.StartSession(r.Context(), id, user, r, loginInfo)
+	if err != nil {
+		loginCounter.WithLabelValues(idpName, loginSessionError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: idpName, UserID: user.UserID, Reason: err.Error()})
+		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.rl.succeed(r.Context(), ipRateLimitKey(clientIP(wh.c, r)))
+	wh.rl.succeed(r.Context(), userRateLimitKey(user.UserID))
+	loginCounter.WithLabelValues(idpName, loginSuccess).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: idpName, UserID: user.UserID, Success: true, Detail: map[string]string{"amr": amr}})
+	wh.c.logger().Info("login", "user", user.UserID, "idp", idpName, "amr", amr)
+	completeLogin(wh.c, wh.s, w, r, newID, oldInfo)
+}
+
+// activeUser returns the user of the active session for settings pages
+func (wh wruHandler) activeUser(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	_, ses := GetSession(r)
+	if ses == nil || ses.Status != ActiveSession {
+		startSessionAndRedirect(wh.c, wh.s, w, r)
+		return nil, false
+	}
+	user, err := wh.ir.FindUserByID(ses.UserID)
+	if err != nil {
+		writeErrorPage(w, r, http.StatusNotFound, "user not found: "+ses.UserID)
+		return nil, false
+	}
+	return user, true
+}
+
+// UserMFA shows the QR code for the enrollment or the status of the second factor
+func (wh wruHandler) UserMFA(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	data, err := wh.secondFactor(r.Context(), user)
+	var page *mfaPageContext
+	if err == nil {
+		page, err = wh.mfaPage("/.wru/user/mfa", user, data)
+	}
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	executeTemplate(w, r, http.StatusOK, MFAPageTemplate, page)
+}
+
+// UserMFAAction enables, disables the second factor or regenerates the recovery codes.
+// All actions require the current code.
+func (wh wruHandler) UserMFAAction(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	userKey := userRateLimitKey(user.UserID)
+	if wait := wh.rl.check(r.Context(), userKey, wh.c.LoginRateLimit.PerUser); wait > 0 {
+		tooManyRequests(wh.c, w, r, user.UserID, wait)
+		return
+	}
+	data, err := wh.secondFactor(r.Context(), user)
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	action := r.Form.Get("action")
+	amr, err := wh.verifySecondFactor(r.Context(), user, data, r.Form.Get("code"))
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page, err := wh.mfaPage("/.wru/user/mfa", user, data)
+	if err != nil {
+		http.Error(w, "second factor error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if amr == "" {
+		wh.rl.fail(r.Context(), userKey)
+		wh.c.audit(r, &AuditEvent{Type: AuditMFAFailure, UserID: user.UserID, Reason: "invalid code"})
+		page.Error = "The code is invalid."
+		executeTemplate(w, r, http.StatusUnauthorized, MFAPageTemplate, page)
+		return
+	}
+	wh.rl.succeed(r.Context(), userKey)
+	switch {
+	case action == "disable" && data.enrolled():
+		passkey, err := wh.hasPasskeys(r.Context(), user.UserID)
+		if err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// passkeys satisfy the requirement
+		if page.Required && !passkey {
+			page.Error = "The second factor is required for your scopes."
+			executeTemplate(w, r, http.StatusForbidden, MFAPageTemplate, page)
+			return
+		}
+		if err := wh.s.DeleteMFA(r.Context(), user.UserID); err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		wh.c.audit(r, &AuditEvent{Type: AuditMFADisabled, UserID: user.UserID, Success: true})
+		wh.c.logger().Info("second factor is disabled", "user", user.UserID)
+		http.Redirect(w, r, "/.wru/user", http.StatusFound)
+	case action == "enable" && !data.enrolled(), action == "recovery" && data.enrolled():
+		codes, err := wh.enableSecondFactor(r, user, data)
+		if err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		executeTemplate(w, r, http.StatusOK, MFAPageTemplate, &mfaPageContext{
+			Action:        "/.wru/user/mfa",
+			Enrolled:      true,
+			RecoveryCodes: codes,
+		})
+	default:
+		page.Error = "Unknown action: " + action
+		executeTemplate(w, r, http.StatusBadRequest, MFAPageTemplate, page)
+	}
+}
@@ -0,0 +1,296 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_initMFA(t *testing.T) {
+	tests := []struct {
+		name          string
+		c             Config
+		wantAvailable bool
+		wantErr       string
+	}{
+		{
+			name:          "encryption key",
+			c:             Config{Host: "https://example.com", MFA: MFAConfig{EncryptionKey: "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}},
+			wantAvailable: true,
+		},
+		{
+			name:          "temporary key in DevMode",
+			c:             Config{Host: "https://example.com", DevMode: true},
+			wantAvailable: true,
+		},
+		{
+			name:          "disabled",
+			c:             Config{Host: "https://example.com"},
+			wantAvailable: false,
+		},
+		{
+			name:    "required scopes without key",
+			c:       Config{Host: "https://example.com", MFA: MFAConfig{RequiredScopes: []string{"admin"}}},
+			wantErr: "encryption key of MFA is required",
+		},
+		{
+			name:    "short key",
+			c:       Config{Host: "https://example.com", MFA: MFAConfig{EncryptionKey: "MDEyMzQ1Njc4OWFiY2RlZg=="}},
+			wantErr: "encryption key of MFA should be 32 bytes: 16 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := initMFA(&tt.c)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantAvailable, tt.c.MFA.Available())
+			assert.Equal(t, "example.com", tt.c.MFA.Issuer)
+		})
+	}
+}
+
+func TestMFAConfig_encrypt(t *testing.T) {
+	c := &Config{Host: "https://example.com", DevMode: true}
+	assert.NoError(t, initMFA(c))
+	encrypted, err := c.MFA.encrypt("user1", "JBSWY3DPEHPK3PXP")
+	assert.NoError(t, err)
+	assert.NotContains(t, encrypted, "JBSWY3DPEHPK3PXP")
+
+	plain, err := c.MFA.decrypt("user1", encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", plain)
+
+	// secrets can't be copied to other users
+	_, err = c.MFA.decrypt("user2", encrypted)
+	assert.Error(t, err)
+}
+
+func Test_verifyTOTP(t *testing.T) {
+	secret := "JBSWY3DPEHPK3PXP"
+	now := time.Date(2021, time.July, 1, 12, 0, 0, 0, time.UTC)
+	step := now.Unix() / totpPeriod
+	code := func(ts time.Time) string {
+		c, err := totp.GenerateCodeCustom(secret, ts, totpValidateOpts())
+		assert.NoError(t, err)
+		return c
+	}
+	tests := []struct {
+		name         string
+		code         string
+		lastUsedStep int64
+		wantStep     int64
+		wantOK       bool
+	}{
+		{
+			name:     "current",
+			code:     code(now),
+			wantStep: step,
+			wantOK:   true,
+		},
+		{
+			name:     "clock skew",
+			code:     code(now.Add(-totpPeriod * time.Second)),
+			wantStep: step - 1,
+			wantOK:   true,
+		},
+		{
+			name:   "too old",
+			code:   code(now.Add(-2 * totpPeriod * time.Second)),
+			wantOK: false,
+		},
+		{
+			name:         "replay",
+			code:         code(now),
+			lastUsedStep: step,
+			wantOK:       false,
+		},
+		{
+			name:   "wrong code",
+			code:   "000000",
+			wantOK: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := verifyTOTP(secret, tt.code, now, tt.lastUsedStep)
+			assert.Equal(t, tt.wantOK, gotOK)
+			assert.Equal(t, tt.wantStep, gotStep)
+		})
+	}
+}
+
+func TestMFAData_useRecoveryCode(t *testing.T) {
+	codes, hashes := newRecoveryCodes()
+	assert.Len(t, codes, recoveryCodeCount)
+	d := &MFAData{RecoveryCodes: hashes}
+
+	assert.True(t, d.useRecoveryCode(codes[3]))
+	assert.Len(t, d.RecoveryCodes, recoveryCodeCount-1)
+	// single use
+	assert.False(t, d.useRecoveryCode(codes[3]))
+	// case and hyphen are ignored
+	assert.True(t, d.useRecoveryCode(" "+strings.ReplaceAll(codes[0], "-", "")+" "))
+	assert.False(t, d.useRecoveryCode("00000-00000"))
+}
+
+// user1 requires MFA by the scope and user2 can opt in
+var mfaTestUsers = []string{
+	"WRU_USER_1=id:user1,name:user1,scope:admin",
+	"WRU_USER_2=id:user2,name:user2,scope:user",
+}
+
+func requireMFAForAdmin(c *Config) {
+	c.MFA.RequiredScopes = []string{"admin"}
+}
+
+func postMFAForm(t *testing.T, h http.Handler, c *Config, path, sid string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	form.Set(CSRFTokenField, "token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, path, sid, "token", form, ""))
+	return w
+}
+
+func totpCodeForTest(t *testing.T, c *Config, s SessionStorage, userID string, now time.Time) string {
+	t.Helper()
+	data, err := s.GetMFA(context.Background(), userID)
+	assert.NoError(t, err)
+	secret, err := c.MFA.decrypt(userID, data.Secret)
+	assert.NoError(t, err)
+	code, err := totp.GenerateCodeCustom(secret, now, totpValidateOpts())
+	assert.NoError(t, err)
+	return code
+}
+
+func TestMFALogin(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin)
+
+	// user1 has required scope. The session doesn't start until the enrollment.
+	w := debugLogin(t, context.Background(), h, c, s, "user1")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/mfa", w.Header().Get("Location"))
+	loginID := cookieValue(w, sessionCookieName(c))
+	ses, err := s.FindBySessionToken(context.Background(), loginID)
+	assert.NoError(t, err)
+	assert.Equal(t, BeforeLogin, ses.Status)
+
+	r := httptest.NewRequest("GET", "/.wru/mfa", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: loginID})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "data:image/png;base64,")
+
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"code": {"000000"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	now := time.Now()
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"code": {totpCodeForTest(t, c, s, "user1", now)}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	recoveryCodes := regexp.MustCompile(`[0-9a-f]{5}-[0-9a-f]{5}`).FindAllString(w.Body.String(), -1)
+	assert.Len(t, recoveryCodes, recoveryCodeCount)
+	loginID = cookieValue(w, sessionCookieName(c))
+
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"action": {"continue"}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+	ses, err = s.FindBySessionToken(context.Background(), cookieValue(w, sessionCookieName(c)))
+	assert.NoError(t, err)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, amrTOTP, ses.loginInfo["amr"])
+	assert.Equal(t, "debug", ses.loginInfo["login-idp"])
+	assert.Equal(t, []AuditEventType{AuditMFAFailure, AuditMFAEnrolled, AuditLoginSuccess}, sink.types())
+
+	// the enrolled user verifies the code at the next login
+	w = debugLogin(t, context.Background(), h, c, s, "user1")
+	assert.Equal(t, "/.wru/mfa", w.Header().Get("Location"))
+	loginID = cookieValue(w, sessionCookieName(c))
+	// the code that was used for the enrollment is rejected
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"code": {totpCodeForTest(t, c, s, "user1", now)}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"code": {totpCodeForTest(t, c, s, "user1", now.Add(totpPeriod*time.Second))}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+
+	// recovery code
+	w = debugLogin(t, context.Background(), h, c, s, "user1")
+	loginID = cookieValue(w, sessionCookieName(c))
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{"code": {recoveryCodes[0]}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	ses, err = s.FindBySessionToken(context.Background(), cookieValue(w, sessionCookieName(c)))
+	assert.NoError(t, err)
+	assert.Equal(t, amrRecoveryCode, ses.loginInfo["amr"])
+	data, err := s.GetMFA(context.Background(), "user1")
+	assert.NoError(t, err)
+	assert.Len(t, data.RecoveryCodes, recoveryCodeCount-1)
+
+	// user2 doesn't have required scope and doesn't enroll
+	w = debugLogin(t, context.Background(), h, c, s, "user2")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+}
+
+func TestMFAPageRequiresPendingLogin(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin)
+	w := postMFAForm(t, h, c, "/.wru/mfa", startLogin(t, context.Background(), s), url.Values{"action": {"continue"}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/login", w.Header().Get("Location"))
+}
+
+func TestUserMFA(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin)
+	sid := startSession(t, context.Background(), s, dummyUser("user2"), "debug")
+
+	r := httptest.NewRequest("GET", "/.wru/user/mfa", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: sid})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "data:image/png;base64,")
+
+	now := time.Now()
+	w = postMFAForm(t, h, c, "/.wru/user/mfa", sid, url.Values{"action": {"enable"}, "code": {totpCodeForTest(t, c, s, "user2", now)}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "recovery codes")
+	data, err := s.GetMFA(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.True(t, data.Enabled)
+
+	w = postMFAForm(t, h, c, "/.wru/user/mfa", sid, url.Values{"action": {"disable"}, "code": {"000000"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = postMFAForm(t, h, c, "/.wru/user/mfa", sid, url.Values{"action": {"disable"}, "code": {totpCodeForTest(t, c, s, "user2", now.Add(totpPeriod*time.Second))}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	_, err = s.GetMFA(context.Background(), "user2")
+	assert.Equal(t, ErrMFANotFound, err)
+	assert.Equal(t, []AuditEventType{AuditMFAEnrolled, AuditMFAFailure, AuditMFADisabled}, sink.types())
+}
+
+func TestUserMFA_RequiredUserCantDisable(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin)
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	now := time.Now()
+	r := httptest.NewRequest("GET", "/.wru/user/mfa", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: sid})
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	w := postMFAForm(t, h, c, "/.wru/user/mfa", sid, url.Values{"action": {"enable"}, "code": {totpCodeForTest(t, c, s, "user1", now)}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = postMFAForm(t, h, c, "/.wru/user/mfa", sid, url.Values{"action": {"disable"}, "code": {totpCodeForTest(t, c, s, "user1", now.Add(totpPeriod*time.Second))}})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	_, err := s.GetMFA(context.Background(), "user1")
+	assert.NoError(t, err)
+}
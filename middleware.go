@@ -2,51 +2,79 @@ package wru
 
 import (
 	"context"
-	"fmt"
-	"github.com/gookit/color"
 	"io"
 	"net/http"
 	"os"
 )
 
-func NewAuthorizationMiddleware(ctx context.Context, c *Config, out io.Writer) (http.Handler, func(http.Handler) http.Handler) {
+// NewAuthorizationMiddleware returns handler for /.wru/ pages and middleware that requires login for other pages.
+// Use WithLogger option to inject logger of your application.
+func NewAuthorizationMiddleware(ctx context.Context, c *Config, out io.Writer, opts ...MiddlewareOption) (http.Handler, func(http.Handler) http.Handler) {
+	for _, opt := range opts {
+		opt(c)
+	}
 	err := c.Init(ctx, out)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Config validation error: %s", err.Error()))
+		c.logger().Error("config validation error", "error", err)
 		os.Exit(1)
 	}
 	sessionStorage, err := NewSessionStorage(ctx, c, os.Stdout)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Connect session error: %s", err.Error()))
+		c.logger().Error("connect session error", "error", err)
 		os.Exit(1)
 	}
 	identityRegister, warnings, err := NewIdentityRegister(ctx, c, os.Stdout)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, color.Error.Sprintf("Read user table error: %s", err.Error()))
+		c.logger().Error("read user table error", "error", err)
 		os.Exit(1)
 	}
 	for _, u := range c.Users {
-		identityRegister.appendUser(u)
+		if err := identityRegister.appendUser(u); err != nil {
+			warnings = append(warnings, err.Error())
+		}
+	}
+	if len(c.Users) > 0 {
+		// users of the config may conflict with the user table
+		for _, w := range identityRegister.duplicateWarnings() {
+			if !containsString(warnings, w) {
+				warnings = append(warnings, w)
+			}
+		}
 	}
+	identityRegister.updateUserGauge()
 	for _, w := range warnings {
-		fmt.Fprintln(os.Stderr, color.Warn.Sprintf("User parse warning: %s", w))
+		c.logger().Warn("user parse warning", "warning", w)
 	}
-	handler := newHandler(c, sessionStorage, identityRegister)
+	handler := tracingMiddleware(accessLogMiddleware(c, securityHeadersMiddleware(c, accessPolicyMiddleware(c, newHandler(c, sessionStorage, identityRegister)))))
+	rl := newLoginLimiter(c)
 	middleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next = routeMiddleware(c, next)
+		return tracingMiddleware(accessLogMiddleware(c, securityHeadersMiddleware(c, accessPolicyMiddleware(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if serveAccessToken(c, sessionStorage, identityRegister, w, r, next) || serveServiceAccount(c, identityRegister, rl, w, r, next) {
+				return
+			}
 			sid, ses, ok := lookupSessionFromRequest(c, sessionStorage, r)
 			if !ok || (ses.Status != ActiveSession) {
-				if r.RequestURI == "/favicon.ico" {
-					http.Error(w, "not found", http.StatusNotFound)
+				if sid, ses, ok = loginWithClientCertificate(c, sessionStorage, identityRegister, w, r); !ok {
+					if r.RequestURI == "/favicon.ico" {
+						http.Error(w, "not found", http.StatusNotFound)
+						return
+					}
+					startSessionAndRedirect(c, sessionStorage, w, r)
 					return
 				}
-				startSessionAndRedirect(c, sessionStorage, w, r)
+				if ses == nil {
+					// redirected to the second factor
+					return
+				}
+			}
+			if !verifySessionBinding(c, sessionStorage, w, r, sid, ses) || !checkAccessPolicy(c, w, r, ses) {
 				return
 			}
+			setIdentityHeaders(c, r.Header, ses)
 			next.ServeHTTP(w, setSessionInfo(r, sid, ses))
 			sessionStorage.UpdateSessionData(r.Context(), sid, ses.directrives)
-
-		})
+		})))))
 	}
 	return handler, middleware
 }
@@ -0,0 +1,506 @@
+package wru
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// OIDCClient is an application that uses wru as an OpenID Connect provider
+type OIDCClient struct {
+	ID string
+	// SecretHash is bcrypt hash or "sha256:<hex>" of the client secret
+	SecretHash   string
+	RedirectURIs []string
+	// Scopes limits users of the client. Users should have at least one of them if it is not empty.
+	Scopes []string
+}
+
+// OIDCIssuerConfig enables minimal OpenID Connect provider endpoints for applications that can't read Wru-Session.
+// Only authorization code flow is supported.
+type OIDCIssuerConfig struct {
+	Clients []OIDCClient
+	// SigningKey is PEM content or file path of RSA private key. Temporary key is generated in DevMode if it is empty.
+	SigningKey string
+	// TokenTerm is the expiration term of ID tokens and access tokens
+	TokenTerm time.Duration
+
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+func (c OIDCIssuerConfig) Available() bool {
+	return len(c.Clients) > 0
+}
+
+func (c OIDCIssuerConfig) findClient(id string) *OIDCClient {
+	for i, cl := range c.Clients {
+		if cl.ID == id {
+			return &c.Clients[i]
+		}
+	}
+	return nil
+}
+
+func (c OIDCIssuerConfig) jwk() jose.JSONWebKey {
+	return jose.JSONWebKey{
+		Key:       &c.key.PublicKey,
+		KeyID:     c.keyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}
+}
+
+// sign returns signed JWT. typ is "JWT" for ID tokens and "at+jwt" for access tokens (RFC 9068).
+func (c OIDCIssuerConfig) sign(typ string, claims ...interface{}) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: c.key, KeyID: c.keyID},
+	}, (&jose.SignerOptions{}).WithType(jose.ContentType(typ)))
+	if err != nil {
+		return "", err
+	}
+	builder := jwt.Signed(signer)
+	for _, claim := range claims {
+		builder = builder.Claims(claim)
+	}
+	return builder.CompactSerialize()
+}
+
+// oidcIssuerURL is the issuer identifier. Discovery document is at <issuer>/.well-known/openid-configuration.
+func oidcIssuerURL(c *Config) string {
+	return c.Host + "/.wru/oidc"
+}
+
+var oidcClientRe = regexp.MustCompile(`^\s*([^\s=]+)\s*=>\s*([^\s(\[]+)(\s*\(([^)]*)\))?(\s*\[([^\]]*)\])?\s*$`)
+
+// parseOIDCClients parses client list like "grafana => https://grafana.example.com/login/generic_oauth (admin, ops) [secret=sha256:...]".
+// Multiple redirect URIs are separated by "|".
+func parseOIDCClients(src string) ([]OIDCClient, error) {
+	var result []OIDCClient
+	for i, def := range strings.Split(src, ";") {
+		if strings.TrimSpace(def) == "" {
+			continue
+		}
+		match := oidcClientRe.FindStringSubmatch(def)
+		if len(match) == 0 {
+			return nil, fmt.Errorf("wrong OIDC client definition: (%d)=%s", i, def)
+		}
+		client := OIDCClient{
+			ID:           match[1],
+			RedirectURIs: splitList(match[2], "|"),
+			Scopes:       splitList(match[4], ","),
+		}
+		for _, opt := range splitList(match[6], ",") {
+			kv := strings.SplitN(opt, "=", 2)
+			switch strings.TrimSpace(kv[0]) {
+			case "secret":
+				if len(kv) == 2 {
+					client.SecretHash = strings.TrimSpace(kv[1])
+				}
+			default:
+				return nil, fmt.Errorf("unknown OIDC client option: %s", kv[0])
+			}
+		}
+		result = append(result, client)
+	}
+	return result, nil
+}
+
+func parseRSAPrivateKey(src string) (*rsa.PrivateKey, error) {
+	pemBytes, err := readPEM(src)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("signing key should be RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func initOIDCIssuer(c *Config) error {
+	ic := &c.OIDCIssuer
+	if !ic.Available() {
+		return nil
+	}
+	if c.ClientSessionFieldCookie.isHeader() {
+		return errors.New("OIDC issuer requires cookie based session")
+	}
+	if ic.TokenTerm == 0 {
+		ic.TokenTerm = time.Hour
+	}
+	for _, cl := range ic.Clients {
+		if !validSecretHash(cl.SecretHash) {
+			return fmt.Errorf("secret of OIDC client %s should be bcrypt hash or sha256:<hex>", cl.ID)
+		}
+		if len(cl.RedirectURIs) == 0 {
+			return fmt.Errorf("OIDC client %s doesn't have redirect URI", cl.ID)
+		}
+		for _, redirectURI := range cl.RedirectURIs {
+			u, err := url.Parse(redirectURI)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Fragment != "" {
+				return fmt.Errorf("invalid redirect URI of OIDC client %s: %s", cl.ID, redirectURI)
+			}
+		}
+	}
+	var err error
+	if ic.SigningKey != "" {
+		ic.key, err = parseRSAPrivateKey(ic.SigningKey)
+		if err != nil {
+			return fmt.Errorf("invalid signing key of OIDC issuer: %w", err)
+		}
+	} else if c.DevMode {
+		ic.key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+	} else {
+		return errors.New("signing key of OIDC issuer is required")
+	}
+	thumbprint, err := (&jose.JSONWebKey{Key: &ic.key.PublicKey}).Thumbprint(crypto.SHA256)
+	if err != nil {
+		return err
+	}
+	ic.keyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return nil
+}
+
+// kind of login codes and keys of their data for authorization codes
+const (
+	oidcCodeKey          = "oidc_code"
+	oidcClientKey        = "oidc_client"
+	oidcRedirectURIKey   = "oidc_redirect_uri"
+	oidcUserKey          = "oidc_user"
+	oidcScopeKey         = "oidc_scope"
+	oidcNonceKey         = "oidc_nonce"
+	oidcCodeChallengeKey = "oidc_code_challenge"
+	oidcAuthTimeKey      = "oidc_auth_time"
+)
+
+// oidcUserClaims returns the claims of the user for the requested scopes
+func oidcUserClaims(u *User, scopes []string) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": u.UserID,
+	}
+	if containsString(scopes, "profile") {
+		claims["name"] = u.DisplayName
+		claims["preferred_username"] = u.UserID
+		if u.Organization != "" {
+			claims["org"] = u.Organization
+		}
+	}
+	if containsString(scopes, "email") && u.Email != "" {
+		claims["email"] = u.Email
+	}
+	if containsString(scopes, "groups") {
+		groups := u.Scopes
+		if groups == nil {
+			groups = []string{}
+		}
+		claims["groups"] = groups
+	}
+	return claims
+}
+
+type oidcDiscoveryResponse struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserinfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+func (wh wruHandler) OIDCDiscovery(w http.ResponseWriter, r *http.Request) {
+	issuer := oidcIssuerURL(wh.c)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&oidcDiscoveryResponse{
+		Issuer:                            issuer,
+		AuthorizationEndpoint:             issuer + "/authorize",
+		TokenEndpoint:                     issuer + "/token",
+		UserinfoEndpoint:                  issuer + "/userinfo",
+		JWKSURI:                           issuer + "/jwks",
+		ResponseTypesSupported:            []string{"code"},
+		GrantTypesSupported:               []string{"authorization_code"},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{string(jose.RS256)},
+		ScopesSupported:                   []string{"openid", "profile", "email", "groups"},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post"},
+		ClaimsSupported:                   []string{"sub", "name", "preferred_username", "org", "email", "groups", "nonce", "auth_time"},
+		CodeChallengeMethodsSupported:     []string{"S256"},
+	})
+}
+
+func (wh wruHandler) OIDCJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&jose.JSONWebKeySet{
+		Keys: []jose.JSONWebKey{wh.c.OIDCIssuer.jwk()},
+	})
+}
+
+// OIDCAuthorize issues authorization code for the user who has logged in to wru.
+// Clients are configured statically, so there is no consent page.
+func (wh wruHandler) OIDCAuthorize(w http.ResponseWriter, r *http.Request) {
+	_, ses := GetSession(r)
+	if ses.Status != ActiveSession {
+		startSessionAndRedirect(wh.c, wh.s, w, r)
+		return
+	}
+	q := r.URL.Query()
+	client := wh.c.OIDCIssuer.findClient(q.Get("client_id"))
+	if client == nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "Unknown client: "+q.Get("client_id"))
+		return
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !containsString(client.RedirectURIs, redirectURI) {
+		writeErrorPage(w, r, http.StatusBadRequest, "redirect_uri is not registered for the client.")
+		return
+	}
+	redirect := func(params url.Values) {
+		u, _ := url.Parse(redirectURI)
+		v := u.Query()
+		for key, values := range params {
+			v[key] = values
+		}
+		if state := q.Get("state"); state != "" {
+			v.Set("state", state)
+		}
+		u.RawQuery = v.Encode()
+		http.Redirect(w, r, u.String(), http.StatusFound)
+	}
+	redirectError := func(code, description string) {
+		redirect(url.Values{"error": {code}, "error_description": {description}})
+	}
+	if q.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only code is supported")
+		return
+	}
+	scopes := strings.Fields(q.Get("scope"))
+	if !containsString(scopes, "openid") {
+		redirectError("invalid_scope", "openid scope is required")
+		return
+	}
+	challenge := q.Get("code_challenge")
+	if challenge != "" && q.Get("code_challenge_method") != "S256" {
+		redirectError("invalid_request", "only S256 is supported for code_challenge_method")
+		return
+	}
+	if !hasAnyScope(ses, client.Scopes) {
+		wh.c.audit(r, &AuditEvent{Type: AuditScopeDenied, UserID: ses.UserID, Reason: "oidc client requires " + strings.Join(client.Scopes, ","), Detail: map[string]string{"client": client.ID}})
+		redirectError("access_denied", "the user doesn't have the scope for the client")
+		return
+	}
+	code := newRandomCode()
+	err := wh.s.CreateLoginCode(r.Context(), oidcCodeKey, code, map[string]string{
+		oidcClientKey:        client.ID,
+		oidcRedirectURIKey:   redirectURI,
+		oidcUserKey:          ses.UserID,
+		oidcScopeKey:         strings.Join(scopes, " "),
+		oidcNonceKey:         q.Get("nonce"),
+		oidcCodeChallengeKey: challenge,
+		oidcAuthTimeKey:      strconv.FormatInt(time.Time(ses.LoginAt).Unix(), 10),
+	}, currentTime(r.Context()).Add(wh.c.LoginTimeoutTerm))
+	if err != nil {
+		wh.c.logger().Error("authorization code error", "error", err)
+		redirectError("server_error", "session storage access error")
+		return
+	}
+	redirect(url.Values{"code": {code}})
+}
+
+// OIDCToken exchanges the authorization code with ID token and access token
+func (wh wruHandler) OIDCToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	ipKey := ipRateLimitKey(clientIP(wh.c, r))
+	clientKey := clientRateLimitKey(clientID)
+	if wait := wh.rl.credentialLimited(r.Context(), ipKey, clientKey); wait > 0 {
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "oidc-client", Reason: loginRateLimited, Detail: map[string]string{"client": clientID}})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeOAuthError(w, http.StatusTooManyRequests, "invalid_client", "too many failed attempts")
+		return
+	}
+	client := wh.c.OIDCIssuer.findClient(clientID)
+	if client == nil || !verifySecretHash(client.SecretHash, secret) {
+		wh.rl.credentialFailed(r.Context(), ipKey, clientKey)
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "oidc-client", Reason: "client authentication failed", Detail: map[string]string{"client": clientID}})
+		w.Header().Set("WWW-Authenticate", `Basic realm="wru"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "only authorization_code is supported")
+		return
+	}
+	// single use. Only one of concurrent requests can consume the code.
+	data, err := wh.s.ConsumeLoginCode(r.Context(), oidcCodeKey, r.PostForm.Get("code"))
+	if err == ErrInvalidSessionToken {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code is expired or invalid")
+		return
+	} else if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	if data[oidcClientKey] != client.ID || data[oidcRedirectURIKey] != r.PostForm.Get("redirect_uri") {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code was issued for another client or redirect_uri")
+		return
+	}
+	if challenge := data[oidcCodeChallengeKey]; challenge != "" {
+		h := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(h[:]) != challenge {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "code_verifier doesn't match")
+			return
+		}
+	}
+	user, err := wh.ir.FindUserByID(data[oidcUserKey])
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "user is not found")
+		return
+	}
+	// the user table may be changed after the authorization
+	if !hasAnyScope(&Session{Scopes: user.Scopes}, client.Scopes) {
+		wh.c.audit(r, &AuditEvent{Type: AuditScopeDenied, UserID: user.UserID, Reason: "oidc client requires " + strings.Join(client.Scopes, ","), Detail: map[string]string{"client": client.ID}})
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "user is not allowed to use the client")
+		return
+	}
+
+	ic := wh.c.OIDCIssuer
+	now := currentTime(r.Context())
+	scopes := strings.Fields(data[oidcScopeKey])
+	claims := jwt.Claims{
+		Issuer:   oidcIssuerURL(wh.c),
+		Subject:  user.UserID,
+		Audience: jwt.Audience{client.ID},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(ic.TokenTerm)),
+	}
+	idTokenClaims := oidcUserClaims(user, scopes)
+	if authTime, err := strconv.ParseInt(data[oidcAuthTimeKey], 10, 64); err == nil {
+		idTokenClaims["auth_time"] = authTime
+	}
+	if nonce := data[oidcNonceKey]; nonce != "" {
+		idTokenClaims["nonce"] = nonce
+	}
+	idToken, err := ic.sign("JWT", claims, idTokenClaims)
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	accessToken, err := ic.sign("at+jwt", claims, map[string]interface{}{
+		"client_id": client.ID,
+		"scope":     data[oidcScopeKey],
+	})
+	if err != nil {
+		writeOAuthError(w, http.StatusInternalServerError, "server_error", err.Error())
+		return
+	}
+	wh.c.audit(r, &AuditEvent{Type: AuditOIDCTokenIssued, UserID: user.UserID, Success: true, Detail: map[string]string{"client": client.ID, "scope": data[oidcScopeKey]}})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&oidcTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(ic.TokenTerm / time.Second),
+		IDToken:     idToken,
+		Scope:       data[oidcScopeKey],
+	})
+}
+
+// verifyOIDCAccessToken returns the current user information and the scopes of the access token
+func (wh wruHandler) verifyOIDCAccessToken(r *http.Request) (*User, []string, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return nil, nil, errors.New("access token is required")
+	}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	// ID tokens are not accepted
+	if len(parsed.Headers) != 1 || parsed.Headers[0].ExtraHeaders[jose.HeaderType] != "at+jwt" {
+		return nil, nil, errors.New("token is not an access token")
+	}
+	var claims jwt.Claims
+	var extra struct {
+		Scope string `json:"scope"`
+	}
+	if err := parsed.Claims(&wh.c.OIDCIssuer.key.PublicKey, &claims, &extra); err != nil {
+		return nil, nil, err
+	}
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer: oidcIssuerURL(wh.c),
+		Time:   currentTime(r.Context()),
+	}, time.Minute)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := wh.ir.FindUserByID(claims.Subject)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, strings.Fields(extra.Scope), nil
+}
+
+// OIDCUserInfo returns the claims of the user. They are read from IdentityRegister for each request.
+func (wh wruHandler) OIDCUserInfo(w http.ResponseWriter, r *http.Request) {
+	user, scopes, err := wh.verifyOIDCAccessToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wru", error="invalid_token"`)
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(oidcUserClaims(user, scopes))
+}
@@ -0,0 +1,528 @@
+package wru
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func Test_parseOIDCClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    []OIDCClient
+		wantErr bool
+	}{
+		{
+			name: "single client",
+			src:  "grafana => https://grafana.example.com/login/generic_oauth (admin, ops) [secret=" + testSecretHash + "]",
+			want: []OIDCClient{
+				{
+					ID:           "grafana",
+					SecretHash:   testSecretHash,
+					RedirectURIs: []string{"https://grafana.example.com/login/generic_oauth"},
+					Scopes:       []string{"admin", "ops"},
+				},
+			},
+		},
+		{
+			name: "multiple clients and redirect URIs",
+			src:  "grafana => https://grafana.example.com/cb [secret=" + testSecretHash + "]; argocd => https://argo.example.com/auth/callback|http://localhost:8085/auth/callback [secret=" + testSecretHash + "]",
+			want: []OIDCClient{
+				{
+					ID:           "grafana",
+					SecretHash:   testSecretHash,
+					RedirectURIs: []string{"https://grafana.example.com/cb"},
+				},
+				{
+					ID:           "argocd",
+					SecretHash:   testSecretHash,
+					RedirectURIs: []string{"https://argo.example.com/auth/callback", "http://localhost:8085/auth/callback"},
+				},
+			},
+		},
+		{
+			name:    "unknown option",
+			src:     "grafana => https://grafana.example.com/cb [public]",
+			wantErr: true,
+		},
+		{
+			name:    "wrong format",
+			src:     "https://grafana.example.com/cb",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseOIDCClients(tt.src)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_initOIDCIssuer(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name: "temporary key in dev mode",
+			config: Config{DevMode: true, OIDCIssuer: OIDCIssuerConfig{Clients: []OIDCClient{
+				{ID: "app", SecretHash: testSecretHash, RedirectURIs: []string{"https://app.example.com/cb"}},
+			}}},
+		},
+		{
+			name: "signing key is required",
+			config: Config{OIDCIssuer: OIDCIssuerConfig{Clients: []OIDCClient{
+				{ID: "app", SecretHash: testSecretHash, RedirectURIs: []string{"https://app.example.com/cb"}},
+			}}},
+			wantErr: true,
+		},
+		{
+			name: "no secret",
+			config: Config{DevMode: true, OIDCIssuer: OIDCIssuerConfig{Clients: []OIDCClient{
+				{ID: "app", RedirectURIs: []string{"https://app.example.com/cb"}},
+			}}},
+			wantErr: true,
+		},
+		{
+			name: "relative redirect URI",
+			config: Config{DevMode: true, OIDCIssuer: OIDCIssuerConfig{Clients: []OIDCClient{
+				{ID: "app", SecretHash: testSecretHash, RedirectURIs: []string{"/cb"}},
+			}}},
+			wantErr: true,
+		},
+		{
+			name: "header transport",
+			config: Config{DevMode: true, ClientSessionFieldCookie: BearerField, OIDCIssuer: OIDCIssuerConfig{Clients: []OIDCClient{
+				{ID: "app", SecretHash: testSecretHash, RedirectURIs: []string{"https://app.example.com/cb"}},
+			}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := initOIDCIssuer(&tt.config)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, tt.config.OIDCIssuer.key)
+				assert.NotEmpty(t, tt.config.OIDCIssuer.keyID)
+			}
+		})
+	}
+}
+
+type oidcTestEnv struct {
+	server *httptest.Server
+	c      *Config
+	s      SessionStorage
+	sink   *memoryAuditSink
+	ir     *IdentityRegister
+	sid    string
+}
+
+const oidcTestRedirectURI = "https://app.example.com/callback"
+
+// newOIDCTestEnv starts wru as a http server because go-oidc accesses the discovery document
+func newOIDCTestEnv(t *testing.T, opts ...func(c *Config)) *oidcTestEnv {
+	t.Helper()
+	var h http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	issuer := func(c *Config) {
+		c.Host = server.URL
+		c.OIDCIssuer.Clients = []OIDCClient{
+			{ID: "app", SecretHash: testSecretHash, RedirectURIs: []string{oidcTestRedirectURI}},
+			{ID: "admin-app", SecretHash: testSecretHash, RedirectURIs: []string{oidcTestRedirectURI}, Scopes: []string{"admin"}},
+		}
+	}
+	ir := newTestRegister(t, "WRU_USER_1=id:user1,name:test user,mail:user1@example.com,org:R&D,scope:user")
+	handler, c, s, sink := newTestHandler(t, ir, append([]func(c *Config){issuer}, opts...)...)
+	h = handler
+
+	user, _ := ir.FindUserByID("user1")
+	sid := startSession(t, context.Background(), s, user, "debug")
+	return &oidcTestEnv{server: server, c: c, s: s, sink: sink, ir: ir, sid: sid}
+}
+
+// authorize calls the authorize endpoint with the session cookie and returns the redirect URL
+func (e *oidcTestEnv) authorize(t *testing.T, params url.Values) (int, *url.URL) {
+	t.Helper()
+	r, err := http.NewRequest("GET", e.server.URL+"/.wru/oidc/authorize?"+params.Encode(), nil)
+	assert.NoError(t, err)
+	r.AddCookie(&http.Cookie{Name: e.c.ClientSessionKey, Value: e.sid})
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Do(r)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	location, _ := url.Parse(res.Header.Get("Location"))
+	return res.StatusCode, location
+}
+
+func (e *oidcTestEnv) oauth2Config(clientID string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     clientID,
+		ClientSecret: "secret",
+		RedirectURL:  oidcTestRedirectURI,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:   e.server.URL + "/.wru/oidc/authorize",
+			TokenURL:  e.server.URL + "/.wru/oidc/token",
+			AuthStyle: oauth2.AuthStyleInHeader,
+		},
+		Scopes: []string{oidc.ScopeOpenID, "profile", "email", "groups"},
+	}
+}
+
+func TestOIDCIssuer(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	ctx := context.Background()
+
+	provider, err := oidc.NewProvider(ctx, e.server.URL+"/.wru/oidc")
+	assert.NoError(t, err)
+
+	conf := e.oauth2Config("app")
+	authURL, _ := url.Parse(conf.AuthCodeURL("state1", oidc.Nonce("nonce1")))
+	status, location := e.authorize(t, authURL.Query())
+	assert.Equal(t, http.StatusFound, status)
+	assert.Equal(t, "app.example.com", location.Host)
+	assert.Equal(t, "state1", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	token, err := conf.Exchange(ctx, code)
+	assert.NoError(t, err)
+	rawIDToken, _ := token.Extra("id_token").(string)
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "app"}).Verify(ctx, rawIDToken)
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", idToken.Subject)
+	assert.Equal(t, "nonce1", idToken.Nonce)
+	var claims struct {
+		Name   string   `json:"name"`
+		Email  string   `json:"email"`
+		Groups []string `json:"groups"`
+	}
+	assert.NoError(t, idToken.Claims(&claims))
+	assert.Equal(t, "test user", claims.Name)
+	assert.Equal(t, "user1@example.com", claims.Email)
+	assert.Equal(t, []string{"user"}, claims.Groups)
+	assert.Equal(t, []AuditEventType{AuditOIDCTokenIssued}, e.sink.types())
+
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	assert.NoError(t, err)
+	assert.Equal(t, "user1", userInfo.Subject)
+	assert.Equal(t, "user1@example.com", userInfo.Email)
+
+	// code is single use
+	_, err = conf.Exchange(ctx, code)
+	assert.Error(t, err)
+
+	// ID token is not an access token
+	r := httptest.NewRequest("GET", "/.wru/oidc/userinfo", nil)
+	r.Header.Set("Authorization", "Bearer "+rawIDToken)
+	w := httptest.NewRecorder()
+	newHandler(e.c, e.s, nil).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestOIDCIssuer_PKCE(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	ctx := context.Background()
+	conf := e.oauth2Config("app")
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	h := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(h[:])
+
+	tests := []struct {
+		name     string
+		verifier string
+		wantErr  bool
+	}{
+		{
+			name:     "valid verifier",
+			verifier: verifier,
+		},
+		{
+			name:     "wrong verifier",
+			verifier: "wrong",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			authURL, _ := url.Parse(conf.AuthCodeURL("state", oauth2.SetAuthURLParam("code_challenge", challenge), oauth2.SetAuthURLParam("code_challenge_method", "S256")))
+			_, location := e.authorize(t, authURL.Query())
+			_, err := conf.Exchange(ctx, location.Query().Get("code"), oauth2.SetAuthURLParam("code_verifier", tt.verifier))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestOIDCIssuer_AuthorizeErrors(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	valid := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app"},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"scope":         {"openid"},
+		"state":         {"state1"},
+	}
+	with := func(key, value string) url.Values {
+		v := url.Values{}
+		for k, values := range valid {
+			v[k] = values
+		}
+		v.Set(key, value)
+		return v
+	}
+
+	tests := []struct {
+		name       string
+		params     url.Values
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "unknown client",
+			params:     with("client_id", "unknown"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unregistered redirect URI",
+			params:     with("redirect_uri", "https://evil.example.com/callback"),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "no openid scope",
+			params:     with("scope", "profile"),
+			wantStatus: http.StatusFound,
+			wantError:  "invalid_scope",
+		},
+		{
+			name:       "implicit flow",
+			params:     with("response_type", "id_token"),
+			wantStatus: http.StatusFound,
+			wantError:  "unsupported_response_type",
+		},
+		{
+			name:       "user doesn't have the scope for the client",
+			params:     with("client_id", "admin-app"),
+			wantStatus: http.StatusFound,
+			wantError:  "access_denied",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, location := e.authorize(t, tt.params)
+			assert.Equal(t, tt.wantStatus, status)
+			if tt.wantStatus == http.StatusFound {
+				assert.Equal(t, "app.example.com", location.Host)
+				assert.Equal(t, tt.wantError, location.Query().Get("error"))
+				assert.Equal(t, "state1", location.Query().Get("state"))
+				assert.Empty(t, location.Query().Get("code"))
+			}
+		})
+	}
+}
+
+func TestOIDCIssuer_TokenErrors(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	h := newHandler(e.c, e.s, nil)
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app"},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"scope":         {"openid"},
+	}
+
+	tests := []struct {
+		name       string
+		clientID   string
+		secret     string
+		form       url.Values
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "wrong secret",
+			clientID:   "app",
+			secret:     "wrong",
+			form:       url.Values{"grant_type": {"authorization_code"}, "redirect_uri": {oidcTestRedirectURI}},
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "invalid_client",
+		},
+		{
+			name:       "code for other client",
+			clientID:   "admin-app",
+			secret:     "secret",
+			form:       url.Values{"grant_type": {"authorization_code"}, "redirect_uri": {oidcTestRedirectURI}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "different redirect URI",
+			clientID:   "app",
+			secret:     "secret",
+			form:       url.Values{"grant_type": {"authorization_code"}, "redirect_uri": {"https://app.example.com/other"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "invalid_grant",
+		},
+		{
+			name:       "unsupported grant type",
+			clientID:   "app",
+			secret:     "secret",
+			form:       url.Values{"grant_type": {"refresh_token"}},
+			wantStatus: http.StatusBadRequest,
+			wantError:  "unsupported_grant_type",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, location := e.authorize(t, params)
+			tt.form.Set("code", location.Query().Get("code"))
+			r := httptest.NewRequest("POST", "/.wru/oidc/token", strings.NewReader(tt.form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(tt.clientID, tt.secret)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			var res map[string]string
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+			assert.Equal(t, tt.wantError, res["error"])
+		})
+	}
+}
+
+func (e *oidcTestEnv) token(clientID, secret, code string) *http.Response {
+	form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {oidcTestRedirectURI}}
+	r, _ := http.NewRequest("POST", e.server.URL+"/.wru/oidc/token", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(clientID, secret)
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		panic(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestOIDCIssuer_ConcurrentRedemption(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	_, location := e.authorize(t, url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app"},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"scope":         {"openid"},
+	})
+	code := location.Query().Get("code")
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var statuses []int
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := e.token("app", "secret", code)
+			lock.Lock()
+			statuses = append(statuses, res.StatusCode)
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+	ok := 0
+	for _, status := range statuses {
+		if status == http.StatusOK {
+			ok++
+		} else {
+			assert.Equal(t, http.StatusBadRequest, status)
+		}
+	}
+	assert.Equal(t, 1, ok)
+	assert.Equal(t, []AuditEventType{AuditOIDCTokenIssued}, e.sink.types())
+}
+
+func TestOIDCIssuer_ScopeIsCheckedAtTokenTime(t *testing.T) {
+	e := newOIDCTestEnv(t)
+	ctx := context.Background()
+	replaceUsers := func(env string) {
+		ir, _, _ := NewIdentityRegisterFromEnv(ctx, []string{env}, nil)
+		e.ir.lock.Lock()
+		e.ir.fromID = ir.fromID
+		e.ir.lock.Unlock()
+	}
+
+	replaceUsers("WRU_USER_1=id:admin1,name:admin,scope:admin")
+	user, _ := e.ir.FindUserByID("admin1")
+	e.sid = startSession(t, ctx, e.s, user, "debug")
+	status, location := e.authorize(t, url.Values{
+		"response_type": {"code"},
+		"client_id":     {"admin-app"},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"scope":         {"openid"},
+	})
+	assert.Equal(t, http.StatusFound, status)
+	code := location.Query().Get("code")
+	assert.NotEmpty(t, code)
+
+	// the scope is removed after the authorization
+	replaceUsers("WRU_USER_1=id:admin1,name:admin,scope:user")
+	res := e.token("admin-app", "secret", code)
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	assert.Equal(t, []AuditEventType{AuditScopeDenied}, e.sink.types())
+}
+
+func TestOIDCIssuer_ClientRateLimit(t *testing.T) {
+	e := newOIDCTestEnv(t, func(c *Config) {
+		c.LoginRateLimit = LoginRateLimit{
+			PerIP:            RateLimit{Count: 100, Per: time.Minute},
+			PerUser:          RateLimit{Count: 100, Per: time.Minute},
+			LockoutThreshold: 2,
+			LockoutDuration:  time.Minute,
+		}
+	})
+	_, location := e.authorize(t, url.Values{
+		"response_type": {"code"},
+		"client_id":     {"app"},
+		"redirect_uri":  {oidcTestRedirectURI},
+		"scope":         {"openid"},
+	})
+	code := location.Query().Get("code")
+
+	assert.Equal(t, http.StatusUnauthorized, e.token("app", "wrong", code).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, e.token("app", "wrong", code).StatusCode)
+	// the right secret is rejected during lockout
+	res := e.token("app", "secret", code)
+	assert.Equal(t, http.StatusTooManyRequests, res.StatusCode)
+	assert.NotEmpty(t, res.Header.Get("Retry-After"))
+	assert.Equal(t, []AuditEventType{AuditLoginFailure, AuditLoginFailure, AuditLoginFailure}, e.sink.types())
+	assert.Equal(t, loginRateLimited, e.sink.events[2].Reason)
+}
@@ -0,0 +1,420 @@
+package wru
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/future-architect/gocloudurls"
+	"gocloud.dev/docstore"
+	"gocloud.dev/gcerrors"
+)
+
+// RateLimit is a token bucket setting. Count tokens are refilled during Per.
+// Zero Count disables the limit.
+type RateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// parseRateLimit parses "10/1m" style string. Empty string or "0" disables the limit.
+func parseRateLimit(src string) (RateLimit, error) {
+	src = strings.TrimSpace(src)
+	if src == "" || src == "0" {
+		return RateLimit{}, nil
+	}
+	fragments := strings.SplitN(src, "/", 2)
+	count, err := strconv.Atoi(strings.TrimSpace(fragments[0]))
+	if err != nil || count < 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit: %s", src)
+	}
+	per := time.Minute
+	if len(fragments) == 2 {
+		per, err = time.ParseDuration(strings.TrimSpace(fragments[1]))
+		if err != nil || per <= 0 {
+			return RateLimit{}, fmt.Errorf("invalid rate limit: %s", src)
+		}
+	}
+	return RateLimit{Count: count, Per: per}, nil
+}
+
+func (r RateLimit) String() string {
+	if r.Count == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d/%s", r.Count, r.Per)
+}
+
+// LoginRateLimit limits login attempts per client IP and per target user.
+// Clients are locked out for LockoutDuration after LockoutThreshold login failures.
+type LoginRateLimit struct {
+	PerIP            RateLimit
+	PerUser          RateLimit
+	LockoutThreshold int
+	LockoutDuration  time.Duration
+}
+
+func (l LoginRateLimit) enabled() bool {
+	return l.PerIP.Count > 0 || l.PerUser.Count > 0 || (l.LockoutThreshold > 0 && l.LockoutDuration > 0)
+}
+
+// rateLimitBucketTTL is how long buckets are kept after the last update
+const rateLimitBucketTTL = 24 * time.Hour
+
+// RateLimitBucket is a state of token bucket and lockout for one key.
+// It is also used to remember single use values like jti claims until LockedUntil.
+type RateLimitBucket struct {
+	Key         string    `docstore:"id"`
+	Tokens      float64   `docstore:"tokens"`
+	UpdatedAt   time.Time `docstore:"updated_at"`
+	Failures    int       `docstore:"failures"`
+	LockedUntil time.Time `docstore:"locked_until"`
+	// ExpireAt is the time when the bucket can be removed. Stores update it and delete expired buckets.
+	ExpireAt time.Time `docstore:"expire_at"`
+
+	DocstoreRevision interface{}
+}
+
+// updateExpiration keeps the bucket for rateLimitBucketTTL or until the lockout ends
+func (b *RateLimitBucket) updateExpiration(now time.Time) {
+	b.ExpireAt = now.Add(rateLimitBucketTTL)
+	if b.LockedUntil.After(b.ExpireAt) {
+		b.ExpireAt = b.LockedUntil
+	}
+}
+
+func (b *RateLimitBucket) expired(now time.Time) bool {
+	return !b.ExpireAt.IsZero() && !now.Before(b.ExpireAt)
+}
+
+// take refills tokens and consumes one. It returns zero if it is allowed or duration until next token.
+func (b *RateLimitBucket) take(now time.Time, r RateLimit) time.Duration {
+	if r.Count == 0 {
+		return 0
+	}
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = float64(r.Count)
+	} else if elapsed := now.Sub(b.UpdatedAt); elapsed > 0 {
+		b.Tokens = math.Min(float64(r.Count), b.Tokens+float64(r.Count)*float64(elapsed)/float64(r.Per))
+	}
+	b.UpdatedAt = now
+	if b.Tokens >= 1 {
+		b.Tokens--
+		return 0
+	}
+	return time.Duration((1 - b.Tokens) * float64(r.Per) / float64(r.Count))
+}
+
+// wait returns duration until next token without consuming it
+func (b *RateLimitBucket) wait(now time.Time, r RateLimit) time.Duration {
+	if r.Count == 0 || b.UpdatedAt.IsZero() {
+		return 0
+	}
+	tokens := b.Tokens
+	if elapsed := now.Sub(b.UpdatedAt); elapsed > 0 {
+		tokens = math.Min(float64(r.Count), tokens+float64(r.Count)*float64(elapsed)/float64(r.Per))
+	}
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - tokens) * float64(r.Per) / float64(r.Count))
+}
+
+func (b *RateLimitBucket) lockedFor(now time.Time) time.Duration {
+	if b.LockedUntil.After(now) {
+		return b.LockedUntil.Sub(now)
+	}
+	return 0
+}
+
+// RateLimitStore keeps buckets. Use docstore based store to share limits between multiple wru instances.
+type RateLimitStore interface {
+	// Update loads bucket of the key (new bucket if not exists), calls f and stores it atomically
+	Update(ctx context.Context, key string, f func(b *RateLimitBucket)) error
+	Close() error
+}
+
+// NewRateLimitStore creates in-memory store if docstoreURL is empty.
+// Otherwise, it uses "loginRateLimits" collection of the docstore.
+func NewRateLimitStore(ctx context.Context, docstoreURL string) (RateLimitStore, error) {
+	if docstoreURL == "" {
+		return &memoryRateLimitStore{buckets: make(map[string]*RateLimitBucket)}, nil
+	}
+	u, err := gocloudurls.NormalizeDocStoreURL(docstoreURL, gocloudurls.Option{
+		KeyName:    "id",
+		Collection: "loginRateLimits",
+	})
+	if err != nil {
+		return nil, err
+	}
+	coll, err := docstore.OpenCollection(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	return &docstoreRateLimitStore{coll: coll}, nil
+}
+
+const rateLimitSweepInterval = 1000
+
+type memoryRateLimitStore struct {
+	buckets map[string]*RateLimitBucket
+	updates int
+	lock    sync.Mutex
+}
+
+func (m *memoryRateLimitStore) Update(ctx context.Context, key string, f func(b *RateLimitBucket)) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &RateLimitBucket{Key: key}
+		m.buckets[key] = b
+	}
+	now := currentTime(ctx)
+	if b.expired(now) {
+		*b = RateLimitBucket{Key: key}
+	}
+	f(b)
+	b.updateExpiration(now)
+	m.updates++
+	if m.updates%rateLimitSweepInterval == 0 {
+		// forget clients that are quiet for a while
+		for k, b := range m.buckets {
+			if b.expired(now) {
+				delete(m.buckets, k)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memoryRateLimitStore) Close() error {
+	return nil
+}
+
+type docstoreRateLimitStore struct {
+	coll    *docstore.Collection
+	updates int64
+}
+
+func (d *docstoreRateLimitStore) Update(ctx context.Context, key string, f func(b *RateLimitBucket)) error {
+	now := currentTime(ctx)
+	if atomic.AddInt64(&d.updates, 1)%rateLimitSweepInterval == 0 {
+		// best effort. Storages that have TTL feature delete them anyway and others are retried at next sweep.
+		d.sweep(ctx, now)
+	}
+	var err error
+	// retry when other instance updates the same bucket
+	for i := 0; i < 3; i++ {
+		b := &RateLimitBucket{Key: key}
+		err = d.coll.Get(ctx, b)
+		exists := err == nil
+		if err != nil && gcerrors.Code(err) != gcerrors.NotFound {
+			return err
+		}
+		if exists && b.expired(now) {
+			// the storage's TTL may not delete it yet
+			*b = RateLimitBucket{Key: key, DocstoreRevision: b.DocstoreRevision}
+		}
+		f(b)
+		b.updateExpiration(now)
+		if exists {
+			err = d.coll.Replace(ctx, b)
+		} else {
+			b.DocstoreRevision = nil
+			err = d.coll.Create(ctx, b)
+		}
+		code := gcerrors.Code(err)
+		if err == nil || (code != gcerrors.FailedPrecondition && code != gcerrors.AlreadyExists) {
+			return err
+		}
+	}
+	return err
+}
+
+// sweep deletes expired buckets like jti claims that are never read again
+func (d *docstoreRateLimitStore) sweep(ctx context.Context, now time.Time) error {
+	iter := d.coll.Query().Where("expire_at", "<=", now).Get(ctx, "id")
+	defer iter.Stop()
+	actions := d.coll.Actions()
+	for {
+		b := &RateLimitBucket{}
+		err := iter.Next(ctx, b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		actions.Delete(b)
+	}
+	return actions.Do(ctx)
+}
+
+func (d *docstoreRateLimitStore) Close() error {
+	return d.coll.Close()
+}
+
+// loginLimiter applies Config.LoginRateLimit. nil limiter allows everything.
+type loginLimiter struct {
+	c     *Config
+	store RateLimitStore
+}
+
+func newLoginLimiter(c *Config) *loginLimiter {
+	if c.RateLimitStore == nil || !c.LoginRateLimit.enabled() {
+		return nil
+	}
+	return &loginLimiter{c: c, store: c.RateLimitStore}
+}
+
+func ipRateLimitKey(ip string) string {
+	return "ip:" + ip
+}
+
+func userRateLimitKey(userID string) string {
+	return "user:" + userID
+}
+
+func clientRateLimitKey(clientID string) string {
+	return "client:" + clientID
+}
+
+// check returns wait time if the key is locked out or it consumes all tokens.
+// Storage errors don't block logins.
+func (l *loginLimiter) check(ctx context.Context, key string, rate RateLimit) time.Duration {
+	if l == nil {
+		return 0
+	}
+	var wait time.Duration
+	now := currentTime(ctx)
+	err := l.store.Update(ctx, key, func(b *RateLimitBucket) {
+		if wait = b.lockedFor(now); wait > 0 {
+			return
+		}
+		wait = b.take(now, rate)
+	})
+	if err != nil {
+		l.c.logger().Error("rate limit storage error", "key", key, "error", err)
+		return 0
+	}
+	return wait
+}
+
+// peek is similar to check but it doesn't consume tokens.
+// It is for clients that are authenticated for each request, whose successful requests shouldn't be limited.
+func (l *loginLimiter) peek(ctx context.Context, key string, rate RateLimit) time.Duration {
+	if l == nil {
+		return 0
+	}
+	var wait time.Duration
+	now := currentTime(ctx)
+	err := l.store.Update(ctx, key, func(b *RateLimitBucket) {
+		if wait = b.lockedFor(now); wait > 0 {
+			return
+		}
+		wait = b.wait(now, rate)
+	})
+	if err != nil {
+		l.c.logger().Error("rate limit storage error", "key", key, "error", err)
+		return 0
+	}
+	return wait
+}
+
+// credentialLimited returns wait time if the client IP address or the key of the credential is limited by past failures.
+// It is for clients that are authenticated for each request like service accounts. Their successful requests don't consume tokens.
+func (l *loginLimiter) credentialLimited(ctx context.Context, ipKey, key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	return max(l.peek(ctx, ipKey, l.c.LoginRateLimit.PerIP), l.peek(ctx, key, l.c.LoginRateLimit.PerUser))
+}
+
+// credentialFailed consumes tokens of the client IP address and the key of the credential, and counts failure of them
+func (l *loginLimiter) credentialFailed(ctx context.Context, ipKey, key string) {
+	if l == nil {
+		return
+	}
+	l.check(ctx, ipKey, l.c.LoginRateLimit.PerIP)
+	l.check(ctx, key, l.c.LoginRateLimit.PerUser)
+	l.fail(ctx, ipKey)
+	l.fail(ctx, key)
+}
+
+// fail counts login failure of the key and locks it out when it reaches threshold
+func (l *loginLimiter) fail(ctx context.Context, key string) {
+	if l == nil || l.c.LoginRateLimit.LockoutThreshold <= 0 {
+		return
+	}
+	now := currentTime(ctx)
+	var lockedUntil time.Time
+	err := l.store.Update(ctx, key, func(b *RateLimitBucket) {
+		b.Failures++
+		if b.Failures >= l.c.LoginRateLimit.LockoutThreshold {
+			b.Failures = 0
+			b.LockedUntil = now.Add(l.c.LoginRateLimit.LockoutDuration)
+			lockedUntil = b.LockedUntil
+		}
+	})
+	if err != nil {
+		l.c.logger().Error("rate limit storage error", "key", key, "error", err)
+	} else if !lockedUntil.IsZero() {
+		l.c.logger().Warn("login lockout", "key", key, "until", lockedUntil)
+	}
+}
+
+// succeed resets failure count of the key
+func (l *loginLimiter) succeed(ctx context.Context, key string) {
+	if l == nil || l.c.LoginRateLimit.LockoutThreshold <= 0 {
+		return
+	}
+	err := l.store.Update(ctx, key, func(b *RateLimitBucket) {
+		b.Failures = 0
+	})
+	if err != nil {
+		l.c.logger().Error("rate limit storage error", "key", key, "error", err)
+	}
+}
+
+// middleware limits requests per client IP
+func (l *loginLimiter) middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait := l.check(r.Context(), ipRateLimitKey(clientIP(l.c, r)), l.c.LoginRateLimit.PerIP); wait > 0 {
+			tooManyRequests(l.c, w, r, "", wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(c *Config, w http.ResponseWriter, r *http.Request, userID string, wait time.Duration) {
+	loginCounter.WithLabelValues(idpOfRequest(r), loginRateLimited).Inc()
+	c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: idpOfRequest(r), UserID: userID, Reason: loginRateLimited})
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeErrorPage(w, r, http.StatusTooManyRequests, "Too many login attempts. Please try again later.")
+}
+
+// idpOfRequest returns ID provider name for metrics and audit logs
+func idpOfRequest(r *http.Request) string {
+	if _, ses := GetSession(r); ses != nil && ses.Data["idp"] != "" {
+		return ses.Data["idp"]
+	}
+	if strings.HasPrefix(r.URL.Path, "/.wru/device") {
+		return "device"
+	}
+	if strings.HasPrefix(r.URL.Path, "/.wru/login/") {
+		// "/.wru/login/email/verify" => "email"
+		return strings.SplitN(strings.TrimPrefix(r.URL.Path, "/.wru/login/"), "/", 2)[0]
+	}
+	return "debug"
+}
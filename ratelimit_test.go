@@ -0,0 +1,226 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"gocloud.dev/gcerrors"
+)
+
+func Test_parseRateLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    RateLimit
+		wantErr bool
+	}{
+		{
+			name: "disabled",
+			src:  "",
+			want: RateLimit{},
+		},
+		{
+			name: "zero",
+			src:  "0",
+			want: RateLimit{},
+		},
+		{
+			name: "count only",
+			src:  "10",
+			want: RateLimit{Count: 10, Per: time.Minute},
+		},
+		{
+			name: "count and duration",
+			src:  "5/30s",
+			want: RateLimit{Count: 5, Per: 30 * time.Second},
+		},
+		{
+			name:    "invalid count",
+			src:     "many/1m",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			src:     "10/0s",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRateLimit(tt.src)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimitBucket_take(t *testing.T) {
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	rate := RateLimit{Count: 2, Per: time.Minute}
+	b := &RateLimitBucket{}
+	assert.Equal(t, time.Duration(0), b.take(now, rate))
+	assert.Equal(t, time.Duration(0), b.take(now, rate))
+	assert.Equal(t, 30*time.Second, b.take(now, rate))
+	assert.Equal(t, time.Duration(0), b.take(now.Add(30*time.Second), rate))
+	assert.Equal(t, 30*time.Second, b.take(now.Add(30*time.Second), rate))
+}
+
+func TestRateLimitBucket_wait(t *testing.T) {
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	rate := RateLimit{Count: 2, Per: time.Minute}
+	b := &RateLimitBucket{}
+	assert.Equal(t, time.Duration(0), b.wait(now, rate))
+	b.take(now, rate)
+	b.take(now, rate)
+	assert.Equal(t, 30*time.Second, b.wait(now, rate))
+	// wait doesn't consume tokens
+	assert.Equal(t, 30*time.Second, b.wait(now, rate))
+	assert.Equal(t, time.Duration(0), b.wait(now.Add(30*time.Second), rate))
+}
+
+func TestRateLimitStore(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{
+			name: "memory",
+			url:  "",
+		},
+		{
+			name: "docstore",
+			url:  "mem://",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, err := NewRateLimitStore(ctx, tt.url)
+			assert.NoError(t, err)
+			defer s.Close()
+			key := "ip:" + xid.New().String()
+			for i := 0; i < 3; i++ {
+				assert.NoError(t, s.Update(ctx, key, func(b *RateLimitBucket) {
+					assert.Equal(t, key, b.Key)
+					assert.Equal(t, i, b.Failures)
+					b.Failures++
+				}))
+			}
+		})
+	}
+}
+
+func TestRateLimitStore_Expiration(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+	}{
+		{
+			name: "memory",
+			url:  "",
+		},
+		{
+			name: "docstore",
+			url:  "mem://",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewRateLimitStore(context.Background(), tt.url)
+			assert.NoError(t, err)
+			defer s.Close()
+			now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+			key := "jti:" + xid.New().String()
+			lockedUntil := now.Add(48 * time.Hour)
+			assert.NoError(t, s.Update(setFixTime(context.Background(), now), key, func(b *RateLimitBucket) {
+				b.LockedUntil = lockedUntil
+			}))
+			// kept until the lockout ends even if it is longer than TTL
+			assert.NoError(t, s.Update(setFixTime(context.Background(), now.Add(47*time.Hour)), key, func(b *RateLimitBucket) {
+				assert.True(t, b.LockedUntil.Equal(lockedUntil))
+			}))
+			assert.NoError(t, s.Update(setFixTime(context.Background(), now.Add(48*time.Hour+rateLimitBucketTTL)), key, func(b *RateLimitBucket) {
+				assert.True(t, b.LockedUntil.IsZero())
+			}))
+		})
+	}
+}
+
+func TestDocstoreRateLimitStore_sweep(t *testing.T) {
+	s, err := NewRateLimitStore(context.Background(), "mem://")
+	assert.NoError(t, err)
+	defer s.Close()
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	ctx := setFixTime(context.Background(), now)
+	assert.NoError(t, s.Update(ctx, "jti:old", func(b *RateLimitBucket) {}))
+	assert.NoError(t, s.Update(ctx, "jti:new", func(b *RateLimitBucket) {
+		b.LockedUntil = now.Add(48 * time.Hour)
+	}))
+
+	ds := s.(*docstoreRateLimitStore)
+	assert.NoError(t, ds.sweep(ctx, now.Add(rateLimitBucketTTL)))
+	err = ds.coll.Get(ctx, &RateLimitBucket{Key: "jti:old"})
+	assert.Equal(t, gcerrors.NotFound, gcerrors.Code(err))
+	assert.NoError(t, ds.coll.Get(ctx, &RateLimitBucket{Key: "jti:new"}))
+}
+
+func withLoginRateLimit(l LoginRateLimit) func(c *Config) {
+	return func(c *Config) {
+		c.LoginRateLimit = l
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withLoginRateLimit(LoginRateLimit{
+		PerIP: RateLimit{Count: 2, Per: time.Minute},
+	}))
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	ctx := setFixTime(context.Background(), now)
+
+	assert.Equal(t, http.StatusFound, debugLogin(t, ctx, h, c, s, "user1").Code)
+	assert.Equal(t, http.StatusFound, debugLogin(t, ctx, h, c, s, "user1").Code)
+	w := debugLogin(t, ctx, h, c, s, "user1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "30", w.Header().Get("Retry-After"))
+
+	ctx = setFixTime(context.Background(), now.Add(30*time.Second))
+	assert.Equal(t, http.StatusFound, debugLogin(t, ctx, h, c, s, "user1").Code)
+}
+
+func TestLoginRateLimitPerUser(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withLoginRateLimit(LoginRateLimit{
+		PerUser: RateLimit{Count: 1, Per: time.Minute},
+	}))
+	ctx := setFixTime(context.Background(), time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC))
+
+	assert.Equal(t, http.StatusFound, debugLogin(t, ctx, h, c, s, "user1").Code)
+	assert.Equal(t, http.StatusTooManyRequests, debugLogin(t, ctx, h, c, s, "user1").Code)
+	// other user is not affected
+	assert.Equal(t, http.StatusNotFound, debugLogin(t, ctx, h, c, s, "user2").Code)
+}
+
+func TestLoginLockout(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withLoginRateLimit(LoginRateLimit{
+		LockoutThreshold: 2,
+		LockoutDuration:  15 * time.Minute,
+	}))
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.UTC)
+	ctx := setFixTime(context.Background(), now)
+
+	assert.Equal(t, http.StatusNotFound, debugLogin(t, ctx, h, c, s, "unknown").Code)
+	assert.Equal(t, http.StatusNotFound, debugLogin(t, ctx, h, c, s, "unknown").Code)
+	w := debugLogin(t, ctx, h, c, s, "user1")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "900", w.Header().Get("Retry-After"))
+
+	ctx = setFixTime(context.Background(), now.Add(15*time.Minute))
+	assert.Equal(t, http.StatusFound, debugLogin(t, ctx, h, c, s, "user1").Code)
+}
@@ -0,0 +1,62 @@
+package wru
+
+import (
+	"net/url"
+	"strings"
+)
+
+// safeLandingURL returns the URL if it is a path of this site or an URL of Config.Host or Config.AllowedRedirectHosts.
+// Otherwise it returns Config.DefaultLandingPage to prevent open redirect.
+func safeLandingURL(c *Config, src string) string {
+	if src == "" {
+		return c.DefaultLandingPage
+	}
+	if isSafeLandingURL(c, src) {
+		return src
+	}
+	c.logger().Warn("unsafe landing URL is replaced with default landing page", "url", src)
+	return c.DefaultLandingPage
+}
+
+func isSafeLandingURL(c *Config, src string) bool {
+	// browsers treat "/\evil.example.com" as "//evil.example.com"
+	for _, r := range src {
+		if r == '\\' || r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	u, err := url.Parse(src)
+	if err != nil || u.User != nil || u.Opaque != "" {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(src, "/") && !strings.HasPrefix(src, "//")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	if h, err := url.Parse(c.Host); err == nil && strings.EqualFold(h.Scheme, u.Scheme) && strings.EqualFold(h.Host, u.Host) {
+		return true
+	}
+	for _, pattern := range c.AllowedRedirectHosts {
+		if matchHost(pattern, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost checks the host of URL. The pattern is a host name like "app.example.com", "app.example.com:8080"
+// or wildcard "*.example.com" that matches subdomains. A pattern without port matches any port.
+func matchHost(pattern string, u *url.URL) bool {
+	host := u.Hostname()
+	if strings.Contains(pattern, ":") {
+		host = u.Host
+	}
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
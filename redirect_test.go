@@ -0,0 +1,188 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_safeLandingURL(t *testing.T) {
+	c := &Config{
+		Host:                 "https://example.com",
+		DefaultLandingPage:   "/home",
+		AllowedRedirectHosts: []string{"app.example.net", "*.example.org", "admin.example.jp:8443"},
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "empty",
+			src:  "",
+			want: "/home",
+		},
+		{
+			name: "path",
+			src:  "/dashboard?tab=1#top",
+			want: "/dashboard?tab=1#top",
+		},
+		{
+			name: "relative path",
+			src:  "dashboard",
+			want: "/home",
+		},
+		{
+			name: "protocol relative URL",
+			src:  "//evil.example.com/",
+			want: "/home",
+		},
+		{
+			name: "backslash",
+			src:  "/\\evil.example.com/",
+			want: "/home",
+		},
+		{
+			name: "control character",
+			src:  "/\t/evil.example.com/",
+			want: "/home",
+		},
+		{
+			name: "javascript",
+			src:  "javascript:alert(1)",
+			want: "/home",
+		},
+		{
+			name: "same host",
+			src:  "https://example.com/dashboard",
+			want: "https://example.com/dashboard",
+		},
+		{
+			name: "same host but http",
+			src:  "http://example.com/dashboard",
+			want: "/home",
+		},
+		{
+			name: "userinfo",
+			src:  "https://example.com@evil.example.com/",
+			want: "/home",
+		},
+		{
+			name: "allowed host",
+			src:  "https://app.example.net/",
+			want: "https://app.example.net/",
+		},
+		{
+			name: "allowed wildcard",
+			src:  "https://a.b.example.org/",
+			want: "https://a.b.example.org/",
+		},
+		{
+			name: "wildcard doesn't match parent domain",
+			src:  "https://example.org/",
+			want: "/home",
+		},
+		{
+			name: "suffix is not a subdomain",
+			src:  "https://evilexample.org/",
+			want: "/home",
+		},
+		{
+			name: "allowed host and port",
+			src:  "https://admin.example.jp:8443/",
+			want: "https://admin.example.jp:8443/",
+		},
+		{
+			name: "allowed host and other port",
+			src:  "https://admin.example.jp/",
+			want: "/home",
+		},
+		{
+			name: "unknown host",
+			src:  "https://evil.example.com/",
+			want: "/home",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, safeLandingURL(c, tt.src))
+		})
+	}
+}
+
+func TestLoginReturnTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		returnTo string
+		want     string
+	}{
+		{
+			name:     "path",
+			returnTo: "/dashboard",
+			want:     "/dashboard",
+		},
+		{
+			name:     "allowed host",
+			returnTo: "https://app.example.net/",
+			want:     "https://app.example.net/",
+		},
+		{
+			name:     "open redirect",
+			returnTo: "https://evil.example.com/",
+			want:     "/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, c, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+			c.AllowedRedirectHosts = []string{"app.example.net"}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/.wru/login?return_to="+url.QueryEscape(tt.returnTo), nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			var sid, token string
+			for _, ck := range w.Result().Cookies() {
+				switch ck.Name {
+				case c.ClientSessionKey:
+					sid = ck.Value
+				case csrfCookieName(c):
+					token = ck.Value
+				}
+			}
+			assert.NotEmpty(t, sid)
+
+			w = httptest.NewRecorder()
+			h.ServeHTTP(w, postForm(c, "/.wru/login", sid, token, url.Values{"userid": {"user1"}, CSRFTokenField: {token}}, ""))
+			assert.Equal(t, http.StatusFound, w.Code)
+			assert.Equal(t, tt.want, w.Header().Get("Location"))
+		})
+	}
+}
+
+func TestLandingURLFromRequest(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	// request line like "GET //evil.example.com HTTP/1.1"
+	sid, err := s.StartLogin(context.Background(), map[string]string{"landingURL": "//evil.example.com"})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, postForm(c, "/.wru/login", sid, "token", url.Values{"userid": {"user1"}, CSRFTokenField: {"token"}}, ""))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/", w.Header().Get("Location"))
+}
+
+func TestMustNotLoginReturnTo(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	r := httptest.NewRequest("GET", "/.wru/login?return_to=%2Fdashboard", nil)
+	r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: sid})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+}
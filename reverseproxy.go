@@ -1,44 +1,75 @@
 package wru
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/http/httputil"
+	"strconv"
 	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ProxyTransport struct {
-	c *Config
-	s SessionStorage
+	c          *Config
+	s          SessionStorage
+	transports []http.RoundTripper
 }
 
 func (p ProxyTransport) RoundTrip(req *http.Request) (res *http.Response, err error) {
-	found := false
-	for _, f := range p.c.ForwardTo {
-		if strings.HasPrefix(req.URL.Path, f.Path) {
-			req.URL.Host = f.Host.Host
-			req.URL.Scheme = f.Host.Scheme
-			found = true
-			break
-		}
-	}
-	if !found {
+	i, f := findRoute(p.c, req.URL.Path)
+	if f == nil {
 		r := httptest.NewRecorder()
 		r.WriteHeader(http.StatusNotFound)
 		r.WriteString(`{"status": "not found"}`)
 		return r.Result(), nil
 	}
+	req.URL.Host = f.Host.Host
+	req.URL.Scheme = f.Host.Scheme
+	transport := p.transports[i]
+	route := f.Path
+	if e := accessLogFromContext(req.Context()); e != nil {
+		e.route = f.Path
+		e.upstream = f.Host.String()
+	}
 	sid, ses := GetSession(req)
-	if ses != nil {
-		sjson, _ := json.Marshal(ses)
-		req.Header.Set(p.c.ServerSessionField, string(sjson))
+	if r := httptest.NewRecorder(); !checkRouteScopes(p.c, r, req, f, ses) {
+		return r.Result(), nil
 	}
-	res, err = http.DefaultTransport.RoundTrip(req)
+	if !f.Policy.empty() {
+		r := httptest.NewRecorder()
+		if !checkAccessPolicy(p.c, r, req, nil, f.Policy) {
+			return r.Result(), nil
+		}
+	}
+	setIdentityHeaders(p.c, req.Header, ses)
+	ctx, span := tracer().Start(req.Context(), "proxy "+route,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPClientAttributesFromHTTPRequest(req)...),
+	)
+	defer span.End()
+	req = req.WithContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	start := time.Now()
+	res, err = transport.RoundTrip(req)
 	if err != nil {
-		log.Println(err)
+		upstreamDuration.WithLabelValues(route, "error").Observe(time.Since(start).Seconds())
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
 	}
+	upstreamDuration.WithLabelValues(route, strconv.Itoa(res.StatusCode)).Observe(time.Since(start).Seconds())
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(res.StatusCode))
+	span.SetStatus(semconv.SpanStatusFromHTTPStatusCode(res.StatusCode))
 	if p.s != nil {
 		var directives []*Directive
 		for _, src := range res.Header.Values("Wru-Set-Session-Data") {
@@ -48,20 +79,170 @@ func (p ProxyTransport) RoundTrip(req *http.Request) (res *http.Response, err er
 			}
 			directives = append(directives, d)
 		}
-		p.s.UpdateSessionData(req.Context(), sid, directives)
+		// sessions authorized by access tokens don't have session data
+		if sid != "" {
+			p.s.UpdateSessionData(req.Context(), sid, directives)
+		}
 		res.Header.Del("Wru-Set-Session-Data")
 	}
+	injectProxyResponseHeaders(p.c, res.Header)
 	return res, nil
 }
 
+// findRoute returns the first route of Config.ForwardTo that matches the path and its index
+func findRoute(c *Config, path string) (int, *Route) {
+	for i, f := range c.ForwardTo {
+		if strings.HasPrefix(path, f.Path) {
+			return i, &c.ForwardTo[i]
+		}
+	}
+	return -1, nil
+}
+
+// checkRouteScopes returns false and writes 403 response if the session doesn't have any scopes that the route requires
+func checkRouteScopes(c *Config, w http.ResponseWriter, r *http.Request, route *Route, ses *Session) bool {
+	if hasAnyScope(ses, route.Scopes) {
+		return true
+	}
+	var userID string
+	if ses != nil {
+		userID = ses.UserID
+	}
+	c.audit(r, &AuditEvent{Type: AuditScopeDenied, UserID: userID, Detail: map[string]string{"route": route.Path, "required": strings.Join(route.Scopes, ",")}})
+	writeErrorPage(w, r, http.StatusForbidden, "You don't have permission to access this page.")
+	return false
+}
+
+// routeMiddleware checks scopes and access policies of Config.ForwardTo in middleware mode. ProxyTransport checks them in proxy mode.
+func routeMiddleware(c *Config, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, route := findRoute(c, r.URL.Path); route != nil {
+			_, ses := GetSession(r)
+			if !checkRouteScopes(c, w, r, route, ses) {
+				return
+			}
+			if !route.Policy.empty() && !checkAccessPolicy(c, w, r, nil, route.Policy) {
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// hasAnyScope returns true if the route doesn't require scopes or the session has at least one of them
+func hasAnyScope(ses *Session, scopes []string) bool {
+	if len(scopes) == 0 {
+		return true
+	}
+	if ses == nil {
+		return false
+	}
+	for _, required := range scopes {
+		for _, s := range ses.Scopes {
+			if s == required {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// setIdentityHeaders removes client supplied copies of session fields and then adds trusted ones
+func setIdentityHeaders(c *Config, h http.Header, ses *Session) {
+	ih := c.IdentityHeaders
+	if c.ClientSessionFieldCookie.isHeader() {
+		// session ID should not be sent to backend servers
+		h.Del(c.ClientSessionKey)
+	}
+	for _, f := range []string{c.ServerSessionField, ih.User, ih.Email, ih.Organization, ih.Scopes} {
+		if f != "" {
+			h.Del(f)
+		}
+	}
+	if ses == nil {
+		return
+	}
+	if ses.Token != nil || ses.Kind == ServiceAccount {
+		// access tokens and credentials of service accounts should not be sent to backend servers
+		h.Del("Authorization")
+	}
+	if c.ServerSessionField != "" {
+		sjson, _ := json.Marshal(ses)
+		h.Set(c.ServerSessionField, string(sjson))
+	}
+	if ih.Enabled {
+		setIfNotEmpty(h, ih.User, ses.UserID)
+		setIfNotEmpty(h, ih.Email, ses.Email)
+		setIfNotEmpty(h, ih.Organization, ses.Organization)
+		setIfNotEmpty(h, ih.Scopes, strings.Join(ses.Scopes, ","))
+	}
+}
+
+func setIfNotEmpty(h http.Header, key, value string) {
+	if key != "" && value != "" {
+		h.Set(key, value)
+	}
+}
+
+type errorPageContext struct {
+	Status  int
+	Title   string
+	Message string
+}
+
+func proxyErrorHandler(c *Config) func(w http.ResponseWriter, r *http.Request, err error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		c.logger().Error("upstream error", "url", r.URL.String(), "error", err)
+		writeProxyError(w, r, err)
+	}
+}
+
+func writeProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusBadGateway
+	message := "The upstream server is not available now."
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+		message = "The upstream server didn't respond in time."
+	}
+	writeErrorPage(w, r, status, message)
+}
+
+func writeErrorPage(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isHTML(r) && pages != nil && pages.Lookup(ErrorPageTemplate) != nil {
+		executeTemplate(w, r, status, ErrorPageTemplate, &errorPageContext{
+			Status:  status,
+			Title:   http.StatusText(status),
+			Message: message,
+		})
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": message,
+		})
+	}
+}
+
 func NewReverseProxy(config *Config, s SessionStorage) (http.Handler, error) {
+	transports := make([]http.RoundTripper, len(config.ForwardTo))
+	for i, r := range config.ForwardTo {
+		t, err := r.Transport.merge(config.Upstream).newTransport()
+		if err != nil {
+			return nil, err
+		}
+		transports[i] = t
+	}
 	rp := &httputil.ReverseProxy{
 		Director: func(req *http.Request) {
 		},
 		Transport: &ProxyTransport{
-			c: config,
-			s: s,
+			c:          config,
+			s:          s,
+			transports: transports,
 		},
+		ErrorHandler: proxyErrorHandler(config),
 	}
 	return rp, nil
 }
@@ -1,11 +1,18 @@
 package wru
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func init() {
@@ -88,3 +95,208 @@ func TestNewProxy(t *testing.T) {
 		})
 	}
 }
+
+func TestProxyUpstreamError(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	closed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	closed.Close()
+
+	p, err := NewReverseProxy(&Config{
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(slow.URL),
+				Path: "/slow/",
+				Transport: &UpstreamTransport{
+					ResponseHeaderTimeout: 50 * time.Millisecond,
+				},
+			},
+			{
+				Host: mustParseUrl(closed.URL),
+				Path: "/closed/",
+			},
+		},
+	}, nil)
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+	proxy := httptest.NewServer(p)
+	defer proxy.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{
+			name:       "timeout",
+			path:       "/slow/test",
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "connection refused",
+			path:       "/closed/test",
+			wantStatus: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Get(proxy.URL + tt.path)
+			assert.NoError(t, err)
+			if err != nil {
+				return
+			}
+			assert.Equal(t, tt.wantStatus, res.StatusCode)
+		})
+	}
+}
+
+func TestProxyIdentityHeaders(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer server.Close()
+
+	c := &Config{
+		ServerSessionField: "Wru-Session",
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(server.URL),
+				Path: "/",
+			},
+		},
+	}
+	c.IdentityHeaders.setDefaults()
+	p, err := NewReverseProxy(c, nil)
+	assert.NoError(t, err)
+	if err != nil {
+		return
+	}
+
+	type args struct {
+		enabled bool
+		ses     *Session
+	}
+	tests := []struct {
+		name       string
+		args       args
+		wantHeader map[string]string
+	}{
+		{
+			name: "strip forged headers without session",
+			args: args{
+				enabled: true,
+			},
+			wantHeader: map[string]string{
+				"Wru-Session":  "",
+				"X-Wru-User":   "",
+				"X-Wru-Scopes": "",
+			},
+		},
+		{
+			name: "only session field",
+			args: args{
+				ses: &Session{UserID: "user1", Scopes: []string{"admin", "user"}},
+			},
+			wantHeader: map[string]string{
+				"X-Wru-User":   "",
+				"X-Wru-Scopes": "",
+			},
+		},
+		{
+			name: "identity headers",
+			args: args{
+				enabled: true,
+				ses:     &Session{UserID: "user1", Email: "user1@example.com", Scopes: []string{"admin", "user"}},
+			},
+			wantHeader: map[string]string{
+				"X-Wru-User":   "user1",
+				"X-Wru-Email":  "user1@example.com",
+				"X-Wru-Org":    "",
+				"X-Wru-Scopes": "admin,user",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.IdentityHeaders.Enabled = tt.args.enabled
+			r := httptest.NewRequest("GET", "/test", nil)
+			r.Header.Set("Wru-Session", `{"id":"admin","scopes":["admin"]}`)
+			r.Header.Set("X-Wru-User", "admin")
+			r.Header.Set("X-Wru-Scopes", "admin")
+			if tt.args.ses != nil {
+				r = setSessionInfo(r, "sid", tt.args.ses)
+			}
+			p.ServeHTTP(httptest.NewRecorder(), r)
+			for k, v := range tt.wantHeader {
+				assert.Equal(t, v, got.Get(k), k)
+			}
+			if tt.args.ses != nil {
+				assert.Contains(t, got.Get("Wru-Session"), `"id":"user1"`)
+			}
+		})
+	}
+}
+
+func TestProxyUpgrade(t *testing.T) {
+	// echo server over the upgraded connection like WebSocket
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		line, _ := brw.ReadString('\n')
+		brw.WriteString(line)
+		brw.Flush()
+	}))
+	defer server.Close()
+
+	c := &Config{
+		Host:            "https://example.com",
+		DevMode:         true,
+		AccessLog:       AccessLogCombined,
+		AccessLogOutput: io.Discard,
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(server.URL),
+				Path: "/",
+			},
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewSessionStorage(context.Background(), c, nil)
+	assert.NoError(t, err)
+	ir, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{"WRU_USER_1=id:user1,name:user1,scope:user"}, nil)
+	h, err := NewIdentityAwareProxyHandler(c, s, ir)
+	assert.NoError(t, err)
+	user, _ := ir.FindUserByID("user1")
+	sid := startSession(t, context.Background(), s, user, "debug")
+	proxy := httptest.NewServer(h)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /echo HTTP/1.1\r\nHost: %s\r\nCookie: %s=%s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", proxy.Listener.Addr().String(), c.ClientSessionKey, sid)
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	}
+	io.WriteString(conn, "hello\n")
+	line, err := br.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+}
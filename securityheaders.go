@@ -0,0 +1,149 @@
+package wru
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityHeaders configures response header fields that protect wru pages
+type SecurityHeaders struct {
+	// HSTSMaxAge is max-age of Strict-Transport-Security. It is sent only when Config.Host is https. 0 disables it.
+	HSTSMaxAge time.Duration
+	// FrameOptions is "DENY" (default) or "SAMEORIGIN". It is also used for frame-ancestors of Content-Security-Policy.
+	FrameOptions string
+	// ReferrerPolicy of wru pages (default is "same-origin")
+	ReferrerPolicy string
+	// ProxyResponseHeaders are added to the responses from backend servers if backends don't set them
+	ProxyResponseHeaders http.Header
+}
+
+func (s *SecurityHeaders) setDefaults() {
+	if s.FrameOptions == "" {
+		s.FrameOptions = "DENY"
+	}
+	if s.ReferrerPolicy == "" {
+		s.ReferrerPolicy = "same-origin"
+	}
+}
+
+func (s SecurityHeaders) validate() error {
+	switch s.FrameOptions {
+	case "DENY", "SAMEORIGIN":
+		return nil
+	default:
+		return fmt.Errorf("invalid frame options: %s (DENY or SAMEORIGIN is available)", s.FrameOptions)
+	}
+}
+
+func (s SecurityHeaders) frameAncestors() string {
+	if s.FrameOptions == "SAMEORIGIN" {
+		return "'self'"
+	}
+	return "'none'"
+}
+
+// parseHeaderList parses header fields separated by "|" like "X-Content-Type-Options: nosniff | Permissions-Policy: camera=()"
+func parseHeaderList(src string) (http.Header, error) {
+	result := make(http.Header)
+	for _, field := range splitList(src, "|") {
+		kv := strings.SplitN(field, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid header field: %s", field)
+		}
+		result.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
+
+func joinHeaders(h http.Header) string {
+	var result []string
+	for k, values := range h {
+		for _, v := range values {
+			result = append(result, k+": "+v)
+		}
+	}
+	return strings.Join(result, " | ")
+}
+
+type contextPageKey string
+
+const pageSecurityKey contextPageKey = "pageSecurity"
+
+// pageSecurity keeps CSP nonce of the request. The nonce is generated when the first page is rendered.
+type pageSecurity struct {
+	nonce          string
+	frameAncestors string
+}
+
+func (p *pageSecurity) cspNonce() string {
+	if p.nonce == "" {
+		b := make([]byte, 16)
+		rand.Read(b)
+		p.nonce = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return p.nonce
+}
+
+func (p *pageSecurity) contentSecurityPolicy() string {
+	nonce := p.cspNonce()
+	return "default-src 'none'; script-src 'nonce-" + nonce + "'; style-src 'nonce-" + nonce + "'; img-src 'self' data:; connect-src 'self'; form-action 'self'; base-uri 'none'; frame-ancestors " + p.frameAncestors
+}
+
+func pageSecurityFromContext(ctx context.Context) *pageSecurity {
+	if p, ok := ctx.Value(pageSecurityKey).(*pageSecurity); ok {
+		return p
+	}
+	return &pageSecurity{frameAncestors: "'none'"}
+}
+
+// securityHeadersMiddleware adds Strict-Transport-Security to all responses and prepares CSP nonce for wru pages
+func securityHeadersMiddleware(c *Config, next http.Handler) http.Handler {
+	var hsts string
+	if c.SecurityHeaders.HSTSMaxAge > 0 && strings.HasPrefix(c.Host, "https://") {
+		hsts = "max-age=" + strconv.Itoa(int(c.SecurityHeaders.HSTSMaxAge.Seconds()))
+	}
+	frameAncestors := c.SecurityHeaders.frameAncestors()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		ctx := context.WithValue(r.Context(), pageSecurityKey, &pageSecurity{frameAncestors: frameAncestors})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// wruPageHeaders adds header fields for /.wru/* endpoints. They are never cached and never framed.
+func wruPageHeaders(c *Config) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("Cache-Control", "no-store")
+			h.Set("Pragma", "no-cache")
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", c.SecurityHeaders.FrameOptions)
+			h.Set("Referrer-Policy", c.SecurityHeaders.ReferrerPolicy)
+			h.Set("Content-Security-Policy", "default-src 'none'; frame-ancestors "+c.SecurityHeaders.frameAncestors())
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// injectProxyResponseHeaders adds Config.SecurityHeaders.ProxyResponseHeaders that backend servers don't set
+func injectProxyResponseHeaders(c *Config, h http.Header) {
+	for k, v := range c.SecurityHeaders.ProxyResponseHeaders {
+		k = textproto.CanonicalMIMEHeaderKey(k)
+		if _, ok := h[k]; !ok {
+			h[k] = append([]string(nil), v...)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseHeaderList(t *testing.T) {
+	got, err := parseHeaderList("X-Content-Type-Options: nosniff | content-security-policy: default-src 'self'; img-src *")
+	assert.NoError(t, err)
+	assert.Equal(t, http.Header{
+		"X-Content-Type-Options":  {"nosniff"},
+		"Content-Security-Policy": {"default-src 'self'; img-src *"},
+	}, got)
+
+	got, err = parseHeaderList("")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	_, err = parseHeaderList("nosniff")
+	assert.Error(t, err)
+}
+
+func TestSecurityHeaders_validate(t *testing.T) {
+	c := &Config{SecurityHeaders: SecurityHeaders{FrameOptions: "ALLOW-FROM https://example.com"}}
+	assert.Error(t, c.Init(context.Background(), nil))
+}
+
+func TestWruPageSecurityHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		wantHSTS string
+	}{
+		{
+			name:     "https",
+			host:     "https://example.com",
+			wantHSTS: "max-age=31536000",
+		},
+		{
+			name:     "http",
+			host:     "http://localhost:3000",
+			wantHSTS: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, c, _, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), func(c *Config) {
+				c.Host = tt.host
+				c.SecurityHeaders.HSTSMaxAge = 365 * 24 * time.Hour
+			})
+			h = securityHeadersMiddleware(c, h)
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/.wru/login", nil)
+			r.Header.Set("Accept", "text/html")
+			h.ServeHTTP(w, r)
+
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tt.wantHSTS, w.Header().Get("Strict-Transport-Security"))
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"))
+			assert.Equal(t, "same-origin", w.Header().Get("Referrer-Policy"))
+			assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+
+			csp := w.Header().Get("Content-Security-Policy")
+			assert.Contains(t, csp, "frame-ancestors 'none'")
+			match := regexp.MustCompile(`script-src 'nonce-([^']+)'`).FindStringSubmatch(csp)
+			if assert.Len(t, match, 2) {
+				assert.Contains(t, w.Body.String(), `<style nonce="`+match[1]+`">`)
+			}
+		})
+	}
+}
+
+func TestCSPNonceIsUniquePerRequest(t *testing.T) {
+	c := &Config{}
+	c.SecurityHeaders.setDefaults()
+	var nonces []string
+	h := securityHeadersMiddleware(c, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, pageSecurityFromContext(r.Context()).cspNonce())
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), dummyRequest())
+	h.ServeHTTP(httptest.NewRecorder(), dummyRequest())
+	assert.Len(t, nonces, 2)
+	assert.NotEqual(t, nonces[0], nonces[1])
+}
+
+func TestProxyResponseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+	}))
+	defer backend.Close()
+
+	routes, err := parseForwardList("/ => " + backend.URL)
+	assert.NoError(t, err)
+	headers, err := parseHeaderList("X-Frame-Options: DENY | X-Content-Type-Options: nosniff")
+	assert.NoError(t, err)
+	p, err := NewReverseProxy(&Config{ForwardTo: routes, SecurityHeaders: SecurityHeaders{ProxyResponseHeaders: headers}}, nil)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	// backend's header is kept
+	assert.Equal(t, "SAMEORIGIN", w.Header().Get("X-Frame-Options"))
+	assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"))
+}
@@ -5,12 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"github.com/future-architect/gocloudurls"
-	"github.com/mssola/user_agent"
 	"github.com/shibukawa/uuid62"
 	"gocloud.dev/docstore"
 	"gocloud.dev/gcerrors"
 	"io"
 	"net/http"
+	"time"
 )
 
 type ServerlessSessionStorage struct {
@@ -19,6 +19,10 @@ type ServerlessSessionStorage struct {
 
 	singleSessions *docstore.Collection
 	userSessions   *docstore.Collection
+	accessTokens   *docstore.Collection
+	loginCodes     *docstore.Collection
+	mfa            *docstore.Collection
+	passkeys       *docstore.Collection
 }
 
 func NewMemorySessionStorage(ctx context.Context, config *Config, prefix string) (*ServerlessSessionStorage, error) {
@@ -38,11 +42,47 @@ func NewMemorySessionStorage(ctx context.Context, config *Config, prefix string)
 	if err != nil {
 		return nil, err
 	}
+	tokensUrl := gocloudurls.MustNormalizeDocStoreURL("mem://", gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "accessTokens",
+	})
+	tokens, err := docstore.OpenCollection(ctx, tokensUrl)
+	if err != nil {
+		return nil, err
+	}
+	codesUrl := gocloudurls.MustNormalizeDocStoreURL("mem://", gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "loginCodes",
+	})
+	codes, err := docstore.OpenCollection(ctx, codesUrl)
+	if err != nil {
+		return nil, err
+	}
+	mfaUrl := gocloudurls.MustNormalizeDocStoreURL("mem://", gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "mfa",
+	})
+	mfa, err := docstore.OpenCollection(ctx, mfaUrl)
+	if err != nil {
+		return nil, err
+	}
+	passkeysUrl := gocloudurls.MustNormalizeDocStoreURL("mem://", gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "passkeys",
+	})
+	passkeys, err := docstore.OpenCollection(ctx, passkeysUrl)
+	if err != nil {
+		return nil, err
+	}
 	return &ServerlessSessionStorage{
 		ctx:            ctx,
 		config:         config,
 		singleSessions: sessions,
 		userSessions:   users,
+		accessTokens:   tokens,
+		loginCodes:     codes,
+		mfa:            mfa,
+		passkeys:       passkeys,
 	}, nil
 }
 
@@ -69,17 +109,69 @@ func NewServerlessSessionStorage(ctx context.Context, config *Config, prefix str
 	if err != nil {
 		return nil, err
 	}
+	tokensUrl, err := gocloudurls.NormalizeDocStoreURL(config.SessionStorage, gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "accessTokens",
+	})
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := docstore.OpenCollection(ctx, tokensUrl)
+	if err != nil {
+		return nil, err
+	}
+	codesUrl, err := gocloudurls.NormalizeDocStoreURL(config.SessionStorage, gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "loginCodes",
+	})
+	if err != nil {
+		return nil, err
+	}
+	codes, err := docstore.OpenCollection(ctx, codesUrl)
+	if err != nil {
+		return nil, err
+	}
+	mfaUrl, err := gocloudurls.NormalizeDocStoreURL(config.SessionStorage, gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "mfa",
+	})
+	if err != nil {
+		return nil, err
+	}
+	mfa, err := docstore.OpenCollection(ctx, mfaUrl)
+	if err != nil {
+		return nil, err
+	}
+	passkeysUrl, err := gocloudurls.NormalizeDocStoreURL(config.SessionStorage, gocloudurls.Option{
+		KeyName:    "id",
+		Collection: prefix + "passkeys",
+	})
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := docstore.OpenCollection(ctx, passkeysUrl)
+	if err != nil {
+		return nil, err
+	}
 	return &ServerlessSessionStorage{
 		ctx:            ctx,
 		config:         config,
 		singleSessions: sessions,
 		userSessions:   users,
+		accessTokens:   tokens,
+		loginCodes:     codes,
+		mfa:            mfa,
+		passkeys:       passkeys,
 	}, nil
 }
 
 func (s *ServerlessSessionStorage) Close() {
 	s.singleSessions.Close()
 	s.userSessions.Close()
+	s.accessTokens.Close()
+	s.loginCodes.Close()
+	s.mfa.Close()
+	s.passkeys.Close()
 }
 
 func (s ServerlessSessionStorage) StartLogin(ctx context.Context, info map[string]string) (sessionID string, err error) {
@@ -126,6 +218,9 @@ func (s ServerlessSessionStorage) AddLoginInfo(ctx context.Context, oldSessionID
 }
 
 func (s *ServerlessSessionStorage) StartSession(ctx context.Context, oldSessionID string, user *User, r *http.Request, newLoginInfo map[string]string) (sessionID string, info map[string]string, err error) {
+	if user.IsService() {
+		return "", nil, errors.New("service account can't start session")
+	}
 	loginSession := &SingleSessionData{
 		ID: oldSessionID,
 	}
@@ -144,17 +239,7 @@ func (s *ServerlessSessionStorage) StartSession(ctx context.Context, oldSessionI
 		return "", nil, err
 	}
 
-	ua := user_agent.New(r.Header.Get("User-Agent"))
-	browser, version := ua.Browser()
-	country, ip := getGeoLocation(s.config, r)
-	loginInfo := map[string]string{
-		"browser":  browser,
-		"version":  version,
-		"os":       ua.OS(),
-		"platform": ua.Platform(),
-		"country":  country,
-		"ip":       ip,
-	}
+	loginInfo := loginFingerprint(s.config, r)
 	for k, v := range newLoginInfo {
 		loginInfo[k] = v
 	}
@@ -223,6 +308,10 @@ func (s ServerlessSessionStorage) Logout(ctx context.Context, sessionID string)
 	if err != nil {
 		return nil
 	}
+	if sSes.UserID == "" {
+		// login session
+		return s.singleSessions.Delete(ctx, &sSes)
+	}
 	uSes := UserSession{ID: sSes.UserID}
 	err = s.userSessions.Get(ctx, &uSes)
 	if err != nil {
@@ -231,9 +320,10 @@ func (s ServerlessSessionStorage) Logout(ctx context.Context, sessionID string)
 	var sesIDs []string
 	for _, sesID := range uSes.Sessions {
 		if sesID != sessionID {
-			sesIDs = append(sesIDs)
+			sesIDs = append(sesIDs, sesID)
 		}
 	}
+	uSes.Sessions = sesIDs
 	s.userSessions.Replace(ctx, &uSes)
 	return s.singleSessions.Delete(ctx, &sSes)
 }
@@ -259,6 +349,26 @@ func (s *ServerlessSessionStorage) GetUserSessions(ctx context.Context, userID s
 	return result, nil
 }
 
+// CountActiveSessions returns the number of logged in sessions that are not timed out
+func (s *ServerlessSessionStorage) CountActiveSessions(ctx context.Context) (int, error) {
+	now := currentTime(ctx)
+	iter := s.singleSessions.Query().Where("login_at", ">", now.Add(-s.config.SessionAbsoluteTimeoutTerm)).Get(ctx, "user_id", "last_access_at")
+	defer iter.Stop()
+	count := 0
+	for {
+		var sSes SingleSessionData
+		err := iter.Next(ctx, &sSes)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		} else if sSes.UserID != "" && now.Sub(sSes.LastAccessAt) < s.config.SessionIdleTimeoutTerm {
+			count++
+		}
+	}
+	return count, nil
+}
+
 func (s *ServerlessSessionStorage) FindBySessionToken(ctx context.Context, token string) (*Session, error) {
 	sSes, uSes, status, err := s.readSession(ctx, token)
 	if err != nil {
@@ -288,10 +398,76 @@ func (s *ServerlessSessionStorage) FindBySessionToken(ctx context.Context, token
 			Scopes:       uSes.Scopes,
 			Status:       status,
 			Data:         data,
+			loginInfo:    sSes.LoginInfo,
 		}, nil
 	}
 }
 
+// loginCodeID returns the key of the login code. The kind prevents codes from being used in other flows.
+func loginCodeID(kind, code string) string {
+	return hashAccessToken(kind + ":" + code)
+}
+
+func (s *ServerlessSessionStorage) CreateLoginCode(ctx context.Context, kind, code string, data map[string]string, expireAt time.Time) error {
+	return s.loginCodes.Create(ctx, &LoginCodeData{
+		ID:       loginCodeID(kind, code),
+		ExpireAt: expireAt,
+		Data:     data,
+	})
+}
+
+func (s *ServerlessSessionStorage) readLoginCode(ctx context.Context, kind, code string) (*LoginCodeData, error) {
+	lc := LoginCodeData{ID: loginCodeID(kind, code)}
+	err := s.loginCodes.Get(ctx, &lc)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, ErrInvalidSessionToken
+		}
+		return nil, err
+	}
+	if !currentTime(ctx).Before(lc.ExpireAt) {
+		s.loginCodes.Delete(ctx, &LoginCodeData{ID: lc.ID})
+		return nil, ErrInvalidSessionToken
+	}
+	if lc.Data == nil {
+		lc.Data = make(map[string]string)
+	}
+	return &lc, nil
+}
+
+func (s *ServerlessSessionStorage) FindLoginCode(ctx context.Context, kind, code string) (map[string]string, error) {
+	lc, err := s.readLoginCode(ctx, kind, code)
+	if err != nil {
+		return nil, err
+	}
+	return lc.Data, nil
+}
+
+func (s *ServerlessSessionStorage) UpdateLoginCode(ctx context.Context, kind, code string, data map[string]string) error {
+	lc, err := s.readLoginCode(ctx, kind, code)
+	if err != nil {
+		return err
+	}
+	lc.Data = data
+	return s.loginCodes.Replace(ctx, lc)
+}
+
+func (s *ServerlessSessionStorage) ConsumeLoginCode(ctx context.Context, kind, code string) (map[string]string, error) {
+	lc, err := s.readLoginCode(ctx, kind, code)
+	if err != nil {
+		return nil, err
+	}
+	// the revision check fails if other request consumed or updated it after Get
+	err = s.loginCodes.Delete(ctx, lc)
+	if err != nil {
+		if c := gcerrors.Code(err); c == gcerrors.NotFound || c == gcerrors.FailedPrecondition {
+			return nil, ErrInvalidSessionToken
+		}
+		return nil, err
+	}
+	return lc.Data, nil
+}
+
 func (s *ServerlessSessionStorage) readSession(ctx context.Context, token string) (*SingleSessionData, *UserSession, SessionStatus, error) {
 	sSes := SingleSessionData{ID: token}
 	err := s.singleSessions.Get(ctx, &sSes)
@@ -0,0 +1,253 @@
+package wru
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// UserKind distinguishes humans that login via ID providers from service accounts that call APIs
+type UserKind string
+
+const (
+	HumanUser      UserKind = "human"
+	ServiceAccount UserKind = "service"
+)
+
+// maxAssertionLifetime is the limit of exp claim of JWT assertions. Long-lived assertions are as dangerous as static secrets.
+const maxAssertionLifetime = time.Hour
+
+var (
+	errInvalidServiceCredential = errors.New("invalid service account credential")
+	errAssertionReplayed        = errors.New("jti claim is already used")
+)
+
+func (u User) IsService() bool {
+	return u.Kind == ServiceAccount
+}
+
+// initServiceAccount validates kind and parses the public key to verify JWT assertions
+func (u *User) initServiceAccount() error {
+	switch u.Kind {
+	case "", HumanUser:
+		return nil
+	case ServiceAccount:
+	default:
+		return fmt.Errorf("unknown kind of user %s: %s (human or service is available)", u.UserID, u.Kind)
+	}
+	if u.SecretHash != "" && !validSecretHash(u.SecretHash) {
+		return fmt.Errorf("unknown secret hash format of service account %s (bcrypt or sha256:<hex> is available)", u.UserID)
+	}
+	if u.JWTKey != "" {
+		key, err := parsePublicKey(u.JWTKey)
+		if err != nil {
+			return fmt.Errorf("invalid jwt key of service account %s: %w", u.UserID, err)
+		}
+		u.jwtKey = key
+	}
+	return nil
+}
+
+// parsePublicKey reads PEM content or file path of PKIX public key or certificate
+func parsePublicKey(src string) (crypto.PublicKey, error) {
+	pemBytes, err := readPEM(src)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	if block.Type == "CERTIFICATE" {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func validSecretHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2") || strings.HasPrefix(hash, "sha256:")
+}
+
+// verifySecretHash compares the secret with bcrypt hash or "sha256:<hex>"
+func verifySecretHash(hash, secret string) bool {
+	if hash == "" {
+		return false
+	}
+	if strings.HasPrefix(hash, "sha256:") {
+		h := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(strings.ToLower(hash[7:]))) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(secret)) == nil
+}
+
+func (u User) verifySecret(secret string) bool {
+	return verifySecretHash(u.SecretHash, secret)
+}
+
+// verifyAssertion verifies JWT signed by the service account like RFC 7523.
+// iss and sub should be the ID of the service account and aud should be Config.Host.
+// jti is required to reject replayed assertions.
+func (u User) verifyAssertion(c *Config, token *jwt.JSONWebToken, now time.Time) (*jwt.Claims, error) {
+	if u.jwtKey == nil {
+		return nil, errInvalidServiceCredential
+	}
+	var claims jwt.Claims
+	if err := token.Claims(u.jwtKey, &claims); err != nil {
+		return nil, err
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("exp claim is required")
+	}
+	if claims.ID == "" {
+		return nil, errors.New("jti claim is required")
+	}
+	err := claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:   u.UserID,
+		Subject:  u.UserID,
+		Audience: jwt.Audience{c.Host},
+		Time:     now,
+	}, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Expiry.Time().Sub(now) > maxAssertionLifetime {
+		return nil, fmt.Errorf("exp claim should be within %s", maxAssertionLifetime)
+	}
+	return &claims, nil
+}
+
+// useAssertionID remembers jti of the assertion until it expires (with the leeway of the exp check).
+// It returns errAssertionReplayed if the jti is already used.
+func useAssertionID(ctx context.Context, c *Config, userID, jti string, expireAt time.Time) error {
+	if c.RateLimitStore == nil {
+		return errors.New("no storage to remember jti claims")
+	}
+	now := currentTime(ctx)
+	replayed := false
+	err := c.RateLimitStore.Update(ctx, "jti:"+userID+":"+jti, func(b *RateLimitBucket) {
+		if b.lockedFor(now) > 0 {
+			replayed = true
+			return
+		}
+		b.UpdatedAt = now
+		b.LockedUntil = expireAt.Add(time.Minute)
+	})
+	if err != nil {
+		return err
+	}
+	if replayed {
+		return errAssertionReplayed
+	}
+	return nil
+}
+
+// authenticateServiceAccount checks "Authorization: Basic" with the secret or "Authorization: Bearer" with JWT assertion.
+// It returns nil user and nil error if the request doesn't have credentials of service accounts.
+// Credentials of other users are passed to backend servers as is.
+func authenticateServiceAccount(c *Config, ir *IdentityRegister, r *http.Request) (*User, *Session, error) {
+	now := currentTime(r.Context())
+	if id, secret, ok := r.BasicAuth(); ok {
+		u, err := ir.FindUserByID(id)
+		if err != nil || !u.IsService() {
+			return nil, nil, nil
+		}
+		if !u.verifySecret(secret) {
+			return u, nil, errInvalidServiceCredential
+		}
+		return u, newServiceAccountSession(u, now, now), nil
+	}
+	token := bearerToken(r)
+	if strings.Count(token, ".") != 2 {
+		return nil, nil, nil
+	}
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, nil, nil
+	}
+	var claims jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, nil, nil
+	}
+	u, err := ir.FindUserByID(claims.Subject)
+	if err != nil || !u.IsService() {
+		return nil, nil, nil
+	}
+	verified, err := u.verifyAssertion(c, parsed, now)
+	if err != nil {
+		return u, nil, err
+	}
+	expireAt := verified.Expiry.Time()
+	if err := useAssertionID(r.Context(), c, u.UserID, verified.ID, expireAt); err != nil {
+		return u, nil, err
+	}
+	return u, newServiceAccountSession(u, now, expireAt), nil
+}
+
+func newServiceAccountSession(u *User, now, expireAt time.Time) *Session {
+	return &Session{
+		LoginAt:      UnixTime(now),
+		ExpireAt:     UnixTime(expireAt),
+		LastAccessAt: UnixTime(now),
+		UserID:       u.UserID,
+		DisplayName:  u.DisplayName,
+		Email:        u.Email,
+		Organization: u.Organization,
+		Scopes:       u.Scopes,
+		Status:       ActiveSession,
+		Data:         make(map[string]string),
+		Kind:         ServiceAccount,
+	}
+}
+
+// serveServiceAccount handles the request from service accounts. It returns false if the request doesn't have their credentials.
+// Service accounts don't have sessions. They are authenticated for each request.
+// Failed credentials consume the login rate limits of the client IP address and the account, and count toward the lockout.
+func serveServiceAccount(c *Config, ir *IdentityRegister, rl *loginLimiter, w http.ResponseWriter, r *http.Request, next http.Handler) bool {
+	u, ses, err := authenticateServiceAccount(c, ir, r)
+	if u == nil {
+		return false
+	}
+	ipKey := ipRateLimitKey(clientIP(c, r))
+	userKey := userRateLimitKey(u.UserID)
+	// valid credentials are rejected too while they are limited not to tell attackers whether guesses are right
+	if wait := rl.credentialLimited(r.Context(), ipKey, userKey); wait > 0 {
+		loginCounter.WithLabelValues("service", loginRateLimited).Inc()
+		c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "service", UserID: u.UserID, Reason: loginRateLimited})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeErrorPage(w, r, http.StatusTooManyRequests, "Too many failed attempts. Please try again later.")
+		return true
+	}
+	if err != nil {
+		rl.credentialFailed(r.Context(), ipKey, userKey)
+		c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "service", UserID: u.UserID, Reason: err.Error()})
+		c.logger().Warn("service account authentication error", "user", u.UserID, "error", err)
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wru", error="invalid_token"`)
+		writeErrorPage(w, r, http.StatusUnauthorized, "The credential of the service account is invalid.")
+		return true
+	}
+	rl.succeed(r.Context(), userKey)
+	if !checkAccessPolicy(c, w, r, ses) {
+		return true
+	}
+	setIdentityHeaders(c, r.Header, ses)
+	next.ServeHTTP(w, setSessionInfo(r, "", ses))
+	return true
+}
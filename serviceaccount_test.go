@@ -0,0 +1,409 @@
+package wru
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// sha256 of "secret"
+const testSecretHash = "sha256:2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b"
+
+func TestUser_verifySecret(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+	tests := []struct {
+		name   string
+		hash   string
+		secret string
+		want   bool
+	}{
+		{
+			name:   "sha256",
+			hash:   testSecretHash,
+			secret: "secret",
+			want:   true,
+		},
+		{
+			name:   "sha256: wrong secret",
+			hash:   testSecretHash,
+			secret: "secret2",
+			want:   false,
+		},
+		{
+			name:   "bcrypt",
+			hash:   string(bcryptHash),
+			secret: "secret",
+			want:   true,
+		},
+		{
+			name:   "bcrypt: wrong secret",
+			hash:   string(bcryptHash),
+			secret: "secret2",
+			want:   false,
+		},
+		{
+			name:   "no hash",
+			hash:   "",
+			secret: "",
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := User{UserID: "batch", Kind: ServiceAccount, SecretHash: tt.hash}
+			assert.Equal(t, tt.want, u.verifySecret(tt.secret))
+		})
+	}
+}
+
+func TestUser_initServiceAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    User
+		wantErr bool
+	}{
+		{
+			name: "human",
+			user: User{UserID: "user1"},
+		},
+		{
+			name: "service",
+			user: User{UserID: "batch", Kind: ServiceAccount, SecretHash: testSecretHash},
+		},
+		{
+			name:    "unknown kind",
+			user:    User{UserID: "batch", Kind: "robot"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown hash",
+			user:    User{UserID: "batch", Kind: ServiceAccount, SecretHash: "md5:5ebe2294ecd0e0f08eab7690d2a6ee69"},
+			wantErr: true,
+		},
+		{
+			name:    "key file doesn't exist",
+			user:    User{UserID: "batch", Kind: ServiceAccount, JWTKey: "/not/found.pem"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.user.initServiceAccount()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func writePublicKey(t *testing.T, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "batch.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600))
+	return path
+}
+
+func signAssertion(t *testing.T, key *ecdsa.PrivateKey, claims jwt.Claims) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	assert.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	assert.NoError(t, err)
+	return token
+}
+
+func TestServiceAccountProxy(t *testing.T) {
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Host:   mustParseUrl(backend.URL),
+				Path:   "/admin/",
+				Scopes: []string{"admin"},
+			},
+			{
+				Host:   mustParseUrl(backend.URL),
+				Path:   "/batch/",
+				Scopes: []string{"batch"},
+			},
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewMemorySessionStorage(context.Background(), c, "")
+	assert.NoError(t, err)
+	ir, warnings, _ := NewIdentityRegisterFromEnv(context.Background(), []string{
+		"WRU_USER_1=id:user1,name:user1,scope:batch,secret:" + testSecretHash,
+		"WRU_USER_2=id:batch,name:batch job,kind:service,scope:batch,secret:" + testSecretHash + ",jwt-key:" + writePublicKey(t, key),
+	}, nil)
+	assert.Empty(t, warnings)
+	h, err := NewIdentityAwareProxyHandler(c, s, ir)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	validClaims := jwt.Claims{
+		Issuer:   "batch",
+		Subject:  "batch",
+		Audience: jwt.Audience{"https://example.com"},
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		ID:       "job-1",
+	}
+	withClaims := func(f func(c *jwt.Claims)) jwt.Claims {
+		c := validClaims
+		c.ID = xid.New().String()
+		f(&c)
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		auth       string
+		wantStatus int
+		wantEvent  []AuditEventType
+	}{
+		{
+			name:       "secret",
+			path:       "/batch/job",
+			auth:       "Basic " + basicAuth("batch", "secret"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "wrong secret",
+			path:       "/batch/job",
+			auth:       "Basic " + basicAuth("batch", "wrong"),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name:       "scope is checked",
+			path:       "/admin/",
+			auth:       "Basic " + basicAuth("batch", "secret"),
+			wantStatus: http.StatusForbidden,
+			wantEvent:  []AuditEventType{AuditScopeDenied},
+		},
+		{
+			name:       "human users can't use secret",
+			path:       "/batch/job",
+			auth:       "Basic " + basicAuth("user1", "secret"),
+			wantStatus: http.StatusFound,
+		},
+		{
+			name:       "jwt assertion",
+			path:       "/batch/job",
+			auth:       "Bearer " + signAssertion(t, key, validClaims),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "jwt assertion: replayed",
+			path:       "/batch/job",
+			auth:       "Bearer " + signAssertion(t, key, validClaims),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name:       "jwt assertion: other jti",
+			path:       "/batch/job",
+			auth:       "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {})),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "jwt assertion: no jti",
+			path: "/batch/job",
+			auth: "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {
+				c.ID = ""
+			})),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name:       "jwt assertion: other key",
+			path:       "/batch/job",
+			auth:       "Bearer " + signAssertion(t, otherKey, validClaims),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name: "jwt assertion: wrong audience",
+			path: "/batch/job",
+			auth: "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {
+				c.Audience = jwt.Audience{"https://evil.example.com"}
+			})),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name: "jwt assertion: expired",
+			path: "/batch/job",
+			auth: "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {
+				c.Expiry = jwt.NewNumericDate(now.Add(-5 * time.Minute))
+			})),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name: "jwt assertion: too long lifetime",
+			path: "/batch/job",
+			auth: "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {
+				c.Expiry = jwt.NewNumericDate(now.Add(24 * time.Hour))
+			})),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+		{
+			name: "jwt assertion: issuer is other account",
+			path: "/batch/job",
+			auth: "Bearer " + signAssertion(t, key, withClaims(func(c *jwt.Claims) {
+				c.Issuer = "user1"
+			})),
+			wantStatus: http.StatusUnauthorized,
+			wantEvent:  []AuditEventType{AuditLoginFailure},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sink.events = nil
+			got = nil
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.Header.Set("Accept", "application/json")
+			r.Header.Set("Authorization", tt.auth)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			assert.Equal(t, tt.wantStatus, w.Code)
+			assert.Equal(t, tt.wantEvent, sink.types())
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			assert.Empty(t, got.Get("Authorization"))
+			var ses map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(got.Get("Wru-Session")), &ses))
+			assert.Equal(t, "batch", ses["id"])
+			assert.Equal(t, "service", ses["kind"])
+		})
+	}
+	// service accounts don't have sessions
+	sessions, err := s.GetUserSessions(context.Background(), "batch")
+	assert.NoError(t, err)
+	assert.Empty(t, sessions)
+}
+
+func TestServiceAccountRateLimit(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(backend.URL),
+				Path: "/",
+			},
+		},
+		LoginRateLimit: LoginRateLimit{
+			PerIP:            RateLimit{Count: 2, Per: time.Minute},
+			PerUser:          RateLimit{Count: 100, Per: time.Minute},
+			LockoutThreshold: 3,
+			LockoutDuration:  time.Minute,
+		},
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewMemorySessionStorage(context.Background(), c, "")
+	assert.NoError(t, err)
+	ir, _, _ := NewIdentityRegisterFromEnv(context.Background(), []string{
+		"WRU_USER_1=id:batch,name:batch job,kind:service,secret:" + testSecretHash,
+	}, nil)
+	h, err := NewIdentityAwareProxyHandler(c, s, ir)
+	assert.NoError(t, err)
+
+	call := func(secret, ip string) int {
+		r := httptest.NewRequest("GET", "/job", nil)
+		r.RemoteAddr = ip + ":12345"
+		r.Header.Set("Accept", "application/json")
+		r.Header.Set("Authorization", "Basic "+basicAuth("batch", secret))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	// successful requests don't consume rate limits
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, http.StatusOK, call("secret", "192.0.2.1"))
+	}
+
+	// failures consume the limit of the IP address
+	assert.Equal(t, http.StatusUnauthorized, call("wrong", "192.0.2.1"))
+	assert.Equal(t, http.StatusUnauthorized, call("wrong", "192.0.2.1"))
+	assert.Equal(t, http.StatusTooManyRequests, call("secret", "192.0.2.1"))
+
+	// the account is locked out from other IP addresses after the third failure
+	assert.Equal(t, http.StatusUnauthorized, call("wrong", "192.0.2.2"))
+	assert.Equal(t, http.StatusTooManyRequests, call("secret", "192.0.2.3"))
+	assert.Equal(t, loginRateLimited, sink.events[len(sink.events)-1].Reason)
+}
+
+func basicAuth(id, secret string) string {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth(id, secret)
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Basic ")
+}
+
+func TestServiceAccountCannotLogin(t *testing.T) {
+	ir := newTestRegister(t,
+		"WRU_USER_1=id:user1,name:user1",
+		"WRU_USER_2=id:batch,name:batch job,kind:service,secret:"+testSecretHash,
+	)
+	h, c, s, _ := newTestHandler(t, ir)
+
+	// not in login list
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/.wru/login", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "user1")
+	assert.NotContains(t, w.Body.String(), "batch job")
+
+	w = debugLogin(t, context.Background(), h, c, s, "batch")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	batch, _ := ir.FindUserByID("batch")
+	_, _, err := s.StartSession(context.Background(), startLogin(t, context.Background(), s), batch, dummyRequest(), nil)
+	assert.Error(t, err)
+}
@@ -1,19 +1,23 @@
 package wru
 
 import (
-	"log"
 	"net/http"
 )
 
 func startSessionAndRedirect(c *Config, s SessionStorage, w http.ResponseWriter, r *http.Request) {
+	if c.ClientSessionFieldCookie.isHeader() && !isHTML(r) {
+		writeUnauthorized(c, w)
+		return
+	}
 	sessionID, err := s.StartLogin(r.Context(), map[string]string{
 		"landingURL": r.RequestURI,
 	})
-	log.Printf("🥚 start login: %s %s\n", sessionID, r.RequestURI)
 	if err != nil {
+		c.logger().Error("start login error", "error", err)
 		http.Error(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	c.logger().Debug("start login", "session", hashSessionID(sessionID), "url", r.RequestURI)
 	setSessionID(r.Context(), w, sessionID, c, BeforeLogin)
 	http.Redirect(w, r, "/.wru/login", http.StatusFound)
 	return
@@ -21,11 +25,12 @@ func startSessionAndRedirect(c *Config, s SessionStorage, w http.ResponseWriter,
 
 func lookupSessionFromRequest(c *Config, s SessionStorage, r *http.Request) (string, *Session, bool) {
 	var sessionID string
-	for _, ck := range r.Cookies() {
-		if ck.Name == c.ClientSessionKey {
-			sessionID = ck.Value
-			break
-		}
+	if c.ClientSessionFieldCookie.isHeader() {
+		sessionID = sessionIDFromHeader(c, r)
+	}
+	if sessionID == "" {
+		// login sessions are always in cookie
+		sessionID = sessionIDFromCookie(c, r)
 	}
 	if sessionID != "" {
 		ses, err := s.FindBySessionToken(r.Context(), sessionID)
@@ -0,0 +1,170 @@
+package wru
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mssola/user_agent"
+)
+
+// SessionBindingAction is a reaction when a session is used from different client
+type SessionBindingAction string
+
+const (
+	// BindingLog only writes log and audit event
+	BindingLog SessionBindingAction = "log"
+	// BindingReauth rejects the request and requires login. The session is still available from the original client.
+	BindingReauth SessionBindingAction = "reauth"
+	// BindingRevoke logs out the session
+	BindingRevoke SessionBindingAction = "revoke"
+)
+
+// SessionBinding binds sessions to the client that logs in.
+// Elements are compared with login information that is captured at StartSession.
+type SessionBinding struct {
+	// UserAgent compares browser name and OS
+	UserAgent bool
+	// IPSubnet compares subnet of client IP address. The size of subnet is IPv4Prefix (default 24) or IPv6Prefix (default 64)
+	IPSubnet   bool
+	IPv4Prefix int
+	IPv6Prefix int
+	// Country compares country of client IP address. It requires GeoIP database.
+	Country bool
+	Action  SessionBindingAction
+}
+
+func (b SessionBinding) enabled() bool {
+	return b.UserAgent || b.IPSubnet || b.Country
+}
+
+func (b *SessionBinding) setDefaults() {
+	if b.IPv4Prefix == 0 {
+		b.IPv4Prefix = 24
+	}
+	if b.IPv6Prefix == 0 {
+		b.IPv6Prefix = 64
+	}
+	if b.Action == "" {
+		b.Action = BindingLog
+	}
+}
+
+func (b SessionBinding) String() string {
+	var elements []string
+	if b.UserAgent {
+		elements = append(elements, "ua")
+	}
+	if b.IPSubnet {
+		elements = append(elements, fmt.Sprintf("subnet(/%d, /%d)", b.IPv4Prefix, b.IPv6Prefix))
+	}
+	if b.Country {
+		elements = append(elements, "country")
+	}
+	return strings.Join(elements, ", ") + " => " + string(b.Action)
+}
+
+// parseSessionBinding parses comma separated elements like "ua, subnet, country"
+func parseSessionBinding(src, action string) (SessionBinding, error) {
+	var b SessionBinding
+	for _, e := range splitList(src, ",") {
+		switch e {
+		case "ua":
+			b.UserAgent = true
+		case "subnet":
+			b.IPSubnet = true
+		case "country":
+			b.Country = true
+		default:
+			return b, fmt.Errorf("unknown session binding element: %s", e)
+		}
+	}
+	switch SessionBindingAction(action) {
+	case "", BindingLog, BindingReauth, BindingRevoke:
+		b.Action = SessionBindingAction(action)
+	default:
+		return b, fmt.Errorf("unknown session binding action: %s", action)
+	}
+	return b, nil
+}
+
+// loginFingerprint returns client information that is stored in login info at StartSession
+func loginFingerprint(c *Config, r *http.Request) map[string]string {
+	ua := user_agent.New(r.Header.Get("User-Agent"))
+	browser, version := ua.Browser()
+	country, ip := getGeoLocation(c, r)
+	return map[string]string{
+		"browser":  browser,
+		"version":  version,
+		"os":       ua.OS(),
+		"platform": ua.Platform(),
+		"country":  country,
+		"ip":       ip,
+	}
+}
+
+// mismatchedBindings returns the names of elements that are different from login info
+func mismatchedBindings(c *Config, r *http.Request, loginInfo map[string]string) []string {
+	b := c.SessionBinding
+	current := loginFingerprint(c, r)
+	var result []string
+	if b.UserAgent && (current["browser"] != loginInfo["browser"] || current["os"] != loginInfo["os"]) {
+		result = append(result, "ua")
+	}
+	if b.IPSubnet && !sameSubnet(net.ParseIP(current["ip"]), net.ParseIP(loginInfo["ip"]), b.IPv4Prefix, b.IPv6Prefix) {
+		result = append(result, "subnet")
+	}
+	if b.Country && c.geoIPDB != nil && current["country"] != loginInfo["country"] {
+		result = append(result, "country")
+	}
+	return result
+}
+
+func sameSubnet(a, b net.IP, v4Prefix, v6Prefix int) bool {
+	if a == nil || b == nil {
+		return a.Equal(b)
+	}
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		if a4 == nil || b4 == nil {
+			return false
+		}
+		m := net.CIDRMask(v4Prefix, 32)
+		return a4.Mask(m).Equal(b4.Mask(m))
+	}
+	m := net.CIDRMask(v6Prefix, 128)
+	return a.Mask(m).Equal(b.Mask(m))
+}
+
+// verifySessionBinding checks that the active session is used from the client that logged in.
+// It returns false if the request is rejected and the response is written.
+func verifySessionBinding(c *Config, s SessionStorage, w http.ResponseWriter, r *http.Request, sid string, ses *Session) bool {
+	if !c.SessionBinding.enabled() || ses == nil || ses.Status != ActiveSession || ses.loginInfo == nil {
+		return true
+	}
+	mismatched := mismatchedBindings(c, r, ses.loginInfo)
+	if len(mismatched) == 0 {
+		return true
+	}
+	action := c.SessionBinding.Action
+	c.logger().Warn("session binding mismatch", "user", ses.UserID, "session", hashSessionID(sid), "elements", mismatched, "action", action)
+	c.audit(r, &AuditEvent{Type: AuditSessionMismatch, UserID: ses.UserID, Reason: strings.Join(mismatched, ","), Detail: map[string]string{
+		"session":       hashSessionID(sid),
+		"action":        string(action),
+		"login_ip":      ses.loginInfo["ip"],
+		"login_country": ses.loginInfo["country"],
+		"login_browser": ses.loginInfo["browser"],
+	}})
+	switch action {
+	case BindingReauth:
+		startSessionAndRedirect(c, s, w, r)
+		return false
+	case BindingRevoke:
+		if err := s.Logout(r.Context(), sid); err != nil {
+			c.logger().Error("revoke session error", "session", hashSessionID(sid), "error", err)
+		}
+		startSessionAndRedirect(c, s, w, r)
+		return false
+	}
+	return true
+}
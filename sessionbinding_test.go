@@ -0,0 +1,153 @@
+package wru
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseSessionBinding(t *testing.T) {
+	got, err := parseSessionBinding("ua, subnet", "revoke")
+	assert.NoError(t, err)
+	assert.Equal(t, SessionBinding{UserAgent: true, IPSubnet: true, Action: BindingRevoke}, got)
+
+	_, err = parseSessionBinding("cookie", "")
+	assert.Error(t, err)
+	_, err = parseSessionBinding("ua", "block")
+	assert.Error(t, err)
+}
+
+func Test_sameSubnet(t *testing.T) {
+	tests := []struct {
+		name string
+		a    string
+		b    string
+		want bool
+	}{
+		{
+			name: "same ipv4 subnet",
+			a:    "192.0.2.1",
+			b:    "192.0.2.200",
+			want: true,
+		},
+		{
+			name: "different ipv4 subnet",
+			a:    "192.0.2.1",
+			b:    "198.51.100.1",
+			want: false,
+		},
+		{
+			name: "same ipv6 subnet",
+			a:    "2001:db8::1",
+			b:    "2001:db8::ffff",
+			want: true,
+		},
+		{
+			name: "different ipv6 subnet",
+			a:    "2001:db8::1",
+			b:    "2001:db8:0:1::1",
+			want: false,
+		},
+		{
+			name: "ipv4 and ipv6",
+			a:    "192.0.2.1",
+			b:    "2001:db8::1",
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, sameSubnet(net.ParseIP(tt.a), net.ParseIP(tt.b), 24, 64))
+		})
+	}
+}
+
+func TestVerifySessionBinding(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     SessionBindingAction
+		userAgent  string
+		remoteAddr string
+		wantOK     bool
+		wantActive bool
+		wantReason string
+	}{
+		{
+			name:       "same client",
+			action:     BindingRevoke,
+			remoteAddr: "192.0.2.100:4321",
+			wantOK:     true,
+			wantActive: true,
+		},
+		{
+			name:       "log only",
+			action:     BindingLog,
+			remoteAddr: "198.51.100.1:1234",
+			wantOK:     true,
+			wantActive: true,
+			wantReason: "subnet",
+		},
+		{
+			name:       "reauth",
+			action:     BindingReauth,
+			userAgent:  "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:89.0) Gecko/20100101 Firefox/89.0",
+			remoteAddr: "192.0.2.1:1234",
+			wantOK:     false,
+			wantActive: true,
+			wantReason: "ua",
+		},
+		{
+			name:       "revoke",
+			action:     BindingRevoke,
+			userAgent:  "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:89.0) Gecko/20100101 Firefox/89.0",
+			remoteAddr: "198.51.100.1:1234",
+			wantOK:     false,
+			wantActive: false,
+			wantReason: "ua,subnet",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, s, sid, err := login(t, "user1")
+			assert.NoError(t, err)
+			sink := &memoryAuditSink{}
+			c := defaultConfig()
+			c.AuditSink = sink
+			c.SessionBinding = SessionBinding{UserAgent: true, IPSubnet: true, Action: tt.action}
+			c.SessionBinding.setDefaults()
+
+			ses, err := s.FindBySessionToken(ctx, sid)
+			assert.NoError(t, err)
+
+			r := dummyRequest().WithContext(ctx)
+			if tt.userAgent != "" {
+				r.Header.Set("User-Agent", tt.userAgent)
+			}
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			assert.Equal(t, tt.wantOK, verifySessionBinding(c, s, w, r, sid, ses))
+			if !tt.wantOK {
+				assert.Equal(t, http.StatusFound, w.Code)
+				assert.Equal(t, "/.wru/login", w.Header().Get("Location"))
+			}
+
+			_, err = s.FindBySessionToken(ctx, sid)
+			if tt.wantActive {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrInvalidSessionToken)
+			}
+
+			if tt.wantReason == "" {
+				assert.Empty(t, sink.events)
+			} else if assert.Len(t, sink.events, 1) {
+				assert.Equal(t, AuditSessionMismatch, sink.events[0].Type)
+				assert.Equal(t, tt.wantReason, sink.events[0].Reason)
+				assert.Equal(t, string(tt.action), sink.events[0].Detail["action"])
+			}
+		})
+	}
+}
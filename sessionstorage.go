@@ -10,7 +10,6 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/ymotongpoo/datemaki"
@@ -37,6 +36,15 @@ type SingleSessionData struct {
 	LoginInfo map[string]string `docstore:"loginInfo" json:"login_info"`
 }
 
+// LoginCodeData is a short lived record of the single use code in login flows like device codes.
+// The code itself is not stored. ID is the hash of the kind and the code.
+type LoginCodeData struct {
+	ID               string            `docstore:"id"`
+	ExpireAt         time.Time         `docstore:"expire_at"`
+	Data             map[string]string `docstore:"data"`
+	DocstoreRevision interface{}
+}
+
 func (s SingleSessionData) LoginAtFormat() string {
 	return s.LoginAt.Format("2006/Jan/02 15:04")
 }
@@ -111,7 +119,13 @@ type Session struct {
 	Scopes       []string          `json:"scopes"`
 	Status       SessionStatus     `json:"-"`
 	Data         map[string]string `json:"data"`
-	directrives  []*Directive      `json:"-"`
+	// Token is set if the request is authorized by personal access token
+	Token *AccessTokenMarker `json:"token,omitempty"`
+	// Kind is "service" if the request is from service account
+	Kind UserKind `json:"kind,omitempty"`
+
+	directrives []*Directive `json:"-"`
+	loginInfo   map[string]string
 }
 
 func (s *Session) AddSessionData(key, value string) {
@@ -141,27 +155,24 @@ func parseDirective(src string) (*Directive, error) {
 }
 
 func getGeoLocation(c *Config, r *http.Request) (string, string) {
-	var remoteAddr string
-	f := r.Header.Get("Forwarded")
-	if f == "" {
-		f = r.Header.Get("X-Forwarded-For")
-	}
-	if f == "" {
-		remoteAddr = r.RemoteAddr
-	} else {
-		ips := strings.Split(f, ",")
-		remoteAddr = strings.TrimSpace(ips[0]) // todo: select proxy if needed
-	}
+	remoteAddr := clientIP(c, r)
+	country, _ := lookupCountry(c, net.ParseIP(remoteAddr))
+	return country, remoteAddr
+}
 
+// lookupCountry returns country name and ISO 3166-1 alpha-2 code of the IP address
+func lookupCountry(c *Config, ip net.IP) (string, string) {
 	if c.geoIPDB == nil {
-		return "No GeoIP DB", remoteAddr
+		return "No GeoIP DB", ""
+	}
+	if ip == nil {
+		return "GeoIP request error", ""
 	}
-	ip := net.ParseIP(remoteAddr)
 	record, err := c.geoIPDB.Country(ip)
 	if err != nil {
-		return "GeoIP request error", remoteAddr
+		return "GeoIP request error", ""
 	}
-	return record.Country.Names["en"], remoteAddr
+	return record.Country.Names["en"], record.Country.IsoCode
 }
 
 type SessionStorage interface {
@@ -177,15 +188,43 @@ type SessionStorage interface {
 	FindBySessionToken(ctx context.Context, sessionID string) (*Session, error)
 	UpdateSessionData(ctx context.Context, sessionID string, directives []*Directive) (err error)
 	RenewSession(ctx context.Context, oldSessionID string) (sessionID string, err error)
+	// CreateAccessToken creates personal access token. Only the hash of the token is stored.
+	CreateAccessToken(ctx context.Context, user *User, name string, scopes []string, expireAt time.Time) (token string, data *AccessTokenData, err error)
+	GetAccessTokens(ctx context.Context, userID string) ([]AccessTokenData, error)
+	RevokeAccessToken(ctx context.Context, userID, tokenID string) error
+	FindByAccessToken(ctx context.Context, token string) (*Session, error)
+	// CreateLoginCode stores the data of the single use code until expireAt. Only the hash of the code is stored.
+	CreateLoginCode(ctx context.Context, kind, code string, data map[string]string, expireAt time.Time) error
+	// FindLoginCode returns the data of the code. It returns ErrInvalidSessionToken if the code is unknown or expired.
+	FindLoginCode(ctx context.Context, kind, code string) (map[string]string, error)
+	// UpdateLoginCode replaces the data of the code. Its expiration time is not changed.
+	UpdateLoginCode(ctx context.Context, kind, code string, data map[string]string) error
+	// ConsumeLoginCode returns the data of the code and deletes it. Only one of concurrent callers gets the data.
+	ConsumeLoginCode(ctx context.Context, kind, code string) (map[string]string, error)
+	// GetMFA returns the second factor of the user. It returns ErrMFANotFound if the user doesn't have it.
+	GetMFA(ctx context.Context, userID string) (*MFAData, error)
+	SaveMFA(ctx context.Context, data *MFAData) error
+	DeleteMFA(ctx context.Context, userID string) error
+	// GetPasskeys returns the passkeys of the user. It returns empty slice if the user doesn't have them.
+	GetPasskeys(ctx context.Context, userID string) ([]WebAuthnCredential, error)
+	// SavePasskeys replaces all passkeys of the user
+	SavePasskeys(ctx context.Context, userID string, credentials []WebAuthnCredential) error
 }
 
 func NewSessionStorage(ctx context.Context, c *Config, out io.Writer) (SessionStorage, error) {
 	// todo: switch redis
+	var s *ServerlessSessionStorage
+	var err error
 	if c.SessionStorage == "" {
-		return NewMemorySessionStorage(ctx, c, "")
+		s, err = NewMemorySessionStorage(ctx, c, "")
 	} else {
-		return NewServerlessSessionStorage(ctx, c, "")
+		s, err = NewServerlessSessionStorage(ctx, c, "")
+	}
+	if err != nil {
+		return nil, err
 	}
+	registerActiveSessionCollector(s)
+	return &instrumentedSessionStorage{s: s}, nil
 }
 
 type RedisSessionStorage struct {
@@ -223,4 +262,56 @@ func (s RedisSessionStorage) FindBySessionToken(ctx context.Context, token strin
 	panic("implement me")
 }
 
+func (s RedisSessionStorage) CreateAccessToken(ctx context.Context, user *User, name string, scopes []string, expireAt time.Time) (string, *AccessTokenData, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) GetAccessTokens(ctx context.Context, userID string) ([]AccessTokenData, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) RevokeAccessToken(ctx context.Context, userID, tokenID string) error {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) FindByAccessToken(ctx context.Context, token string) (*Session, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) CreateLoginCode(ctx context.Context, kind, code string, data map[string]string, expireAt time.Time) error {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) FindLoginCode(ctx context.Context, kind, code string) (map[string]string, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) UpdateLoginCode(ctx context.Context, kind, code string, data map[string]string) error {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) ConsumeLoginCode(ctx context.Context, kind, code string) (map[string]string, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) GetMFA(ctx context.Context, userID string) (*MFAData, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) SaveMFA(ctx context.Context, data *MFAData) error {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) DeleteMFA(ctx context.Context, userID string) error {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) GetPasskeys(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	panic("implement me")
+}
+
+func (s RedisSessionStorage) SavePasskeys(ctx context.Context, userID string, credentials []WebAuthnCredential) error {
+	panic("implement me")
+}
+
 var _ SessionStorage = &RedisSessionStorage{}
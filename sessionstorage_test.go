@@ -310,3 +310,50 @@ func TestSessionStorage_RenewSession(t *testing.T) {
 	assert.NotNil(t, ses2)
 	assert.NoError(t, err)
 }
+
+func TestSessionStorage_LoginCode(t *testing.T) {
+	s, err := NewMemorySessionStorage(context.Background(), defaultConfig(), xid.New().String())
+	assert.NoError(t, err)
+
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.Local)
+	ctx := setFixTime(context.Background(), now)
+
+	err = s.CreateLoginCode(ctx, "device_code", "code1", map[string]string{"key": "value"}, now.Add(time.Minute))
+	assert.NoError(t, err)
+	// the same code can't be created twice
+	err = s.CreateLoginCode(ctx, "device_code", "code1", nil, now.Add(time.Minute))
+	assert.Error(t, err)
+
+	data, err := s.FindLoginCode(ctx, "device_code", "code1")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", data["key"])
+
+	// the code is usable only in the flow of its kind
+	_, err = s.FindLoginCode(ctx, "oidc_code", "code1")
+	assert.Equal(t, ErrInvalidSessionToken, err)
+
+	err = s.UpdateLoginCode(ctx, "device_code", "code1", map[string]string{"key": "updated"})
+	assert.NoError(t, err)
+
+	data, err = s.ConsumeLoginCode(ctx, "device_code", "code1")
+	assert.NoError(t, err)
+	assert.Equal(t, "updated", data["key"])
+	// single use
+	_, err = s.ConsumeLoginCode(ctx, "device_code", "code1")
+	assert.Equal(t, ErrInvalidSessionToken, err)
+}
+
+func TestSessionStorage_LoginCode_Expired(t *testing.T) {
+	s, err := NewMemorySessionStorage(context.Background(), defaultConfig(), xid.New().String())
+	assert.NoError(t, err)
+
+	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.Local)
+	err = s.CreateLoginCode(setFixTime(context.Background(), now), "device_code", "code1", nil, now.Add(time.Minute))
+	assert.NoError(t, err)
+
+	ctx := setFixTime(context.Background(), now.Add(time.Minute))
+	_, err = s.FindLoginCode(ctx, "device_code", "code1")
+	assert.Equal(t, ErrInvalidSessionToken, err)
+	_, err = s.ConsumeLoginCode(ctx, "device_code", "code1")
+	assert.Equal(t, ErrInvalidSessionToken, err)
+}
@@ -0,0 +1,136 @@
+package wru
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// isHeader returns true if clients send session ID by header field instead of cookie
+func (t ClientSessionFieldType) isHeader() bool {
+	return t == HeaderField || t == BearerField
+}
+
+// sessionCookieName returns the name of the cookie.
+// Header based transports still use cookie during login sequence.
+func sessionCookieName(c *Config) string {
+	if c.ClientSessionFieldCookie.isHeader() {
+		return c.Cookie.Prefix + "WRU_SESSION"
+	}
+	return c.ClientSessionKey
+}
+
+func sessionIDFromCookie(c *Config, r *http.Request) string {
+	name := sessionCookieName(c)
+	for _, ck := range r.Cookies() {
+		if ck.Name == name {
+			return ck.Value
+		}
+	}
+	return ""
+}
+
+func sessionIDFromHeader(c *Config, r *http.Request) string {
+	switch c.ClientSessionFieldCookie {
+	case HeaderField:
+		return strings.TrimSpace(r.Header.Get(c.ClientSessionKey))
+	case BearerField:
+		if token := bearerToken(r); !strings.HasPrefix(token, AccessTokenPrefix) {
+			return token
+		}
+	}
+	return ""
+}
+
+// bearerToken returns the token of "Authorization: Bearer <token>"
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func writeUnauthorized(c *Config, w http.ResponseWriter) {
+	if c.ClientSessionFieldCookie == BearerField {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wru"`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":    "error",
+		"message":   "login required",
+		"login_url": "/.wru/login",
+	})
+}
+
+// completeLogin sends the new session to the client and redirects to the landing page.
+// For header based transports, the session ID is not sent by Set-Cookie.
+// The client gets it from /.wru/login/token by single use code in the login cookie.
+func completeLogin(c *Config, s SessionStorage, w http.ResponseWriter, r *http.Request, sessionID string, oldInfo map[string]string) {
+	if userCode := oldInfo[deviceApprovalKey]; userCode != "" {
+		completeDeviceLogin(c, s, w, r, sessionID, userCode)
+		return
+	}
+	landingURL := safeLandingURL(c, oldInfo["landingURL"])
+	if !c.ClientSessionFieldCookie.isHeader() {
+		setSessionID(r.Context(), w, sessionID, c, ActiveSession)
+		http.Redirect(w, r, landingURL, http.StatusFound)
+		return
+	}
+	code, err := s.StartLogin(r.Context(), map[string]string{
+		"token":      sessionID,
+		"landingURL": landingURL,
+	})
+	if err != nil {
+		c.logger().Error("start login error", "error", err)
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionID(r.Context(), w, code, c, BeforeLogin)
+	http.Redirect(w, r, "/.wru/login/token", http.StatusFound)
+}
+
+type loginTokenResponse struct {
+	Token      string   `json:"token"`
+	TokenType  string   `json:"token_type,omitempty"`
+	Header     string   `json:"header"`
+	ExpireAt   UnixTime `json:"expire_at"`
+	LandingURL string   `json:"landing_url"`
+}
+
+// LoginToken returns the session ID for header based transports once after login
+func (wh wruHandler) LoginToken(w http.ResponseWriter, r *http.Request) {
+	code := sessionIDFromCookie(wh.c, r)
+	var ses *Session
+	var err error
+	if code != "" {
+		ses, err = wh.s.FindBySessionToken(r.Context(), code)
+	}
+	if code == "" || err != nil || ses.Status != BeforeLogin || ses.Data["token"] == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "error",
+			"message": "login token is not available",
+		})
+		return
+	}
+	// single use
+	wh.s.Logout(r.Context(), code)
+	removeSessionID(w, wh.c)
+	token := ses.Data["token"]
+	res := loginTokenResponse{
+		Token:      token,
+		Header:     wh.c.ClientSessionKey,
+		LandingURL: ses.Data["landingURL"],
+	}
+	if wh.c.ClientSessionFieldCookie == BearerField {
+		res.TokenType = "Bearer"
+	}
+	if active, err := wh.s.FindBySessionToken(r.Context(), token); err == nil {
+		res.ExpireAt = active.ExpireAt
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(&res)
+}
@@ -0,0 +1,169 @@
+package wru
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_sessionIDFromHeader(t *testing.T) {
+	tests := []struct {
+		name      string
+		fieldType ClientSessionFieldType
+		key       string
+		header    http.Header
+		want      string
+	}{
+		{
+			name:      "custom header",
+			fieldType: HeaderField,
+			key:       "X-Wru-Token",
+			header:    http.Header{"X-Wru-Token": {"sid"}},
+			want:      "sid",
+		},
+		{
+			name:      "bearer",
+			fieldType: BearerField,
+			key:       "Authorization",
+			header:    http.Header{"Authorization": {"bearer sid"}},
+			want:      "sid",
+		},
+		{
+			name:      "basic auth is not a session",
+			fieldType: BearerField,
+			key:       "Authorization",
+			header:    http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}},
+			want:      "",
+		},
+		{
+			name:      "cookie",
+			fieldType: CookieField,
+			key:       "WRU_SESSION",
+			header:    http.Header{"Authorization": {"Bearer sid"}},
+			want:      "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{ClientSessionKey: tt.key, ClientSessionFieldCookie: tt.fieldType}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header = tt.header
+			assert.Equal(t, tt.want, sessionIDFromHeader(c, r))
+		})
+	}
+}
+
+// withHeaderSession passes the session ID by the header and enables the device flow for wru-cli
+func withHeaderSession(key string, fieldType ClientSessionFieldType) func(c *Config) {
+	return func(c *Config) {
+		c.ClientSessionKey = key
+		c.ClientSessionFieldCookie = fieldType
+		c.DeviceClients = []string{"wru-cli"}
+	}
+}
+
+func cookieValue(w *httptest.ResponseRecorder, name string) string {
+	for _, ck := range w.Result().Cookies() {
+		if ck.Name == name {
+			return ck.Value
+		}
+	}
+	return ""
+}
+
+func TestHeaderTransportLogin(t *testing.T) {
+	h, c, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("X-Wru-Token", HeaderField))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/.wru/login?return_to=%2Fdashboard", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	loginID := cookieValue(w, "WRU_SESSION")
+	csrfToken := cookieValue(w, "WRU_SESSION_CSRF")
+	assert.NotEmpty(t, loginID)
+
+	// login session is in the cookie
+	r := postForm(c, "/.wru/login", "", csrfToken, url.Values{"userid": {"user1"}, CSRFTokenField: {csrfToken}}, "")
+	r.AddCookie(&http.Cookie{Name: "WRU_SESSION", Value: loginID})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/login/token", w.Header().Get("Location"))
+	code := cookieValue(w, "WRU_SESSION")
+	assert.NotEmpty(t, code)
+
+	// session ID is returned by JSON
+	r = httptest.NewRequest("GET", "/.wru/login/token", nil)
+	r.AddCookie(&http.Cookie{Name: "WRU_SESSION", Value: code})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var res struct {
+		Token      string `json:"token"`
+		Header     string `json:"header"`
+		ExpireAt   int64  `json:"expire_at"`
+		LandingURL string `json:"landing_url"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.NotEmpty(t, res.Token)
+	assert.NotZero(t, res.ExpireAt)
+	assert.Equal(t, "X-Wru-Token", res.Header)
+	assert.Equal(t, "/dashboard", res.LandingURL)
+
+	// code is single use
+	r = httptest.NewRequest("GET", "/.wru/login/token", nil)
+	r.AddCookie(&http.Cookie{Name: "WRU_SESSION", Value: code})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// use session by header
+	r = httptest.NewRequest("GET", "/.wru/user", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("X-Wru-Token", res.Token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// header based requests don't need CSRF token
+	r = httptest.NewRequest("POST", "/.wru/logout", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("X-Wru-Token", res.Token)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	_, err := s.FindBySessionToken(context.Background(), res.Token)
+	assert.ErrorIs(t, err, ErrInvalidSessionToken)
+}
+
+func TestBearerTransport(t *testing.T) {
+	h, _, s, _ := newTestHandler(t, newTestRegister(t, "WRU_USER_1=id:user1,name:user1"), withHeaderSession("Authorization", BearerField))
+	sid := startSession(t, context.Background(), s, dummyUser("user1"), "debug")
+
+	r := httptest.NewRequest("GET", "/.wru/user", nil)
+	r.Header.Set("Accept", "application/json")
+	r.Header.Set("Authorization", "Bearer "+sid)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// API clients get 401 instead of redirect
+	r = httptest.NewRequest("GET", "/.wru/user", nil)
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, `Bearer realm="wru"`, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestHeaderTransportIsNotForwarded(t *testing.T) {
+	c := &Config{ClientSessionKey: "Authorization", ClientSessionFieldCookie: BearerField, ServerSessionField: "Wru-Session"}
+	h := http.Header{"Authorization": {"Bearer sid"}}
+	setIdentityHeaders(c, h, &Session{UserID: "user1"})
+	assert.Empty(t, h.Get("Authorization"))
+	assert.NotEmpty(t, h.Get("Wru-Session"))
+}
@@ -1,9 +1,13 @@
 package wru
 
 import (
+	"bytes"
 	"embed"
+	"fmt"
 	"html/template"
 	"io"
+	"log/slog"
+	"net/http"
 	"path/filepath"
 )
 
@@ -15,29 +19,111 @@ const (
 	DebugLoginPageTemplate   = "debug_login.html"
 	UserStatusPageTemplate   = "user_status.html"
 	UserSessionsPageTemplate = "user_sessions.html"
+	UserTokensPageTemplate   = "user_tokens.html"
+	ErrorPageTemplate        = "error.html"
+	LogoutPageTemplate       = "logout.html"
+	DevicePageTemplate       = "device.html"
+	MFAPageTemplate          = "mfa.html"
+	UserPasskeysPageTemplate = "user_passkeys.html"
+	EmailLoginPageTemplate   = "email_login.html"
+	// WebAuthnScriptTemplate is the script of passkeys that is included by other pages
+	WebAuthnScriptTemplate = "webauthn.html"
 )
 
 var pages *template.Template
 
+// pageLogger is the logger of the config that initialized pages
+var pageLogger = slog.Default()
+
+// templateFuncs are available in templates.
+// cspNonce returns the nonce for inline <script> and <style> elements and csrfToken returns the token for forms.
+var templateFuncs = template.FuncMap{
+	"cspNonce":  func() string { return "" },
+	"csrfToken": func() string { return "" },
+}
+
 type loginPageContext struct {
 	GitHub  bool
 	Twitter bool
 	OIDC    bool
+	Passkey bool
+	Email   bool
 }
 
 type debugLoginPageContext struct {
-	Users []*User
+	Users   []*User
+	Passkey bool
+	Email   bool
 }
 
 func initTemplate(c *Config, out io.Writer) error {
 	var err error
 	if c.HTMLTemplateFolder != "" {
-		pages, err = template.ParseGlob(filepath.Join(c.HTMLTemplateFolder, "*"))
+		pages, err = template.New("").Funcs(templateFuncs).ParseGlob(filepath.Join(c.HTMLTemplateFolder, "*"))
 	} else {
-		pages, err = template.ParseFS(defaultTemplates, "templates/*.html")
+		pages, err = template.New("").Funcs(templateFuncs).ParseFS(defaultTemplates, "templates/*.html")
 	}
 	if err != nil {
 		return err
 	}
+	// custom template folder should have all pages. Missing pages are found at startup instead of at the first access.
+	for _, name := range requiredTemplates(c) {
+		if pages.Lookup(name) == nil {
+			return fmt.Errorf("%s is not found in %s", name, c.HTMLTemplateFolder)
+		}
+	}
+	pageLogger = c.logger()
 	return nil
 }
+
+// requiredTemplates returns pages that the enabled features use
+func requiredTemplates(c *Config) []string {
+	result := []string{
+		LoginPageTemplate,
+		DebugLoginPageTemplate,
+		UserStatusPageTemplate,
+		UserSessionsPageTemplate,
+		UserTokensPageTemplate,
+		ErrorPageTemplate,
+		LogoutPageTemplate,
+	}
+	if c.deviceFlowAvailable() {
+		result = append(result, DevicePageTemplate)
+	}
+	// the second factor step is also used by passkeys without TOTP
+	if c.MFA.Available() || c.WebAuthn.Available() {
+		result = append(result, MFAPageTemplate)
+	}
+	if c.WebAuthn.Available() {
+		result = append(result, UserPasskeysPageTemplate, WebAuthnScriptTemplate)
+	}
+	if c.EmailLogin.Available() {
+		result = append(result, EmailLoginPageTemplate)
+	}
+	return result
+}
+
+// executeTemplate renders the page with Content-Security-Policy that allows only inline elements that have the nonce.
+// The page is rendered into a buffer first. Errors are logged and sent as 500 error instead of a broken page.
+func executeTemplate(w http.ResponseWriter, r *http.Request, status int, name string, data interface{}) {
+	p := pageSecurityFromContext(r.Context())
+	csrfToken := csrfTokenFromContext(r.Context())
+	var buf bytes.Buffer
+	t, err := pages.Clone()
+	if err == nil {
+		t.Funcs(template.FuncMap{
+			"cspNonce":  p.cspNonce,
+			"csrfToken": func() string { return csrfToken },
+		})
+		err = t.ExecuteTemplate(&buf, name, data)
+	}
+	if err != nil {
+		pageLogger.Error("render page error", "page", name, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", p.contentSecurityPolicy())
+	w.WriteHeader(status)
+	buf.WriteTo(w)
+}
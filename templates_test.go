@@ -0,0 +1,76 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInitTemplate_CustomFolder(t *testing.T) {
+	// DevMode enables two-factor authentication with a temporary key
+	devModePages := append(requiredTemplates(&Config{}), MFAPageTemplate)
+	tests := []struct {
+		name    string
+		files   []string
+		opts    []func(c *Config)
+		wantErr string
+	}{
+		{
+			name:  "all pages",
+			files: devModePages,
+		},
+		{
+			name:    "missing page",
+			files:   []string{LoginPageTemplate, ErrorPageTemplate},
+			wantErr: DebugLoginPageTemplate + " is not found",
+		},
+		{
+			name:    "missing page of enabled feature",
+			files:   devModePages,
+			opts:    []func(c *Config){withHeaderSession("Authorization", BearerField)},
+			wantErr: DevicePageTemplate + " is not found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.files {
+				assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(`{{ define "`+name+`" }}ok{{ end }}`), 0o644))
+			}
+			c := &Config{
+				Host:               "https://example.com",
+				DevMode:            true,
+				HTMLTemplateFolder: dir,
+			}
+			for _, opt := range tt.opts {
+				opt(c)
+			}
+			err := c.Init(context.Background(), nil)
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestExecuteTemplate_Error(t *testing.T) {
+	c := &Config{
+		Host:    "https://example.com",
+		DevMode: true,
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+
+	w := httptest.NewRecorder()
+	executeTemplate(w, dummyRequest(), http.StatusOK, "unknown.html", nil)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Empty(t, w.Header().Get("Content-Security-Policy"))
+}
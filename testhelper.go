@@ -4,6 +4,9 @@ import (
 	"context"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -44,24 +47,105 @@ func login(t *testing.T, userID string) (context.Context, *ServerlessSessionStor
 	now := time.Date(2021, time.July, 2, 10, 0, 0, 0, time.Local)
 	ctx := setFixTime(context.Background(), now)
 
-	oldSessionID, err := s.StartLogin(ctx, map[string]string{})
+	sid := startSession(t, ctx, s, dummyUser(userID), "debug")
+	assert.NotEqual(t, "", sid)
+	return ctx, s, sid, nil
+}
 
-	r := httptest.NewRequest("GET", "/test", nil)
-	r.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.114 Safari/537.36")
+// startLogin starts a login flow and returns the temporary session ID
+func startLogin(t *testing.T, ctx context.Context, s SessionStorage) string {
+	t.Helper()
+	loginID, err := s.StartLogin(ctx, map[string]string{"landingURL": "/dashboard"})
+	assert.NoError(t, err)
+	return loginID
+}
 
-	user := &User{
-		DisplayName:  userID,
-		Organization: "secret",
-		UserID:       userID,
-		Email:        userID + "@example.com",
-		Scopes:       []string{"login"},
+// startSession logins the user as if idp authenticated it and returns the session ID
+func startSession(t *testing.T, ctx context.Context, s SessionStorage, user *User, idp string) string {
+	t.Helper()
+	sid, _, err := s.StartSession(ctx, startLogin(t, ctx, s), user, dummyRequest(), map[string]string{"login-idp": idp})
+	assert.NoError(t, err)
+	return sid
+}
+
+// debugLogin posts the user ID to the debug login page in a new login flow and returns the response
+func debugLogin(t *testing.T, ctx context.Context, h http.Handler, c *Config, s SessionStorage, userID string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := postForm(c, "/.wru/login", startLogin(t, ctx, s), "token", url.Values{"userid": {userID}, CSRFTokenField: {"token"}}, "")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r.WithContext(ctx))
+	return w
+}
+
+// postForm creates a form request with the session cookie and the CSRF cookie
+func postForm(c *Config, path, sid, cookieToken string, form url.Values, origin string) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "text/html")
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if sid != "" {
+		r.AddCookie(&http.Cookie{Name: c.ClientSessionKey, Value: sid})
 	}
+	if cookieToken != "" {
+		r.AddCookie(&http.Cookie{Name: csrfCookieName(c), Value: cookieToken})
+	}
+	return r
+}
 
-	loginInfo := map[string]string{"login-idp": "debug"}
-	sid, _, err := s.StartSession(ctx, oldSessionID, user, r, loginInfo)
+// newTestRegister creates an identity register from WRU_USER_* entries
+func newTestRegister(t *testing.T, users ...string) *IdentityRegister {
+	t.Helper()
+	ir, _, err := NewIdentityRegisterFromEnv(context.Background(), users, nil)
 	assert.NoError(t, err)
-	assert.NotEqual(t, "", sid)
-	return ctx, s, sid, err
+	return ir
+}
+
+// newTestHandler creates wru's handler with the memory session storage and the memory audit sink.
+// opts modify the config before initialization.
+func newTestHandler(t *testing.T, ir *IdentityRegister, opts ...func(c *Config)) (http.Handler, *Config, SessionStorage, *memoryAuditSink) {
+	t.Helper()
+	sink := &memoryAuditSink{}
+	c := &Config{
+		Host:      "https://example.com",
+		DevMode:   true,
+		AuditSink: sink,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	assert.NoError(t, c.Init(context.Background(), nil))
+	s, err := NewMemorySessionStorage(context.Background(), c, xid.New().String())
+	assert.NoError(t, err)
+	return newHandler(c, s, ir), c, s, sink
+}
+
+// memoryAuditSink keeps audit events for assertions
+type memoryAuditSink struct {
+	events []*AuditEvent
+	lock   sync.Mutex
+}
+
+func (m *memoryAuditSink) Write(ctx context.Context, e *AuditEvent) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memoryAuditSink) Close() error {
+	return nil
+}
+
+func (m *memoryAuditSink) types() []AuditEventType {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var result []AuditEventType
+	for _, e := range m.events {
+		result = append(result, e.Type)
+	}
+	return result
 }
 
 func dummyUser(userID string) *User {
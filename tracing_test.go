@@ -0,0 +1,58 @@
+package wru
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	var exported int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/traces" {
+			atomic.AddInt32(&exported, 1)
+		}
+	}))
+	defer collector.Close()
+
+	var traceParent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceParent = r.Header.Get("traceparent")
+	}))
+	defer backend.Close()
+
+	c := &Config{
+		OTLPEndpoint: strings.TrimPrefix(collector.URL, "http://"),
+		OTLPInsecure: true,
+		ForwardTo: []Route{
+			{
+				Host: mustParseUrl(backend.URL),
+				Path: "/",
+			},
+		},
+	}
+	err := initTracing(context.Background(), c, nil)
+	assert.NoError(t, err)
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	p, err := NewReverseProxy(c, nil)
+	assert.NoError(t, err)
+	proxy := httptest.NewServer(tracingMiddleware(p))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/test")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Regexp(t, `^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`, traceParent)
+
+	err = c.Shutdown(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&exported))
+}
@@ -0,0 +1,242 @@
+package wru
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamTransport is a connection setting to backend servers.
+// Zero values mean "use default value". Nil flags are inherited from the global setting.
+type UpstreamTransport struct {
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+
+	// CACert is a PEM content or a file path of CA bundle to verify backend servers
+	CACert string
+	// ClientCert and ClientKey are PEM contents or file paths of client certificate for mTLS
+	ClientCert string
+	ClientKey  string
+
+	InsecureSkipVerify *bool
+	HTTP2              *bool
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func (t UpstreamTransport) insecureSkipVerify() bool {
+	return t.InsecureSkipVerify != nil && *t.InsecureSkipVerify
+}
+
+func (t UpstreamTransport) http2() bool {
+	return t.HTTP2 != nil && *t.HTTP2
+}
+
+// merge returns new setting that overwrites fields of base with non-zero fields of t.
+func (t *UpstreamTransport) merge(base UpstreamTransport) UpstreamTransport {
+	if t == nil {
+		return base
+	}
+	result := base
+	if t.DialTimeout != 0 {
+		result.DialTimeout = t.DialTimeout
+	}
+	if t.ResponseHeaderTimeout != 0 {
+		result.ResponseHeaderTimeout = t.ResponseHeaderTimeout
+	}
+	if t.IdleConnTimeout != 0 {
+		result.IdleConnTimeout = t.IdleConnTimeout
+	}
+	if t.MaxIdleConns != 0 {
+		result.MaxIdleConns = t.MaxIdleConns
+	}
+	if t.MaxIdleConnsPerHost != 0 {
+		result.MaxIdleConnsPerHost = t.MaxIdleConnsPerHost
+	}
+	if t.CACert != "" {
+		result.CACert = t.CACert
+	}
+	if t.ClientCert != "" {
+		result.ClientCert = t.ClientCert
+		result.ClientKey = t.ClientKey
+	}
+	if t.InsecureSkipVerify != nil {
+		result.InsecureSkipVerify = t.InsecureSkipVerify
+	}
+	if t.HTTP2 != nil {
+		result.HTTP2 = t.HTTP2
+	}
+	return result
+}
+
+func (t UpstreamTransport) newTransport() (*http.Transport, error) {
+	dialTimeout := t.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 30 * time.Second
+	}
+	idleConnTimeout := t.IdleConnTimeout
+	if idleConnTimeout == 0 {
+		idleConnTimeout = 90 * time.Second
+	}
+	maxIdleConns := t.MaxIdleConns
+	if maxIdleConns == 0 {
+		maxIdleConns = 100
+	}
+	dialer := &net.Dialer{
+		Timeout:   dialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     t.http2(),
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	tlsConfig, err := t.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	tr.TLSClientConfig = tlsConfig
+	return tr, nil
+}
+
+func (t UpstreamTransport) tlsConfig() (*tls.Config, error) {
+	if t.CACert == "" && t.ClientCert == "" && !t.insecureSkipVerify() {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: t.insecureSkipVerify(),
+	}
+	if t.CACert != "" {
+		ca, err := readPEM(t.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("can't read upstream CA cert: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("upstream CA cert doesn't contain any certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if t.ClientCert != "" {
+		if t.ClientKey == "" {
+			return nil, errors.New("upstream client key is required for client cert")
+		}
+		certPEM, err := readPEM(t.ClientCert)
+		if err != nil {
+			return nil, fmt.Errorf("can't read upstream client cert: %w", err)
+		}
+		keyPEM, err := readPEM(t.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("can't read upstream client key: %w", err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream client cert: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// readPEM accepts PEM content itself (like WRU_TLS_CERT) or file path
+func readPEM(src string) ([]byte, error) {
+	if strings.Contains(src, "-----BEGIN") {
+		return []byte(strings.ReplaceAll(src, `\n`, "\n")), nil
+	}
+	return os.ReadFile(src)
+}
+
+// parseRouteOptions parses per-route options like "insecure, h2=false, ca=/etc/ca.pem, response-header-timeout=10s, allow-ip=10.0.0.0/8".
+// Returned values are nil if there are no transport options or no policy options.
+func parseRouteOptions(src string) (*UpstreamTransport, *AccessPolicy, error) {
+	t := &UpstreamTransport{}
+	p := &AccessPolicy{}
+	hasTransport := false
+	for _, opt := range strings.Split(src, ",") {
+		opt = strings.TrimSpace(opt)
+		if opt == "" {
+			continue
+		}
+		kv := strings.SplitN(opt, "=", 2)
+		key := strings.TrimSpace(kv[0])
+		var value string
+		if len(kv) == 2 {
+			value = strings.TrimSpace(kv[1])
+		}
+		if ok, err := p.parseOption(key, value); ok {
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid route option %s: %w", key, err)
+			}
+			continue
+		}
+		hasTransport = true
+		var err error
+		switch key {
+		case "insecure":
+			t.InsecureSkipVerify, err = parseFlagOption(value)
+		case "h2":
+			t.HTTP2, err = parseFlagOption(value)
+		case "ca":
+			t.CACert = value
+		case "cert":
+			t.ClientCert = value
+		case "key":
+			t.ClientKey = value
+		case "dial-timeout":
+			t.DialTimeout, err = time.ParseDuration(value)
+		case "response-header-timeout":
+			t.ResponseHeaderTimeout, err = time.ParseDuration(value)
+		case "idle-timeout":
+			t.IdleConnTimeout, err = time.ParseDuration(value)
+		case "max-idle-conns":
+			t.MaxIdleConns, err = strconv.Atoi(value)
+		case "max-idle-conns-per-host":
+			t.MaxIdleConnsPerHost, err = strconv.Atoi(value)
+		default:
+			return nil, nil, fmt.Errorf("unknown route option: %s", key)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid route option %s: %w", key, err)
+		}
+	}
+	if t.ClientKey != "" && t.ClientCert == "" {
+		return nil, nil, errors.New("route option key requires cert")
+	}
+	if !hasTransport {
+		t = nil
+	}
+	if p.empty() {
+		p = nil
+	}
+	return t, p, nil
+}
+
+// parseFlagOption parses values of flag options. A flag without value like "h2" means true.
+func parseFlagOption(value string) (*bool, error) {
+	if value == "" {
+		return boolPtr(true), nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
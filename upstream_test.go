@@ -0,0 +1,57 @@
+package wru
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreamTransport_merge(t *testing.T) {
+	base := UpstreamTransport{
+		DialTimeout:        time.Second,
+		InsecureSkipVerify: boolPtr(false),
+		HTTP2:              boolPtr(true),
+	}
+	tests := []struct {
+		name         string
+		route        *UpstreamTransport
+		wantInsecure bool
+		wantHTTP2    bool
+	}{
+		{
+			name:         "no route setting",
+			route:        nil,
+			wantInsecure: false,
+			wantHTTP2:    true,
+		},
+		{
+			name:         "flags are inherited",
+			route:        &UpstreamTransport{DialTimeout: time.Minute},
+			wantInsecure: false,
+			wantHTTP2:    true,
+		},
+		{
+			name:         "turn on",
+			route:        &UpstreamTransport{InsecureSkipVerify: boolPtr(true)},
+			wantInsecure: true,
+			wantHTTP2:    true,
+		},
+		{
+			name:         "turn off",
+			route:        &UpstreamTransport{HTTP2: boolPtr(false)},
+			wantInsecure: false,
+			wantHTTP2:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.route.merge(base)
+			assert.Equal(t, tt.wantInsecure, got.insecureSkipVerify())
+			assert.Equal(t, tt.wantHTTP2, got.http2())
+			tr, err := got.newTransport()
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantHTTP2, tr.ForceAttemptHTTP2)
+		})
+	}
+}
@@ -0,0 +1,891 @@
+package wru
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/go-chi/chi/v5"
+	"github.com/ymotongpoo/datemaki"
+	"gocloud.dev/gcerrors"
+)
+
+// WebAuthn (passkey) authentication.
+// Users register passkeys at /.wru/user/passkeys. They are discoverable credentials, so they can be used as a standalone
+// login method on the login page and also as the second factor after the login of ID providers (see mfa.go).
+// Attestation statements are not verified because users are identified by the user table, not by authenticator models.
+
+// COSE algorithms that wru accepts
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// flags of authenticator data
+const (
+	authDataUserPresent  = 0x01
+	authDataUserVerified = 0x04
+	authDataAttested     = 0x40
+)
+
+// kind of login codes and keys of their data for challenges
+const (
+	webAuthnChallengeKey = "webauthn_challenge"
+	webAuthnPurposeKey   = "webauthn_purpose"
+	webAuthnUserKey      = "webauthn_user"
+	webAuthnSessionKey   = "webauthn_session"
+)
+
+// purposes of challenges
+const (
+	webAuthnRegister = "register"
+	webAuthnLogin    = "login"
+	webAuthnMFA      = "mfa"
+)
+
+// amrPasskey is amr value (RFC 8176) of passkeys.
+// The standalone login requires user verification (PIN or biometrics), so both usages are multi-factor.
+const amrPasskey = "mfa,hwk"
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// WebAuthnConfig enables passkeys
+type WebAuthnConfig struct {
+	Enabled bool
+	// RPID is the relying party ID. Default is the host name of wru.
+	// Passkeys are bound to it and they can't be used after it is changed.
+	RPID string
+	// RPName is the name shown by authenticators. Default is "wru".
+	RPName string
+
+	origin string
+}
+
+func (wc WebAuthnConfig) Available() bool {
+	return wc.origin != ""
+}
+
+func initWebAuthn(c *Config) error {
+	if !c.WebAuthn.Enabled {
+		return nil
+	}
+	u, err := url.Parse(c.Host)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("WebAuthn requires valid Host: %s", c.Host)
+	}
+	host := u.Hostname()
+	if u.Scheme != "https" && host != "localhost" {
+		return errors.New("WebAuthn requires https Host (or http://localhost)")
+	}
+	if c.WebAuthn.RPID == "" {
+		c.WebAuthn.RPID = host
+	}
+	if host != c.WebAuthn.RPID && !strings.HasSuffix(host, "."+c.WebAuthn.RPID) {
+		return fmt.Errorf("WebAuthn RP ID should be the host name of wru or its parent domain: %s", c.WebAuthn.RPID)
+	}
+	if c.WebAuthn.RPName == "" {
+		c.WebAuthn.RPName = "wru"
+	}
+	c.WebAuthn.origin = u.Scheme + "://" + u.Host
+	return nil
+}
+
+// base64URL is binary data that is encoded as base64url without padding in JSON like WebAuthn JSON serialization
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	d, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return err
+	}
+	*b = d
+	return nil
+}
+
+type webAuthnEntity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+type webAuthnUserEntity struct {
+	ID          base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type webAuthnParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webAuthnDescriptor struct {
+	Type string    `json:"type"`
+	ID   base64URL `json:"id"`
+}
+
+type webAuthnAuthenticatorSelection struct {
+	ResidentKey        string `json:"residentKey"`
+	RequireResidentKey bool   `json:"requireResidentKey"`
+	UserVerification   string `json:"userVerification"`
+}
+
+// webAuthnCreationOptions is passed to navigator.credentials.create()
+type webAuthnCreationOptions struct {
+	Challenge              base64URL                      `json:"challenge"`
+	RP                     webAuthnEntity                 `json:"rp"`
+	User                   webAuthnUserEntity             `json:"user"`
+	PubKeyCredParams       []webAuthnParameter            `json:"pubKeyCredParams"`
+	Timeout                int64                          `json:"timeout"`
+	ExcludeCredentials     []webAuthnDescriptor           `json:"excludeCredentials"`
+	AuthenticatorSelection webAuthnAuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                         `json:"attestation"`
+}
+
+// webAuthnRequestOptions is passed to navigator.credentials.get()
+type webAuthnRequestOptions struct {
+	Challenge        base64URL            `json:"challenge"`
+	Timeout          int64                `json:"timeout"`
+	RPID             string               `json:"rpId"`
+	AllowCredentials []webAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string               `json:"userVerification"`
+}
+
+// webAuthnCredentialResponse is PublicKeyCredential that is serialized by the script of login pages
+type webAuthnCredentialResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AttestationObject base64URL `json:"attestationObject,omitempty"`
+		AuthenticatorData base64URL `json:"authenticatorData,omitempty"`
+		Signature         base64URL `json:"signature,omitempty"`
+		UserHandle        base64URL `json:"userHandle,omitempty"`
+	} `json:"response"`
+}
+
+func parseWebAuthnCredential(src string) (*webAuthnCredentialResponse, error) {
+	var cred webAuthnCredentialResponse
+	if err := json.Unmarshal([]byte(src), &cred); err != nil {
+		return nil, fmt.Errorf("invalid credential: %w", err)
+	}
+	if cred.Type != "public-key" || cred.ID == "" || len(cred.Response.ClientDataJSON) == 0 {
+		return nil, errors.New("invalid credential")
+	}
+	return &cred, nil
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func parseClientData(raw []byte) (*webAuthnClientData, error) {
+	var cd webAuthnClientData
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return nil, fmt.Errorf("invalid client data: %w", err)
+	}
+	cd.Challenge = strings.TrimRight(cd.Challenge, "=")
+	return &cd, nil
+}
+
+func (wc WebAuthnConfig) verifyClientData(cd *webAuthnClientData, ceremony, challenge string) error {
+	if cd.Type != ceremony {
+		return fmt.Errorf("invalid client data type: %s", cd.Type)
+	}
+	if subtle.ConstantTimeCompare([]byte(cd.Challenge), []byte(challenge)) != 1 {
+		return errors.New("challenge mismatch")
+	}
+	if cd.Origin != wc.origin {
+		return fmt.Errorf("origin mismatch: %s", cd.Origin)
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// credentialID and publicKey (COSE_Key) exist only in registration
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&authDataAttested != 0 {
+		// AAGUID(16) + credential ID length(2) + credential ID + public key
+		rest := data[37:]
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data is too short")
+		}
+		l := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < l {
+			return nil, errors.New("attested credential data is too short")
+		}
+		ad.credentialID = rest[:l]
+		var key cbor.RawMessage
+		if err := cbor.NewDecoder(bytes.NewReader(rest[l:])).Decode(&key); err != nil {
+			return nil, fmt.Errorf("invalid credential public key: %w", err)
+		}
+		ad.publicKey = key
+	}
+	return ad, nil
+}
+
+func (wc WebAuthnConfig) verifyAuthenticatorData(ad *authenticatorData, requireUV bool) error {
+	rpIDHash := sha256.Sum256([]byte(wc.RPID))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, rpIDHash[:]) != 1 {
+		return errors.New("RP ID hash mismatch")
+	}
+	if ad.flags&authDataUserPresent == 0 {
+		return errors.New("user presence is not confirmed")
+	}
+	if requireUV && ad.flags&authDataUserVerified == 0 {
+		return errors.New("user verification is required")
+	}
+	return nil
+}
+
+// coseKey is the public key of a passkey
+type coseKey struct {
+	alg int
+	pub crypto.PublicKey
+}
+
+// parseCOSEKey supports ES256 (P-256), RS256 and EdDSA (Ed25519) keys
+func parseCOSEKey(raw []byte) (*coseKey, error) {
+	var m map[int]cbor.RawMessage
+	if err := cbor.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("invalid COSE key: %w", err)
+	}
+	get := func(label int, v interface{}) error {
+		src, ok := m[label]
+		if !ok {
+			return fmt.Errorf("COSE key doesn't have parameter %d", label)
+		}
+		return cbor.Unmarshal(src, v)
+	}
+	var kty, alg int
+	if err := get(1, &kty); err != nil {
+		return nil, err
+	}
+	if err := get(3, &alg); err != nil {
+		return nil, err
+	}
+	switch {
+	case kty == 2 && alg == coseAlgES256:
+		var crv int
+		var x, y []byte
+		if err := get(-1, &crv); err != nil {
+			return nil, err
+		}
+		if err := get(-2, &x); err != nil {
+			return nil, err
+		}
+		if err := get(-3, &y); err != nil {
+			return nil, err
+		}
+		if crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported EC2 key: only P-256 is supported")
+		}
+		// validates the point
+		if _, err := ecdh.P256().NewPublicKey(append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, fmt.Errorf("invalid EC2 key: %w", err)
+		}
+		return &coseKey{alg: alg, pub: &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}}, nil
+	case kty == 3 && alg == coseAlgRS256:
+		var n, e []byte
+		if err := get(-1, &n); err != nil {
+			return nil, err
+		}
+		if err := get(-2, &e); err != nil {
+			return nil, err
+		}
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &coseKey{alg: alg, pub: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}}, nil
+	case kty == 1 && alg == coseAlgEdDSA:
+		var crv int
+		var x []byte
+		if err := get(-1, &crv); err != nil {
+			return nil, err
+		}
+		if err := get(-2, &x); err != nil {
+			return nil, err
+		}
+		if crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("unsupported OKP key: only Ed25519 is supported")
+		}
+		return &coseKey{alg: alg, pub: ed25519.PublicKey(x)}, nil
+	}
+	return nil, fmt.Errorf("unsupported COSE key: kty=%d alg=%d", kty, alg)
+}
+
+func (k *coseKey) verify(data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	switch pub := k.pub.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+			return errInvalidSignature
+		}
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) != nil {
+			return errInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, data, sig) {
+			return errInvalidSignature
+		}
+	default:
+		// keys that are not parsed by parseCOSEKey must not pass
+		return errInvalidSignature
+	}
+	return nil
+}
+
+type webAuthnAttestation struct {
+	Fmt      string          `cbor:"fmt"`
+	AuthData []byte          `cbor:"authData"`
+	AttStmt  cbor.RawMessage `cbor:"attStmt"`
+}
+
+// verifyRegistration checks the response of navigator.credentials.create() and returns the new passkey
+func (wc WebAuthnConfig) verifyRegistration(cred *webAuthnCredentialResponse, challenge string, now time.Time) (*WebAuthnCredential, error) {
+	cd, err := parseClientData(cred.Response.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := wc.verifyClientData(cd, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+	var att webAuthnAttestation
+	if err := cbor.Unmarshal(cred.Response.AttestationObject, &att); err != nil {
+		return nil, fmt.Errorf("invalid attestation object: %w", err)
+	}
+	ad, err := parseAuthenticatorData(att.AuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := wc.verifyAuthenticatorData(ad, false); err != nil {
+		return nil, err
+	}
+	if ad.flags&authDataAttested == 0 {
+		return nil, errors.New("attested credential data is missing")
+	}
+	if base64.RawURLEncoding.EncodeToString(ad.credentialID) != cred.ID {
+		return nil, errors.New("credential ID mismatch")
+	}
+	if _, err := parseCOSEKey(ad.publicKey); err != nil {
+		return nil, err
+	}
+	return &WebAuthnCredential{
+		ID:        cred.ID,
+		PublicKey: ad.publicKey,
+		SignCount: int64(ad.signCount),
+		CreatedAt: now,
+	}, nil
+}
+
+// verifyAssertion checks the response of navigator.credentials.get() by the registered passkey and updates its sign count
+func (wc WebAuthnConfig) verifyAssertion(cred *webAuthnCredentialResponse, challenge string, requireUV bool, stored *WebAuthnCredential, now time.Time) error {
+	cd, err := parseClientData(cred.Response.ClientDataJSON)
+	if err != nil {
+		return err
+	}
+	if err := wc.verifyClientData(cd, "webauthn.get", challenge); err != nil {
+		return err
+	}
+	ad, err := parseAuthenticatorData(cred.Response.AuthenticatorData)
+	if err != nil {
+		return err
+	}
+	if err := wc.verifyAuthenticatorData(ad, requireUV); err != nil {
+		return err
+	}
+	key, err := parseCOSEKey(stored.PublicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(cred.Response.ClientDataJSON)
+	signed := append(append([]byte{}, cred.Response.AuthenticatorData...), clientDataHash[:]...)
+	if err := key.verify(signed, cred.Response.Signature); err != nil {
+		return err
+	}
+	// authenticators that don't have counters always return 0
+	if (ad.signCount != 0 || stored.SignCount != 0) && int64(ad.signCount) <= stored.SignCount {
+		return errors.New("sign count is not increased. The authenticator may be cloned")
+	}
+	stored.SignCount = int64(ad.signCount)
+	stored.LastUsedAt = now
+	return nil
+}
+
+// WebAuthnCredential is a registered passkey. ID is the credential ID encoded as base64url.
+type WebAuthnCredential struct {
+	ID   string `docstore:"id"`
+	Name string `docstore:"name"`
+	// PublicKey is COSE_Key
+	PublicKey  []byte    `docstore:"public_key"`
+	SignCount  int64     `docstore:"sign_count"`
+	CreatedAt  time.Time `docstore:"created_at"`
+	LastUsedAt time.Time `docstore:"last_used_at"`
+}
+
+func (p WebAuthnCredential) CreatedAtFormat() string {
+	return p.CreatedAt.Format("2006/Jan/02 15:04")
+}
+
+func (p WebAuthnCredential) LastUsedAtForHuman() string {
+	if p.LastUsedAt.IsZero() {
+		return "never"
+	}
+	return datemaki.FormatDuration(time.Now().Sub(p.LastUsedAt))
+}
+
+// userPasskeys is the document of the passkeys collection. ID is the user ID.
+type userPasskeys struct {
+	ID          string               `docstore:"id"`
+	Credentials []WebAuthnCredential `docstore:"credentials"`
+}
+
+func (s *ServerlessSessionStorage) GetPasskeys(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	d := &userPasskeys{ID: userID}
+	err := s.passkeys.Get(ctx, d)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return d.Credentials, nil
+}
+
+func (s *ServerlessSessionStorage) SavePasskeys(ctx context.Context, userID string, credentials []WebAuthnCredential) error {
+	if len(credentials) == 0 {
+		err := s.passkeys.Delete(ctx, &userPasskeys{ID: userID})
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return nil
+		}
+		return err
+	}
+	return s.passkeys.Put(ctx, &userPasskeys{ID: userID, Credentials: credentials})
+}
+
+func findPasskey(credentials []WebAuthnCredential, id string) int {
+	for i, c := range credentials {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func passkeyDescriptors(credentials []WebAuthnCredential) []webAuthnDescriptor {
+	result := []webAuthnDescriptor{}
+	for _, c := range credentials {
+		id, err := base64.RawURLEncoding.DecodeString(c.ID)
+		if err == nil {
+			result = append(result, webAuthnDescriptor{Type: "public-key", ID: id})
+		}
+	}
+	return result
+}
+
+type passkeysPageContext struct {
+	Passkeys []WebAuthnCredential
+	Error    string
+}
+
+// hasPasskeys returns true if the user can use passkeys
+func (wh wruHandler) hasPasskeys(ctx context.Context, userID string) (bool, error) {
+	if !wh.c.WebAuthn.Available() {
+		return false, nil
+	}
+	credentials, err := wh.s.GetPasskeys(ctx, userID)
+	return len(credentials) > 0, err
+}
+
+// webAuthnSessionHash returns the value to bind the challenge to the session. Empty session ID means no binding.
+func webAuthnSessionHash(sessionID string) string {
+	if sessionID == "" {
+		return ""
+	}
+	return hashAccessToken(sessionID)
+}
+
+// newWebAuthnChallenge stores the challenge as a login code until the response comes.
+// The challenge is bound to the user and the session if they are given.
+func (wh wruHandler) newWebAuthnChallenge(ctx context.Context, purpose, userID, sessionID string) (base64URL, error) {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	err := wh.s.CreateLoginCode(ctx, webAuthnChallengeKey, base64.RawURLEncoding.EncodeToString(challenge), map[string]string{
+		webAuthnPurposeKey: purpose,
+		webAuthnUserKey:    userID,
+		webAuthnSessionKey: webAuthnSessionHash(sessionID),
+	}, currentTime(ctx).Add(wh.c.LoginTimeoutTerm))
+	return challenge, err
+}
+
+// consumeWebAuthnChallenge finds the challenge of the client data and removes it (single use).
+// It returns the challenge and the user ID that is bound to it.
+func (wh wruHandler) consumeWebAuthnChallenge(ctx context.Context, cred *webAuthnCredentialResponse, purpose, sessionID string) (string, string, error) {
+	cd, err := parseClientData(cred.Response.ClientDataJSON)
+	if err != nil {
+		return "", "", err
+	}
+	data, err := wh.s.ConsumeLoginCode(ctx, webAuthnChallengeKey, cd.Challenge)
+	if err != nil {
+		return "", "", errors.New("challenge is expired or invalid")
+	}
+	if data[webAuthnPurposeKey] != purpose || data[webAuthnSessionKey] != webAuthnSessionHash(sessionID) {
+		return "", "", errors.New("challenge is expired or invalid")
+	}
+	return cd.Challenge, data[webAuthnUserKey], nil
+}
+
+// verifyPasskey checks the assertion and returns the user.
+// The user of the second factor is bound to the challenge and the user of the standalone login is found by the user handle.
+// sessionID is the login session that waits for the second factor. It is empty for the standalone login.
+func (wh wruHandler) verifyPasskey(r *http.Request, src, purpose, sessionID string) (*User, *WebAuthnCredential, error) {
+	cred, err := parseWebAuthnCredential(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	challenge, userID, err := wh.consumeWebAuthnChallenge(r.Context(), cred, purpose, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if purpose == webAuthnLogin {
+		userID = string(cred.Response.UserHandle)
+	}
+	user, err := wh.ir.FindUserByID(userID)
+	if err == nil && user.IsService() {
+		err = ErrUserNotFound
+	}
+	if err != nil {
+		return nil, nil, ErrUserNotFound
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), userID)
+	if err != nil {
+		return user, nil, err
+	}
+	i := findPasskey(credentials, cred.ID)
+	if i == -1 {
+		return user, nil, errors.New("passkey is not registered")
+	}
+	if err := wh.c.WebAuthn.verifyAssertion(cred, challenge, purpose == webAuthnLogin, &credentials[i], currentTime(r.Context())); err != nil {
+		return user, nil, err
+	}
+	if err := wh.s.SavePasskeys(r.Context(), userID, credentials); err != nil {
+		return user, nil, err
+	}
+	return user, &credentials[i], nil
+}
+
+func (wh wruHandler) webAuthnTimeout() int64 {
+	return int64(wh.c.LoginTimeoutTerm / time.Millisecond)
+}
+
+func writeWebAuthnOptions(w http.ResponseWriter, options interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(options)
+}
+
+// PasskeyLoginOptions returns the options of navigator.credentials.get() for the login page.
+// allowCredentials is empty because the user is not known yet.
+func (wh wruHandler) PasskeyLoginOptions(w http.ResponseWriter, r *http.Request) {
+	challenge, err := wh.newWebAuthnChallenge(r.Context(), webAuthnLogin, "", "")
+	if err != nil {
+		writeErrorPage(w, r, http.StatusInternalServerError, "session storage access error: "+err.Error())
+		return
+	}
+	writeWebAuthnOptions(w, &webAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          wh.webAuthnTimeout(),
+		RPID:             wh.c.WebAuthn.RPID,
+		AllowCredentials: []webAuthnDescriptor{},
+		UserVerification: "required",
+	})
+}
+
+// PasskeyLogin starts the session by the passkey without ID providers
+func (wh wruHandler) PasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	id, _ := GetSession(r)
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	ipKey := ipRateLimitKey(clientIP(wh.c, r))
+	user, cred, err := wh.verifyPasskey(r, r.Form.Get("credential"), webAuthnLogin, "")
+	if err != nil {
+		wh.rl.fail(r.Context(), ipKey)
+		var userID string
+		if user != nil {
+			userID = user.UserID
+		}
+		reason := err.Error()
+		if err == ErrUserNotFound {
+			reason = loginUserNotFound
+			loginCounter.WithLabelValues("passkey", loginUserNotFound).Inc()
+		} else {
+			loginCounter.WithLabelValues("passkey", loginIDPError).Inc()
+		}
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "passkey", UserID: userID, Reason: reason})
+		wh.c.logger().Info("passkey login error", "user", userID, "error", err)
+		writeErrorPage(w, r, http.StatusUnauthorized, "Passkey authentication failed. Please try again.")
+		return
+	}
+	if id == "" {
+		id, err = wh.s.StartLogin(r.Context(), map[string]string{
+			"landingURL": wh.c.DefaultLandingPage,
+		})
+		if err != nil {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	newID, oldInfo, err := wh.s.StartSession(r.Context(), id, user, r, map[string]string{
+		"login-idp": "passkey",
+		"amr":       amrPasskey,
+		"passkey":   cred.Name,
+	})
+	if err != nil {
+		loginCounter.WithLabelValues("passkey", loginSessionError).Inc()
+		wh.c.audit(r, &AuditEvent{Type: AuditLoginFailure, IdP: "passkey", UserID: user.UserID, Reason: err.Error()})
+		http.Error(w, "login error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	wh.rl.succeed(r.Context(), ipKey)
+	loginCounter.WithLabelValues("passkey", loginSuccess).Inc()
+	wh.c.audit(r, &AuditEvent{Type: AuditLoginSuccess, IdP: "passkey", UserID: user.UserID, Success: true, Detail: map[string]string{
+		"amr":     amrPasskey,
+		"passkey": cred.Name,
+	}})
+	wh.c.logger().Info("login", "user", user.UserID, "idp", "passkey")
+	completeLogin(wh.c, wh.s, w, r, newID, oldInfo)
+}
+
+// MFAPasskeyOptions returns the options of navigator.credentials.get() for the user who waits for the second factor
+func (wh wruHandler) MFAPasskeyOptions(w http.ResponseWriter, r *http.Request) {
+	id, _, user, ok := wh.pendingSecondFactor(w, r)
+	if !ok {
+		return
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), user.UserID)
+	var challenge base64URL
+	if err == nil {
+		challenge, err = wh.newWebAuthnChallenge(r.Context(), webAuthnMFA, user.UserID, id)
+	}
+	if err != nil {
+		writeErrorPage(w, r, http.StatusInternalServerError, "session storage access error: "+err.Error())
+		return
+	}
+	writeWebAuthnOptions(w, &webAuthnRequestOptions{
+		Challenge:        challenge,
+		Timeout:          wh.webAuthnTimeout(),
+		RPID:             wh.c.WebAuthn.RPID,
+		AllowCredentials: passkeyDescriptors(credentials),
+		UserVerification: "preferred",
+	})
+}
+
+// UserPasskeys shows the registered passkeys
+func (wh wruHandler) UserPasskeys(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), user.UserID)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	executeTemplate(w, r, http.StatusOK, UserPasskeysPageTemplate, &passkeysPageContext{
+		Passkeys: credentials,
+	})
+}
+
+// PasskeyRegisterOptions returns the options of navigator.credentials.create()
+func (wh wruHandler) PasskeyRegisterOptions(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), user.UserID)
+	var challenge base64URL
+	if err == nil {
+		challenge, err = wh.newWebAuthnChallenge(r.Context(), webAuthnRegister, user.UserID, "")
+	}
+	if err != nil {
+		writeErrorPage(w, r, http.StatusInternalServerError, "session storage access error: "+err.Error())
+		return
+	}
+	displayName := user.DisplayName
+	if displayName == "" {
+		displayName = user.UserID
+	}
+	writeWebAuthnOptions(w, &webAuthnCreationOptions{
+		Challenge: challenge,
+		RP: webAuthnEntity{
+			ID:   wh.c.WebAuthn.RPID,
+			Name: wh.c.WebAuthn.RPName,
+		},
+		User: webAuthnUserEntity{
+			ID:          base64URL(user.UserID),
+			Name:        user.UserID,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []webAuthnParameter{
+			{Type: "public-key", Alg: coseAlgES256},
+			{Type: "public-key", Alg: coseAlgEdDSA},
+			{Type: "public-key", Alg: coseAlgRS256},
+		},
+		Timeout:            wh.webAuthnTimeout(),
+		ExcludeCredentials: passkeyDescriptors(credentials),
+		AuthenticatorSelection: webAuthnAuthenticatorSelection{
+			ResidentKey:        "required",
+			RequireResidentKey: true,
+			UserVerification:   "preferred",
+		},
+		Attestation: "none",
+	})
+}
+
+// RegisterPasskey verifies the response of navigator.credentials.create() and stores the new passkey
+func (wh wruHandler) RegisterPasskey(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		writeErrorPage(w, r, http.StatusBadRequest, "http request error: "+err.Error())
+		return
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), user.UserID)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" {
+		name = "Passkey"
+	} else if len(name) > 100 {
+		name = name[:100]
+	}
+	var passkey *WebAuthnCredential
+	cred, err := parseWebAuthnCredential(r.Form.Get("credential"))
+	if err == nil {
+		var challenge, userID string
+		challenge, userID, err = wh.consumeWebAuthnChallenge(r.Context(), cred, webAuthnRegister, "")
+		if err == nil && userID != user.UserID {
+			err = errors.New("challenge is expired or invalid")
+		}
+		if err == nil {
+			passkey, err = wh.c.WebAuthn.verifyRegistration(cred, challenge, currentTime(r.Context()))
+		}
+	}
+	if err == nil && findPasskey(credentials, passkey.ID) != -1 {
+		err = errors.New("the passkey is already registered")
+	}
+	if err != nil {
+		wh.c.logger().Info("passkey registration error", "user", user.UserID, "error", err)
+		executeTemplate(w, r, http.StatusBadRequest, UserPasskeysPageTemplate, &passkeysPageContext{
+			Passkeys: credentials,
+			Error:    "Passkey registration failed: " + err.Error(),
+		})
+		return
+	}
+	passkey.Name = name
+	if err := wh.s.SavePasskeys(r.Context(), user.UserID, append(credentials, *passkey)); err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wh.c.audit(r, &AuditEvent{Type: AuditPasskeyRegistered, UserID: user.UserID, Success: true, Detail: map[string]string{"passkey": name}})
+	wh.c.logger().Info("passkey is registered", "user", user.UserID, "name", name)
+	http.Redirect(w, r, "/.wru/user/passkeys", http.StatusFound)
+}
+
+// RemovePasskey removes the passkey. The last second factor of the user who has to use it can't be removed.
+func (wh wruHandler) RemovePasskey(w http.ResponseWriter, r *http.Request) {
+	user, ok := wh.activeUser(w, r)
+	if !ok {
+		return
+	}
+	credentials, err := wh.s.GetPasskeys(r.Context(), user.UserID)
+	if err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	i := findPasskey(credentials, chi.URLParam(r, "passkeyID"))
+	if i == -1 {
+		writeErrorPage(w, r, http.StatusNotFound, "passkey not found")
+		return
+	}
+	if len(credentials) == 1 && wh.c.MFA.requiredFor(user) {
+		data, err := wh.s.GetMFA(r.Context(), user.UserID)
+		if err != nil && err != ErrMFANotFound {
+			http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !data.enrolled() {
+			executeTemplate(w, r, http.StatusForbidden, UserPasskeysPageTemplate, &passkeysPageContext{
+				Passkeys: credentials,
+				Error:    "The second factor is required for your scopes. Enable the authenticator app before removing the last passkey.",
+			})
+			return
+		}
+	}
+	name := credentials[i].Name
+	credentials = append(credentials[:i:i], credentials[i+1:]...)
+	if err := wh.s.SavePasskeys(r.Context(), user.UserID, credentials); err != nil {
+		http.Error(w, "session storage access error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	wh.c.audit(r, &AuditEvent{Type: AuditPasskeyRemoved, UserID: user.UserID, Success: true, Detail: map[string]string{"passkey": name}})
+	wh.c.logger().Info("passkey is removed", "user", user.UserID, "name", name)
+	http.Redirect(w, r, "/.wru/user/passkeys", http.StatusFound)
+}
@@ -0,0 +1,515 @@
+package wru
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAuthenticator is a software authenticator that has one ES256 passkey
+type testAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+	rpID         string
+	origin       string
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &testAuthenticator{
+		key:          key,
+		credentialID: id,
+		rpID:         "example.com",
+		origin:       "https://example.com",
+	}
+}
+
+func (a *testAuthenticator) id() string {
+	return base64.RawURLEncoding.EncodeToString(a.credentialID)
+}
+
+func (a *testAuthenticator) coseKey(t *testing.T) []byte {
+	t.Helper()
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	key, err := cbor.Marshal(map[int]interface{}{1: 2, 3: coseAlgES256, -1: 1, -2: x, -3: y})
+	assert.NoError(t, err)
+	return key
+}
+
+func (a *testAuthenticator) authData(t *testing.T, flags byte, attested bool) []byte {
+	t.Helper()
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey(t)...)
+	}
+	return data
+}
+
+func (a *testAuthenticator) clientData(t *testing.T, ceremony string, challenge []byte) []byte {
+	t.Helper()
+	cd, err := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   base64.RawURLEncoding.EncodeToString(challenge),
+		"origin":      a.origin,
+		"crossOrigin": false,
+	})
+	assert.NoError(t, err)
+	return cd
+}
+
+// create works like navigator.credentials.create()
+func (a *testAuthenticator) create(t *testing.T, challenge, userHandle []byte) *webAuthnCredentialResponse {
+	t.Helper()
+	a.userHandle = userHandle
+	att, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"authData": a.authData(t, authDataUserPresent|authDataUserVerified|authDataAttested, true),
+		"attStmt":  map[string]interface{}{},
+	})
+	assert.NoError(t, err)
+	cred := &webAuthnCredentialResponse{ID: a.id(), Type: "public-key"}
+	cred.Response.ClientDataJSON = a.clientData(t, "webauthn.create", challenge)
+	cred.Response.AttestationObject = att
+	return cred
+}
+
+// get works like navigator.credentials.get()
+func (a *testAuthenticator) get(t *testing.T, challenge []byte, flags byte) *webAuthnCredentialResponse {
+	t.Helper()
+	a.signCount++
+	authData := a.authData(t, flags, false)
+	clientData := a.clientData(t, "webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	assert.NoError(t, err)
+	cred := &webAuthnCredentialResponse{ID: a.id(), Type: "public-key"}
+	cred.Response.ClientDataJSON = clientData
+	cred.Response.AuthenticatorData = authData
+	cred.Response.Signature = sig
+	cred.Response.UserHandle = a.userHandle
+	return cred
+}
+
+func credentialJSON(t *testing.T, cred *webAuthnCredentialResponse) string {
+	t.Helper()
+	src, err := json.Marshal(cred)
+	assert.NoError(t, err)
+	return string(src)
+}
+
+func Test_initWebAuthn(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		config     WebAuthnConfig
+		wantRPID   string
+		wantOrigin string
+		wantErr    bool
+	}{
+		{
+			name:   "disabled",
+			host:   "https://example.com",
+			config: WebAuthnConfig{},
+		},
+		{
+			name:       "default",
+			host:       "https://login.example.com:8443",
+			config:     WebAuthnConfig{Enabled: true},
+			wantRPID:   "login.example.com",
+			wantOrigin: "https://login.example.com:8443",
+		},
+		{
+			name:       "parent domain",
+			host:       "https://login.example.com",
+			config:     WebAuthnConfig{Enabled: true, RPID: "example.com"},
+			wantRPID:   "example.com",
+			wantOrigin: "https://login.example.com",
+		},
+		{
+			name:       "localhost",
+			host:       "http://localhost:3000",
+			config:     WebAuthnConfig{Enabled: true},
+			wantRPID:   "localhost",
+			wantOrigin: "http://localhost:3000",
+		},
+		{
+			name:    "other domain",
+			host:    "https://login.example.com",
+			config:  WebAuthnConfig{Enabled: true, RPID: "example.org"},
+			wantErr: true,
+		},
+		{
+			name:    "http",
+			host:    "http://example.com",
+			config:  WebAuthnConfig{Enabled: true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Host: tt.host, WebAuthn: tt.config}
+			err := initWebAuthn(c)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantRPID, c.WebAuthn.RPID)
+			assert.Equal(t, tt.wantOrigin, c.WebAuthn.origin)
+			assert.Equal(t, tt.wantOrigin != "", c.WebAuthn.Available())
+		})
+	}
+}
+
+func Test_coseKey_verify_UnknownKey(t *testing.T) {
+	for _, k := range []*coseKey{{}, {pub: "unknown"}} {
+		assert.Equal(t, errInvalidSignature, k.verify([]byte("data"), []byte("sig")))
+	}
+}
+
+func TestWebAuthnConfig_verifyAssertion(t *testing.T) {
+	wc := WebAuthnConfig{Enabled: true, RPID: "example.com", origin: "https://example.com"}
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	encoded := base64.RawURLEncoding.EncodeToString(challenge)
+	userVerified := authDataUserPresent | authDataUserVerified
+
+	tests := []struct {
+		name      string
+		modify    func(a *testAuthenticator)
+		flags     byte
+		requireUV bool
+		challenge string
+		signCount int64
+		wantErr   string
+	}{
+		{
+			name:      "valid",
+			flags:     byte(userVerified),
+			requireUV: true,
+			challenge: encoded,
+		},
+		{
+			name:      "without user verification",
+			flags:     authDataUserPresent,
+			challenge: encoded,
+		},
+		{
+			name:      "user verification is required",
+			flags:     authDataUserPresent,
+			requireUV: true,
+			challenge: encoded,
+			wantErr:   "user verification is required",
+		},
+		{
+			name:      "user presence",
+			flags:     0,
+			challenge: encoded,
+			wantErr:   "user presence is not confirmed",
+		},
+		{
+			name:      "other challenge",
+			flags:     byte(userVerified),
+			challenge: base64.RawURLEncoding.EncodeToString([]byte("other")),
+			wantErr:   "challenge mismatch",
+		},
+		{
+			name:      "other origin",
+			modify:    func(a *testAuthenticator) { a.origin = "https://example.com.evil.test" },
+			flags:     byte(userVerified),
+			challenge: encoded,
+			wantErr:   "origin mismatch: https://example.com.evil.test",
+		},
+		{
+			name:      "other RP ID",
+			modify:    func(a *testAuthenticator) { a.rpID = "evil.test" },
+			flags:     byte(userVerified),
+			challenge: encoded,
+			wantErr:   "RP ID hash mismatch",
+		},
+		{
+			name:      "other key",
+			modify:    func(a *testAuthenticator) { a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader) },
+			flags:     byte(userVerified),
+			challenge: encoded,
+			wantErr:   "invalid signature",
+		},
+		{
+			name:      "cloned authenticator",
+			flags:     byte(userVerified),
+			challenge: encoded,
+			signCount: 10,
+			wantErr:   "sign count is not increased. The authenticator may be cloned",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAuthenticator(t)
+			stored, err := wc.verifyRegistration(a.create(t, challenge, []byte("user1")), encoded, time.Now())
+			assert.NoError(t, err)
+			stored.SignCount = tt.signCount
+			if tt.modify != nil {
+				tt.modify(a)
+			}
+			now := time.Now()
+			err = wc.verifyAssertion(a.get(t, challenge, tt.flags), tt.challenge, tt.requireUV, stored, now)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, int64(1), stored.SignCount)
+				assert.Equal(t, now, stored.LastUsedAt)
+			}
+		})
+	}
+}
+
+func TestWebAuthnConfig_verifyRegistration(t *testing.T) {
+	wc := WebAuthnConfig{Enabled: true, RPID: "example.com", origin: "https://example.com"}
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	encoded := base64.RawURLEncoding.EncodeToString(challenge)
+
+	a := newTestAuthenticator(t)
+	cred, err := wc.verifyRegistration(a.create(t, challenge, []byte("user1")), encoded, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, a.id(), cred.ID)
+	_, err = parseCOSEKey(cred.PublicKey)
+	assert.NoError(t, err)
+
+	// assertion can't be used for registration
+	_, err = wc.verifyRegistration(a.get(t, challenge, authDataUserPresent), encoded, time.Now())
+	assert.EqualError(t, err, "invalid client data type: webauthn.get")
+
+	// credential ID should be same as the authenticator data
+	mismatch := a.create(t, challenge, []byte("user1"))
+	mismatch.ID = "other"
+	_, err = wc.verifyRegistration(mismatch, encoded, time.Now())
+	assert.EqualError(t, err, "credential ID mismatch")
+}
+
+func enablePasskeys(c *Config) {
+	c.WebAuthn.Enabled = true
+}
+
+// fetchWebAuthnOptions calls the options API like the script of login pages
+func fetchWebAuthnOptions(t *testing.T, h http.Handler, c *Config, path, sid string, options interface{}) {
+	t.Helper()
+	r := postForm(c, path, sid, "token", url.Values{}, "https://example.com")
+	r.Header.Set(CSRFTokenHeader, "token")
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), options))
+}
+
+func registerPasskeyForTest(t *testing.T, h http.Handler, c *Config, s SessionStorage, a *testAuthenticator, userID string) {
+	t.Helper()
+	sid := startSession(t, context.Background(), s, dummyUser(userID), "debug")
+	var options webAuthnCreationOptions
+	fetchWebAuthnOptions(t, h, c, "/.wru/user/passkeys/options", sid, &options)
+	w := postMFAForm(t, h, c, "/.wru/user/passkeys", sid, url.Values{
+		"name":       {"Laptop"},
+		"credential": {credentialJSON(t, a.create(t, options.Challenge, options.User.ID))},
+	})
+	assert.Equal(t, http.StatusFound, w.Code)
+}
+
+func TestPasskeyRegistrationAndLogin(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin, enablePasskeys)
+	a := newTestAuthenticator(t)
+	sid := startSession(t, context.Background(), s, dummyUser("user2"), "debug")
+
+	var creation webAuthnCreationOptions
+	fetchWebAuthnOptions(t, h, c, "/.wru/user/passkeys/options", sid, &creation)
+	assert.Equal(t, "example.com", creation.RP.ID)
+	assert.Equal(t, "user2", string(creation.User.ID))
+	assert.Equal(t, "required", creation.AuthenticatorSelection.ResidentKey)
+	assert.Empty(t, creation.ExcludeCredentials)
+
+	registration := credentialJSON(t, a.create(t, creation.Challenge, creation.User.ID))
+	w := postMFAForm(t, h, c, "/.wru/user/passkeys", sid, url.Values{"name": {"Laptop"}, "credential": {registration}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/user/passkeys", w.Header().Get("Location"))
+	passkeys, err := s.GetPasskeys(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.Len(t, passkeys, 1)
+	assert.Equal(t, "Laptop", passkeys[0].Name)
+
+	// the challenge is single use
+	w = postMFAForm(t, h, c, "/.wru/user/passkeys", sid, url.Values{"name": {"Laptop"}, "credential": {registration}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r := httptest.NewRequest("GET", "/.wru/user/passkeys", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: sid})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Laptop")
+
+	// the registered passkey is excluded
+	fetchWebAuthnOptions(t, h, c, "/.wru/user/passkeys/options", sid, &creation)
+	assert.Len(t, creation.ExcludeCredentials, 1)
+
+	// standalone login
+	loginID := startLogin(t, context.Background(), s)
+	var request webAuthnRequestOptions
+	fetchWebAuthnOptions(t, h, c, "/.wru/login/passkey/options", loginID, &request)
+	assert.Equal(t, "example.com", request.RPID)
+	assert.Equal(t, "required", request.UserVerification)
+	assertion := credentialJSON(t, a.get(t, request.Challenge, authDataUserPresent|authDataUserVerified))
+	w = postMFAForm(t, h, c, "/.wru/login/passkey", loginID, url.Values{"credential": {assertion}})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+	ses, err := s.FindBySessionToken(context.Background(), cookieValue(w, sessionCookieName(c)))
+	assert.NoError(t, err)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, "user2", ses.UserID)
+	assert.Equal(t, "passkey", ses.loginInfo["login-idp"])
+	assert.Equal(t, amrPasskey, ses.loginInfo["amr"])
+	passkeys, err = s.GetPasskeys(context.Background(), "user2")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), passkeys[0].SignCount)
+	assert.False(t, passkeys[0].LastUsedAt.IsZero())
+
+	// replayed assertion is rejected
+	w = postMFAForm(t, h, c, "/.wru/login/passkey", startLogin(t, context.Background(), s), url.Values{"credential": {assertion}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	assert.Equal(t, []AuditEventType{AuditPasskeyRegistered, AuditLoginSuccess, AuditLoginFailure}, sink.types())
+}
+
+func TestPasskeyLogin_UnknownUser(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin, enablePasskeys)
+	a := newTestAuthenticator(t)
+	registerPasskeyForTest(t, h, c, s, a, "user2")
+	// the user handle doesn't match the owner of the passkey
+	a.userHandle = []byte("user3")
+
+	loginID := startLogin(t, context.Background(), s)
+	var request webAuthnRequestOptions
+	fetchWebAuthnOptions(t, h, c, "/.wru/login/passkey/options", loginID, &request)
+	w := postMFAForm(t, h, c, "/.wru/login/passkey", loginID, url.Values{
+		"credential": {credentialJSON(t, a.get(t, request.Challenge, authDataUserPresent|authDataUserVerified))},
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []AuditEventType{AuditPasskeyRegistered, AuditLoginFailure}, sink.types())
+	assert.Equal(t, loginUserNotFound, sink.events[1].Reason)
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin, enablePasskeys)
+	a := newTestAuthenticator(t)
+	registerPasskeyForTest(t, h, c, s, a, "user1")
+
+	// user1 has the required scope and the passkey satisfies it
+	w := debugLogin(t, context.Background(), h, c, s, "user1")
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/.wru/mfa", w.Header().Get("Location"))
+	loginID := cookieValue(w, sessionCookieName(c))
+
+	r := httptest.NewRequest("GET", "/.wru/mfa", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookieName(c), Value: loginID})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "Use passkey")
+	assert.NotContains(t, w.Body.String(), "data:image/png;base64,")
+	// TOTP secret is not created for the passkey user
+	_, err := s.GetMFA(context.Background(), "user1")
+	assert.Equal(t, ErrMFANotFound, err)
+
+	var request webAuthnRequestOptions
+	fetchWebAuthnOptions(t, h, c, "/.wru/mfa/passkey/options", loginID, &request)
+	assert.Len(t, request.AllowCredentials, 1)
+	assert.Equal(t, a.credentialID, []byte(request.AllowCredentials[0].ID))
+
+	// other user's passkey is rejected
+	other := newTestAuthenticator(t)
+	registerPasskeyForTest(t, h, c, s, other, "user2")
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{
+		"credential": {credentialJSON(t, other.get(t, request.Challenge, authDataUserPresent))},
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	fetchWebAuthnOptions(t, h, c, "/.wru/mfa/passkey/options", loginID, &request)
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{
+		"credential": {credentialJSON(t, a.get(t, request.Challenge, authDataUserPresent))},
+	})
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "/dashboard", w.Header().Get("Location"))
+	ses, err := s.FindBySessionToken(context.Background(), cookieValue(w, sessionCookieName(c)))
+	assert.NoError(t, err)
+	assert.Equal(t, ActiveSession, ses.Status)
+	assert.Equal(t, "debug", ses.loginInfo["login-idp"])
+	assert.Equal(t, amrPasskey, ses.loginInfo["amr"])
+	assert.Equal(t, []AuditEventType{AuditPasskeyRegistered, AuditPasskeyRegistered, AuditMFAFailure, AuditLoginSuccess}, sink.types())
+
+	// user2 doesn't have the required scope, but the registered passkey is used as the second factor
+	w = debugLogin(t, context.Background(), h, c, s, "user2")
+	assert.Equal(t, "/.wru/mfa", w.Header().Get("Location"))
+	otherLoginID := cookieValue(w, sessionCookieName(c))
+
+	// the assertion for the challenge of other pending login can't finish user1's login
+	fetchWebAuthnOptions(t, h, c, "/.wru/mfa/passkey/options", otherLoginID, &request)
+	w = debugLogin(t, context.Background(), h, c, s, "user1")
+	loginID = cookieValue(w, sessionCookieName(c))
+	w = postMFAForm(t, h, c, "/.wru/mfa", loginID, url.Values{
+		"credential": {credentialJSON(t, other.get(t, request.Challenge, authDataUserPresent))},
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	ses, err = s.FindBySessionToken(context.Background(), loginID)
+	assert.NoError(t, err)
+	assert.Equal(t, BeforeLogin, ses.Status)
+}
+
+func TestRemovePasskey(t *testing.T) {
+	h, c, s, sink := newTestHandler(t, newTestRegister(t, mfaTestUsers...), requireMFAForAdmin, enablePasskeys)
+	for _, userID := range []string{"user1", "user2"} {
+		a := newTestAuthenticator(t)
+		registerPasskeyForTest(t, h, c, s, a, userID)
+		sid := startSession(t, context.Background(), s, dummyUser(userID), "passkey")
+		w := postMFAForm(t, h, c, "/.wru/user/passkeys/"+a.id()+"/delete", sid, url.Values{})
+		passkeys, err := s.GetPasskeys(context.Background(), userID)
+		assert.NoError(t, err)
+		if userID == "user1" {
+			// the last second factor of the user who has the required scope
+			assert.Equal(t, http.StatusForbidden, w.Code)
+			assert.Len(t, passkeys, 1)
+		} else {
+			assert.Equal(t, http.StatusFound, w.Code)
+			assert.Empty(t, passkeys)
+		}
+		w = postMFAForm(t, h, c, "/.wru/user/passkeys/unknown/delete", sid, url.Values{})
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+	assert.Equal(t, []AuditEventType{AuditPasskeyRegistered, AuditPasskeyRegistered, AuditPasskeyRemoved}, sink.types())
+}